@@ -171,9 +171,9 @@ const WhatsAppLivePage: React.FC = () => {
       const response = await axios.get('http://localhost:8081/api/chats');
       console.log('Chats API response:', response.data);
       
-      // Convert the response data to array format
-      const chatsArray = Object.entries(response.data).map(([id, chat]: [string, any]) => ({
-        id,
+      // Chats come back as an ordered list, pinned first and then newest first
+      const chatsArray = response.data.chats.map((chat: any) => ({
+        id: chat.jid,
         name: chat.name,
         lastMessage: 'No messages yet',
         timestamp: chat.timestamp,
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// accessLogConfig controls the optional per-request log. With redaction on
+// (the default), phone numbers and query values that may hold message text
+// or contacts are masked.
+type accessLogConfig struct {
+	Enabled bool
+	Redact  bool
+}
+
+// loadAccessLogConfig reads THREADSCRIBE_ACCESS_LOG and THREADSCRIBE_ACCESS_LOG_REDACT
+func loadAccessLogConfig() accessLogConfig {
+	return accessLogConfig{
+		Enabled: envBool("THREADSCRIBE_ACCESS_LOG", false),
+		Redact:  envBool("THREADSCRIBE_ACCESS_LOG_REDACT", true),
+	}
+}
+
+// phoneNumberPattern matches the digit runs of phone numbers and the user
+// part of JIDs, which are phone numbers too
+var phoneNumberPattern = regexp.MustCompile(`\+?\d{6,}`)
+
+// safeQueryParams are query parameters whose values never identify a
+// person or carry message text, so they're logged as is
+var safeQueryParams = map[string]bool{
+	"limit":      true,
+	"offset":     true,
+	"v":          true,
+	"type":       true,
+	"since":      true,
+	"older_than": true,
+	"events":     true,
+	"refresh":    true,
+}
+
+const redacted = "REDACTED"
+
+// redactURL masks phone numbers in the path and the values of query
+// parameters that aren't known to be harmless
+func redactURL(u *url.URL) string {
+	path := phoneNumberPattern.ReplaceAllString(u.Path, redacted)
+	if u.RawQuery == "" {
+		return path
+	}
+
+	query := u.Query()
+	for key, values := range query {
+		if safeQueryParams[strings.ToLower(key)] {
+			continue
+		}
+		for i := range values {
+			values[i] = redacted
+		}
+	}
+	return path + "?" + query.Encode()
+}
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming responses working through the recorder
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack keeps WebSocket upgrades working through the recorder
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// accessLog logs the method, path, status and duration of every request
+// handled by next. Request and response bodies are never logged.
+func accessLog(config accessLogConfig, next http.Handler) http.Handler {
+	if !config.Enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		target := r.URL.RequestURI()
+		if config.Redact {
+			target = redactURL(r.URL)
+		}
+		log.Printf("%s %s %d %s", r.Method, target, rec.status, time.Since(start).Round(time.Microsecond))
+	})
+}
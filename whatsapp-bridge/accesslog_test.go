@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLog collects what's logged during a test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prevOutput, prevFlags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(prevOutput)
+		log.SetFlags(prevFlags)
+	})
+	return &buf
+}
+
+// accessLogLine serves one request through accessLog and returns its log line
+func accessLogLine(t *testing.T, config accessLogConfig, target string) string {
+	t.Helper()
+	buf := captureLog(t)
+	handler := accessLog(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	return strings.TrimSpace(buf.String())
+}
+
+const sensitiveTarget = "/api/contact/14155550100@s.whatsapp.net?q=meet+me+at+the+station&phone=%2B442071838750&limit=20&type=image"
+
+func TestAccessLogRedactsSensitiveFields(t *testing.T) {
+	line := accessLogLine(t, accessLogConfig{Enabled: true, Redact: true}, sensitiveTarget)
+	for _, secret := range []string{"14155550100", "442071838750", "meet", "station"} {
+		if strings.Contains(line, secret) {
+			t.Errorf("access log leaks %q: %s", secret, line)
+		}
+	}
+	for _, want := range []string{"GET ", "/api/contact/REDACTED@s.whatsapp.net", "q=REDACTED", "phone=REDACTED", "limit=20", "type=image", " 404 "} {
+		if !strings.Contains(line, want) {
+			t.Errorf("access log %q doesn't contain %q", line, want)
+		}
+	}
+}
+
+func TestAccessLogWithoutRedaction(t *testing.T) {
+	line := accessLogLine(t, accessLogConfig{Enabled: true, Redact: false}, sensitiveTarget)
+	if !strings.Contains(line, "14155550100") || !strings.Contains(line, "meet+me") {
+		t.Errorf("unredacted access log = %s", line)
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	if line := accessLogLine(t, accessLogConfig{Redact: true}, sensitiveTarget); line != "" {
+		t.Errorf("disabled access log wrote %s", line)
+	}
+}
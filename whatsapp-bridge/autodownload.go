@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"go.mau.fi/whatsmeow"
+)
+
+const (
+	// autoDownloadWorkers bounds how many media files download at once
+	autoDownloadWorkers = 3
+	// autoDownloadBacklog is how many media messages may wait for a worker
+	// before new ones are skipped
+	autoDownloadBacklog = 256
+)
+
+// autoDownloads downloads incoming media as it arrives, nil unless
+// AUTO_DOWNLOAD is set
+var autoDownloads *autoDownloader
+
+// autoDownloader downloads the media of incoming messages in the
+// background with a fixed number of workers
+type autoDownloader struct {
+	maxBytes uint64
+	jobs     chan *Message
+
+	// mu guards closed against Submit sending on a closed jobs channel
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// startAutoDownloader starts downloading incoming media when AUTO_DOWNLOAD
+// is set, up to MAX_AUTO_DOWNLOAD_BYTES per file. It returns nil otherwise.
+func startAutoDownloader(client *whatsmeow.Client, messageStore *MessageStore) *autoDownloader {
+	if !envBool("AUTO_DOWNLOAD", false) {
+		return nil
+	}
+	maxBytes := envInt("MAX_AUTO_DOWNLOAD_BYTES", 16*1024*1024)
+	if maxBytes <= 0 {
+		log.Printf("Ignoring AUTO_DOWNLOAD: MAX_AUTO_DOWNLOAD_BYTES must be positive")
+		return nil
+	}
+	log.Printf("Downloading incoming media up to %d bytes with %d workers", maxBytes, autoDownloadWorkers)
+
+	d := &autoDownloader{maxBytes: uint64(maxBytes), jobs: make(chan *Message, autoDownloadBacklog)}
+	for i := 0; i < autoDownloadWorkers; i++ {
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			for msg := range d.jobs {
+				if _, err := downloadMedia(client, messageStore, msg); err != nil {
+					log.Printf("Failed to download media of %s in %s: %v", msg.ID, msg.ChatJID, err)
+				}
+			}
+		}()
+	}
+	return d
+}
+
+// Submit queues the media of a stored message for download. It never
+// blocks, so message handling isn't held up by slow downloads.
+func (d *autoDownloader) Submit(msg *Message) {
+	if msg.MediaType == "" {
+		return
+	}
+	if msg.FileLength > d.maxBytes {
+		log.Printf("Not downloading %s media of %s: %d bytes is over MAX_AUTO_DOWNLOAD_BYTES (%d)", msg.MediaType, msg.ID, msg.FileLength, d.maxBytes)
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.jobs <- msg:
+	default:
+		log.Printf("Not downloading %s media of %s: %d downloads are already waiting", msg.MediaType, msg.ID, autoDownloadBacklog)
+	}
+}
+
+// Close stops taking media and waits until the queued downloads finish, or
+// until ctx is done
+func (d *autoDownloader) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.jobs)
+	}
+	d.mu.Unlock()
+	return waitGroupContext(ctx, &d.workers)
+}
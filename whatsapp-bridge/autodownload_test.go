@@ -0,0 +1,15 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAutoDownloaderSubmitAfterClose(t *testing.T) {
+	d := &autoDownloader{maxBytes: 1 << 20, jobs: make(chan *Message, 1)}
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Must not panic by sending on the closed channel
+	d.Submit(&Message{ID: "A", MediaType: "image", FileLength: 10})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// BlockRequest is the body of /api/block and /api/unblock
+type BlockRequest struct {
+	// JID is the contact's JID or phone number
+	JID string `json:"jid"`
+}
+
+// ReplaceBlocklist replaces the local copy of the blocklist
+func (ms *MessageStore) ReplaceBlocklist(jids []types.JID) error {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM blocklist"); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, jid := range jids {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO blocklist (jid, updated_at) VALUES (?, ?)", jid.ToNonAD().String(), now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetBlocked adds a contact to or removes it from the local copy of the
+// blocklist
+func (ms *MessageStore) SetBlocked(jid types.JID, blocked bool) error {
+	if !blocked {
+		_, err := ms.db.Exec("DELETE FROM blocklist WHERE jid = ?", jid.ToNonAD().String())
+		return err
+	}
+	_, err := ms.db.Exec(
+		"INSERT INTO blocklist (jid, updated_at) VALUES (?, ?) ON CONFLICT(jid) DO UPDATE SET updated_at = excluded.updated_at",
+		jid.ToNonAD().String(), time.Now(),
+	)
+	return err
+}
+
+// GetBlocklist returns the local copy of the blocklist
+func (ms *MessageStore) GetBlocklist() ([]string, error) {
+	rows, err := ms.db.Query("SELECT jid FROM blocklist ORDER BY jid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jids := []string{}
+	for rows.Next() {
+		var jid string
+		if err := rows.Scan(&jid); err != nil {
+			return nil, err
+		}
+		jids = append(jids, jid)
+	}
+	return jids, rows.Err()
+}
+
+// refreshBlocklist fetches the blocklist from WhatsApp into the local copy
+func refreshBlocklist(client *whatsmeow.Client, messageStore *MessageStore) ([]string, error) {
+	blocklist, err := client.GetBlocklist()
+	if err != nil {
+		return nil, err
+	}
+	if err := messageStore.ReplaceBlocklist(blocklist.JIDs); err != nil {
+		return nil, err
+	}
+	return messageStore.GetBlocklist()
+}
+
+// updateBlocklist blocks or unblocks a contact and stores the blocklist
+// WhatsApp answers with
+func updateBlocklist(client *whatsmeow.Client, messageStore *MessageStore, jid types.JID, block bool) error {
+	action := events.BlocklistChangeActionUnblock
+	if block {
+		action = events.BlocklistChangeActionBlock
+	}
+	blocklist, err := client.UpdateBlocklist(jid, action)
+	if err != nil {
+		return err
+	}
+	if err := messageStore.ReplaceBlocklist(blocklist.JIDs); err != nil {
+		log.Printf("Failed to store blocklist: %v", err)
+	}
+	return nil
+}
+
+// handleBlocklist applies blocklist changes made on other devices. When
+// WhatsApp only says the list was modified, it's fetched again.
+func handleBlocklist(client *whatsmeow.Client, messageStore *MessageStore, v *events.Blocklist) {
+	if v.Action == events.BlocklistActionModify {
+		// Fetch it in the background rather than hold up the event handler
+		go func() {
+			if _, err := refreshBlocklist(client, messageStore); err != nil {
+				log.Printf("Failed to refresh blocklist: %v", err)
+			}
+		}()
+		return
+	}
+	for _, change := range v.Changes {
+		if err := messageStore.SetBlocked(change.JID, change.Action == events.BlocklistChangeActionBlock); err != nil {
+			log.Printf("Failed to update blocklist for %s: %v", change.JID, err)
+		}
+	}
+}
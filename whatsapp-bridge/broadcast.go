@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Broadcast lists are not groups. A group is one shared chat that every
+// member sees and replies in. A broadcast list is private to its owner: each
+// recipient gets the message in their one-to-one chat with the owner, doesn't
+// know who else got it, and replies privately. Only the owner's own devices
+// see a chat under the list JID.
+
+// SendBroadcastRequest is the body of /api/send-broadcast
+type SendBroadcastRequest struct {
+	ListJID string `json:"list_jid"`
+	Message string `json:"message"`
+}
+
+// BroadcastDelivery is the outcome of sending a broadcast to one recipient
+type BroadcastDelivery struct {
+	Recipient string `json:"recipient"`
+	Success   bool   `json:"success"`
+	ID        string `json:"id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// errUnknownBroadcastRecipients is returned when sending to a broadcast list
+// whose members haven't been seen yet
+var errUnknownBroadcastRecipients = errors.New("the recipients of this broadcast list are not known yet, send a message to the list from the phone first")
+
+// fileBroadcastMessage files a message someone sent us through their
+// broadcast list under our chat with them, which is where WhatsApp shows it
+// and where our replies go. Messages we sent to our own lists stay in the
+// list's chat, and the recipients they went to are remembered.
+func fileBroadcastMessage(messageStore *MessageStore, info *types.MessageInfo) {
+	if classifyJID(info.Chat) != jidBroadcast {
+		return
+	}
+	if !info.IsFromMe {
+		info.Chat = info.Sender.ToNonAD()
+		return
+	}
+	if len(info.BroadcastRecipients) == 0 {
+		return
+	}
+
+	recipients := make([]string, 0, len(info.BroadcastRecipients))
+	for _, recipient := range info.BroadcastRecipients {
+		jid := recipient.PN
+		if jid.IsEmpty() {
+			jid = recipient.LID
+		}
+		if jid.User == info.Sender.User {
+			continue
+		}
+		recipients = append(recipients, jid.ToNonAD().String())
+	}
+	if err := messageStore.SetBroadcastRecipients(info.Chat.String(), recipients, info.Timestamp); err != nil {
+		log.Printf("Failed to save recipients of broadcast list %s: %v", info.Chat, err)
+	}
+}
+
+// SetBroadcastRecipients replaces the known recipients of a broadcast list
+func (ms *MessageStore) SetBroadcastRecipients(listJID string, recipients []string, updatedAt time.Time) error {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM broadcast_recipients WHERE list_jid = ?", listJID); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if _, err := tx.Exec(
+			"INSERT OR REPLACE INTO broadcast_recipients (list_jid, jid, updated_at) VALUES (?, ?, ?)",
+			listJID, recipient, updatedAt,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetBroadcastRecipients returns the known recipients of a broadcast list
+func (ms *MessageStore) GetBroadcastRecipients(listJID string) ([]string, error) {
+	rows, err := ms.db.Query("SELECT jid FROM broadcast_recipients WHERE list_jid = ? ORDER BY jid", listJID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []string
+	for rows.Next() {
+		var jid string
+		if err := rows.Scan(&jid); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, jid)
+	}
+	return recipients, rows.Err()
+}
+
+// sendBroadcast sends a text message to a broadcast list. whatsmeow can't
+// address broadcast lists other than the status feed yet, so when it refuses
+// the message is sent to each known recipient's chat instead, which is how
+// the recipients would see it anyway. The result lists one delivery per
+// recipient, or a single delivery to the list when it was addressed directly.
+func sendBroadcast(client *whatsmeow.Client, messageStore *MessageStore, list types.JID, message string) ([]BroadcastDelivery, error) {
+	sent, _, err := sendWhatsAppMessage(client, messageStore, list, &SendMessageRequest{Recipient: list.String(), Message: message})
+	if err == nil {
+		return []BroadcastDelivery{{Recipient: list.String(), Success: true, ID: sent.ID}}, nil
+	}
+	if !errors.Is(err, whatsmeow.ErrBroadcastListUnsupported) {
+		return nil, err
+	}
+
+	recipients, err := messageStore.GetBroadcastRecipients(list.String())
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, errUnknownBroadcastRecipients
+	}
+
+	deliveries := make([]BroadcastDelivery, 0, len(recipients))
+	for _, recipient := range recipients {
+		delivery := BroadcastDelivery{Recipient: recipient}
+		jid, err := types.ParseJID(recipient)
+		if err == nil {
+			sent, _, err = sendWhatsAppMessage(client, messageStore, jid, &SendMessageRequest{Recipient: recipient, Message: message})
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		} else {
+			delivery.Success = true
+			delivery.ID = sent.ID
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// validateBroadcastList checks that a JID is a broadcast list rather than
+// the status feed or a chat
+func validateBroadcastList(list types.JID) error {
+	if kind := classifyJID(list); kind != jidBroadcast {
+		return fmt.Errorf("list_jid must be a broadcast list, not a %s JID", kind)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestSaveChatKeepsRealName(t *testing.T) {
+	ms := newTestStore(t)
+	group := "120363000000000001@g.us"
+	if err := ms.SaveChat(group, "Book club"); err != nil {
+		t.Fatal(err)
+	}
+	// A failed group info lookup falls back to a placeholder
+	if err := ms.SaveChat(group, "Group 120363000000000001"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := ms.GetChatNames(); err != nil || names[group] != "Book club" {
+		t.Fatalf("name after saving a placeholder = %q, %v, want Book club", names[group], err)
+	}
+	if err := ms.SaveChat(group, "Book club 2024"); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := ms.GetChatNames(); names[group] != "Book club 2024" {
+		t.Fatalf("renamed chat = %q, want Book club 2024", names[group])
+	}
+
+	// Placeholders still fill in a chat without a name
+	user := "222@s.whatsapp.net"
+	if err := ms.SaveChat(user, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SaveChat(user, "+222"); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := ms.GetChatNames(); names[user] != "+222" {
+		t.Fatalf("unnamed chat = %q, want +222", names[user])
+	}
+}
+
+func TestChatsResponseUsesStoredNames(t *testing.T) {
+	ms := newTestStore(t)
+	if err := ms.SaveChat("120363000000000001@g.us", "Book club"); err != nil {
+		t.Fatal(err)
+	}
+	chats, err := ms.GetChats(ChatQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No client is needed: names aren't looked up while listing
+	resp := chatsResponse(chats, 0)
+	if len(resp.Chats) != 1 || resp.Chats[0].Name != "Book club" {
+		t.Fatalf("chats = %+v, want the stored name", resp.Chats)
+	}
+}
+
+// pageThroughChats follows next_cursor from the first page to the last,
+// listing the JIDs of every page
+func pageThroughChats(t *testing.T, ms *MessageStore, limit int) []string {
+	t.Helper()
+	var pages []string
+	var before *chatCursor
+	for i := 0; i < 20; i++ {
+		chats, err := ms.GetChats(ChatQuery{Before: before, Limit: limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := chatsResponse(chats, limit)
+		var jids []string
+		for _, chat := range resp.Chats {
+			jids = append(jids, chat.JID)
+		}
+		pages = append(pages, strings.Join(jids, ","))
+		if resp.NextCursor == "" {
+			return pages
+		}
+		if before, err = parseChatCursor(resp.NextCursor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Fatal("paging through the chats doesn't end")
+	return nil
+}
+
+func TestChatPagesKeepTiesAndZones(t *testing.T) {
+	ms := newTestStore(t)
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tokyo := time.FixedZone("JST", 9*60*60)
+	newYork := time.FixedZone("EST", -5*60*60)
+	chats := []struct {
+		jid string
+		at  time.Time
+	}{
+		{"a@s.whatsapp.net", base.Add(5 * time.Second)},
+		// Three chats active in the same second, two in the same instant,
+		// stored in different zones
+		{"b@s.whatsapp.net", base.Add(4*time.Second + 500*time.Millisecond).In(tokyo)},
+		{"c@s.whatsapp.net", base.Add(4 * time.Second).In(newYork)},
+		{"d@s.whatsapp.net", base.Add(4 * time.Second)},
+		// Later in UTC but earlier as text than the chats above
+		{"e@s.whatsapp.net", base.Add(3 * time.Second).In(newYork)},
+		{"f@s.whatsapp.net", base.Add(2 * time.Second).In(tokyo)},
+		{"pinned@s.whatsapp.net", base},
+	}
+	for _, chat := range chats {
+		if err := ms.SaveChat(chat.jid, chat.jid); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ms.db.Exec("UPDATE chats SET timestamp = ? WHERE jid = ?", chat.at, chat.jid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ms.SetChatPinned("pinned@s.whatsapp.net", true, base); err != nil {
+		t.Fatal(err)
+	}
+
+	all := "pinned@s.whatsapp.net,a@s.whatsapp.net,b@s.whatsapp.net,d@s.whatsapp.net,c@s.whatsapp.net,e@s.whatsapp.net,f@s.whatsapp.net"
+	if got := pageThroughChats(t, ms, 0); fmt.Sprint(got) != "["+all+"]" {
+		t.Fatalf("unpaged chats = %v, want [%s]", got, all)
+	}
+	for limit := 1; limit <= 7; limit++ {
+		pages := pageThroughChats(t, ms, limit)
+		var listed []string
+		for _, page := range pages {
+			if page != "" {
+				listed = append(listed, page)
+			}
+		}
+		if got := strings.Join(listed, ","); got != all {
+			t.Errorf("limit %d: pages %q list %s, want every chat once: %s", limit, pages, got, all)
+		}
+	}
+
+	want := []string{
+		"pinned@s.whatsapp.net,a@s.whatsapp.net,b@s.whatsapp.net",
+		"d@s.whatsapp.net,c@s.whatsapp.net",
+		"e@s.whatsapp.net,f@s.whatsapp.net",
+		"",
+	}
+	if got := pageThroughChats(t, ms, 2); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("pages of 2 = %q, want %q", got, want)
+	}
+}
+
+func TestParseChatCursor(t *testing.T) {
+	cursor := chatCursor{UnixMilli: 1714564800123, JID: "120363000000000001@g.us"}
+	got, err := parseChatCursor(cursor.String())
+	if err != nil || *got != cursor {
+		t.Fatalf("parseChatCursor(%q) = %v, %v, want %v", cursor.String(), got, err, cursor)
+	}
+	for _, s := range []string{"", "2024-05-01T12:00:00Z", "123", "123_", "x_111@s.whatsapp.net"} {
+		if _, err := parseChatCursor(s); err == nil {
+			t.Errorf("parseChatCursor(%q) accepted", s)
+		}
+	}
+}
+
+func TestRefreshedNameIsListed(t *testing.T) {
+	ms := newTestStore(t)
+	client := newTestClient(t)
+	jid := types.NewJID("222", types.DefaultUserServer)
+	// Stored during the cold start, before contacts synced
+	if err := ms.SaveChat(jid.String(), "+222"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ms.ChatsFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Store.Contacts.PutContactName(context.Background(), jid, "Bob", "Bob Smith"); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := refreshChatNames(client, ms, 0)
+	if err != nil || updated != 1 {
+		t.Fatalf("refreshChatNames = %d, %v, want 1 updated", updated, err)
+	}
+
+	chats, err := ms.GetChats(ChatQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := chatsResponse(chats, 0)
+	if len(resp.Chats) != 1 || resp.Chats[0].Name != "Bob Smith" {
+		t.Fatalf("/api/chats lists %+v, want the refreshed name", resp.Chats)
+	}
+
+	// Clients that polled before the refresh must not be told nothing changed
+	after, err := ms.ChatsFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.etag() == before.etag() {
+		t.Fatal("renaming a chat didn't change the /api/chats ETag")
+	}
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/chats", nil)
+	r.Header.Set("If-None-Match", before.etag())
+	if checkNotModified(rec, r, after) {
+		t.Fatal("a client with the list from before the refresh got 304")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// fingerprint cheaply identifies the state of a set of rows, so polling
+// clients can be told nothing changed
+type fingerprint struct {
+	Count  int
+	Latest time.Time
+}
+
+// etag formats the fingerprint as a strong entity tag
+func (fp fingerprint) etag() string {
+	return fmt.Sprintf(`"%d-%d"`, fp.Count, fp.Latest.UnixNano())
+}
+
+// MessagesFingerprint returns the message count and newest message time of
+// a chat, counting reactions, receipts, edits, deletions and other updates
+// to stored messages too since they're part of the messages payload
+func (ms *MessageStore) MessagesFingerprint(chatJID string) (fingerprint, error) {
+	fp, err := ms.tableFingerprint("messages", "WHERE chat_jid = ?", chatJID)
+	if err != nil {
+		return fp, err
+	}
+	reactions, err := ms.tableFingerprint("reactions", "WHERE chat_jid = ?", chatJID)
+	if err != nil {
+		return fp, err
+	}
+	receipts, err := ms.tableFingerprint("receipts", "WHERE chat_jid = ?", chatJID)
+	if err != nil {
+		return fp, err
+	}
+	for _, related := range []fingerprint{reactions, receipts} {
+		fp.Count += related.Count
+		if related.Latest.After(fp.Latest) {
+			fp.Latest = related.Latest
+		}
+	}
+	edit, err := ms.latestEdit(chatJID)
+	if err != nil {
+		return fp, err
+	}
+	if edit.After(fp.Latest) {
+		fp.Latest = edit
+	}
+	revoke, err := ms.latestRevoke(chatJID)
+	if err != nil {
+		return fp, err
+	}
+	if revoke.After(fp.Latest) {
+		fp.Latest = revoke
+	}
+	update, err := ms.latestMessageUpdate(chatJID)
+	if update.After(fp.Latest) {
+		fp.Latest = update
+	}
+	return fp, err
+}
+
+// latestMessageUpdate returns when a stored message of the chat last had
+// its pin, media, read time or sender name updated, or the zero time
+func (ms *MessageStore) latestMessageUpdate(chatJID string) (time.Time, error) {
+	var at time.Time
+	err := ms.db.QueryRow("SELECT updated_at FROM messages WHERE chat_jid = ? AND updated_at IS NOT NULL ORDER BY updated_at DESC LIMIT 1", chatJID).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return at, err
+}
+
+// ChatsFingerprint returns the chat count and most recent chat activity,
+// pinning, unpinning, hiding, unhiding and renaming included
+func (ms *MessageStore) ChatsFingerprint() (fingerprint, error) {
+	fp, err := ms.tableFingerprint("chats", "")
+	if err != nil {
+		return fp, err
+	}
+	pinChange, err := ms.latestPinChange()
+	if err != nil {
+		return fp, err
+	}
+	if pinChange.After(fp.Latest) {
+		fp.Latest = pinChange
+	}
+	hideChange, err := ms.latestHideChange()
+	if err != nil {
+		return fp, err
+	}
+	if hideChange.After(fp.Latest) {
+		fp.Latest = hideChange
+	}
+	nameChange, err := ms.latestNameChange()
+	if nameChange.After(fp.Latest) {
+		fp.Latest = nameChange
+	}
+	return fp, err
+}
+
+// tableFingerprint counts the rows of table matching where and finds their
+// newest timestamp
+func (ms *MessageStore) tableFingerprint(table, where string, args ...interface{}) (fingerprint, error) {
+	var fp fingerprint
+	err := ms.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s %s", table, where), args...).Scan(&fp.Count)
+	if err != nil || fp.Count == 0 {
+		return fp, err
+	}
+
+	// Selecting the column itself rather than MAX() keeps its DATETIME type,
+	// so the driver parses it into a time.Time
+	query := fmt.Sprintf("SELECT timestamp FROM %s %s ORDER BY timestamp DESC LIMIT 1", table, where)
+	err = ms.db.QueryRow(query, args...).Scan(&fp.Latest)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return fp, err
+}
+
+// checkNotModified sets the ETag and Last-Modified headers for fp and
+// answers 304 Not Modified if the client already has this version.
+// It returns true when the response has been written.
+func checkNotModified(w http.ResponseWriter, r *http.Request, fp fingerprint) bool {
+	etag := fp.etag()
+	w.Header().Set("ETag", etag)
+	if !fp.Latest.IsZero() {
+		w.Header().Set("Last-Modified", fp.Latest.UTC().Format(http.TimeFormat))
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+
+	if since := r.Header.Get("If-Modified-Since"); since != "" && !fp.Latest.IsZero() {
+		t, err := http.ParseTime(since)
+		// HTTP dates have second precision
+		if err == nil && !fp.Latest.Truncate(time.Second).After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
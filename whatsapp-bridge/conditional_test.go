@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// conditionalGet runs checkNotModified for a request with the given header
+func conditionalGet(fp fingerprint, header, value string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+	if header != "" {
+		r.Header.Set(header, value)
+	}
+	if !checkNotModified(rec, r, fp) {
+		rec.WriteHeader(http.StatusOK)
+	}
+	return rec
+}
+
+func TestMessagesNotModifiedWhileUnchanged(t *testing.T) {
+	ms := newTestStore(t)
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := testMessage("M1", "hello", ts)
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := ms.MessagesFingerprint(msg.ChatJID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := conditionalGet(fp, "", "")
+	etag, lastModified := first.Header().Get("ETag"), first.Header().Get("Last-Modified")
+	if first.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("first poll: %d, ETag %q, Last-Modified %q", first.Code, etag, lastModified)
+	}
+
+	fp, _ = ms.MessagesFingerprint(msg.ChatJID)
+	if rec := conditionalGet(fp, "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match on unchanged data: %d, want 304", rec.Code)
+	}
+	if rec := conditionalGet(fp, "If-Modified-Since", lastModified); rec.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since on unchanged data: %d, want 304", rec.Code)
+	}
+
+	// A reaction is part of the payload, so it's a change too
+	if err := ms.SaveReaction(msg.ChatJID, msg.ID, "222@s.whatsapp.net", "👍", ts.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	fp, _ = ms.MessagesFingerprint(msg.ChatJID)
+	if rec := conditionalGet(fp, "If-None-Match", etag); rec.Code != http.StatusOK {
+		t.Errorf("If-None-Match after a reaction: %d, want 200", rec.Code)
+	}
+	if rec := conditionalGet(fp, "If-Modified-Since", lastModified); rec.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since after a reaction: %d, want 200", rec.Code)
+	}
+}
+
+func TestMessagesFingerprintChangesWithNewMessage(t *testing.T) {
+	ms := newTestStore(t)
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := ms.SaveMessage(testMessage("M1", "hello", ts)); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ms.MessagesFingerprint("111@s.whatsapp.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Even a message older than the newest one changes the count
+	if err := ms.SaveMessage(testMessage("M0", "earlier", ts.Add(-time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ms.MessagesFingerprint("111@s.whatsapp.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.etag() == after.etag() {
+		t.Fatalf("fingerprint unchanged after a new message: %s", after.etag())
+	}
+}
+
+func TestChatsNotModifiedWhileUnchanged(t *testing.T) {
+	ms := newTestStore(t)
+	if err := ms.SaveChat("111@s.whatsapp.net", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := ms.ChatsFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := conditionalGet(fp, "", "").Header().Get("ETag")
+	if rec := conditionalGet(fp, "If-None-Match", `"other", `+etag); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match listing the current ETag: %d, want 304", rec.Code)
+	}
+
+	if err := ms.SetChatPinned("111@s.whatsapp.net", true, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	fp, _ = ms.ChatsFingerprint()
+	if rec := conditionalGet(fp, "If-None-Match", etag); rec.Code != http.StatusOK {
+		t.Errorf("If-None-Match after pinning a chat: %d, want 200", rec.Code)
+	}
+}
+
+// messagesChangedBy polls the messages of msg's chat, applies update and
+// checks the next poll with the first poll's validators gets 200 instead of 304
+func messagesChangedBy(t *testing.T, update func(ms *MessageStore, msg *Message) error) {
+	t.Helper()
+	ms := newTestStore(t)
+	msg := testMessage("M1", "hello", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := ms.MessagesFingerprint(msg.ChatJID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := conditionalGet(fp, "", "")
+	etag, lastModified := first.Header().Get("ETag"), first.Header().Get("Last-Modified")
+	if rec := conditionalGet(fp, "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Fatalf("If-None-Match before the update: %d, want 304", rec.Code)
+	}
+
+	if err := update(ms, msg); err != nil {
+		t.Fatal(err)
+	}
+	fp, err = ms.MessagesFingerprint(msg.ChatJID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := conditionalGet(fp, "If-None-Match", etag); rec.Code != http.StatusOK {
+		t.Errorf("If-None-Match after the update: %d, want 200", rec.Code)
+	}
+	if rec := conditionalGet(fp, "If-Modified-Since", lastModified); rec.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since after the update: %d, want 200", rec.Code)
+	}
+}
+
+func TestMessagesModifiedByPin(t *testing.T) {
+	messagesChangedBy(t, func(ms *MessageStore, msg *Message) error {
+		until := time.Now().Add(7 * 24 * time.Hour)
+		return ms.SetMessagePinned(msg.ChatJID, msg.ID, true, &until)
+	})
+}
+
+func TestMessagesModifiedByDownload(t *testing.T) {
+	messagesChangedBy(t, func(ms *MessageStore, msg *Message) error {
+		return ms.SetMediaLocalPath(msg.ChatJID, msg.ID, "store/111@s.whatsapp.net/M1.jpg")
+	})
+}
+
+func TestMessagesModifiedByRead(t *testing.T) {
+	messagesChangedBy(t, func(ms *MessageStore, msg *Message) error {
+		return ms.SetMessagesRead(msg.ChatJID, []string{msg.ID}, time.Now())
+	})
+}
+
+func TestMessagesModifiedBySenderName(t *testing.T) {
+	messagesChangedBy(t, func(ms *MessageStore, msg *Message) error {
+		_, err := ms.SetSenderName(msg.Sender, "Alice")
+		return err
+	})
+}
+
+func TestSaveMessageKeepsUpdateTime(t *testing.T) {
+	ms := newTestStore(t)
+	msg := testMessage("M1", "hello", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SetMessagePinned(msg.ChatJID, msg.ID, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ms.MessagesFingerprint(msg.ChatJID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Saving the same message again must not lose when it was last updated
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ms.MessagesFingerprint(msg.ChatJID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.etag() != after.etag() {
+		t.Errorf("fingerprint changed by re-saving the message: %s, then %s", before.etag(), after.etag())
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	// contactSyncGrace is how long after connecting we expect the contact
+	// list to still be syncing
+	contactSyncGrace = 30 * time.Second
+	// contactRetries and contactRetryBackoff bound the wait for a contact
+	// that isn't synced yet, doubling the backoff after each try
+	contactRetries      = 3
+	contactRetryBackoff = 250 * time.Millisecond
+)
+
+// appStateSynced reports whether the app state, which carries the contact
+// list, has finished syncing
+func appStateSynced() bool {
+	connectionStats.Lock()
+	defer connectionStats.Unlock()
+	return connectionStats.appStateSynced
+}
+
+// contactsSyncing reports whether contact names may still be on their way:
+// we connected recently and the app state hasn't finished syncing
+func contactsSyncing(now time.Time) bool {
+	connectionStats.Lock()
+	defer connectionStats.Unlock()
+	return !connectionStats.appStateSynced && !connectionStats.lastConnectedAt.IsZero() &&
+		now.Sub(connectionStats.lastConnectedAt) < contactSyncGrace
+}
+
+// lookupContact gets a contact, briefly retrying a contact without a name
+// right after connecting, before the contact list has synced. whatsmeow's
+// store already caches contacts in memory, so repeated lookups are cheap.
+func lookupContact(ctx context.Context, client *whatsmeow.Client, jid types.JID) (types.ContactInfo, error) {
+	backoff := contactRetryBackoff
+	for attempt := 0; ; attempt++ {
+		contact, err := client.Store.Contacts.GetContact(ctx, jid)
+		if err != nil || contact.FullName != "" || contact.PushName != "" ||
+			attempt == contactRetries || !contactsSyncing(time.Now()) {
+			return contact, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return contact, nil
+		}
+		backoff *= 2
+	}
+}
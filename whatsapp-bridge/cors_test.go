@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setAllowedOrigins loads ALLOWED_ORIGINS set to value for the length of a test
+func setAllowedOrigins(t *testing.T, value string) {
+	t.Helper()
+	t.Setenv("ALLOWED_ORIGINS", value)
+	prev := allowedOrigins
+	allowedOrigins = loadAllowedOrigins()
+	t.Cleanup(func() { allowedOrigins = prev })
+}
+
+// corsRequest sends a request from origin through corsMiddleware
+func corsRequest(method, origin string) (*httptest.ResponseRecorder, bool) {
+	called := false
+	handler := corsMiddleware(func(w http.ResponseWriter, r *http.Request) { called = true })
+	r := httptest.NewRequest(method, "/api/status", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+	return rec, called
+}
+
+func TestLoadAllowedOrigins(t *testing.T) {
+	setAllowedOrigins(t, " https://app.example.com/ ,http://localhost:3000,,")
+	if len(allowedOrigins) != 2 || !allowedOrigins["https://app.example.com"] || !allowedOrigins["http://localhost:3000"] {
+		t.Fatalf("allowedOrigins = %v", allowedOrigins)
+	}
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	setAllowedOrigins(t, "https://app.example.com,http://localhost:3000")
+	rec, called := corsRequest(http.MethodGet, "http://localhost:3000")
+	if !called {
+		t.Fatal("handler didn't run")
+	}
+	h := rec.Header()
+	if got := h.Get("Access-Control-Allow-Origin"); got != "http://localhost:3000" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the request's origin echoed", got)
+	}
+	if got := h.Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+	}
+	if got := h.Get("Vary"); got != "Origin" {
+		t.Errorf("Vary = %q, want Origin", got)
+	}
+	if !originAllowed("http://localhost:3000") {
+		t.Error("originAllowed rejected a listed origin")
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	setAllowedOrigins(t, "https://app.example.com")
+	for _, method := range []string{http.MethodGet, http.MethodOptions} {
+		rec, _ := corsRequest(method, "https://evil.example.com")
+		h := rec.Header()
+		if got := h.Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q for an unlisted origin", method, got)
+		}
+		if got := h.Get("Access-Control-Allow-Credentials"); got != "" {
+			t.Errorf("%s: Access-Control-Allow-Credentials = %q for an unlisted origin", method, got)
+		}
+		if got := h.Get("Vary"); got != "Origin" {
+			t.Errorf("%s: Vary = %q, want Origin so caches keep origins apart", method, got)
+		}
+	}
+	if originAllowed("https://evil.example.com") || originAllowed("https://app.example.com.evil.com") {
+		t.Error("originAllowed accepted an unlisted origin")
+	}
+}
+
+func TestCORSMissingOrigin(t *testing.T) {
+	setAllowedOrigins(t, "https://app.example.com")
+	rec, called := corsRequest(http.MethodGet, "")
+	if !called {
+		t.Fatal("handler didn't run for a request without an Origin")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q without an Origin", got)
+	}
+	if !originAllowed("") {
+		t.Error("originAllowed rejected a request that doesn't come from a page")
+	}
+}
+
+func TestCORSWildcardWithoutAllowedOrigins(t *testing.T) {
+	setAllowedOrigins(t, "")
+	rec, called := corsRequest(http.MethodGet, "https://anywhere.example.com")
+	if !called {
+		t.Fatal("handler didn't run")
+	}
+	h := rec.Header()
+	if got := h.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+	// Browsers reject credentials together with a wildcard origin
+	if got := h.Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %q with a wildcard origin", got)
+	}
+	if !originAllowed("https://anywhere.example.com") {
+		t.Error("originAllowed rejected an origin with no list configured")
+	}
+}
+
+func TestCORSPreflightSkipsHandler(t *testing.T) {
+	setAllowedOrigins(t, "https://app.example.com")
+	rec, called := corsRequest(http.MethodOptions, "https://app.example.com")
+	if called {
+		t.Error("preflight reached the handler")
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Errorf("preflight = %d %v", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// storePaths are the database files of the bridge. The session store holds
+// the WhatsApp keys and is small but hot, the message store is the archive
+// and grows without bound, so they can live on different disks.
+type storePaths struct {
+	MessageDB string
+	SessionDB string
+}
+
+// loadStorePaths reads the database locations from the environment.
+// THREADSCRIBE_MESSAGE_DB and THREADSCRIBE_SESSION_DB are either a bare file
+// name, kept in THREADSCRIBE_DATA_DIR (./data by default), or a path.
+func loadStorePaths() storePaths {
+	dataDir := strings.TrimSpace(os.Getenv("THREADSCRIBE_DATA_DIR"))
+	if dataDir == "" {
+		dataDir = "./data"
+	}
+	return storePaths{
+		MessageDB: resolveDBPath(dataDir, os.Getenv("THREADSCRIBE_MESSAGE_DB"), "messages.db"),
+		SessionDB: resolveDBPath(dataDir, os.Getenv("THREADSCRIBE_SESSION_DB"), "whatsapp.db"),
+	}
+}
+
+// resolveDBPath places a bare file name in dataDir and leaves paths alone
+func resolveDBPath(dataDir, value, def string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		value = def
+	}
+	if filepath.Base(value) == value {
+		return filepath.Join(dataDir, value)
+	}
+	return value
+}
+
+// prepare creates the directories of the databases and checks that both
+// the directories and any existing database files are writable, so a
+// read-only volume fails at startup rather than on the first write
+func (p storePaths) prepare() error {
+	for _, path := range []string{p.MessageDB, p.SessionDB} {
+		dir := filepath.Dir(path)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+
+		probe, err := os.CreateTemp(dir, ".write-test-*")
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %w", dir, err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err == nil {
+			f.Close()
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("%s is not writable: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// files lists the database files, for reporting their size
+func (p storePaths) files() []string {
+	return []string{p.MessageDB, p.SessionDB}
+}
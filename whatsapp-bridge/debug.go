@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// adminOnly rejects requests that don't carry THREADSCRIBE_ADMIN_TOKEN as a
+// bearer token. Admin endpoints are disabled when the token isn't set.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	token := os.Getenv("THREADSCRIBE_ADMIN_TOKEN")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeError(w, "Admin endpoints are disabled, set THREADSCRIBE_ADMIN_TOKEN to enable them", http.StatusForbidden)
+			return
+		}
+
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// connectionStats collects connection events that are otherwise only
+// visible in the logs, for /api/debug
+var connectionStats = struct {
+	sync.Mutex
+	appStateSynced     bool
+	lastQREvent        string
+	lastQREventAt      time.Time
+	connects           int
+	disconnects        int
+	connectFailures    int
+	manualReconnects   int
+	lastConnectedAt    time.Time
+	lastDisconnectedAt time.Time
+}{}
+
+// recordConnectionEvent updates connectionStats from a whatsmeow event
+func recordConnectionEvent(evt interface{}) {
+	connectionStats.Lock()
+	defer connectionStats.Unlock()
+
+	now := time.Now()
+	switch evt.(type) {
+	case *events.QR:
+		connectionStats.lastQREvent = "code"
+		connectionStats.lastQREventAt = now
+	case *events.PairSuccess:
+		connectionStats.lastQREvent = "success"
+		connectionStats.lastQREventAt = now
+	case *events.PairError:
+		connectionStats.lastQREvent = "error"
+		connectionStats.lastQREventAt = now
+	case *events.Connected:
+		connectionStats.connects++
+		connectionStats.lastConnectedAt = now
+	case *events.Disconnected:
+		connectionStats.disconnects++
+		connectionStats.lastDisconnectedAt = now
+	case *events.ConnectFailure:
+		connectionStats.connectFailures++
+	case *events.AppStateSyncComplete:
+		connectionStats.appStateSynced = true
+	case *events.LoggedOut:
+		connectionStats.appStateSynced = false
+	}
+}
+
+// recordConnectFailure counts a failed connection attempt
+func recordConnectFailure() {
+	connectionStats.Lock()
+	defer connectionStats.Unlock()
+	connectionStats.connectFailures++
+}
+
+// recordManualReconnect counts a reconnect triggered through the API
+func recordManualReconnect() {
+	connectionStats.Lock()
+	defer connectionStats.Unlock()
+	connectionStats.manualReconnects++
+}
+
+// optionalTime returns nil for the zero time so it encodes as null
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// debugInfo gathers the device and connection details shown by /api/debug
+func debugInfo(client *whatsmeow.Client, queue *eventQueue) map[string]interface{} {
+	var jid string
+	if client.Store.ID != nil {
+		jid = client.Store.ID.String()
+	}
+
+	connectionStats.Lock()
+	defer connectionStats.Unlock()
+
+	var lastQR interface{}
+	if connectionStats.lastQREvent != "" {
+		lastQR = map[string]interface{}{
+			"event": connectionStats.lastQREvent,
+			"at":    connectionStats.lastQREventAt,
+		}
+	}
+
+	return map[string]interface{}{
+		"jid":              jid,
+		"platform":         client.Store.Platform,
+		"push_name":        client.Store.PushName,
+		"registration_id":  client.Store.RegistrationID,
+		"state":            getConnectionState(),
+		"connected":        client.IsConnected(),
+		"logged_in":        client.IsLoggedIn(),
+		"app_state_synced": connectionStats.appStateSynced,
+		"last_qr_event":    lastQR,
+		"event_queue":      queue.stats(),
+		"reconnects": map[string]interface{}{
+			"connects":                connectionStats.connects,
+			"disconnects":             connectionStats.disconnects,
+			"connect_failures":        connectionStats.connectFailures,
+			"manual_reconnects":       connectionStats.manualReconnects,
+			"auto_reconnect_errors":   client.AutoReconnectErrors,
+			"last_connected_at":       optionalTime(connectionStats.lastConnectedAt),
+			"last_disconnected_at":    optionalTime(connectionStats.lastDisconnectedAt),
+			"last_successful_connect": optionalTime(client.LastSuccessfulConnect),
+		},
+	}
+}
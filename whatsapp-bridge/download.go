@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// DownloadMediaRequest is the body of /api/download
+type DownloadMediaRequest struct {
+	MessageID string `json:"message_id"`
+	ChatJID   string `json:"chat_jid"`
+}
+
+// DownloadMediaResponse tells where the downloaded media was saved
+type DownloadMediaResponse struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	MediaType string `json:"media_type,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	Path      string `json:"path,omitempty"`
+}
+
+var (
+	// errNotMedia is returned when asked to download a message without media
+	errNotMedia = errors.New("not a media message")
+	// errIncompleteMedia is returned for media stored without what's needed
+	// to download it, which is the case for messages stored before the
+	// bridge kept media keys
+	errIncompleteMedia = errors.New("incomplete media information for download: the message was stored without its media key")
+)
+
+// downloadInfo returns what's needed to download the media of msg. The
+// direct path is only guessed from the URL for messages stored without it.
+func (msg *Message) downloadInfo() mediaDownloadInfo {
+	directPath := msg.DirectPath
+	if directPath == "" {
+		directPath = extractDirectPathFromURL(msg.URL)
+	}
+	return mediaDownloadInfo{
+		URL:           msg.URL,
+		DirectPath:    directPath,
+		MediaKey:      msg.MediaKey,
+		FileSHA256:    msg.FileSHA256,
+		FileEncSHA256: msg.FileEncSHA256,
+		FileLength:    msg.FileLength,
+	}
+}
+
+// cacheFilename is the name the media of msg is cached under: its message
+// ID, which unlike the filename is unique within the chat, and an extension
+// from its mime type
+func (msg *Message) cacheFilename() string {
+	id := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, msg.ID)
+	return id + mediaExtension(msg.MimeType, msg.Filename)
+}
+
+// cachePath returns where the media of msg is cached on disk
+func (msg *Message) cachePath() string {
+	return mediaCachePath(msg.ChatJID, msg.cacheFilename())
+}
+
+// downloadMedia saves the media of a stored message in the chat's media
+// cache directory and returns the absolute path. Media that is already
+// cached isn't downloaded again. When WhatsApp no longer has the media, the
+// message is marked so /api/messages stops offering it.
+func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, msg *Message) (string, error) {
+	if msg.MediaType == "" {
+		return "", errNotMedia
+	}
+	path, err := filepath.Abs(msg.cachePath())
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		touchMediaFile(path)
+		return path, nil
+	}
+
+	if (msg.URL == "" && msg.DirectPath == "") || len(msg.MediaKey) == 0 || len(msg.FileSHA256) == 0 || len(msg.FileEncSHA256) == 0 || msg.FileLength == 0 {
+		return "", errIncompleteMedia
+	}
+	downloadable, err := downloadableMessage(msg.MediaType, msg.downloadInfo())
+	if err != nil {
+		return "", err
+	}
+	data, err := client.Download(context.Background(), downloadable)
+	if err != nil {
+		if isMediaExpiredError(err) {
+			if err := messageStore.SetMediaExpired(msg.ChatJID, msg.ID); err != nil {
+				log.Printf("Failed to mark media of %s as expired: %v", msg.ID, err)
+			}
+		}
+		return "", fmt.Errorf("failed to download media: %w", err)
+	}
+
+	// Write to a temporary file first, so a failed write never leaves a
+	// truncated file that looks cached
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create chat directory: %w", err)
+	}
+	tmp := path + ".part"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to save media file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to save media file: %w", err)
+	}
+	log.Printf("Downloaded %s media of %s to %s (%d bytes)", msg.MediaType, msg.ID, path, len(data))
+	if err := messageStore.SetMediaLocalPath(msg.ChatJID, msg.ID, path); err != nil {
+		log.Printf("Failed to save where the media of %s was downloaded to: %v", msg.ID, err)
+	}
+	msg.LocalPath = path
+	return path, nil
+}
+
+// downloadStatusCode picks the HTTP status for a failed download
+func downloadStatusCode(err error) int {
+	var unsupported *unsupportedMediaError
+	switch {
+	case errors.Is(err, errNotMedia):
+		return http.StatusBadRequest
+	case errors.Is(err, errIncompleteMedia), errors.As(err, &unsupported):
+		return http.StatusUnprocessableEntity
+	case isMediaExpiredError(err):
+		return http.StatusGone
+	case errors.Is(err, whatsmeow.ErrNotConnected), errors.Is(err, whatsmeow.ErrNotLoggedIn):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// extractDirectPathFromURL guesses the direct path of media from its URL,
+// e.g. /v/t62.7118-24/1381_n.enc for
+// https://mmg.whatsapp.net/v/t62.7118-24/1381_n.enc?ccb=11-4, whatever the
+// CDN host. It returns "" when rawURL isn't a URL with a path.
+func extractDirectPathFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Path == "" {
+		return ""
+	}
+	return u.Path
+}
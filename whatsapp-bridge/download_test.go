@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCachePathIsPerMessage(t *testing.T) {
+	// Media received within the same second gets the same generated filename
+	a := &Message{ID: "3EB0AAA", ChatJID: "111@s.whatsapp.net", MediaType: "image", Filename: "image_20240501_120000.jpg", MimeType: "image/jpeg"}
+	b := &Message{ID: "3EB0BBB", ChatJID: "111@s.whatsapp.net", MediaType: "image", Filename: "image_20240501_120000.jpg", MimeType: "image/jpeg"}
+	if a.cachePath() == b.cachePath() {
+		t.Fatalf("two messages share the cache path %s", a.cachePath())
+	}
+	if got := filepath.Base(a.cachePath()); got != "3EB0AAA.jpg" {
+		t.Errorf("cache file of a = %q, want 3EB0AAA.jpg", got)
+	}
+}
+
+func TestCacheFilename(t *testing.T) {
+	tests := []struct {
+		msg  Message
+		want string
+	}{
+		{Message{ID: "ABC", MimeType: "audio/ogg; codecs=opus", Filename: "audio_20240501_120000.ogg"}, "ABC.ogg"},
+		{Message{ID: "ABC", MimeType: "video/mp4"}, "ABC.mp4"},
+		{Message{ID: "ABC", MimeType: "application/octet-stream", Filename: "Report.DOCX"}, "ABC.docx"},
+		{Message{ID: "ABC", MimeType: "image/webp", Filename: "sticker_1.webp"}, "ABC.webp"},
+		{Message{ID: "../x/ABC"}, "___x_ABC"},
+	}
+	for _, tt := range tests {
+		if got := tt.msg.cacheFilename(); got != tt.want {
+			t.Errorf("cacheFilename(%q, %q, %q) = %q, want %q", tt.msg.ID, tt.msg.MimeType, tt.msg.Filename, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadMediaOnlyUsesOwnCachedFile(t *testing.T) {
+	inTempDir(t)
+	ms := newTestStore(t)
+
+	first := &Message{ID: "3EB0AAA", ChatJID: "111@s.whatsapp.net", MediaType: "image", Filename: "image_20240501_120000.jpg", MimeType: "image/jpeg"}
+	second := &Message{ID: "3EB0BBB", ChatJID: first.ChatJID, MediaType: "image", Filename: first.Filename, MimeType: "image/jpeg"}
+	if err := os.MkdirAll(filepath.Dir(first.cachePath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(first.cachePath(), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := downloadMedia(nil, ms, first)
+	if err != nil || !strings.HasSuffix(path, "3EB0AAA.jpg") {
+		t.Fatalf("downloadMedia(first) = %q, %v", path, err)
+	}
+	// The second message has no media keys stored, so it must fail rather
+	// than be served the first one's file
+	if _, err := downloadMedia(nil, ms, second); !errors.Is(err, errIncompleteMedia) {
+		t.Fatalf("downloadMedia(second) error = %v, want errIncompleteMedia", err)
+	}
+}
+
+func TestDownloadableMessageForEachMediaType(t *testing.T) {
+	info := mediaDownloadInfo{
+		URL:           "https://mmg.whatsapp.net/v/t62.7118-24/1381_n.enc?ccb=11-4",
+		DirectPath:    "/v/t62.7118-24/1381_n.enc",
+		MediaKey:      []byte("key"),
+		FileSHA256:    []byte("sha"),
+		FileEncSHA256: []byte("encsha"),
+		FileLength:    1234,
+	}
+	tests := []struct {
+		mediaType string
+		want      whatsmeow.MediaType
+	}{
+		{"image", whatsmeow.MediaImage},
+		{"video", whatsmeow.MediaVideo},
+		{"audio", whatsmeow.MediaAudio},
+		{"document", whatsmeow.MediaDocument},
+		// Stickers are encrypted like images
+		{"sticker", whatsmeow.MediaImage},
+	}
+	for _, tt := range tests {
+		downloadable, err := downloadableMessage(tt.mediaType, info)
+		if err != nil {
+			t.Errorf("downloadableMessage(%s): %v", tt.mediaType, err)
+			continue
+		}
+		if got := whatsmeow.GetMediaType(downloadable); got != tt.want {
+			t.Errorf("downloadableMessage(%s) is downloaded as %q, want %q", tt.mediaType, got, tt.want)
+		}
+		if downloadable.GetDirectPath() != info.DirectPath || string(downloadable.GetMediaKey()) != "key" ||
+			string(downloadable.GetFileSHA256()) != "sha" || string(downloadable.GetFileEncSHA256()) != "encsha" {
+			t.Errorf("downloadableMessage(%s) lost download info: %v", tt.mediaType, downloadable)
+		}
+	}
+}
+
+func TestDownloadUnsupportedMediaType(t *testing.T) {
+	if _, err := downloadableMessage("hologram", mediaDownloadInfo{}); err == nil {
+		t.Fatal("downloadableMessage accepted an unknown media type")
+	}
+
+	inTempDir(t)
+	msg := &Message{
+		ID:            "3EB0CCC",
+		ChatJID:       "111@s.whatsapp.net",
+		MediaType:     "hologram",
+		DirectPath:    "/v/t62.7118-24/1381_n.enc",
+		MediaKey:      []byte("key"),
+		FileSHA256:    []byte("sha"),
+		FileEncSHA256: []byte("encsha"),
+		FileLength:    1234,
+	}
+	_, err := downloadMedia(nil, newTestStore(t), msg)
+	var unsupported *unsupportedMediaError
+	if !errors.As(err, &unsupported) || unsupported.MediaType != "hologram" {
+		t.Fatalf("downloadMedia(hologram) error = %v, want an unsupportedMediaError", err)
+	}
+	if code := downloadStatusCode(err); code != http.StatusUnprocessableEntity {
+		t.Errorf("status for unsupported media = %d, want 422", code)
+	}
+}
+
+func TestDownloadStatusCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errNotMedia, http.StatusBadRequest},
+		{errIncompleteMedia, http.StatusUnprocessableEntity},
+		{fmt.Errorf("failed to download media: %w", whatsmeow.ErrMediaDownloadFailedWith410), http.StatusGone},
+		{whatsmeow.ErrNotConnected, http.StatusServiceUnavailable},
+		{errors.New("connection reset"), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		if got := downloadStatusCode(tt.err); got != tt.want {
+			t.Errorf("downloadStatusCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestExtractDirectPathFromURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{
+			"https://mmg.whatsapp.net/v/t62.7118-24/30119180_1381260589560731_5523473040734195211_n.enc?ccb=11-4&oh=01_Q5AaIOBsyvz8UZfKAQ&oe=67A1B2C3&_nc_sid=5e03e0&mms3=true",
+			"/v/t62.7118-24/30119180_1381260589560731_5523473040734195211_n.enc",
+		},
+		// Regional CDN hosts, which the old ".net/" split only handled by luck
+		{
+			"https://media-ams4-1.cdn.whatsapp.net/v/t62.7161-24/24066742_963524815574215_n.enc?ccb=11-4&oh=01_AdQz&oe=65F0A1B2",
+			"/v/t62.7161-24/24066742_963524815574215_n.enc",
+		},
+		{
+			"https://media.fcgh10-1.fna.whatsapp.net/v/t62.7119-24/21935427_692874376272939_n.enc?ccb=11-4&oh=01_Q5AaIA&oe=66C3D4E5&_nc_sid=5e03e0",
+			"/v/t62.7119-24/21935427_692874376272939_n.enc",
+		},
+		// A host outside .net, and one with a port
+		{"https://mmg.whatsapp.com/v/t62.7117-24/1234_n.enc?ccb=11-4", "/v/t62.7117-24/1234_n.enc"},
+		{"https://mmg.whatsapp.net:443/v/t62.7118-24/1234_n.enc", "/v/t62.7118-24/1234_n.enc"},
+		// The older shape of media URLs
+		{"https://mmg.whatsapp.net/d/f/AqkK3ibYnw8CEUC0zNKcRu9XvqLxsBGSfbqqdKtjLYkY.enc", "/d/f/AqkK3ibYnw8CEUC0zNKcRu9XvqLxsBGSfbqqdKtjLYkY.enc"},
+		// The fragment is dropped along with the query
+		{"https://mmg.whatsapp.net/v/t62.7118-24/1234_n.enc?ccb=11-4#frag", "/v/t62.7118-24/1234_n.enc"},
+		{"", ""},
+		{"https://mmg.whatsapp.net", ""},
+		{"https://mmg.whatsapp.net/v/%zz", ""},
+	}
+	for _, tt := range tests {
+		if got := extractDirectPathFromURL(tt.url); got != tt.want {
+			t.Errorf("extractDirectPathFromURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadInfoPrefersStoredDirectPath(t *testing.T) {
+	msg := &Message{
+		URL:        "https://media-ams4-1.cdn.whatsapp.net/v/t62.7118-24/guessed_n.enc?ccb=11-4",
+		DirectPath: "/v/t62.7118-24/stored_n.enc",
+	}
+	if got := msg.downloadInfo().DirectPath; got != msg.DirectPath {
+		t.Errorf("direct path = %q, want the stored %q", got, msg.DirectPath)
+	}
+	// Messages stored before the direct path was kept fall back to the URL
+	msg.DirectPath = ""
+	if got := msg.downloadInfo().DirectPath; got != "/v/t62.7118-24/guessed_n.enc" {
+		t.Errorf("direct path without a stored one = %q, want it taken from the URL", got)
+	}
+}
+
+func TestDirectPathIsStored(t *testing.T) {
+	ms := newTestStore(t)
+	waMsg := &waE2E.Message{ImageMessage: &waE2E.ImageMessage{
+		URL:        proto.String("https://media-ams4-1.cdn.whatsapp.net/v/t62.7118-24/guessed_n.enc?ccb=11-4"),
+		DirectPath: proto.String("/v/t62.7118-24/real_n.enc"),
+		MediaKey:   []byte("key"),
+	}}
+	msg := testMessage("IMG1", "", time.Now())
+	msg.Type, msg.MediaType = "image", "image"
+	applyMediaKeys(msg, waMsg)
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := ms.GetMessage(msg.ChatJID, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stored.downloadInfo().DirectPath; got != "/v/t62.7118-24/real_n.enc" {
+		t.Errorf("direct path = %q, want the one from the message", got)
+	}
+}
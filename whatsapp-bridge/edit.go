@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	errEditNotOwn   = errors.New("only messages we sent can be edited")
+	errEditTooOld   = errors.New("message is too old to be edited")
+	errEditNotText  = errors.New("only text messages can be edited")
+	errEditRevoked  = errors.New("message was deleted")
+	errEditUnsynced = errors.New("message hasn't been accepted by the server yet")
+)
+
+// checkEdit returns why target can't be edited, or nil if it can. WhatsApp
+// only takes edits of our own text messages within whatsmeow.EditWindow.
+func checkEdit(target *Message, now time.Time) error {
+	switch {
+	case !target.IsFromMe:
+		return errEditNotOwn
+	case target.Revoked:
+		return errEditRevoked
+	case target.Type != "text":
+		return errEditNotText
+	case !target.ServerAcked:
+		return errEditUnsynced
+	case now.Sub(target.Timestamp) > whatsmeow.EditWindow:
+		return errEditTooOld
+	}
+	return nil
+}
+
+// buildEditMessage builds the protocol message replacing the text of one
+// of our messages
+func buildEditMessage(client *whatsmeow.Client, chat types.JID, id, text string) *waE2E.Message {
+	return client.BuildEdit(chat, id, &waE2E.Message{Conversation: proto.String(text)})
+}
+
+// SetMessageEdited replaces the text of a stored message and records when
+// it was edited. The replaced text is kept in message_edits. Edits older
+// than the one already stored are ignored, so late deliveries can't undo
+// a newer edit.
+func (ms *MessageStore) SetMessageEdited(chatJID, id, content string, editedAt time.Time) error {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const newer = "chat_jid = ? AND id = ? AND (edited_at IS NULL OR edited_at < ?)"
+	if _, err := tx.Exec(
+		"INSERT INTO message_edits (chat_jid, message_id, content, replaced_at) SELECT chat_jid, id, content, ? FROM messages WHERE "+newer+" AND content != ?",
+		editedAt, chatJID, id, editedAt, content,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE messages SET content = ?, edited_at = ? WHERE "+newer,
+		content, editedAt, chatJID, id, editedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// handleEdit applies an edit someone made to one of their messages. Our
+// own edits from other devices arrive here too.
+func handleEdit(messageStore *MessageStore, v *events.Message, protocol *waE2E.ProtocolMessage) {
+	targetID := protocol.GetKey().GetID()
+	if targetID == "" {
+		return
+	}
+	editedAt := v.Info.Timestamp
+	if ms := protocol.GetTimestampMS(); ms > 0 {
+		editedAt = time.UnixMilli(ms)
+	}
+	content := extractTextContent(protocol.GetEditedMessage())
+	if err := messageStore.SetMessageEdited(v.Info.Chat.String(), targetID, content, editedAt); err != nil {
+		log.Printf("Failed to save edit of message %s: %v", targetID, err)
+	}
+}
+
+// latestEdit returns when a message of a chat was last edited
+func (ms *MessageStore) latestEdit(chatJID string) (time.Time, error) {
+	var at time.Time
+	err := ms.db.QueryRow("SELECT edited_at FROM messages WHERE chat_jid = ? AND edited_at IS NOT NULL ORDER BY edited_at DESC LIMIT 1", chatJID).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return at, err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestBuildEditMessage(t *testing.T) {
+	client := newTestClient(t)
+	chat := types.NewJID("111", types.DefaultUserServer)
+	edit := buildEditMessage(client, chat, "3EB0AAA", "fixed typo")
+
+	// Edits are wrapped in a future-proof message
+	protocol := edit.GetEditedMessage().GetMessage().GetProtocolMessage()
+	if protocol.GetType() != waE2E.ProtocolMessage_MESSAGE_EDIT {
+		t.Fatalf("protocol message type = %v, want MESSAGE_EDIT", protocol.GetType())
+	}
+	key := protocol.GetKey()
+	if key.GetID() != "3EB0AAA" || !key.GetFromMe() || key.GetRemoteJID() != chat.String() {
+		t.Errorf("edit targets %v, want our message 3EB0AAA in %s", key, chat)
+	}
+	if got := protocol.GetEditedMessage().GetConversation(); got != "fixed typo" {
+		t.Errorf("edited text = %q, want %q", got, "fixed typo")
+	}
+	if protocol.GetTimestampMS() == 0 {
+		t.Error("edit has no timestamp")
+	}
+}
+
+func TestCheckEdit(t *testing.T) {
+	now := time.Now()
+	editable := Message{ID: "3EB0AAA", Type: "text", IsFromMe: true, ServerAcked: true, Timestamp: now.Add(-time.Minute)}
+	tests := []struct {
+		name   string
+		modify func(*Message)
+		want   error
+	}{
+		{"own recent text", func(*Message) {}, nil},
+		{"someone else's", func(m *Message) { m.IsFromMe = false }, errEditNotOwn},
+		{"revoked", func(m *Message) { m.Revoked = true }, errEditRevoked},
+		{"image", func(m *Message) { m.Type = "image" }, errEditNotText},
+		{"not acked", func(m *Message) { m.ServerAcked = false }, errEditUnsynced},
+		{"too old", func(m *Message) { m.Timestamp = now.Add(-whatsmeow.EditWindow - time.Second) }, errEditTooOld},
+	}
+	for _, tt := range tests {
+		target := editable
+		tt.modify(&target)
+		if err := checkEdit(&target, now); err != tt.want {
+			t.Errorf("%s: checkEdit = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSetMessageEdited(t *testing.T) {
+	ms := newTestStore(t)
+	ts := time.Now().Truncate(time.Second)
+	msg := testMessage("3EB0AAA", "helo", ts)
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	editedAt := ts.Add(time.Minute)
+	if err := ms.SetMessageEdited(msg.ChatJID, msg.ID, "hello", editedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saving the message again, like a history sync does, keeps the edit time
+	resaved := testMessage("3EB0AAA", "hello", ts)
+	if err := ms.SaveMessage(resaved); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := ms.GetMessages(msg.ChatJID, MessageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	got := messages[0]
+	if got.Content != "hello" {
+		t.Errorf("content = %q, want the edited text", got.Content)
+	}
+	if got.EditedAt == nil || !got.EditedAt.Equal(editedAt) {
+		t.Errorf("edited_at = %v, want %v", got.EditedAt, editedAt)
+	}
+	latest, err := ms.latestEdit(msg.ChatJID)
+	if err != nil || !latest.Equal(editedAt) {
+		t.Errorf("latestEdit = %v, %v, want %v", latest, err, editedAt)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// SetChatEphemeral records a chat's disappearing messages timer in seconds,
+// 0 meaning disappearing messages are off
+func (ms *MessageStore) SetChatEphemeral(jid string, expiration uint32) error {
+	_, err := ms.db.Exec("UPDATE chats SET ephemeral_expiration = ? WHERE jid = ?", expiration, jid)
+	return err
+}
+
+// GetChatEphemeral returns a chat's disappearing messages timer in seconds
+func (ms *MessageStore) GetChatEphemeral(jid string) (uint32, error) {
+	var expiration uint32
+	err := ms.db.QueryRow("SELECT ephemeral_expiration FROM chats WHERE jid = ?", jid).Scan(&expiration)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return expiration, err
+}
+
+// saveChatEphemeral stores a chat's timer, logging failures
+func saveChatEphemeral(messageStore *MessageStore, chat types.JID, expiration uint32) {
+	if err := messageStore.SetChatEphemeral(chat.String(), expiration); err != nil {
+		log.Printf("Failed to save disappearing messages timer of %s: %v", chat, err)
+	}
+}
+
+// groupEphemeral returns the disappearing messages timer of a group
+func groupEphemeral(ephemeral types.GroupEphemeral) uint32 {
+	if !ephemeral.IsEphemeral {
+		return 0
+	}
+	return ephemeral.DisappearingTimer
+}
+
+// messageContextInfo returns the ContextInfo of the message types we store,
+// or nil if the message doesn't carry one
+func messageContextInfo(msg *waE2E.Message) *waE2E.ContextInfo {
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetContextInfo()
+	case msg.GetLocationMessage() != nil:
+		return msg.GetLocationMessage().GetContextInfo()
+	case msg.GetContactMessage() != nil:
+		return msg.GetContactMessage().GetContextInfo()
+	case msg.GetContactsArrayMessage() != nil:
+		return msg.GetContactsArrayMessage().GetContextInfo()
+	}
+	return nil
+}
+
+// matchChatEphemeral sets the disappearing messages timer of a chat on an
+// outgoing message to it
+func matchChatEphemeral(messageStore *MessageStore, chat types.JID, msg *waE2E.Message) {
+	expiration, err := messageStore.GetChatEphemeral(chat.String())
+	if err != nil {
+		log.Printf("Failed to get disappearing messages timer of %s: %v", chat, err)
+	} else if expiration > 0 {
+		applyEphemeral(msg, expiration)
+	}
+}
+
+// applyEphemeral sets the disappearing messages timer on an outgoing
+// message, so it vanishes like the rest of the chat
+func applyEphemeral(msg *waE2E.Message, expiration uint32) {
+	if contextInfo := outgoingContextInfo(msg); contextInfo != nil {
+		contextInfo.Expiration = proto.Uint32(expiration)
+	}
+}
+
+// outgoingContextInfo returns the ContextInfo of an outgoing message,
+// creating it if needed, or nil for message types without one. Plain text
+// has no ContextInfo, so it's turned into an extended text message.
+func outgoingContextInfo(msg *waE2E.Message) *waE2E.ContextInfo {
+	if msg.Conversation != nil {
+		msg.ExtendedTextMessage = &waE2E.ExtendedTextMessage{Text: msg.Conversation}
+		msg.Conversation = nil
+	}
+
+	var contextInfo **waE2E.ContextInfo
+	switch {
+	case msg.ExtendedTextMessage != nil:
+		contextInfo = &msg.ExtendedTextMessage.ContextInfo
+	case msg.ImageMessage != nil:
+		contextInfo = &msg.ImageMessage.ContextInfo
+	case msg.VideoMessage != nil:
+		contextInfo = &msg.VideoMessage.ContextInfo
+	case msg.AudioMessage != nil:
+		contextInfo = &msg.AudioMessage.ContextInfo
+	case msg.DocumentMessage != nil:
+		contextInfo = &msg.DocumentMessage.ContextInfo
+	case msg.LocationMessage != nil:
+		contextInfo = &msg.LocationMessage.ContextInfo
+	case msg.ContactMessage != nil:
+		contextInfo = &msg.ContactMessage.ContextInfo
+	case msg.ContactsArrayMessage != nil:
+		contextInfo = &msg.ContactsArrayMessage.ContextInfo
+	case msg.StickerMessage != nil:
+		contextInfo = &msg.StickerMessage.ContextInfo
+	default:
+		return nil
+	}
+
+	if *contextInfo == nil {
+		*contextInfo = &waE2E.ContextInfo{}
+	}
+	return *contextInfo
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMatchChatEphemeralWith24hTimer(t *testing.T) {
+	ms := newTestStore(t)
+	chat := types.NewJID("111", types.DefaultUserServer)
+	if err := ms.SaveChat(chat.String(), "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	const day = 24 * 60 * 60
+	if err := ms.SetChatEphemeral(chat.String(), day); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plain text has no ContextInfo and is turned into an extended text
+	text := &waE2E.Message{Conversation: proto.String("hi")}
+	matchChatEphemeral(ms, chat, text)
+	if text.Conversation != nil || text.GetExtendedTextMessage().GetText() != "hi" {
+		t.Fatalf("text wasn't converted to an extended text: %v", text)
+	}
+	if got := text.GetExtendedTextMessage().GetContextInfo().GetExpiration(); got != day {
+		t.Errorf("text expiration = %d, want %d", got, day)
+	}
+
+	image := &waE2E.Message{ImageMessage: &waE2E.ImageMessage{Caption: proto.String("pic")}}
+	matchChatEphemeral(ms, chat, image)
+	if got := image.GetImageMessage().GetContextInfo().GetExpiration(); got != day {
+		t.Errorf("image expiration = %d, want %d", got, day)
+	}
+}
+
+func TestMatchChatEphemeralWithoutTimer(t *testing.T) {
+	ms := newTestStore(t)
+	chat := types.NewJID("222", types.DefaultUserServer)
+	if err := ms.SaveChat(chat.String(), "Bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &waE2E.Message{Conversation: proto.String("hi")}
+	matchChatEphemeral(ms, chat, msg)
+	if msg.GetConversation() != "hi" || msg.ExtendedTextMessage != nil {
+		t.Fatalf("message to a chat without a timer was changed: %v", msg)
+	}
+
+	// Unknown chats have no timer either
+	matchChatEphemeral(ms, types.NewJID("333", types.DefaultUserServer), msg)
+	if msg.ExtendedTextMessage != nil {
+		t.Fatalf("message to an unknown chat was changed: %v", msg)
+	}
+}
+
+func TestGroupEphemeral(t *testing.T) {
+	if got := groupEphemeral(types.GroupEphemeral{IsEphemeral: true, DisappearingTimer: 86400}); got != 86400 {
+		t.Errorf("groupEphemeral(on) = %d, want 86400", got)
+	}
+	if got := groupEphemeral(types.GroupEphemeral{DisappearingTimer: 86400}); got != 0 {
+		t.Errorf("groupEphemeral(off) = %d, want 0", got)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// errorCode is a stable identifier sent with every error response, so
+// clients can branch on what went wrong instead of parsing the English
+// message. Codes are never renamed or reused, new ones may be added.
+type errorCode string
+
+const (
+	// 400: the request is malformed or misses a field
+	codeInvalidRequest errorCode = "INVALID_REQUEST"
+	// 400: the recipient of a send isn't a valid JID or phone number
+	codeInvalidRecipient errorCode = "INVALID_RECIPIENT"
+	// 400: a JID other than a send's recipient doesn't parse
+	codeInvalidJID errorCode = "INVALID_JID"
+	// 401: the admin token is missing or wrong
+	codeUnauthorized errorCode = "UNAUTHORIZED"
+	// 403: the request isn't allowed
+	codeForbidden errorCode = "FORBIDDEN"
+	// 403: the bridge runs read-only (THREADSCRIBE_READ_ONLY)
+	codeReadOnly errorCode = "READ_ONLY"
+	// 403: the action needs us to be an admin of the group
+	codeNotAdmin errorCode = "NOT_ADMIN"
+	// 403: we aren't a member of the group
+	codeNotGroupMember errorCode = "NOT_GROUP_MEMBER"
+	// 404: the chat, message or other resource doesn't exist
+	codeNotFound errorCode = "NOT_FOUND"
+	// 405: the endpoint doesn't accept this method
+	codeMethodNotAllowed errorCode = "METHOD_NOT_ALLOWED"
+	// 409: the request conflicts with the current state
+	codeConflict errorCode = "CONFLICT"
+	// 409: no WhatsApp account is paired yet
+	codeNotPaired errorCode = "NOT_PAIRED"
+	// 410: the media is gone from WhatsApp's servers
+	codeMediaExpired errorCode = "MEDIA_EXPIRED"
+	// 422: the request is well-formed but can't be applied, e.g. a message
+	// too old to edit
+	codeUnprocessable errorCode = "UNPROCESSABLE"
+	// 429: WhatsApp is rate limiting us
+	codeRateLimited errorCode = "RATE_LIMITED"
+	// 500: something failed inside the bridge
+	codeInternal errorCode = "INTERNAL"
+	// 502: WhatsApp rejected or failed the request
+	codeWhatsAppError errorCode = "WHATSAPP_ERROR"
+	// 503: the bridge isn't connected to WhatsApp
+	codeNotConnected errorCode = "NOT_CONNECTED"
+)
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Success bool      `json:"success"`
+	Error   string    `json:"error"`
+	Code    errorCode `json:"code"`
+}
+
+// statusErrorCode is the code for an error that has nothing more specific
+// to say than its HTTP status
+func statusErrorCode(status int) errorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return codeInvalidRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusGone:
+		return codeMediaExpired
+	case http.StatusUnprocessableEntity:
+		return codeUnprocessable
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusBadGateway:
+		return codeWhatsAppError
+	case http.StatusServiceUnavailable:
+		return codeNotConnected
+	}
+	return codeInternal
+}
+
+// errorCodeFor picks the code for a failure caused by err, falling back to
+// the one for status when err isn't one we recognize
+func errorCodeFor(err error, status int) errorCode {
+	switch {
+	case errors.Is(err, errNotGroupMember), errors.Is(err, whatsmeow.ErrNotInGroup):
+		return codeNotGroupMember
+	case errors.Is(err, errRevokeNotAdmin), errors.Is(err, errNotGroupAdmin):
+		return codeNotAdmin
+	case errors.Is(err, whatsmeow.ErrIQRateOverLimit):
+		return codeRateLimited
+	case errors.Is(err, whatsmeow.ErrNotConnected), errors.Is(err, whatsmeow.ErrNotLoggedIn):
+		return codeNotConnected
+	case isMediaExpiredError(err):
+		return codeMediaExpired
+	}
+	return statusErrorCode(status)
+}
+
+// writeError answers with an error envelope whose code follows from the
+// status. It takes the place of http.Error.
+func writeError(w http.ResponseWriter, message string, status int) {
+	writeErrorCode(w, message, statusErrorCode(status), status)
+}
+
+// writeErrorCode answers with an error envelope carrying a specific code
+func writeErrorCode(w http.ResponseWriter, message string, code errorCode, status int) {
+	writeErrorBody(w, ErrorResponse{Error: message, Code: code}, status)
+}
+
+// writeSendError answers a failed send, pin, edit or similar with the error
+// envelope. It also sets message, which send responses always carried.
+func writeSendError(w http.ResponseWriter, message string, code errorCode, status int) {
+	writeErrorBody(w, SendMessageResponse{Message: message, Error: message, Code: code}, status)
+}
+
+// writeErrorBody writes body as the JSON answer to a failed request
+func writeErrorBody(w http.ResponseWriter, body interface{}, status int) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to write error response: %v", err)
+	}
+}
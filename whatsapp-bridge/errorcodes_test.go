@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mau.fi/whatsmeow"
+)
+
+func TestWriteErrorEnvelope(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "text/plain")
+	rec.Header().Set("Content-Length", "12")
+	writeError(rec, "WhatsApp not connected", http.StatusServiceUnavailable)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("stale Content-Length %q was kept", cl)
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"success": false, "error": "WhatsApp not connected", "code": "NOT_CONNECTED"}
+	if fmt.Sprint(body) != fmt.Sprint(want) {
+		t.Errorf("body = %v, want %v", body, want)
+	}
+
+	rec = httptest.NewRecorder()
+	writeErrorCode(rec, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+	var resp ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest || resp.Code != codeInvalidJID || resp.Success {
+		t.Errorf("writeErrorCode = %d %+v, want 400 with INVALID_JID", rec.Code, resp)
+	}
+}
+
+func TestWriteSendErrorEnvelope(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeSendError(rec, "Failed to pin message: not connected", codeNotConnected, http.StatusInternalServerError)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	// message stays for clients that read it before error existed
+	want := map[string]interface{}{
+		"success": false,
+		"message": "Failed to pin message: not connected",
+		"error":   "Failed to pin message: not connected",
+		"code":    "NOT_CONNECTED",
+	}
+	if fmt.Sprint(body) != fmt.Sprint(want) {
+		t.Errorf("body = %v, want %v", body, want)
+	}
+}
+
+func TestStatusErrorCode(t *testing.T) {
+	tests := []struct {
+		status int
+		want   errorCode
+	}{
+		{http.StatusBadRequest, codeInvalidRequest},
+		{http.StatusUnauthorized, codeUnauthorized},
+		{http.StatusForbidden, codeForbidden},
+		{http.StatusNotFound, codeNotFound},
+		{http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{http.StatusConflict, codeConflict},
+		{http.StatusGone, codeMediaExpired},
+		{http.StatusUnprocessableEntity, codeUnprocessable},
+		{http.StatusTooManyRequests, codeRateLimited},
+		{http.StatusInternalServerError, codeInternal},
+		{http.StatusBadGateway, codeWhatsAppError},
+		{http.StatusServiceUnavailable, codeNotConnected},
+		{http.StatusTeapot, codeInternal},
+	}
+	for _, tt := range tests {
+		if got := statusErrorCode(tt.status); got != tt.want {
+			t.Errorf("statusErrorCode(%d) = %s, want %s", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestErrorCodeFor(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		want   errorCode
+	}{
+		{errNotGroupMember, http.StatusForbidden, codeNotGroupMember},
+		{fmt.Errorf("failed to leave: %w", whatsmeow.ErrNotInGroup), http.StatusBadGateway, codeNotGroupMember},
+		{errRevokeNotAdmin, http.StatusForbidden, codeNotAdmin},
+		{fmt.Errorf("failed to update participants: %w", errNotGroupAdmin), http.StatusForbidden, codeNotAdmin},
+		{fmt.Errorf("failed to get group info: %w", whatsmeow.ErrIQRateOverLimit), http.StatusBadGateway, codeRateLimited},
+		{whatsmeow.ErrNotConnected, http.StatusInternalServerError, codeNotConnected},
+		{whatsmeow.ErrNotLoggedIn, http.StatusInternalServerError, codeNotConnected},
+		{fmt.Errorf("failed to download media: %w", whatsmeow.ErrMediaDownloadFailedWith410), http.StatusBadGateway, codeMediaExpired},
+		{whatsmeow.ErrMediaDownloadFailedWith404, http.StatusBadGateway, codeMediaExpired},
+		// Anything else gets the code of its status
+		{fmt.Errorf("connection reset"), http.StatusBadGateway, codeWhatsAppError},
+		{fmt.Errorf("disk full"), http.StatusInternalServerError, codeInternal},
+	}
+	for _, tt := range tests {
+		if got := errorCodeFor(tt.err, tt.status); got != tt.want {
+			t.Errorf("errorCodeFor(%v, %d) = %s, want %s", tt.err, tt.status, got, tt.want)
+		}
+	}
+}
+
+// TestNoPlainTextErrors checks that no handler answers with http.Error or
+// builds its own error body, which would skip the envelope or its code
+func TestNoPlainTextErrors(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Error" {
+				if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "http" {
+					t.Errorf("%s: http.Error answers without an error code", fset.Position(call.Pos()))
+				}
+			}
+			return true
+		})
+		ast.Inspect(file, func(n ast.Node) bool {
+			if fn, ok := n.(*ast.FuncLit); ok && isHandler(fn.Type) {
+				ast.Inspect(fn.Body, func(n ast.Node) bool {
+					if lit, ok := n.(*ast.CompositeLit); ok {
+						if problem := adHocErrorBody(lit); problem != "" {
+							t.Errorf("%s: %s, use writeErrorCode or writeSendError", fset.Position(lit.Pos()), problem)
+						}
+					}
+					return true
+				})
+				return false
+			}
+			return true
+		})
+	}
+}
+
+// isHandler reports whether a function has the signature of an http.HandlerFunc
+func isHandler(fn *ast.FuncType) bool {
+	if len(fn.Params.List) != 2 {
+		return false
+	}
+	sel, ok := fn.Params.List[0].Type.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "ResponseWriter"
+}
+
+// adHocErrorBody describes what's wrong with lit if it builds an error
+// response by hand: a map with an "error" key, or a failed
+// SendMessageResponse
+func adHocErrorBody(lit *ast.CompositeLit) string {
+	switch typ := lit.Type.(type) {
+	case *ast.MapType:
+		for _, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if key, isString := kv.Key.(*ast.BasicLit); ok && isString && key.Value == `"error"` {
+				return "error map built by hand"
+			}
+		}
+	case *ast.Ident:
+		if typ.Name != "SendMessageResponse" {
+			return ""
+		}
+		for _, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			if key, ok := kv.Key.(*ast.Ident); ok && key.Name == "Success" {
+				if value, ok := kv.Value.(*ast.Ident); !ok || value.Name != "true" {
+					return "failed SendMessageResponse built by hand"
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// eventQueue runs slow event handling off the whatsmeow event callback, so
+// a slow database write or name lookup doesn't hold up the events behind
+// it. Work is spread over a fixed number of workers by key (the chat JID),
+// so everything for one chat still runs in order on the same worker.
+type eventQueue struct {
+	queues    []chan func()
+	processed atomic.Int64
+
+	// mu guards closed against Submit sending on a closed queue
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// loadEventQueue starts the workers configured through the environment
+func loadEventQueue() *eventQueue {
+	workers := envInt("THREADSCRIBE_EVENT_WORKERS", 4)
+	if workers < 1 {
+		workers = 1
+	}
+	size := envInt("THREADSCRIBE_EVENT_QUEUE_SIZE", 256)
+	if size < 1 {
+		size = 1
+	}
+	log.Printf("Handling events with %d workers (queue size %d each)", workers, size)
+	return newEventQueue(workers, size)
+}
+
+func newEventQueue(workers, size int) *eventQueue {
+	q := &eventQueue{queues: make([]chan func(), workers)}
+	for i := range q.queues {
+		q.queues[i] = make(chan func(), size)
+		q.workers.Add(1)
+		go q.work(q.queues[i])
+	}
+	return q
+}
+
+func (q *eventQueue) work(queue chan func()) {
+	defer q.workers.Done()
+	for fn := range queue {
+		fn()
+		q.processed.Add(1)
+	}
+}
+
+// Submit queues fn on the worker for key. It blocks while that worker's
+// queue is full, which holds up whatsmeow rather than dropping events.
+// Events arriving after Close are dropped.
+func (q *eventQueue) Submit(key string, fn func()) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	q.queues[h.Sum32()%uint32(len(q.queues))] <- fn
+}
+
+// Close stops taking events and waits until the queued ones are handled,
+// or until ctx is done
+func (q *eventQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, queue := range q.queues {
+			close(queue)
+		}
+	}
+	q.mu.Unlock()
+	return waitGroupContext(ctx, &q.workers)
+}
+
+// stats reports queue depths for /api/debug
+func (q *eventQueue) stats() map[string]interface{} {
+	depths := make([]int, len(q.queues))
+	total := 0
+	for i, queue := range q.queues {
+		depths[i] = len(queue)
+		total += depths[i]
+	}
+	return map[string]interface{}{
+		"workers":   len(q.queues),
+		"capacity":  cap(q.queues[0]),
+		"depth":     total,
+		"depths":    depths,
+		"processed": q.processed.Load(),
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventQueueKeepsChatOrder(t *testing.T) {
+	q := newEventQueue(4, 8)
+	var mu sync.Mutex
+	got := make(map[string][]int)
+	for i := 0; i < 50; i++ {
+		for _, chat := range []string{"a", "b", "c"} {
+			q.Submit(chat, func() {
+				mu.Lock()
+				got[chat] = append(got[chat], i)
+				mu.Unlock()
+			})
+		}
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for chat, order := range got {
+		if len(order) != 50 {
+			t.Fatalf("chat %s handled %d events, want 50", chat, len(order))
+		}
+		for i, n := range order {
+			if n != i {
+				t.Fatalf("chat %s handled event %d at position %d", chat, n, i)
+			}
+		}
+	}
+}
+
+func TestEventQueueCloseWaitsForQueuedEvents(t *testing.T) {
+	q := newEventQueue(2, 16)
+	var handled atomic.Int32
+	for i := 0; i < 10; i++ {
+		q.Submit("chat", func() {
+			time.Sleep(time.Millisecond)
+			handled.Add(1)
+		})
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := handled.Load(); n != 10 {
+		t.Fatalf("Close returned with %d of 10 events handled", n)
+	}
+
+	// Late events are dropped rather than sent on a closed queue
+	q.Submit("chat", func() { handled.Add(1) })
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := handled.Load(); n != 10 {
+		t.Fatalf("event submitted after Close was handled")
+	}
+}
+
+func TestEventQueueCloseGivesUpAtDeadline(t *testing.T) {
+	q := newEventQueue(1, 1)
+	release := make(chan struct{})
+	q.Submit("chat", func() { <-release })
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Close = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestEventQueueStats(t *testing.T) {
+	q := newEventQueue(1, 8)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	q.Submit("chat", func() {
+		close(started)
+		<-release
+	})
+	<-started
+	for i := 0; i < 3; i++ {
+		q.Submit("chat", func() {})
+	}
+
+	stats := q.stats()
+	if stats["workers"] != 1 || stats["capacity"] != 8 || stats["depth"] != 3 {
+		t.Errorf("stats while blocked = %v, want 1 worker, capacity 8, depth 3", stats)
+	}
+	close(release)
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := q.stats(); stats["depth"] != 0 || stats["processed"] != int64(4) {
+		t.Errorf("stats after Close = %v, want depth 0 and 4 processed", stats)
+	}
+}
+
+func TestEventQueueSlowChatDoesntHoldUpOthers(t *testing.T) {
+	q := newEventQueue(2, 8)
+	defer q.Close(context.Background())
+
+	// Find a chat handled by the other worker than "slow"
+	worker := func(key string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return h.Sum32() % 2
+	}
+	other := "fast"
+	for i := 0; worker(other) == worker("slow"); i++ {
+		other = fmt.Sprintf("fast%d", i)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	q.Submit("slow", func() { <-release })
+	done := make(chan struct{})
+	q.Submit(other, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow chat held up another chat's events")
+	}
+}
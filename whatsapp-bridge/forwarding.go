@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// forwardingInfo reports whether a message was forwarded and how many times
+// it has been forwarded along the way. WhatsApp labels messages with a
+// score of 5 or more as "Forwarded many times".
+func forwardingInfo(msg *waE2E.Message) (bool, uint32) {
+	contextInfo := messageContextInfo(msg)
+	return contextInfo.GetIsForwarded(), contextInfo.GetForwardingScore()
+}
+
+// ForwardMessageRequest is the body of /api/forward
+type ForwardMessageRequest struct {
+	SourceChatJID string `json:"source_chat_jid"`
+	MessageID     string `json:"message_id"`
+	// Target is the JID or phone number to forward to
+	Target string `json:"target"`
+}
+
+var (
+	// errForwardNotFound is returned when forwarding a message that isn't stored
+	errForwardNotFound = errors.New("message to forward not found")
+	// errForwardUnsupported is returned for messages WhatsApp doesn't let
+	// us forward, or that we can't rebuild
+	errForwardUnsupported = errors.New("this kind of message can't be forwarded")
+	// errForwardMediaUnavailable is returned for media that is neither
+	// cached nor stored with what's needed to send it again
+	errForwardMediaUnavailable = errors.New("the media of this message is neither cached nor stored with its media key")
+)
+
+// forwardMessage sends a copy of a stored message to another chat, marked
+// as forwarded. Media is sent by reference to WhatsApp's copy when its key
+// is stored, and uploaded again from the media cache otherwise.
+func forwardMessage(client *whatsmeow.Client, messageStore *MessageStore, source types.JID, id string, to types.JID) (*Message, error) {
+	original, err := messageStore.GetMessage(source.String(), id)
+	if err == sql.ErrNoRows {
+		return nil, errForwardNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if original.Revoked || original.ViewOnce || original.Type == "poll" {
+		return nil, errForwardUnsupported
+	}
+
+	msg := &Message{
+		Content:         original.Content,
+		ChatJID:         to.String(),
+		Type:            original.Type,
+		IsFromMe:        true,
+		IsForwarded:     true,
+		ForwardingScore: original.ForwardingScore + 1,
+		Location:        original.Location,
+		Contacts:        original.Contacts,
+	}
+
+	var waMsg *waE2E.Message
+	switch {
+	case original.MediaType != "":
+		waMsg, err = forwardedMedia(client, original)
+		if err != nil {
+			return nil, err
+		}
+		msg.MediaType = original.MediaType
+		msg.Filename = original.Filename
+		msg.MimeType, msg.FileLength = extractMediaMeta(waMsg)
+		applyMediaKeys(msg, waMsg)
+	case original.Location != nil:
+		waMsg = buildLocationMessage(original.Location)
+	case len(original.Contacts) == 1:
+		waMsg, _, err = buildContactMessage(original.Contacts[0].VCard)
+		if err != nil {
+			return nil, err
+		}
+	case len(original.Contacts) > 1:
+		contacts := make([]*waE2E.ContactMessage, len(original.Contacts))
+		for i, contact := range original.Contacts {
+			contacts[i] = &waE2E.ContactMessage{DisplayName: proto.String(contact.Name), Vcard: proto.String(contact.VCard)}
+		}
+		waMsg = &waE2E.Message{ContactsArrayMessage: &waE2E.ContactsArrayMessage{
+			DisplayName: proto.String(original.Content),
+			Contacts:    contacts,
+		}}
+	case original.Content != "":
+		waMsg = &waE2E.Message{Conversation: proto.String(original.Content)}
+	default:
+		return nil, errForwardUnsupported
+	}
+
+	if contextInfo := outgoingContextInfo(waMsg); contextInfo != nil {
+		contextInfo.IsForwarded = proto.Bool(true)
+		contextInfo.ForwardingScore = proto.Uint32(msg.ForwardingScore)
+	}
+	matchChatEphemeral(messageStore, to, waMsg)
+
+	if err := sendAndStore(client, messageStore, to, msg, waMsg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// forwardedMedia rebuilds the media message of a stored message. With the
+// media key stored, the message points at the file already on WhatsApp's
+// servers; otherwise the cached file is uploaded again.
+func forwardedMedia(client *whatsmeow.Client, original *Message) (*waE2E.Message, error) {
+	if !original.MediaExpired && (original.URL != "" || original.DirectPath != "") && len(original.MediaKey) > 0 &&
+		len(original.FileSHA256) > 0 && len(original.FileEncSHA256) > 0 && original.FileLength > 0 {
+		media, err := downloadableMessage(original.MediaType, original.downloadInfo())
+		if err != nil {
+			return nil, err
+		}
+		var mimeType *string
+		if original.MimeType != "" {
+			mimeType = proto.String(original.MimeType)
+		}
+		switch m := media.(type) {
+		case *waE2E.ImageMessage:
+			m.Caption, m.Mimetype = proto.String(original.Content), mimeType
+			return &waE2E.Message{ImageMessage: m}, nil
+		case *waE2E.VideoMessage:
+			m.Caption, m.Mimetype = proto.String(original.Content), mimeType
+			return &waE2E.Message{VideoMessage: m}, nil
+		case *waE2E.AudioMessage:
+			m.Mimetype = mimeType
+			return &waE2E.Message{AudioMessage: m}, nil
+		case *waE2E.DocumentMessage:
+			m.FileName, m.Title, m.Mimetype = proto.String(original.Filename), proto.String(original.Filename), mimeType
+			if original.Content != "" {
+				m.Caption = proto.String(original.Content)
+			}
+			return &waE2E.Message{DocumentMessage: m}, nil
+		case *waE2E.StickerMessage:
+			m.Mimetype = mimeType
+			return &waE2E.Message{StickerMessage: m}, nil
+		}
+	}
+
+	path := original.LocalPath
+	if path == "" {
+		path = original.cachePath()
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, errForwardMediaUnavailable
+	}
+	waMsg, _, err := buildMediaMessage(client, path, original.Content, original.Filename, original.MediaType == "document")
+	return waMsg, err
+}
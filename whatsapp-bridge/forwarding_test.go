@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestForwardingInfo(t *testing.T) {
+	forwarded := &waE2E.ContextInfo{IsForwarded: proto.Bool(true), ForwardingScore: proto.Uint32(6)}
+	tests := []struct {
+		name      string
+		msg       *waE2E.Message
+		forwarded bool
+		score     uint32
+	}{
+		{"plain text", &waE2E.Message{Conversation: proto.String("hi")}, false, 0},
+		{"forwarded text", &waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+			Text: proto.String("hi"), ContextInfo: forwarded}}, true, 6},
+		{"forwarded image", &waE2E.Message{ImageMessage: &waE2E.ImageMessage{ContextInfo: forwarded}}, true, 6},
+		{"forwarded once", &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{
+			ContextInfo: &waE2E.ContextInfo{IsForwarded: proto.Bool(true)}}}, true, 0},
+		{"reply", &waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+			Text: proto.String("hi"), ContextInfo: &waE2E.ContextInfo{StanzaID: proto.String("3EB0AAA")}}}, false, 0},
+	}
+	for _, tt := range tests {
+		isForwarded, score := forwardingInfo(tt.msg)
+		if isForwarded != tt.forwarded || score != tt.score {
+			t.Errorf("%s: forwardingInfo = %v, %d, want %v, %d", tt.name, isForwarded, score, tt.forwarded, tt.score)
+		}
+	}
+}
+
+func TestForwardedMessageRoundTrip(t *testing.T) {
+	ms := newTestStore(t)
+	waMsg := &waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+		Text:        proto.String("chain letter"),
+		ContextInfo: &waE2E.ContextInfo{IsForwarded: proto.Bool(true), ForwardingScore: proto.Uint32(5)},
+	}}
+	msg := testMessage("FWD1", extractTextContent(waMsg), time.Now())
+	msg.IsForwarded, msg.ForwardingScore = forwardingInfo(waMsg)
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := ms.GetMessages(msg.ChatJID, MessageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	if !messages[0].IsForwarded || messages[0].ForwardingScore != 5 {
+		t.Fatalf("stored is_forwarded = %v, forwarding_score = %d, want true, 5",
+			messages[0].IsForwarded, messages[0].ForwardingScore)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// groupInfoTTL is how long group info fetched for /api/group/{jid} is
+// reused before asking WhatsApp again
+const groupInfoTTL = 30 * time.Second
+
+// GroupMember is a participant of a group as listed by /api/group/{jid}
+type GroupMember struct {
+	JID          string `json:"jid"`
+	PushName     string `json:"push_name,omitempty"`
+	IsAdmin      bool   `json:"is_admin"`
+	IsSuperAdmin bool   `json:"is_super_admin"`
+}
+
+// GroupMetadata is the response of /api/group/{jid}
+type GroupMetadata struct {
+	JID   string `json:"jid"`
+	Name  string `json:"name"`
+	Topic string `json:"topic"`
+	// Owner is the creator of the group, empty when WhatsApp doesn't say
+	Owner        string        `json:"owner,omitempty"`
+	CreatedAt    time.Time     `json:"created_at"`
+	Participants []GroupMember `json:"participants"`
+}
+
+// groupInfoCache keeps recently fetched group info, so clients polling a
+// group don't send WhatsApp a query each time
+var groupInfoCache = struct {
+	sync.Mutex
+	entries map[types.JID]cachedGroupInfo
+}{entries: make(map[types.JID]cachedGroupInfo)}
+
+type cachedGroupInfo struct {
+	info      *types.GroupInfo
+	fetchedAt time.Time
+}
+
+// getCachedGroupInfo returns the info of a group, fetching it from WhatsApp
+// unless it was fetched less than groupInfoTTL ago
+func getCachedGroupInfo(client *whatsmeow.Client, jid types.JID) (*types.GroupInfo, error) {
+	groupInfoCache.Lock()
+	entry, ok := groupInfoCache.entries[jid]
+	groupInfoCache.Unlock()
+	if ok && time.Since(entry.fetchedAt) < groupInfoTTL {
+		return entry.info, nil
+	}
+
+	info, err := client.GetGroupInfo(jid)
+	if err != nil {
+		return nil, err
+	}
+	groupInfoCache.Lock()
+	groupInfoCache.entries[jid] = cachedGroupInfo{info: info, fetchedAt: time.Now()}
+	groupInfoCache.Unlock()
+	return info, nil
+}
+
+// forgetGroupInfo drops the cached info of a group after it changed
+func forgetGroupInfo(jid types.JID) {
+	groupInfoCache.Lock()
+	defer groupInfoCache.Unlock()
+	delete(groupInfoCache.entries, jid)
+}
+
+// groupMetadata describes a group, with the push names we know of its
+// participants
+func groupMetadata(ctx context.Context, client *whatsmeow.Client, info *types.GroupInfo) GroupMetadata {
+	metadata := GroupMetadata{
+		JID:          info.JID.String(),
+		Name:         info.Name,
+		Topic:        info.Topic,
+		CreatedAt:    info.GroupCreated,
+		Participants: make([]GroupMember, 0, len(info.Participants)),
+	}
+	if !info.OwnerJID.IsEmpty() {
+		metadata.Owner = info.OwnerJID.String()
+	}
+
+	for _, p := range info.Participants {
+		member := GroupMember{
+			JID:          p.JID.ToNonAD().String(),
+			IsAdmin:      p.IsAdmin || p.IsSuperAdmin,
+			IsSuperAdmin: p.IsSuperAdmin,
+		}
+		// Contacts are usually stored under their phone number, while
+		// participants may be listed by LID
+		for _, jid := range []types.JID{p.JID, p.PhoneNumber} {
+			if jid.IsEmpty() {
+				continue
+			}
+			if contact, err := client.Store.Contacts.GetContact(ctx, jid.ToNonAD()); err == nil && contact.PushName != "" {
+				member.PushName = contact.PushName
+				break
+			}
+		}
+		metadata.Participants = append(metadata.Participants, member)
+	}
+	return metadata
+}
+
+// maxGroupSubjectLength is the longest group name WhatsApp accepts
+const maxGroupSubjectLength = 25
+
+// CreateGroupRequest is the body of /api/group/create
+type CreateGroupRequest struct {
+	Subject string `json:"subject"`
+	// Participants are JIDs or phone numbers, without ourselves
+	Participants []string `json:"participants"`
+}
+
+// GroupParticipantResult is the outcome of adding one participant to a group
+type GroupParticipantResult struct {
+	// Participant is the JID or phone number as given in the request
+	Participant string `json:"participant"`
+	JID         string `json:"jid,omitempty"`
+	Success     bool   `json:"success"`
+	Error       string `json:"error,omitempty"`
+}
+
+// CreateGroupResponse is the response of /api/group/create
+type CreateGroupResponse struct {
+	Success bool   `json:"success"`
+	JID     string `json:"jid"`
+	Subject string `json:"subject"`
+	// Participants tells which participants were added. The group is
+	// created even when some of them couldn't be.
+	Participants []GroupParticipantResult `json:"participants"`
+}
+
+// groupParticipantError explains the error code WhatsApp reports for a
+// participant it couldn't add to a group
+func groupParticipantError(code int) string {
+	switch code {
+	case 401:
+		return "they blocked us"
+	case 403:
+		return "their privacy settings don't allow being added, invite them instead"
+	case 404:
+		return "not on WhatsApp"
+	case 408:
+		return "they recently left the group"
+	case 409:
+		return "already a member"
+	}
+	return fmt.Sprintf("WhatsApp error %d", code)
+}
+
+// parseGroupParticipants turns the JIDs or phone numbers of people to add to
+// a group into user JIDs, failing on the first that isn't one
+func parseGroupParticipants(participants []string) ([]types.JID, error) {
+	jids := make([]types.JID, len(participants))
+	for i, participant := range participants {
+		jid, err := parseRecipient(participant)
+		if err != nil {
+			return nil, fmt.Errorf("invalid participant %q: %v", participant, err)
+		}
+		if kind := classifyJID(jid); kind != jidIndividual && kind != jidLID {
+			return nil, fmt.Errorf("invalid participant %q: not a user", participant)
+		}
+		jids[i] = jid.ToNonAD()
+	}
+	return jids, nil
+}
+
+// createGroup creates a group with req.Participants, leaving out numbers
+// that aren't on WhatsApp, and stores it as a chat. Which participants
+// couldn't be added is reported in the response rather than as an error.
+func createGroup(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, req CreateGroupRequest, jids []types.JID) (*CreateGroupResponse, error) {
+	results := make([]GroupParticipantResult, len(jids))
+	for i, jid := range jids {
+		results[i] = GroupParticipantResult{Participant: req.Participants[i], JID: jid.String()}
+	}
+
+	// WhatsApp would create the group without telling which numbers aren't
+	// registered, so ask first
+	var phones []string
+	for _, jid := range jids {
+		if jid.Server == types.DefaultUserServer {
+			phones = append(phones, "+"+jid.User)
+		}
+	}
+	registered := make(map[string]bool)
+	checked := false
+	if len(phones) > 0 {
+		if found, err := client.IsOnWhatsApp(phones); err != nil {
+			log.Printf("Failed to check which group participants are on WhatsApp: %v", err)
+		} else {
+			checked = true
+			for _, r := range found {
+				if r.IsIn {
+					registered[r.JID.User] = true
+				}
+			}
+		}
+	}
+
+	var invite []types.JID
+	for i, jid := range jids {
+		if checked && jid.Server == types.DefaultUserServer && !registered[jid.User] {
+			results[i].Error = groupParticipantError(404)
+			continue
+		}
+		invite = append(invite, jid)
+	}
+
+	info, err := client.CreateGroup(ctx, whatsmeow.ReqCreateGroup{Name: req.Subject, Participants: invite})
+	if err != nil {
+		return nil, err
+	}
+	if err := messageStore.SaveChat(info.JID.String(), info.Name); err != nil {
+		log.Printf("Failed to store new group %s: %v", info.JID, err)
+	}
+	if err := messageStore.ReplaceGroupParticipants(info.JID.String(), info.Participants); err != nil {
+		log.Printf("Failed to store participants of %s: %v", info.JID, err)
+	}
+
+	applyParticipantResults(results, info.Participants)
+	return &CreateGroupResponse{
+		Success:      true,
+		JID:          info.JID.String(),
+		Subject:      info.Name,
+		Participants: results,
+	}, nil
+}
+
+// validateGroupSubject checks a group name before asking WhatsApp, which
+// rejects long ones with an unhelpful error
+func validateGroupSubject(subject string) error {
+	if subject == "" {
+		return fmt.Errorf("subject is required")
+	}
+	if utf8.RuneCountInString(subject) > maxGroupSubjectLength {
+		return fmt.Errorf("subject must be at most %d characters", maxGroupSubjectLength)
+	}
+	return nil
+}
+
+// applyParticipantResults fills in the outcome WhatsApp reported for each
+// participant of a group change, skipping those that already failed
+func applyParticipantResults(results []GroupParticipantResult, reported []types.GroupParticipant) {
+	// Participants may come back under their LID, with the phone number
+	// alongside
+	codes := make(map[string]int)
+	for _, p := range reported {
+		codes[p.JID.ToNonAD().String()] = p.Error
+		if !p.PhoneNumber.IsEmpty() {
+			codes[p.PhoneNumber.ToNonAD().String()] = p.Error
+		}
+	}
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+		switch code, ok := codes[results[i].JID]; {
+		case !ok:
+			results[i].Error = "not reported by WhatsApp"
+		case code == 0:
+			results[i].Success = true
+		default:
+			results[i].Error = groupParticipantError(code)
+		}
+	}
+}
+
+// errNotGroupAdmin is returned when changing the participants of a group
+// we don't administer
+var errNotGroupAdmin = errors.New("only group admins can change participants")
+
+// participantChanges maps the actions of /api/group/{jid}/participants to
+// whatsmeow's
+var participantChanges = map[string]whatsmeow.ParticipantChange{
+	"add":     whatsmeow.ParticipantChangeAdd,
+	"remove":  whatsmeow.ParticipantChangeRemove,
+	"promote": whatsmeow.ParticipantChangePromote,
+	"demote":  whatsmeow.ParticipantChangeDemote,
+}
+
+// UpdateParticipantsRequest is the body of /api/group/{jid}/participants
+type UpdateParticipantsRequest struct {
+	// Action is add, remove, promote or demote
+	Action       string   `json:"action"`
+	Participants []string `json:"participants"`
+}
+
+// UpdateParticipantsResponse is the response of
+// /api/group/{jid}/participants. Success is set when at least one
+// participant was changed.
+type UpdateParticipantsResponse struct {
+	Success      bool                     `json:"success"`
+	JID          string                   `json:"jid"`
+	Action       string                   `json:"action"`
+	Participants []GroupParticipantResult `json:"participants"`
+}
+
+// updateGroupParticipants adds, removes, promotes or demotes participants
+// of a group we administer. Each participant can fail on its own, which is
+// reported in the results rather than as an error.
+func updateGroupParticipants(client *whatsmeow.Client, group types.JID, action string, participants []string, jids []types.JID) ([]GroupParticipantResult, error) {
+	change, ok := participantChanges[action]
+	if !ok {
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+	admin, err := isGroupAdmin(client, group)
+	if err != nil {
+		return nil, err
+	}
+	if !admin {
+		return nil, errNotGroupAdmin
+	}
+
+	reported, err := client.UpdateGroupParticipants(group, jids, change)
+	if err != nil {
+		return nil, err
+	}
+	// The stored participants follow from the group info event WhatsApp
+	// sends for the change
+	forgetGroupInfo(group)
+
+	results := make([]GroupParticipantResult, len(jids))
+	for i, jid := range jids {
+		results[i] = GroupParticipantResult{Participant: participants[i], JID: jid.String()}
+	}
+	applyParticipantResults(results, reported)
+	return results, nil
+}
+
+// groupStatusCode picks the HTTP status for a failed group request
+func groupStatusCode(err error) int {
+	switch {
+	case errors.Is(err, whatsmeow.ErrGroupNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, whatsmeow.ErrNotInGroup), errors.Is(err, errNotGroupAdmin):
+		return http.StatusForbidden
+	case errors.Is(err, whatsmeow.ErrNotConnected), errors.Is(err, whatsmeow.ErrNotLoggedIn):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// GroupEvent is a change to the members of a group, as listed by
+// /api/group/{jid}/events
+type GroupEvent struct {
+	// Actor made the change, empty when WhatsApp doesn't say, e.g. for
+	// members joining through an invite link
+	Actor  string `json:"actor,omitempty"`
+	Target string `json:"target"`
+	// Action is join, leave, promote or demote
+	Action    string    `json:"action"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// handleGroupInfo applies a change to a group: its name, disappearing
+// messages timer and members. Member changes are also kept as group events.
+func handleGroupInfo(messageStore *MessageStore, v *events.GroupInfo) {
+	forgetGroupInfo(v.JID)
+	if v.Name != nil && v.Name.Name != "" {
+		if err := messageStore.UpdateChatName(v.JID.String(), v.Name.Name); err != nil {
+			log.Printf("Failed to update name of %s: %v", v.JID, err)
+		}
+	}
+	if v.Ephemeral != nil {
+		saveChatEphemeral(messageStore, v.JID, groupEphemeral(*v.Ephemeral))
+	}
+	if len(v.Join) == 0 && len(v.Leave) == 0 && len(v.Promote) == 0 && len(v.Demote) == 0 {
+		return
+	}
+	if err := messageStore.UpdateGroupParticipants(v.JID.String(), v.Join, v.Leave, v.Promote, v.Demote); err != nil {
+		log.Printf("Failed to update participants of %s: %v", v.JID, err)
+	}
+
+	var actor string
+	if v.SenderPN != nil && !v.SenderPN.IsEmpty() {
+		actor = v.SenderPN.ToNonAD().String()
+	} else if v.Sender != nil && !v.Sender.IsEmpty() {
+		actor = v.Sender.ToNonAD().String()
+	}
+	timestamp := v.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	var changes []GroupEvent
+	for _, c := range []struct {
+		action  string
+		targets []types.JID
+	}{{"join", v.Join}, {"leave", v.Leave}, {"promote", v.Promote}, {"demote", v.Demote}} {
+		for _, target := range c.targets {
+			changes = append(changes, GroupEvent{Actor: actor, Target: target.ToNonAD().String(), Action: c.action, Timestamp: timestamp})
+		}
+	}
+	if err := messageStore.SaveGroupEvents(v.JID.String(), changes); err != nil {
+		log.Printf("Failed to save member changes of %s: %v", v.JID, err)
+	}
+}
+
+// SaveGroupEvents records changes to the members of a group
+func (ms *MessageStore) SaveGroupEvents(chatJID string, changes []GroupEvent) error {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, change := range changes {
+		_, err := tx.Exec(
+			"INSERT INTO group_events (chat_jid, actor, target, action, timestamp) VALUES (?, ?, ?, ?, ?)",
+			chatJID, change.Actor, change.Target, change.Action, change.Timestamp,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetGroupEvents retrieves the latest changes to the members of a group,
+// newest first
+func (ms *MessageStore) GetGroupEvents(chatJID string, limit int) ([]GroupEvent, error) {
+	rows, err := ms.db.Query(
+		"SELECT actor, target, action, timestamp FROM group_events WHERE chat_jid = ? ORDER BY timestamp DESC, rowid DESC LIMIT ?",
+		chatJID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []GroupEvent{}
+	for rows.Next() {
+		var change GroupEvent
+		if err := rows.Scan(&change.Actor, &change.Target, &change.Action, &change.Timestamp); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
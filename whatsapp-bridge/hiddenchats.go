@@ -0,0 +1,34 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Hiding a chat only takes it out of the default /api/chats listing. It's
+// local to the bridge, not WhatsApp's archive, and the chat keeps its
+// messages and keeps receiving new ones while hidden.
+
+// SetChatHidden hides or unhides a chat, returning sql.ErrNoRows if there is
+// no such chat. The time of the change is kept so it shows up in the
+// /api/chats fingerprint.
+func (ms *MessageStore) SetChatHidden(jid string, hidden bool, at time.Time) error {
+	res, err := ms.db.Exec("UPDATE chats SET hidden = ?, hidden_at = ? WHERE jid = ?", hidden, at, jid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// latestHideChange returns when a chat was last hidden or unhidden
+func (ms *MessageStore) latestHideChange() (time.Time, error) {
+	var at time.Time
+	err := ms.db.QueryRow("SELECT hidden_at FROM chats WHERE hidden_at IS NOT NULL ORDER BY hidden_at DESC LIMIT 1").Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return at, err
+}
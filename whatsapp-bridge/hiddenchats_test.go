@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// chatJIDs lists the JIDs of chats in order
+func chatJIDs(chats []*Chat) []string {
+	var jids []string
+	for _, chat := range chats {
+		jids = append(jids, chat.JID)
+	}
+	return jids
+}
+
+func TestHiddenChatsFiltering(t *testing.T) {
+	ms := newTestStore(t)
+	for _, jid := range []string{"111@s.whatsapp.net", "222@s.whatsapp.net", "333@s.whatsapp.net"} {
+		if err := ms.SaveChat(jid, jid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := testMessage("M1", "keep me", time.Now())
+	msg.ChatJID = "222@s.whatsapp.net"
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ms.SetChatHidden("222@s.whatsapp.net", true, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	chats, err := ms.GetChats(ChatQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chat := range chats {
+		if chat.JID == "222@s.whatsapp.net" {
+			t.Fatalf("hidden chat listed by default: %v", chatJIDs(chats))
+		}
+	}
+	if len(chats) != 2 {
+		t.Fatalf("default listing = %v, want the 2 other chats", chatJIDs(chats))
+	}
+
+	chats, err = ms.GetChats(ChatQuery{IncludeHidden: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, chat := range chats {
+		if chat.JID == "222@s.whatsapp.net" {
+			found = true
+			if !chat.Hidden {
+				t.Error("hidden chat listed with include_hidden isn't flagged hidden")
+			}
+		}
+	}
+	if !found || len(chats) != 3 {
+		t.Fatalf("include_hidden listing = %v, want all 3 chats", chatJIDs(chats))
+	}
+
+	// Hiding keeps the messages, and new activity doesn't unhide the chat
+	if messages, err := ms.GetMessages("222@s.whatsapp.net", MessageQuery{}); err != nil || len(messages) != 1 {
+		t.Fatalf("hidden chat messages = %d, %v, want 1", len(messages), err)
+	}
+	if err := ms.SaveChat("222@s.whatsapp.net", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if chats, _ := ms.GetChats(ChatQuery{}); len(chats) != 2 {
+		t.Fatalf("new activity unhid the chat: %v", chatJIDs(chats))
+	}
+
+	if err := ms.SetChatHidden("222@s.whatsapp.net", false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if chats, _ := ms.GetChats(ChatQuery{}); len(chats) != 3 {
+		t.Fatalf("unhidden chat not listed: %v", chatJIDs(chats))
+	}
+}
+
+func TestHideUnknownChat(t *testing.T) {
+	ms := newTestStore(t)
+	if err := ms.SetChatHidden("999@s.whatsapp.net", true, time.Now()); err != sql.ErrNoRows {
+		t.Fatalf("SetChatHidden(unknown) = %v, want sql.ErrNoRows", err)
+	}
+}
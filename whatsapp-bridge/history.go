@@ -0,0 +1,213 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// historySyncLimits caps how much of a single history sync event is stored,
+// so one huge sync doesn't hold the database for minutes. Zero means no limit.
+type historySyncLimits struct {
+	MaxConversations int
+	MaxMessages      int
+}
+
+// loadHistorySyncLimits reads the history sync caps from the environment
+func loadHistorySyncLimits() historySyncLimits {
+	return historySyncLimits{
+		MaxConversations: envInt("THREADSCRIBE_HISTORY_SYNC_MAX_CONVERSATIONS", 100),
+		MaxMessages:      envInt("THREADSCRIBE_HISTORY_SYNC_MAX_MESSAGES", 500),
+	}
+}
+
+// handleHistorySync stores the conversations and messages from a history
+// sync event. WhatsApp sends the most recent conversations and messages
+// first, so anything over the limits is the oldest history and is skipped.
+func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, historySync *events.HistorySync, limits historySyncLimits) {
+	conversations := historySync.Data.GetConversations()
+	log.Printf("Received history sync with %d conversations", len(conversations))
+
+	if limits.MaxConversations > 0 && len(conversations) > limits.MaxConversations {
+		log.Printf("History sync capped: skipping %d of %d conversations (THREADSCRIBE_HISTORY_SYNC_MAX_CONVERSATIONS=%d)",
+			len(conversations)-limits.MaxConversations, len(conversations), limits.MaxConversations)
+		conversations = conversations[:limits.MaxConversations]
+	}
+
+	syncedCount := 0
+	for _, conversation := range conversations {
+		chatJID := conversation.GetID()
+		jid, err := types.ParseJID(chatJID)
+		if err != nil {
+			log.Printf("Failed to parse history sync JID %s: %v", chatJID, err)
+			continue
+		}
+		if classifyJID(jid) == jidUnknown {
+			log.Printf("History sync chat is on an unrecognized server: %s", chatJID)
+		}
+
+		messages := conversation.GetMessages()
+		if len(messages) == 0 {
+			continue
+		}
+		if limits.MaxMessages > 0 && len(messages) > limits.MaxMessages {
+			log.Printf("History sync capped: skipping %d of %d messages in %s (THREADSCRIBE_HISTORY_SYNC_MAX_MESSAGES=%d)",
+				len(messages)-limits.MaxMessages, len(messages), chatJID, limits.MaxMessages)
+			messages = messages[:limits.MaxMessages]
+		}
+
+		name := historyChatName(client, messageStore, jid, conversation)
+		if err := messageStore.SaveChat(chatJID, name); err != nil {
+			log.Printf("Failed to save chat %s: %v", chatJID, err)
+		}
+		saveChatEphemeral(messageStore, jid, conversation.GetEphemeralExpiration())
+
+		// Each conversation is stored in one transaction
+		msgs := make([]*Message, 0, len(messages))
+		polls := make(map[*Message]*waHistorySync.HistorySyncMsg)
+		for _, historyMsg := range messages {
+			msg := historyMessage(client, jid, historyMsg)
+			if msg == nil {
+				continue
+			}
+			msgs = append(msgs, msg)
+			if msg.Type == "poll" {
+				polls[msg] = historyMsg
+			}
+		}
+		stored, err := messageStore.SaveMessages(msgs)
+		if err != nil {
+			log.Printf("Failed to store %d of %d history messages in %s: %v", len(msgs)-stored, len(msgs), chatJID, err)
+		}
+		syncedCount += stored
+		if stored == 0 {
+			continue
+		}
+
+		// Votes on polls created before pairing can only be decrypted
+		// once the poll itself has synced
+		for msg, historyMsg := range polls {
+			saveHistoryPoll(client, messageStore, jid, msg, historyMsg.GetMessage())
+		}
+	}
+
+	log.Printf("History sync complete. Stored %d messages", syncedCount)
+}
+
+const (
+	// defaultChatSyncCount is how many older messages /api/sync-chat asks
+	// for by default, as recommended by whatsmeow
+	defaultChatSyncCount = 50
+	maxChatSyncCount     = 500
+)
+
+// buildChatHistoryRequest builds the peer message asking our phone for up to
+// count messages of chat sent before oldest
+func buildChatHistoryRequest(client *whatsmeow.Client, chat types.JID, oldest *Message, count int) *waE2E.Message {
+	return client.BuildHistorySyncRequest(&types.MessageInfo{
+		MessageSource: types.MessageSource{
+			Chat:     chat,
+			IsFromMe: oldest.IsFromMe,
+		},
+		ID:        oldest.ID,
+		Timestamp: oldest.Timestamp,
+	}, count)
+}
+
+// historyChatName prefers the name carried in the sync over looking it up
+func historyChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types.JID, conversation *waHistorySync.Conversation) string {
+	if name := conversation.GetDisplayName(); name != "" {
+		return name
+	}
+	if name := conversation.GetName(); name != "" {
+		return name
+	}
+	return GetChatName(client, messageStore, jid, jid.String(), nil, "")
+}
+
+// historyMessage converts a history sync message into a stored message, or
+// returns nil if it has no ID, no timestamp or nothing worth storing
+func historyMessage(client *whatsmeow.Client, chat types.JID, historyMsg *waHistorySync.HistorySyncMsg) *Message {
+	webMsg := historyMsg.GetMessage()
+	key := webMsg.GetKey()
+	if key.GetID() == "" {
+		return nil
+	}
+
+	// History sync keeps view-once media in its wrapper
+	message, _ := unwrapViewOnce(webMsg.GetMessage())
+	content := extractTextContent(message)
+	mediaType, filename, viewOnce := extractMediaInfo(webMsg.GetMessage())
+	mimeType, fileLength := extractMediaMeta(message)
+	poll := pollCreation(message)
+	if poll != nil {
+		content = poll.GetName()
+	}
+	if content == "" && mediaType == "" {
+		return nil
+	}
+
+	isFromMe := key.GetFromMe()
+	var sender types.JID
+	switch {
+	case isFromMe && client.Store.ID != nil:
+		sender = client.Store.ID.ToNonAD()
+	case !isFromMe && key.GetParticipant() != "":
+		participant, err := types.ParseJID(key.GetParticipant())
+		if err != nil {
+			return nil
+		}
+		sender = participant.ToNonAD()
+	default:
+		sender = chat
+	}
+
+	// The name may not be known yet this early after pairing, in which case
+	// resolveUnnamedSenders fills it in once the contacts have synced
+	pushName := webMsg.GetPushName()
+	if isFromMe {
+		pushName = client.Store.PushName
+	}
+	senderName := resolveSenderName(client, sender, pushName)
+
+	// The send time can't be made up, and time.Now() would put a message
+	// from years ago at the end of the chat
+	ts := webMsg.GetMessageTimestamp()
+	if ts == 0 {
+		return nil
+	}
+	timestamp := time.Unix(int64(ts), 0)
+
+	msg := &Message{
+		ID:          key.GetID(),
+		Sender:      sender.String(),
+		SenderName:  senderName,
+		Content:     content,
+		Timestamp:   timestamp,
+		ChatJID:     chat.String(),
+		Type:        "text",
+		IsFromMe:    isFromMe,
+		ServerAcked: isFromMe,
+		MediaType:   mediaType,
+		Filename:    filename,
+		MimeType:    mimeType,
+		FileLength:  fileLength,
+		ViewOnce:    viewOnce,
+	}
+	msg.IsForwarded, msg.ForwardingScore = forwardingInfo(message)
+	applyMediaKeys(msg, message)
+	if mediaType != "" {
+		msg.Type = mediaType
+	}
+	if poll != nil {
+		msg.Type = "poll"
+	}
+	applyLocation(msg, message)
+	applyContacts(msg, message)
+	return msg
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// syntheticHistorySync builds a sync of conversations chats with perChat
+// text messages each, newest first like WhatsApp sends them
+func syntheticHistorySync(chats, perChat int) *events.HistorySync {
+	var conversations []*waHistorySync.Conversation
+	for c := 0; c < chats; c++ {
+		conversation := &waHistorySync.Conversation{
+			ID:          proto.String(fmt.Sprintf("%d@s.whatsapp.net", 1000+c)),
+			DisplayName: proto.String(fmt.Sprintf("Chat %d", c)),
+		}
+		for m := 0; m < perChat; m++ {
+			conversation.Messages = append(conversation.Messages, &waHistorySync.HistorySyncMsg{
+				Message: &waWeb.WebMessageInfo{
+					Key: &waCommon.MessageKey{
+						RemoteJID: conversation.ID,
+						ID:        proto.String(fmt.Sprintf("C%dM%d", c, m)),
+					},
+					Message:          &waE2E.Message{Conversation: proto.String(fmt.Sprintf("message %d", m))},
+					MessageTimestamp: proto.Uint64(uint64(1700000000 - m)),
+				},
+			})
+		}
+		conversations = append(conversations, conversation)
+	}
+	return &events.HistorySync{Data: &waHistorySync.HistorySync{Conversations: conversations}}
+}
+
+func TestHandleHistorySyncCapsLargeSync(t *testing.T) {
+	ms := newTestStore(t)
+	client := newTestClient(t)
+	handleHistorySync(client, ms, syntheticHistorySync(40, 300), historySyncLimits{MaxConversations: 25, MaxMessages: 120})
+
+	var chats, messages int
+	if err := ms.db.QueryRow("SELECT COUNT(*) FROM chats").Scan(&chats); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&messages); err != nil {
+		t.Fatal(err)
+	}
+	if chats != 25 || messages != 25*120 {
+		t.Fatalf("stored %d chats and %d messages, want 25 and %d", chats, messages, 25*120)
+	}
+
+	// The most recent conversations and messages are the ones kept
+	if _, err := ms.GetMessage("1000@s.whatsapp.net", "C0M0"); err != nil {
+		t.Errorf("newest message of the first chat wasn't stored: %v", err)
+	}
+	if _, err := ms.GetMessage("1000@s.whatsapp.net", "C0M120"); err == nil {
+		t.Error("message over the per-chat cap was stored")
+	}
+	if _, err := ms.GetMessage("1025@s.whatsapp.net", "C25M0"); err == nil {
+		t.Error("conversation over the cap was stored")
+	}
+}
+
+func TestHandleHistorySyncWithoutLimits(t *testing.T) {
+	ms := newTestStore(t)
+	handleHistorySync(newTestClient(t), ms, syntheticHistorySync(5, 700), historySyncLimits{})
+
+	var messages int
+	if err := ms.db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&messages); err != nil {
+		t.Fatal(err)
+	}
+	if messages != 5*700 {
+		t.Fatalf("stored %d messages, want %d", messages, 5*700)
+	}
+}
+
+func TestBuildChatHistoryRequestFromOldestMessage(t *testing.T) {
+	ms := newTestStore(t)
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range []string{"NEWER", "OLDEST", "NEWEST"} {
+		msg := testMessage(id, "hi", base.Add(time.Duration([]int{1, 0, 2}[i])*time.Hour))
+		msg.IsFromMe = id == "OLDEST"
+		if err := ms.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Other chats don't affect the anchor
+	other := testMessage("ELSEWHERE", "hi", base.Add(-time.Hour))
+	other.ChatJID = "222@s.whatsapp.net"
+	if err := ms.SaveMessage(other); err != nil {
+		t.Fatal(err)
+	}
+
+	chat := types.NewJID("111", types.DefaultUserServer)
+	oldest, err := ms.GetOldestMessage(chat.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := buildChatHistoryRequest(newTestClient(t), chat, oldest, 120)
+
+	protocol := msg.GetProtocolMessage()
+	if protocol.GetType() != waE2E.ProtocolMessage_PEER_DATA_OPERATION_REQUEST_MESSAGE {
+		t.Fatalf("protocol message type = %s", protocol.GetType())
+	}
+	peerReq := protocol.GetPeerDataOperationRequestMessage()
+	if peerReq.GetPeerDataOperationRequestType() != waE2E.PeerDataOperationRequestType_HISTORY_SYNC_ON_DEMAND {
+		t.Fatalf("peer request type = %s", peerReq.GetPeerDataOperationRequestType())
+	}
+	onDemand := peerReq.GetHistorySyncOnDemandRequest()
+	if onDemand.GetChatJID() != chat.String() || onDemand.GetOldestMsgID() != "OLDEST" || !onDemand.GetOldestMsgFromMe() {
+		t.Errorf("anchor = %s/%s from me %v, want %s/OLDEST from me", onDemand.GetChatJID(), onDemand.GetOldestMsgID(), onDemand.GetOldestMsgFromMe(), chat)
+	}
+	if onDemand.GetOldestMsgTimestampMS() != base.UnixMilli() {
+		t.Errorf("anchor timestamp = %d, want %d", onDemand.GetOldestMsgTimestampMS(), base.UnixMilli())
+	}
+	if onDemand.GetOnDemandMsgCount() != 120 {
+		t.Errorf("count = %d, want 120", onDemand.GetOnDemandMsgCount())
+	}
+}
+
+func TestHistoryMessagesKeepServerTimestamp(t *testing.T) {
+	ms := newTestStore(t)
+	client := newTestClient(t)
+	before := time.Now().Add(-time.Second)
+	handleHistorySync(client, ms, syntheticHistorySync(1, 3), historySyncLimits{})
+
+	got, err := ms.GetMessage("1000@s.whatsapp.net", "C0M2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1700000000-2, 0); !got.Timestamp.Equal(want) {
+		t.Errorf("timestamp = %s, want the server timestamp %s", got.Timestamp, want)
+	}
+	if got.ReceivedAt.Before(before) || got.ReceivedAt.After(time.Now()) {
+		t.Errorf("received_at = %s, want the time of the sync", got.ReceivedAt)
+	}
+
+	// Syncing the same history again keeps when it was first received
+	first := got.ReceivedAt
+	handleHistorySync(client, ms, syntheticHistorySync(1, 3), historySyncLimits{})
+	got, err = ms.GetMessage("1000@s.whatsapp.net", "C0M2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.ReceivedAt.Equal(first) {
+		t.Errorf("received_at changed from %s to %s on a second sync", first, got.ReceivedAt)
+	}
+}
+
+func TestHistoryMessageWithoutTimestampIsSkipped(t *testing.T) {
+	sync := syntheticHistorySync(1, 1)
+	historyMsg := sync.Data.GetConversations()[0].GetMessages()[0]
+	historyMsg.Message.MessageTimestamp = nil
+	chat := types.NewJID("1000", types.DefaultUserServer)
+	if msg := historyMessage(newTestClient(t), chat, historyMsg); msg != nil {
+		t.Fatalf("history message without a timestamp stored at %s", msg.Timestamp)
+	}
+}
+
+// BenchmarkHistorySync stores a 10,000 message sync of 10 conversations
+// into a fresh database, one message at a time as it used to be and in one
+// transaction per conversation as handleHistorySync does now
+func BenchmarkHistorySync(b *testing.B) {
+	client := newTestClient(b)
+	historySync := syntheticHistorySync(10, 1000)
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	b.Run("one by one", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			ms := newTestStore(b)
+			b.StartTimer()
+			for _, conversation := range historySync.Data.GetConversations() {
+				jid, _ := types.ParseJID(conversation.GetID())
+				if err := ms.SaveChat(jid.String(), conversation.GetDisplayName()); err != nil {
+					b.Fatal(err)
+				}
+				for _, historyMsg := range conversation.GetMessages() {
+					if err := ms.SaveMessage(historyMessage(client, jid, historyMsg)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			ms := newTestStore(b)
+			b.StartTimer()
+			handleHistorySync(client, ms, historySync, historySyncLimits{})
+
+			b.StopTimer()
+			var stored int
+			if err := ms.db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&stored); err != nil || stored != 10000 {
+				b.Fatalf("stored %d messages, %v, want 10000", stored, err)
+			}
+			b.StartTimer()
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// InboxMessage is a message in the unified inbox, tagged with its chat's name
+type InboxMessage struct {
+	*Message
+	ChatName string `json:"chat_name"`
+}
+
+// inboxCursor marks the last message of an inbox page. Messages are ordered
+// by timestamp, then chat and ID, so messages sent in the same instant are
+// neither skipped nor repeated across pages.
+type inboxCursor struct {
+	Timestamp time.Time `json:"t"`
+	ChatJID   string    `json:"c"`
+	ID        string    `json:"i"`
+}
+
+// encode returns the cursor as an opaque URL-safe string
+func (c inboxCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseInboxCursor reads a cursor made by encode
+func parseInboxCursor(value string) (*inboxCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	var c inboxCursor
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.Timestamp.IsZero() {
+		return nil, fmt.Errorf("invalid cursor %q", value)
+	}
+	return &c, nil
+}
+
+// extraScanner scans the columns after messageSelectColumns into extra, so
+// scanMessage can read rows that select more than a message
+type extraScanner struct {
+	rowScanner
+	extra []interface{}
+}
+
+func (s extraScanner) Scan(dest ...interface{}) error {
+	return s.rowScanner.Scan(append(dest, s.extra...)...)
+}
+
+// GetInbox returns the most recent messages across every chat that isn't
+// hidden, newest first, starting after before when it's set
+func (ms *MessageStore) GetInbox(before *inboxCursor, limit int) ([]*InboxMessage, error) {
+	// The chat name is looked up per row rather than joined, since the
+	// chats table shares column names with messageSelectColumns
+	query := `
+	SELECT ` + messageSelectColumns + `,
+		COALESCE((SELECT name FROM chats WHERE chats.jid = messages.chat_jid), '')
+	FROM messages
+	WHERE chat_jid NOT IN (SELECT jid FROM chats WHERE hidden = 1)
+	`
+	var args []interface{}
+	if before != nil {
+		query += " AND (timestamp, chat_jid, id) < (?, ?, ?)"
+		args = append(args, before.Timestamp, before.ChatJID, before.ID)
+	}
+	query += " ORDER BY timestamp DESC, chat_jid DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := ms.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*InboxMessage
+	for rows.Next() {
+		var item InboxMessage
+		item.Message, err = scanMessage(extraScanner{rows, []interface{}{&item.ChatName}})
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &item)
+	}
+	return messages, rows.Err()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"go.mau.fi/whatsmeow/types"
+)
+
+// jidKind classifies what a JID refers to, so checks on the JID server are
+// made in one place
+type jidKind int
+
+const (
+	jidUnknown jidKind = iota
+	jidIndividual
+	jidGroup
+	jidBroadcast
+	jidNewsletter
+	jidStatus
+	jidLID
+)
+
+func (k jidKind) String() string {
+	switch k {
+	case jidIndividual:
+		return "individual"
+	case jidGroup:
+		return "group"
+	case jidBroadcast:
+		return "broadcast"
+	case jidNewsletter:
+		return "newsletter"
+	case jidStatus:
+		return "status"
+	case jidLID:
+		return "lid"
+	}
+	return "unknown"
+}
+
+// classifyJID returns the kind of chat or user a JID refers to
+func classifyJID(jid types.JID) jidKind {
+	switch jid.Server {
+	case types.DefaultUserServer, types.LegacyUserServer, types.HostedServer:
+		return jidIndividual
+	case types.HiddenUserServer, types.HostedLIDServer:
+		return jidLID
+	case types.GroupServer:
+		return jidGroup
+	case types.NewsletterServer:
+		return jidNewsletter
+	case types.BroadcastServer:
+		// status@broadcast is the status feed, every other broadcast JID is a broadcast list
+		if jid.User == types.StatusBroadcastJID.User {
+			return jidStatus
+		}
+		return jidBroadcast
+	}
+	return jidUnknown
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestClassifyJID(t *testing.T) {
+	tests := []struct {
+		jid  string
+		want jidKind
+	}{
+		{"14155550100@s.whatsapp.net", jidIndividual},
+		{"14155550100:3@s.whatsapp.net", jidIndividual},
+		{"14155550100@c.us", jidIndividual},
+		{"14155550100@hosted", jidIndividual},
+		{"123456789012345@lid", jidLID},
+		{"123456789012345@hosted.lid", jidLID},
+		{"120363000000000000@g.us", jidGroup},
+		{"14155550100-1600000000@g.us", jidGroup},
+		{"1600000000@broadcast", jidBroadcast},
+		{"status@broadcast", jidStatus},
+		{"120363000000000000@newsletter", jidNewsletter},
+		{"bot@example.com", jidUnknown},
+	}
+	for _, tt := range tests {
+		jid, err := types.ParseJID(tt.jid)
+		if err != nil {
+			t.Fatalf("ParseJID(%s): %v", tt.jid, err)
+		}
+		if got := classifyJID(jid); got != tt.want {
+			t.Errorf("classifyJID(%s) = %s, want %s", tt.jid, got, tt.want)
+		}
+	}
+	if got := classifyJID(types.EmptyJID); got != jidUnknown {
+		t.Errorf("classifyJID(empty) = %s, want unknown", got)
+	}
+}
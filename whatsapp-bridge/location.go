@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+// Location is a pin on the map, as sent or received in a location message
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Name and Address describe the place, both are optional
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+var (
+	errInvalidLocation = errors.New("location needs a latitude between -90 and 90 and a longitude between -180 and 180")
+	// errMixedContent is returned when a send carries more than one of
+	// media, a location, a vCard and a poll
+	errMixedContent = errors.New("only one of media_path, location, vcard and poll can be sent at a time")
+)
+
+// validate checks that a location to send is a point on Earth
+func (l *Location) validate() error {
+	if l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 || l.Longitude > 180 {
+		return errInvalidLocation
+	}
+	return nil
+}
+
+// text describes a location for the content column, so it reads sensibly
+// in previews and search: its name and address, or its coordinates
+func (l *Location) text() string {
+	var parts []string
+	for _, part := range []string{l.Name, l.Address} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("%.6f, %.6f", l.Latitude, l.Longitude)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// messageLocation returns the location a message shares, or nil if it
+// isn't a location message
+func messageLocation(msg *waE2E.Message) *Location {
+	loc := msg.GetLocationMessage()
+	if loc == nil {
+		return nil
+	}
+	return &Location{
+		Latitude:  loc.GetDegreesLatitude(),
+		Longitude: loc.GetDegreesLongitude(),
+		Name:      loc.GetName(),
+		Address:   loc.GetAddress(),
+	}
+}
+
+// applyLocation marks a stored message as a location message when the
+// received message shares one
+func applyLocation(msg *Message, waMsg *waE2E.Message) {
+	if loc := messageLocation(waMsg); loc != nil {
+		msg.Type = "location"
+		msg.Location = loc
+	}
+}
+
+// buildLocationMessage builds the message sharing a location
+func buildLocationMessage(l *Location) *waE2E.Message {
+	loc := &waE2E.LocationMessage{
+		DegreesLatitude:  proto.Float64(l.Latitude),
+		DegreesLongitude: proto.Float64(l.Longitude),
+	}
+	if l.Name != "" {
+		loc.Name = proto.String(l.Name)
+	}
+	if l.Address != "" {
+		loc.Address = proto.String(l.Address)
+	}
+	return &waE2E.Message{LocationMessage: loc}
+}
+
+// locationColumns returns the values stored in the location columns of a
+// message, NULL coordinates meaning it isn't a location message
+func locationColumns(l *Location) (latitude, longitude interface{}, name, address string) {
+	if l == nil {
+		return nil, nil, "", ""
+	}
+	return l.Latitude, l.Longitude, l.Name, l.Address
+}
@@ -5,47 +5,124 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/skip2/go-qrcode"
 	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
 	"go.mau.fi/whatsmeow/proto/waE2E"
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
 )
 
 // Message represents a WhatsApp message
 type Message struct {
-	ID        string    `json:"id"`
-	Sender    string    `json:"sender"`
-	Content   string    `json:"content"`
+	ID     string `json:"id"`
+	Sender string `json:"sender"`
+	// SenderName is the sender's contact or push name, empty until known
+	SenderName string `json:"sender_name"`
+	Content    string `json:"content"`
+	// Timestamp is when the message was sent according to WhatsApp's
+	// server, messages are ordered by it
 	Timestamp time.Time `json:"timestamp"`
-	ChatJID   string    `json:"chat_jid"`
-	Type      string    `json:"type"`
+	// ReceivedAt is when the bridge first stored the message
+	ReceivedAt time.Time `json:"received_at"`
+	ChatJID    string    `json:"chat_jid"`
+	Type       string    `json:"type"`
+	IsFromMe   bool      `json:"is_from_me"`
+	MediaType  string    `json:"media_type,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	MimeType   string    `json:"mime_type,omitempty"`
+	// FileLength is the media size in bytes
+	FileLength uint64 `json:"file_length,omitempty"`
+	// URL and the keys and hashes below are needed to download and
+	// decrypt the media again, and are never handed out
+	URL string `json:"-"`
+	// DirectPath is the media path on WhatsApp's servers, without the host
+	DirectPath    string `json:"-"`
+	MediaKey      []byte `json:"-"`
+	FileSHA256    []byte `json:"-"`
+	FileEncSHA256 []byte `json:"-"`
+	// LocalPath is where the media was last downloaded to
+	LocalPath string `json:"local_path,omitempty"`
+	Pinned    bool   `json:"pinned"`
+	// PinnedUntil is when the pin expires, nil if the message isn't pinned
+	PinnedUntil *time.Time `json:"pinned_until,omitempty"`
+	// Revoked is set once the message was deleted for everyone
+	Revoked bool `json:"revoked"`
+	// EditedAt is when the text was last edited, nil if it never was
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// ReadAt is when we marked the message read, nil while it's unread
+	ReadAt *time.Time `json:"read_at,omitempty"`
+	// Status tells how far our own message got: sent, delivered, read or
+	// played. Receipts lists it per member in groups.
+	Status   string           `json:"status,omitempty"`
+	Receipts []MessageReceipt `json:"receipts,omitempty"`
+	// IsForwarded is set on forwarded messages, and ForwardingScore counts
+	// how often they were forwarded before reaching us
+	IsForwarded     bool   `json:"is_forwarded"`
+	ForwardingScore uint32 `json:"forwarding_score,omitempty"`
+	// ViewOnce is set on media that can only be opened once
+	ViewOnce bool `json:"view_once"`
+	// Location is the shared pin of location messages
+	Location *Location `json:"location,omitempty"`
+	// Contacts are the cards shared by contact messages
+	Contacts []SharedContact `json:"contacts,omitempty"`
+	// ServerAcked is set on our own messages once WhatsApp's server accepted them
+	ServerAcked bool `json:"server_acked"`
+	// MediaExpired is set once downloading the media failed because it's gone
+	MediaExpired bool `json:"-"`
+	// Downloadable hints whether the media can still be fetched, only set
+	// on media messages
+	Downloadable *bool `json:"downloadable,omitempty"`
+	// Reactions aggregates the reactions to the message, nil without any
+	Reactions *ReactionSummary `json:"reactions,omitempty"`
 }
 
 // ChatInfo represents chat information
 type ChatInfo struct {
+	JID       string    `json:"jid"`
 	Name      string    `json:"name"`
 	Timestamp time.Time `json:"timestamp"`
+	Pinned    bool      `json:"pinned"`
+	Hidden    bool      `json:"hidden"`
+}
+
+// ChatsResponse is one page of /api/chats
+type ChatsResponse struct {
+	Chats []ChatInfo `json:"chats"`
+	// NextCursor is passed as before to get the next page, and is left out
+	// on the last one
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 // MessageStore handles message storage
 type MessageStore struct {
-	db *sql.DB
+	db *loggedDB
+	// fullText is set when the FTS5 search index is available
+	fullText bool
 }
 
 // NewMessageStore creates a new message store
 func NewMessageStore(dbPath string) (*MessageStore, error) {
-	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=1")
+	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=1&_recursive_triggers=1")
 	if err != nil {
 		return nil, err
 	}
@@ -58,290 +135,3553 @@ func NewMessageStore(dbPath string) (*MessageStore, error) {
 		content TEXT NOT NULL,
 		timestamp DATETIME NOT NULL,
 		chat_jid TEXT NOT NULL,
-		type TEXT NOT NULL
+		type TEXT NOT NULL,
+		is_from_me BOOLEAN NOT NULL DEFAULT 0,
+		media_type TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL DEFAULT '',
+		pinned BOOLEAN NOT NULL DEFAULT 0,
+		pinned_until DATETIME,
+		revoked BOOLEAN NOT NULL DEFAULT 0,
+		sender_name TEXT NOT NULL DEFAULT '',
+		server_acked BOOLEAN NOT NULL DEFAULT 0,
+		mime_type TEXT NOT NULL DEFAULT '',
+		file_length INTEGER NOT NULL DEFAULT 0,
+		received_at DATETIME,
+		media_expired BOOLEAN NOT NULL DEFAULT 0,
+		edited_at DATETIME,
+		is_forwarded BOOLEAN NOT NULL DEFAULT 0,
+		forwarding_score INTEGER NOT NULL DEFAULT 0,
+		view_once BOOLEAN NOT NULL DEFAULT 0,
+		revoked_at DATETIME,
+		latitude REAL,
+		longitude REAL,
+		location_name TEXT NOT NULL DEFAULT '',
+		location_address TEXT NOT NULL DEFAULT '',
+		contacts TEXT NOT NULL DEFAULT '',
+		url TEXT NOT NULL DEFAULT '',
+		media_key BLOB,
+		file_sha256 BLOB,
+		file_enc_sha256 BLOB,
+		direct_path TEXT NOT NULL DEFAULT '',
+		local_path TEXT NOT NULL DEFAULT '',
+		read_at DATETIME,
+		updated_at DATETIME
 	);
 	
 	CREATE TABLE IF NOT EXISTS chats (
 		jid TEXT PRIMARY KEY,
 		name TEXT NOT NULL,
+		timestamp DATETIME NOT NULL,
+		ephemeral_expiration INTEGER NOT NULL DEFAULT 0,
+		pinned BOOLEAN NOT NULL DEFAULT 0,
+		pinned_at DATETIME,
+		hidden BOOLEAN NOT NULL DEFAULT 0,
+		hidden_at DATETIME,
+		last_read_timestamp DATETIME,
+		name_updated_at DATETIME
+	);
+	
+	CREATE TABLE IF NOT EXISTS group_participants (
+		group_jid TEXT NOT NULL,
+		jid TEXT NOT NULL,
+		is_admin BOOLEAN NOT NULL DEFAULT 0,
+		is_super_admin BOOLEAN NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (group_jid, jid)
+	);
+	
+	CREATE TABLE IF NOT EXISTS contact_presence (
+		jid TEXT PRIMARY KEY,
+		online BOOLEAN NOT NULL DEFAULT 0,
+		last_seen DATETIME,
+		updated_at DATETIME NOT NULL
+	);
+	
+	CREATE TABLE IF NOT EXISTS polls (
+		chat_jid TEXT NOT NULL,
+		id TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		question TEXT NOT NULL,
+		options TEXT NOT NULL,
+		selectable_count INTEGER NOT NULL DEFAULT 0,
+		timestamp DATETIME NOT NULL,
+		PRIMARY KEY (chat_jid, id)
+	);
+	
+	CREATE TABLE IF NOT EXISTS poll_votes (
+		chat_jid TEXT NOT NULL,
+		poll_id TEXT NOT NULL,
+		voter TEXT NOT NULL,
+		options TEXT NOT NULL,
+		timestamp DATETIME NOT NULL,
+		PRIMARY KEY (chat_jid, poll_id, voter)
+	);
+	
+	CREATE TABLE IF NOT EXISTS pending_poll_votes (
+		chat_jid TEXT NOT NULL,
+		id TEXT NOT NULL,
+		poll_id TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		is_from_me BOOLEAN NOT NULL DEFAULT 0,
+		timestamp DATETIME NOT NULL,
+		raw BLOB NOT NULL,
+		PRIMARY KEY (chat_jid, id)
+	);
+	
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		chat_jid TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	
+	CREATE TABLE IF NOT EXISTS broadcast_recipients (
+		list_jid TEXT NOT NULL,
+		jid TEXT NOT NULL,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (list_jid, jid)
+	);
+	
+	CREATE TABLE IF NOT EXISTS reactions (
+		chat_jid TEXT NOT NULL,
+		target_message_id TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		emoji TEXT NOT NULL,
+		timestamp DATETIME NOT NULL,
+		PRIMARY KEY (chat_jid, target_message_id, sender)
+	);
+	
+	CREATE TABLE IF NOT EXISTS message_edits (
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		content TEXT NOT NULL,
+		replaced_at DATETIME NOT NULL
+	);
+	
+	CREATE TABLE IF NOT EXISTS receipts (
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		participant TEXT NOT NULL,
+		status TEXT NOT NULL,
+		timestamp DATETIME NOT NULL,
+		PRIMARY KEY (chat_jid, message_id, participant)
+	);
+	
+	CREATE TABLE IF NOT EXISTS blocklist (
+		jid TEXT PRIMARY KEY,
+		updated_at DATETIME NOT NULL
+	);
+	
+	CREATE TABLE IF NOT EXISTS group_events (
+		chat_jid TEXT NOT NULL,
+		actor TEXT NOT NULL DEFAULT '',
+		target TEXT NOT NULL,
+		action TEXT NOT NULL,
 		timestamp DATETIME NOT NULL
 	);
 	
 	CREATE INDEX IF NOT EXISTS idx_messages_chat_jid ON messages(chat_jid);
+	CREATE INDEX IF NOT EXISTS idx_webhooks_chat_jid ON webhooks(chat_jid);
+	CREATE INDEX IF NOT EXISTS idx_pending_poll_votes_poll ON pending_poll_votes(chat_jid, poll_id);
 	CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_messages_chat_type ON messages(chat_jid, type, timestamp);
+	CREATE INDEX IF NOT EXISTS idx_message_edits_message ON message_edits(chat_jid, message_id);
+	CREATE INDEX IF NOT EXISTS idx_group_events_chat ON group_events(chat_jid, timestamp);
 	`
 
 	if _, err := db.Exec(createTables); err != nil {
 		return nil, err
 	}
 
-	return &MessageStore{db: db}, nil
+	// Bring databases created by older versions up to date
+	for _, col := range messageColumns {
+		added, err := addColumnIfMissing(db, "messages", col.name, col.definition)
+		if err != nil {
+			return nil, err
+		}
+		if backfill := messageBackfills[col.name]; added && backfill != "" {
+			if _, err := db.Exec(backfill); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, col := range chatColumns {
+		added, err := addColumnIfMissing(db, "chats", col.name, col.definition)
+		if err != nil {
+			return nil, err
+		}
+		if backfill := chatBackfills[col.name]; added && backfill != "" {
+			if _, err := db.Exec(backfill); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Indexes on migrated columns can only be created once the columns exist
+	createIndexes := `
+	CREATE INDEX IF NOT EXISTS idx_messages_chat_media ON messages(chat_jid, media_type, timestamp);
+	CREATE INDEX IF NOT EXISTS idx_messages_chat_updated ON messages(chat_jid, updated_at);
+	`
+
+	if _, err := db.Exec(createIndexes); err != nil {
+		return nil, err
+	}
+
+	fullText, err := setupSearchIndex(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageStore{db: &loggedDB{DB: db, slowThreshold: loadSlowQueryThreshold()}, fullText: fullText}, nil
+}
+
+// Close closes the database
+func (ms *MessageStore) Close() error {
+	return ms.db.Close()
+}
+
+// messageColumns lists columns added to the messages table after its
+// initial schema, so they can be ALTERed into existing databases
+var messageColumns = []struct {
+	name       string
+	definition string
+}{
+	{"is_from_me", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"media_type", "TEXT NOT NULL DEFAULT ''"},
+	{"filename", "TEXT NOT NULL DEFAULT ''"},
+	{"pinned", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"pinned_until", "DATETIME"},
+	{"revoked", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"sender_name", "TEXT NOT NULL DEFAULT ''"},
+	{"server_acked", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"mime_type", "TEXT NOT NULL DEFAULT ''"},
+	{"file_length", "INTEGER NOT NULL DEFAULT 0"},
+	{"received_at", "DATETIME"},
+	{"media_expired", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"edited_at", "DATETIME"},
+	{"is_forwarded", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"forwarding_score", "INTEGER NOT NULL DEFAULT 0"},
+	{"view_once", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"revoked_at", "DATETIME"},
+	{"latitude", "REAL"},
+	{"longitude", "REAL"},
+	{"location_name", "TEXT NOT NULL DEFAULT ''"},
+	{"location_address", "TEXT NOT NULL DEFAULT ''"},
+	{"contacts", "TEXT NOT NULL DEFAULT ''"},
+	{"url", "TEXT NOT NULL DEFAULT ''"},
+	{"media_key", "BLOB"},
+	{"file_sha256", "BLOB"},
+	{"file_enc_sha256", "BLOB"},
+	{"local_path", "TEXT NOT NULL DEFAULT ''"},
+	{"direct_path", "TEXT NOT NULL DEFAULT ''"},
+	{"read_at", "DATETIME"},
+	{"updated_at", "DATETIME"},
+}
+
+// messageBackfills fills in a newly added column for the rows stored before it existed
+var messageBackfills = map[string]string{
+	// Before server_acked, only messages the server accepted were stored
+	"server_acked": "UPDATE messages SET server_acked = 1 WHERE is_from_me = 1",
+	// The send time is the closest we have for messages stored before
+	"received_at": "UPDATE messages SET received_at = timestamp WHERE received_at IS NULL",
+}
+
+// chatColumns lists columns added to the chats table after its initial schema
+var chatColumns = []struct {
+	name       string
+	definition string
+}{
+	{"ephemeral_expiration", "INTEGER NOT NULL DEFAULT 0"},
+	{"pinned", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"pinned_at", "DATETIME"},
+	{"hidden", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"hidden_at", "DATETIME"},
+	{"last_read_timestamp", "DATETIME"},
+	{"name_updated_at", "DATETIME"},
+}
+
+// chatBackfills fills in a newly added chats column for the rows stored before it existed
+var chatBackfills = map[string]string{
+	// Count everything stored before unread tracking as read
+	"last_read_timestamp": "UPDATE chats SET last_read_timestamp = (SELECT MAX(timestamp) FROM messages WHERE chat_jid = chats.jid)",
+}
+
+// addColumnIfMissing adds a column to a table unless it already exists,
+// reporting whether it was added
+func addColumnIfMissing(db *sql.DB, table, column, definition string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err == nil, err
 }
 
 // SaveMessage saves a message to the database
 func (ms *MessageStore) SaveMessage(msg *Message) error {
-	query := `
-	INSERT OR REPLACE INTO messages (id, sender, content, timestamp, chat_jid, type)
-	VALUES (?, ?, ?, ?, ?, ?)
-	`
-	_, err := ms.db.Exec(query, msg.ID, msg.Sender, msg.Content, msg.Timestamp, msg.ChatJID, msg.Type)
+	_, err := ms.db.Exec(saveMessageQuery, saveMessageArgs(msg)...)
 	return err
 }
 
-// GetMessages retrieves messages for a specific chat
-func (ms *MessageStore) GetMessages(chatJID string) ([]*Message, error) {
-	// Calculate 3 weeks ago
-	threeWeeksAgo := time.Now().AddDate(0, 0, -21)
+// SaveMessages stores many messages in one transaction, which is much
+// faster than storing them one by one. A message that fails to store is
+// skipped; the others are still committed. It returns how many were stored,
+// along with the errors of the skipped ones.
+func (ms *MessageStore) SaveMessages(msgs []*Message) (int, error) {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(saveMessageQuery)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	stored := 0
+	var errs []error
+	for _, msg := range msgs {
+		if _, err := stmt.Exec(saveMessageArgs(msg)...); err != nil {
+			errs = append(errs, fmt.Errorf("message %s: %w", msg.ID, err))
+			continue
+		}
+		stored++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return stored, errors.Join(errs...)
+}
+
+// Storing a message again (e.g. once it's acknowledged, or when history
+// sync delivers it twice) keeps the time it was first received, when it was
+// last edited, where its media was saved, when it was read, whether it was
+// revoked or pinned and whether its media expired. INSERT OR REPLACE drops
+// the old row, so anything not carried over here is reset.
+const saveMessageQuery = `
+	INSERT OR REPLACE INTO messages (id, sender, content, timestamp, chat_jid, type, is_from_me, media_type, filename, sender_name,
+		server_acked, mime_type, file_length, is_forwarded, forwarding_score, view_once,
+		latitude, longitude, location_name, location_address, contacts, url, media_key, file_sha256, file_enc_sha256, direct_path,
+		received_at, edited_at, local_path, read_at, revoked, revoked_at, pinned, pinned_until, media_expired, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+		COALESCE((SELECT received_at FROM messages WHERE id = ? AND chat_jid = ?), ?),
+		COALESCE(?, (SELECT edited_at FROM messages WHERE id = ? AND chat_jid = ?)),
+		COALESCE((SELECT local_path FROM messages WHERE id = ? AND chat_jid = ?), ''),
+		(SELECT read_at FROM messages WHERE id = ? AND chat_jid = ?),
+		COALESCE((SELECT revoked FROM messages WHERE id = ? AND chat_jid = ?), 0),
+		(SELECT revoked_at FROM messages WHERE id = ? AND chat_jid = ?),
+		COALESCE((SELECT pinned FROM messages WHERE id = ? AND chat_jid = ?), 0),
+		(SELECT pinned_until FROM messages WHERE id = ? AND chat_jid = ?),
+		COALESCE((SELECT media_expired FROM messages WHERE id = ? AND chat_jid = ?), 0),
+		(SELECT updated_at FROM messages WHERE id = ? AND chat_jid = ?))
+	`
+
+// saveMessageArgs lists the arguments of saveMessageQuery for msg, setting
+// its receive time if missing
+func saveMessageArgs(msg *Message) []interface{} {
+	if msg.ReceivedAt.IsZero() {
+		msg.ReceivedAt = time.Now()
+	}
+	latitude, longitude, locationName, locationAddress := locationColumns(msg.Location)
+	return []interface{}{msg.ID, msg.Sender, msg.Content, msg.Timestamp, msg.ChatJID, msg.Type, msg.IsFromMe,
+		msg.MediaType, msg.Filename, msg.SenderName, msg.ServerAcked, msg.MimeType, msg.FileLength,
+		msg.IsForwarded, msg.ForwardingScore, msg.ViewOnce,
+		latitude, longitude, locationName, locationAddress, contactsColumn(msg.Contacts),
+		msg.URL, msg.MediaKey, msg.FileSHA256, msg.FileEncSHA256, msg.DirectPath,
+		msg.ID, msg.ChatJID, msg.ReceivedAt,
+		msg.EditedAt, msg.ID, msg.ChatJID,
+		msg.ID, msg.ChatJID,
+		msg.ID, msg.ChatJID,
+		msg.ID, msg.ChatJID,
+		msg.ID, msg.ChatJID,
+		msg.ID, msg.ChatJID,
+		msg.ID, msg.ChatJID,
+		msg.ID, msg.ChatJID,
+		msg.ID, msg.ChatJID}
+}
+
+// MessageQuery narrows down and pages the messages GetMessages returns.
+// The zero value matches every message of the chat, oldest first.
+type MessageQuery struct {
+	// Type only matches messages of that type when set
+	Type string
+	// After and Before bound the send time: After is inclusive, Before
+	// exclusive, and a zero time leaves that side open
+	After  time.Time
+	Before time.Time
+	// Limit caps the number of messages, 0 meaning no cap
+	Limit  int
+	Offset int
+	// Newest lists the newest messages first
+	Newest bool
+}
 
+// GetMessages retrieves the messages of a chat matching q
+func (ms *MessageStore) GetMessages(chatJID string, q MessageQuery) ([]*Message, error) {
 	query := `
-	SELECT id, sender, content, timestamp, chat_jid, type
+	SELECT ` + messageSelectColumns + `
 	FROM messages
-	WHERE chat_jid = ? AND timestamp >= ?
-	ORDER BY timestamp ASC
+	WHERE chat_jid = ?
+	`
+	args := []interface{}{chatJID}
+	if q.Type != "" {
+		query += " AND type = ?"
+		args = append(args, q.Type)
+	}
+	if !q.After.IsZero() {
+		query += " AND timestamp >= ?"
+		args = append(args, q.After)
+	}
+	if !q.Before.IsZero() {
+		query += " AND timestamp < ?"
+		args = append(args, q.Before)
+	}
+	if q.Newest {
+		query += " ORDER BY timestamp DESC"
+	} else {
+		query += " ORDER BY timestamp ASC"
+	}
+	if q.Limit > 0 || q.Offset > 0 {
+		// SQLite takes a negative limit as no limit
+		limit := q.Limit
+		if limit == 0 {
+			limit = -1
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, q.Offset)
+	}
+
+	rows, err := ms.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMessages(rows)
+}
+
+// GetMediaMessages retrieves media messages for a chat, newest first. An
+// empty mediaType matches every kind of media.
+func (ms *MessageStore) GetMediaMessages(chatJID, mediaType string, limit, offset int) ([]*Message, error) {
+	query := `
+	SELECT ` + messageSelectColumns + `
+	FROM messages
+	WHERE chat_jid = ? AND media_type != ''
 	`
-	rows, err := ms.db.Query(query, chatJID, threeWeeksAgo)
+	args := []interface{}{chatJID}
+	if mediaType != "" {
+		query += " AND media_type = ?"
+		args = append(args, mediaType)
+	}
+	query += " ORDER BY timestamp DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := ms.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	return scanMessages(rows)
+}
+
+// messageSelectColumns are the columns scanMessages expects, in order
+const messageSelectColumns = "id, sender, content, timestamp, chat_jid, type, is_from_me, media_type, filename, pinned, pinned_until, revoked, sender_name, server_acked, mime_type, file_length, received_at, media_expired, edited_at, is_forwarded, forwarding_score, view_once, latitude, longitude, location_name, location_address, contacts, url, media_key, file_sha256, file_enc_sha256, direct_path, local_path, read_at"
+
+// scanMessages reads every row of a query selecting messageSelectColumns
+func scanMessages(rows *sql.Rows) ([]*Message, error) {
 	var messages []*Message
 	for rows.Next() {
-		var msg Message
-		err := rows.Scan(&msg.ID, &msg.Sender, &msg.Content, &msg.Timestamp, &msg.ChatJID, &msg.Type)
+		msg, err := scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
-		messages = append(messages, &msg)
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage reads a single row selecting messageSelectColumns
+func scanMessage(row rowScanner) (*Message, error) {
+	var msg Message
+	var pinnedUntil, receivedAt, editedAt, readAt sql.NullTime
+	var latitude, longitude sql.NullFloat64
+	var location Location
+	var contacts string
+	err := row.Scan(&msg.ID, &msg.Sender, &msg.Content, &msg.Timestamp, &msg.ChatJID, &msg.Type, &msg.IsFromMe,
+		&msg.MediaType, &msg.Filename, &msg.Pinned, &pinnedUntil, &msg.Revoked, &msg.SenderName, &msg.ServerAcked,
+		&msg.MimeType, &msg.FileLength, &receivedAt, &msg.MediaExpired, &editedAt, &msg.IsForwarded, &msg.ForwardingScore, &msg.ViewOnce,
+		&latitude, &longitude, &location.Name, &location.Address, &contacts,
+		&msg.URL, &msg.MediaKey, &msg.FileSHA256, &msg.FileEncSHA256, &msg.DirectPath, &msg.LocalPath, &readAt)
+	if err != nil {
+		return nil, err
+	}
+	msg.ReceivedAt = receivedAt.Time
+	if pinnedUntil.Valid {
+		msg.PinnedUntil = &pinnedUntil.Time
+	}
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	if readAt.Valid {
+		msg.ReadAt = &readAt.Time
+	}
+	if latitude.Valid && longitude.Valid {
+		location.Latitude, location.Longitude = latitude.Float64, longitude.Float64
+		msg.Location = &location
+	}
+	msg.Contacts = parseContactsColumn(contacts)
+	return &msg, nil
+}
+
+// GetMessage retrieves a single message, returning sql.ErrNoRows if it isn't stored
+func (ms *MessageStore) GetMessage(chatJID, id string) (*Message, error) {
+	row := ms.db.QueryRow("SELECT "+messageSelectColumns+" FROM messages WHERE chat_jid = ? AND id = ?", chatJID, id)
+	return scanMessage(row)
+}
+
+// SetMessagePinned records whether a message is pinned and until when
+func (ms *MessageStore) SetMessagePinned(chatJID, id string, pinned bool, until *time.Time) error {
+	_, err := ms.db.Exec("UPDATE messages SET pinned = ?, pinned_until = ?, updated_at = ? WHERE chat_jid = ? AND id = ?",
+		pinned, until, time.Now(), chatJID, id)
+	return err
+}
+
+// GetOldestMessage retrieves the oldest stored message of a chat, returning
+// sql.ErrNoRows if the chat has none
+func (ms *MessageStore) GetOldestMessage(chatJID string) (*Message, error) {
+	query := `
+	SELECT ` + messageSelectColumns + `
+	FROM messages
+	WHERE chat_jid = ?
+	ORDER BY timestamp ASC
+	LIMIT 1
+	`
+	return scanMessage(ms.db.QueryRow(query, chatJID))
+}
+
+// DeleteMessage removes a stored message
+func (ms *MessageStore) DeleteMessage(chatJID, id string) error {
+	_, err := ms.db.Exec("DELETE FROM messages WHERE chat_jid = ? AND id = ?", chatJID, id)
+	return err
+}
+
+// SetMessageRevoked marks a message as deleted for everyone at the given
+// time. The message itself is kept, so it can be shown as deleted.
+func (ms *MessageStore) SetMessageRevoked(chatJID, id string, at time.Time) error {
+	_, err := ms.db.Exec("UPDATE messages SET revoked = 1, revoked_at = ? WHERE chat_jid = ? AND id = ?", at, chatJID, id)
+	return err
+}
+
+// GetPinnedMessages retrieves the messages of a chat whose pin hasn't expired yet
+func (ms *MessageStore) GetPinnedMessages(chatJID string) ([]*Message, error) {
+	query := `
+	SELECT ` + messageSelectColumns + `
+	FROM messages
+	WHERE chat_jid = ? AND pinned = 1 AND (pinned_until IS NULL OR pinned_until > ?)
+	ORDER BY timestamp ASC
+	`
+	rows, err := ms.db.Query(query, chatJID, time.Now())
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return messages, nil
+	return scanMessages(rows)
 }
 
-// SaveChat saves chat information
+// SaveChat saves chat information. /api/chats lists the stored name as it
+// is, so a placeholder from a failed lookup doesn't replace a real name.
 func (ms *MessageStore) SaveChat(jid, name string) error {
 	query := `
-	INSERT OR REPLACE INTO chats (jid, name, timestamp)
+	INSERT INTO chats (jid, name, timestamp)
 	VALUES (?, ?, ?)
+	ON CONFLICT(jid) DO UPDATE SET name = excluded.name, timestamp = excluded.timestamp
 	`
+	if parsed, err := types.ParseJID(jid); err == nil && isFallbackChatName(parsed, name) {
+		query = `
+		INSERT INTO chats (jid, name, timestamp)
+		VALUES (?, ?, ?)
+		ON CONFLICT(jid) DO UPDATE SET name = CASE WHEN chats.name = '' THEN excluded.name ELSE chats.name END,
+			timestamp = excluded.timestamp
+		`
+	}
 	_, err := ms.db.Exec(query, jid, name, time.Now())
 	return err
 }
 
-// GetChats retrieves all chats
-func (ms *MessageStore) GetChats() (map[string]time.Time, error) {
+// ChatQuery pages through the chat list, newest first. The zero value
+// matches every chat that isn't hidden.
+type ChatQuery struct {
+	IncludeHidden bool
+	// Before only matches the chats listed after it. Pinned chats head
+	// the first page, so they're left out once Before is set.
+	Before *chatCursor
+	// Limit caps the number of unpinned chats, 0 meaning no cap
+	Limit int
+}
+
+// chatCursor is the position of a chat in the chat list: its last activity
+// in unix milliseconds, with the JID breaking ties between chats active in
+// the same millisecond
+type chatCursor struct {
+	UnixMilli int64
+	JID       string
+}
+
+// chatSortKey is the last activity of a chat in unix milliseconds. Stored
+// timestamps carry the zone they were written in, so they're compared
+// after normalizing rather than as text.
+const chatSortKey = "CAST(round(unixepoch(timestamp, 'subsec') * 1000) AS INTEGER)"
+
+// String formats the cursor as handed out in next_cursor
+func (c chatCursor) String() string {
+	return fmt.Sprintf("%d_%s", c.UnixMilli, c.JID)
+}
+
+// parseChatCursor reads a cursor formatted by chatCursor.String
+func parseChatCursor(s string) (*chatCursor, error) {
+	millis, jid, ok := strings.Cut(s, "_")
+	if !ok || jid == "" {
+		return nil, fmt.Errorf("invalid cursor %q", s)
+	}
+	n, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", s)
+	}
+	return &chatCursor{UnixMilli: n, JID: jid}, nil
+}
+
+// GetChats retrieves the chats matching q, pinned chats first with the most
+// recently pinned at the top, then the rest by their last activity
+func (ms *MessageStore) GetChats(q ChatQuery) ([]*Chat, error) {
+	where := "WHERE 1 = 1"
+	var args []interface{}
+	if !q.IncludeHidden {
+		where += " AND hidden = 0"
+	}
+	if q.Before != nil {
+		where += " AND pinned = 0 AND (" + chatSortKey + " < ? OR (" + chatSortKey + " = ? AND jid < ?))"
+		args = append(args, q.Before.UnixMilli, q.Before.UnixMilli, q.Before.JID)
+	}
+	if q.Limit > 0 {
+		where += ` AND (pinned = 1 OR jid IN (
+			SELECT jid FROM chats ` + where + ` AND pinned = 0
+			ORDER BY ` + chatSortKey + ` DESC, jid DESC LIMIT ?
+		))`
+		args = append(args, args...)
+		args = append(args, q.Limit)
+	}
 	query := `
-	SELECT jid, name, timestamp
+	SELECT jid, name, timestamp, pinned, hidden, ` + chatSortKey + `
 	FROM chats
-	ORDER BY timestamp DESC
+	` + where + `
+	ORDER BY pinned DESC, CASE WHEN pinned = 1 THEN pinned_at END DESC, ` + chatSortKey + ` DESC, jid DESC
 	`
-	rows, err := ms.db.Query(query)
+	rows, err := ms.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	chats := make(map[string]time.Time)
+	var chats []*Chat
 	for rows.Next() {
-		var jid, name string
-		var timestamp time.Time
-		err := rows.Scan(&jid, &name, &timestamp)
+		var chat Chat
+		err := rows.Scan(&chat.JID, &chat.Name, &chat.Timestamp, &chat.Pinned, &chat.Hidden, &chat.sortKey)
 		if err != nil {
 			return nil, err
 		}
-		chats[jid] = timestamp
+		chats = append(chats, &chat)
 	}
 
-	return chats, nil
+	return chats, rows.Err()
 }
 
-// CORS middleware
-func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Cache-Control, Pragma")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Max-Age", "86400")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+// chatsResponse builds a page of /api/chats. Names are resolved when chats
+// are stored or refreshed, so the stored ones are listed as they are.
+func chatsResponse(chats []*Chat, limit int) ChatsResponse {
+	resp := ChatsResponse{Chats: make([]ChatInfo, 0, len(chats))}
+	unpinned := 0
+	for _, chat := range chats {
+		if !chat.Pinned {
+			unpinned++
 		}
+		resp.Chats = append(resp.Chats, ChatInfo{
+			JID:       chat.JID,
+			Name:      chat.Name,
+			Timestamp: chat.Timestamp,
+			Pinned:    chat.Pinned,
+			Hidden:    chat.Hidden,
+		})
+	}
+	// A full page may be followed by more, the one after the last page
+	// comes back empty
+	if limit > 0 && unpinned >= limit {
+		last := chats[len(chats)-1]
+		resp.NextCursor = chatCursor{UnixMilli: last.sortKey, JID: last.JID}.String()
+	}
+	return resp
+}
 
-		next(w, r)
+// SendMessageRequest represents the request body for the send message API
+type SendMessageRequest struct {
+	Recipient string `json:"recipient"`
+	Message   string `json:"message"`
+	MediaPath string `json:"media_path,omitempty"`
+	// Caption shown under media; defaults to Message when empty
+	Caption string `json:"caption,omitempty"`
+	// Filename shown for documents; defaults to the base name of MediaPath
+	Filename string `json:"filename,omitempty"`
+	// SendAsDocument sends images as documents to preserve original quality
+	SendAsDocument bool `json:"send_as_document,omitempty"`
+	// ClientMessageID is used as the WhatsApp message ID instead of a
+	// generated one, so retried requests don't send the message twice
+	ClientMessageID string `json:"client_message_id,omitempty"`
+	// ViewOnce sends image, video or audio media that the recipient can
+	// only open once
+	ViewOnce bool `json:"view_once,omitempty"`
+	// QuotedMessageID makes the message a reply to a stored message of the
+	// same chat
+	QuotedMessageID string `json:"quoted_message_id,omitempty"`
+	// Location sends a map pin instead of text or media
+	Location *Location `json:"location,omitempty"`
+	// VCard sends a contact card instead of text or media
+	VCard string `json:"vcard,omitempty"`
+	// Mentions are the JIDs or phone numbers of group members tagged in
+	// the message, each written as @ and their number in the text
+	Mentions []string `json:"mentions,omitempty"`
+	// Poll sends a poll instead of text or media
+	Poll *PollRequest `json:"poll,omitempty"`
+}
+
+// SendMessageResponse represents the response for the send message API
+type SendMessageResponse struct {
+	Success   bool       `json:"success"`
+	Message   string     `json:"message"`
+	ID        string     `json:"id,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// Media is set when a file was uploaded with the message
+	Media *UploadedMedia `json:"media,omitempty"`
+	// ClientMessageID echoes the ID the caller chose for the message
+	ClientMessageID string `json:"client_message_id,omitempty"`
+	// Error and Code tell why a send failed, see writeSendError
+	Error string    `json:"error,omitempty"`
+	Code  errorCode `json:"code,omitempty"`
+}
+
+// clientMessageIDPattern matches the IDs WhatsApp clients generate, which
+// are upper case hex or alphanumerics of a few dozen characters
+var clientMessageIDPattern = regexp.MustCompile(`^[0-9A-Z]{10,64}$`)
+
+// validateClientMessageID checks that a caller supplied message ID looks
+// like one WhatsApp would accept
+func validateClientMessageID(id string) error {
+	if !clientMessageIDPattern.MatchString(id) {
+		return fmt.Errorf("client_message_id must be 10 to 64 upper case letters and digits")
 	}
+	return nil
 }
 
-// GetChatName extracts chat name from JID
-func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types.JID, fallbackJID string, info *types.GroupInfo, pushName string) string {
-	if jid.Server == types.GroupServer {
-		if info != nil {
-			return info.Name
-		}
-		// Try to get group info
-		groupInfo, err := client.GetGroupInfo(jid)
-		if err == nil && groupInfo != nil {
-			return groupInfo.Name
-		}
-		return fmt.Sprintf("Group %s", jid.User)
-	} else if jid.Server == types.BroadcastServer {
-		return "Broadcast"
-	} else {
-		if pushName != "" {
-			return pushName
-		}
-		// Try to get contact info
-		contact, err := client.Store.Contacts.GetContact(context.Background(), jid)
-		if err == nil && contact.FullName != "" {
-			return contact.FullName
-		}
-		return fmt.Sprintf("+%s", jid.User)
+// parseRecipient turns a JID or a phone number into a JID
+func parseRecipient(recipient string) (types.JID, error) {
+	recipient = strings.TrimSpace(recipient)
+	if strings.Contains(recipient, "@") {
+		return types.ParseJID(recipient)
+	}
+
+	// Strip the formatting people tend to put in phone numbers
+	phone := strings.NewReplacer("+", "", "-", "", " ", "").Replace(recipient)
+	if phone == "" {
+		return types.JID{}, fmt.Errorf("empty phone number")
 	}
+	return types.NewJID(phone, types.DefaultUserServer), nil
 }
 
-var isReconnecting bool
+// errNotGroupMember is returned when sending to a group we aren't part of
+var errNotGroupMember = errors.New("not a member of this group")
 
-func main() {
-	// Create data directory
-	dataDir := "./data"
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		log.Fatalf("Failed to create data directory: %v", err)
+// errMessageIDInUse is returned when a client_message_id belongs to a
+// message that is still being sent
+var errMessageIDInUse = errors.New("a message with this client_message_id is already being sent")
+
+// explainSendError turns the opaque error whatsmeow returns when sending to
+// a group we aren't part of into errNotGroupMember. The membership check
+// only happens after a send has failed, so successful sends don't pay for it.
+func explainSendError(client *whatsmeow.Client, to types.JID, err error) error {
+	if classifyJID(to) != jidGroup {
+		return err
+	}
+	if errors.Is(err, whatsmeow.ErrNotInGroup) || errors.Is(err, whatsmeow.ErrGroupNotFound) {
+		return errNotGroupMember
 	}
 
-	// Initialize message store
-	messageStore, err := NewMessageStore(filepath.Join(dataDir, "messages.db"))
-	if err != nil {
-		log.Fatalf("Failed to initialize message store: %v", err)
+	_, infoErr := client.GetGroupInfo(to)
+	if errors.Is(infoErr, whatsmeow.ErrNotInGroup) || errors.Is(infoErr, whatsmeow.ErrGroupNotFound) {
+		return errNotGroupMember
+	}
+	return err
+}
+
+// sendStatusCode picks the HTTP status for a failed send
+func sendStatusCode(err error) int {
+	if errors.Is(err, errNotGroupMember) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, errMessageIDInUse) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, errViewOnceUnsupported) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, errInvalidLocation) || errors.Is(err, errInvalidVCard) || errors.Is(err, errMixedContent) || errors.Is(err, errInvalidPoll) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, errInvalidMention) || errors.Is(err, errMentionNotMember) || errors.Is(err, errMentionsNotGroup) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, errQuotedNotFound) || errors.Is(err, errForwardNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, errForwardUnsupported) || errors.Is(err, errForwardMediaUnavailable) {
+		return http.StatusUnprocessableEntity
 	}
+	if errors.Is(err, whatsmeow.ErrIQRateOverLimit) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
 
-	// Initialize WhatsApp client
-	container, err := sqlstore.New(context.Background(), "sqlite3", filepath.Join(dataDir, "whatsapp.db")+"?_foreign_keys=1", nil)
-	if err != nil {
-		log.Fatalf("Failed to create database: %v", err)
+// sendWhatsAppMessage sends a text or media message and stores it right away,
+// so it shows up in /api/messages without waiting for WhatsApp to echo it back.
+// The uploaded media is nil for text messages. Repeating a send with the
+// same ClientMessageID returns the stored message instead of sending it again.
+func sendWhatsAppMessage(client *whatsmeow.Client, messageStore *MessageStore, to types.JID, req *SendMessageRequest) (*Message, *UploadedMedia, error) {
+	if err := validateViewOnce(req); err != nil {
+		return nil, nil, err
+	}
+	variants := 0
+	for _, set := range []bool{req.MediaPath != "", req.Location != nil, req.VCard != "", req.Poll != nil} {
+		if set {
+			variants++
+		}
+	}
+	if variants > 1 {
+		return nil, nil, errMixedContent
 	}
+	if req.Location != nil {
+		if err := req.Location.validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if req.Poll != nil {
+		if err := req.Poll.validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if req.ClientMessageID != "" {
+		existing, err := messageStore.GetMessage(to.String(), req.ClientMessageID)
+		if err == nil {
+			if !existing.ServerAcked {
+				return nil, nil, errMessageIDInUse
+			}
+			return existing, nil, nil
+		} else if err != sql.ErrNoRows {
+			return nil, nil, err
+		}
+	}
+
+	mentioned, err := resolveMentions(client, to, req.Mentions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var quoted *Message
+	if req.QuotedMessageID != "" {
+		var err error
+		quoted, err = messageStore.GetMessage(to.String(), req.QuotedMessageID)
+		if err == sql.ErrNoRows {
+			return nil, nil, errQuotedNotFound
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	msg := &Message{
+		Content:  req.Message,
+		ChatJID:  to.String(),
+		Type:     "text",
+		IsFromMe: true,
+	}
+
+	waMsg := &waE2E.Message{Conversation: &req.Message}
+	var upload *UploadedMedia
+	if req.MediaPath != "" {
+		caption := req.Caption
+		if caption == "" {
+			caption = req.Message
+		}
+
+		var err error
+		waMsg, upload, err = buildMediaMessage(client, req.MediaPath, caption, req.Filename, req.SendAsDocument)
+		if err != nil {
+			return nil, nil, err
+		}
+		msg.MediaType = upload.Type
+		msg.Filename = upload.Filename
+		msg.MimeType, msg.FileLength = extractMediaMeta(waMsg)
+		applyMediaKeys(msg, waMsg)
+		msg.Type = msg.MediaType
+		msg.Content = caption
+	} else if req.Location != nil {
+		waMsg = buildLocationMessage(req.Location)
+		msg.Type = "location"
+		msg.Location = req.Location
+		msg.Content = req.Location.text()
+	} else if req.VCard != "" {
+		var contact SharedContact
+		var err error
+		waMsg, contact, err = buildContactMessage(req.VCard)
+		if err != nil {
+			return nil, nil, err
+		}
+		msg.Type = "contact"
+		msg.Contacts = []SharedContact{contact}
+		msg.Content = contact.Name
+	} else if req.Poll != nil {
+		waMsg = client.BuildPollCreation(req.Poll.Name, req.Poll.Options, req.Poll.SelectableCount)
+		msg.Type = "poll"
+		msg.Content = req.Poll.Name
+	}
+
+	if quoted != nil {
+		applyQuote(waMsg, quoted)
+	}
+	if len(mentioned) > 0 {
+		applyMentions(waMsg, mentioned)
+	}
+
+	matchChatEphemeral(messageStore, to, waMsg)
+	if req.ViewOnce {
+		waMsg = wrapViewOnce(waMsg)
+		msg.ViewOnce = true
+	}
+
+	msg.ID = req.ClientMessageID
+	if err := sendAndStore(client, messageStore, to, msg, waMsg); err != nil {
+		return nil, nil, err
+	}
+	if poll := pollCreation(waMsg); poll != nil {
+		// Our own polls aren't echoed back, so store it to tally its votes
+		info := &types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: to, Sender: client.Store.ID.ToNonAD(), IsFromMe: true},
+			ID:            msg.ID,
+			Timestamp:     msg.Timestamp,
+		}
+		savePoll(client, messageStore, info, poll)
+	}
+	return msg, upload, nil
+}
+
+// sendAndStore sends waMsg to a chat and stores it as msg. The message is
+// stored as pending first, so it's listed without a tick until the server
+// acknowledges it, and removed again if the send fails. An empty msg.ID is
+// generated.
+func sendAndStore(client *whatsmeow.Client, messageStore *MessageStore, to types.JID, msg *Message, waMsg *waE2E.Message) error {
+	if msg.ID == "" {
+		msg.ID = client.GenerateMessageID()
+	}
+	msg.Sender = client.Store.ID.ToNonAD().String()
+	msg.SenderName = client.Store.PushName
+	msg.Timestamp = time.Now()
+	if err := messageStore.SaveMessage(msg); err != nil {
+		log.Printf("Failed to save pending message: %v", err)
+	}
+
+	// SendMessage only returns once the server acknowledged the message
+	resp, err := client.SendMessage(context.Background(), to, waMsg, whatsmeow.SendRequestExtra{ID: msg.ID})
+	if err != nil {
+		if err := messageStore.DeleteMessage(msg.ChatJID, msg.ID); err != nil {
+			log.Printf("Failed to remove unsent message: %v", err)
+		}
+		return explainSendError(client, to, err)
+	}
+
+	msg.Timestamp = resp.Timestamp
+	msg.ServerAcked = true
+	if err := messageStore.SaveMessage(msg); err != nil {
+		log.Printf("Failed to save sent message: %v", err)
+	}
+
+	chatName := GetChatName(client, messageStore, to, to.String(), nil, "")
+	if err := messageStore.SaveChat(to.String(), chatName); err != nil {
+		log.Printf("Failed to save chat: %v", err)
+	}
+	return nil
+}
+
+// GetChatNames retrieves the stored name of every chat
+func (ms *MessageStore) GetChatNames() (map[string]string, error) {
+	rows, err := ms.db.Query("SELECT jid, name FROM chats")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string]string)
+	for rows.Next() {
+		var jid, name string
+		if err := rows.Scan(&jid, &name); err != nil {
+			return nil, err
+		}
+		names[jid] = name
+	}
+
+	return names, rows.Err()
+}
+
+// UpdateChatName changes the stored name of a chat without touching its
+// timestamp. The time of the change is recorded, so clients polling
+// /api/chats see the new name.
+func (ms *MessageStore) UpdateChatName(jid, name string) error {
+	_, err := ms.db.Exec("UPDATE chats SET name = ?, name_updated_at = ? WHERE jid = ? AND name != ?", name, time.Now(), jid, name)
+	return err
+}
+
+// latestNameChange returns when a chat was last renamed
+func (ms *MessageStore) latestNameChange() (time.Time, error) {
+	var at time.Time
+	err := ms.db.QueryRow("SELECT name_updated_at FROM chats WHERE name_updated_at IS NOT NULL ORDER BY name_updated_at DESC LIMIT 1").Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return at, err
+}
+
+// decodeJSONBody decodes the request body into v. On malformed JSON it
+// writes a 400 response and returns false, and the handler must stop.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(v)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("unexpected data after JSON object")
+	}
+	if err != nil {
+		writeError(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeJSON encodes v as the response body. A failed write almost always
+// means the client went away mid-response, which is logged rather than
+// silently dropped; nothing else can be sent by then.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response to %s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+// mediaCacheDir is where downloaded media is kept, one directory per chat
+const mediaCacheDir = "store"
+
+// mediaCachePath returns where a chat's media file is cached on disk. Media
+// of messages is cached under their ID, see Message.cachePath.
+func mediaCachePath(chatJID, filename string) string {
+	return filepath.Join(mediaCacheDir, strings.ReplaceAll(chatJID, ":", "_"), filepath.Base(filename))
+}
+
+// mediaTypeFilters maps the type filter accepted by the media listing to
+// the stored media_type
+var mediaTypeFilters = map[string]string{
+	"image":     "image",
+	"images":    "image",
+	"video":     "video",
+	"videos":    "video",
+	"audio":     "audio",
+	"document":  "document",
+	"documents": "document",
+	"docs":      "document",
+	"sticker":   "sticker",
+	"stickers":  "sticker",
+}
+
+// messageTypeFilter maps the type filter accepted by /api/messages to the
+// stored message type. Every media type filter is accepted too.
+func messageTypeFilter(filter string) (string, bool) {
+	filter = strings.ToLower(filter)
+	switch filter {
+	case "text":
+		return "text", true
+	case "poll", "polls":
+		return "poll", true
+	case "location", "locations":
+		return "location", true
+	case "contact", "contacts":
+		return "contact", true
+	}
+	msgType, ok := mediaTypeFilters[filter]
+	return msgType, ok
+}
+
+// MessageMedia describes the media attached to a message
+type MessageMedia struct {
+	Type     string `json:"type"`
+	Filename string `json:"filename"`
+	Mime     string `json:"mime,omitempty"`
+	Size     uint64 `json:"size,omitempty"`
+	Cached   bool   `json:"cached"`
+	// Downloadable hints whether the media can still be fetched
+	Downloadable bool `json:"downloadable"`
+	// DownloadURL serves the file once it's cached
+	DownloadURL string `json:"download_url"`
+}
+
+// MessageV2 is the /api/messages?v=2 shape of a message, with the media
+// fields nested under media instead of inlined
+type MessageV2 struct {
+	*Message
+	// Zero-valued fields shadowing the inlined media fields of Message,
+	// so they're left out of the JSON
+	MediaType    string `json:"media_type,omitempty"`
+	Filename     string `json:"filename,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileLength   uint64 `json:"file_length,omitempty"`
+	Downloadable *bool  `json:"downloadable,omitempty"`
+
+	Media *MessageMedia `json:"media"`
+}
+
+// messagesV2 converts messages to their v2 shape
+func messagesV2(messages []*Message) []MessageV2 {
+	now := time.Now()
+	out := make([]MessageV2, 0, len(messages))
+	for _, msg := range messages {
+		v2 := MessageV2{Message: msg}
+		if msg.MediaType != "" {
+			_, err := os.Stat(msg.cachePath())
+			v2.Media = &MessageMedia{
+				Type:         msg.MediaType,
+				Filename:     msg.Filename,
+				Mime:         msg.MimeType,
+				Size:         msg.FileLength,
+				Cached:       err == nil,
+				Downloadable: mediaDownloadable(msg, err == nil, now),
+				DownloadURL:  "/api/media/" + url.PathEscape(msg.ChatJID) + "/" + url.PathEscape(msg.cacheFilename()),
+			}
+		}
+		out = append(out, v2)
+	}
+	return out
+}
+
+// MediaItem is a media message along with whether it's already cached locally
+type MediaItem struct {
+	*Message
+	Cached bool `json:"cached"`
+}
+
+// parsePagination reads the limit and offset query parameters
+func parsePagination(r *http.Request, defaultLimit, maxLimit int) (int, int, error) {
+	limit, err := parseLimit(r, defaultLimit, maxLimit)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", v)
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+// parseMessageQuery reads the type, after, before, limit, offset and order
+// parameters of /api/messages. Without any, the whole history is listed
+// oldest first.
+func parseMessageQuery(r *http.Request, now time.Time) (MessageQuery, error) {
+	var query MessageQuery
+	if filter := r.URL.Query().Get("type"); filter != "" {
+		var ok bool
+		query.Type, ok = messageTypeFilter(filter)
+		if !ok {
+			return query, fmt.Errorf("unknown message type %q", filter)
+		}
+	}
+	// after and before take an RFC 3339 timestamp or an age like 2d
+	for _, bound := range []struct {
+		param string
+		t     *time.Time
+	}{{"after", &query.After}, {"before", &query.Before}} {
+		if value := r.URL.Query().Get(bound.param); value != "" {
+			t, err := parseSince(value, now)
+			if err != nil {
+				return query, fmt.Errorf("%s must be an RFC 3339 timestamp or an age like 2d or 6h", bound.param)
+			}
+			*bound.t = t
+		}
+	}
+	var err error
+	query.Limit, query.Offset, err = parsePagination(r, 0, 5000)
+	if err != nil {
+		return query, err
+	}
+	switch order := r.URL.Query().Get("order"); order {
+	case "", "asc":
+	case "desc":
+		query.Newest = true
+	default:
+		return query, fmt.Errorf("invalid order %q, expected asc or desc", order)
+	}
+	return query, nil
+}
+
+// parseLimit reads the limit query parameter, capped at maxLimit
+func parseLimit(r *http.Request, defaultLimit, maxLimit int) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultLimit, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid limit %q", v)
+	}
+	return min(n, maxLimit), nil
+}
+
+// GroupParticipant represents a member of a group
+type GroupParticipant struct {
+	JID          string `json:"jid"`
+	IsAdmin      bool   `json:"is_admin"`
+	IsSuperAdmin bool   `json:"is_super_admin"`
+}
+
+// ReplaceGroupParticipants replaces the stored participant list of a group
+func (ms *MessageStore) ReplaceGroupParticipants(groupJID string, participants []types.GroupParticipant) error {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM group_participants WHERE group_jid = ?", groupJID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, p := range participants {
+		_, err := tx.Exec(
+			"INSERT INTO group_participants (group_jid, jid, is_admin, is_super_admin, updated_at) VALUES (?, ?, ?, ?, ?)",
+			groupJID, p.JID.ToNonAD().String(), p.IsAdmin || p.IsSuperAdmin, p.IsSuperAdmin, now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpdateGroupParticipants applies membership changes reported by a group info event
+func (ms *MessageStore) UpdateGroupParticipants(groupJID string, join, leave, promote, demote []types.JID) error {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, jid := range join {
+		_, err := tx.Exec(
+			"INSERT OR IGNORE INTO group_participants (group_jid, jid, updated_at) VALUES (?, ?, ?)",
+			groupJID, jid.ToNonAD().String(), now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for _, jid := range leave {
+		if _, err := tx.Exec("DELETE FROM group_participants WHERE group_jid = ? AND jid = ?", groupJID, jid.ToNonAD().String()); err != nil {
+			return err
+		}
+	}
+	for _, jid := range promote {
+		_, err := tx.Exec(
+			"INSERT INTO group_participants (group_jid, jid, is_admin, updated_at) VALUES (?, ?, 1, ?) "+
+				"ON CONFLICT (group_jid, jid) DO UPDATE SET is_admin = 1, updated_at = excluded.updated_at",
+			groupJID, jid.ToNonAD().String(), now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for _, jid := range demote {
+		_, err := tx.Exec(
+			"UPDATE group_participants SET is_admin = 0, is_super_admin = 0, updated_at = ? WHERE group_jid = ? AND jid = ?",
+			now, groupJID, jid.ToNonAD().String(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetGroupParticipants retrieves the stored participant list of a group
+func (ms *MessageStore) GetGroupParticipants(groupJID string) ([]GroupParticipant, error) {
+	rows, err := ms.db.Query(
+		"SELECT jid, is_admin, is_super_admin FROM group_participants WHERE group_jid = ? ORDER BY is_super_admin DESC, is_admin DESC, jid",
+		groupJID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var participants []GroupParticipant
+	for rows.Next() {
+		var p GroupParticipant
+		if err := rows.Scan(&p.JID, &p.IsAdmin, &p.IsSuperAdmin); err != nil {
+			return nil, err
+		}
+		participants = append(participants, p)
+	}
+
+	return participants, rows.Err()
+}
+
+// allowedOrigins lists the origins from the comma-separated ALLOWED_ORIGINS
+// that browsers may call the bridge from. Without it every origin may, but
+// without credentials.
+var allowedOrigins = loadAllowedOrigins()
+
+func loadAllowedOrigins() map[string]bool {
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			origins[origin] = true
+		}
+	}
+	return origins
+}
+
+// originAllowed reports whether a browser on origin may call the bridge.
+// Requests without an Origin don't come from a page and are let through.
+func originAllowed(origin string) bool {
+	return origin == "" || len(allowedOrigins) == 0 || allowedOrigins[origin]
+}
+
+// CORS middleware
+func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(allowedOrigins) == 0 {
+			// Browsers refuse credentials with a wildcard origin
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); origin != "" && allowedOrigins[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Cache-Control, Pragma")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// GetChatName extracts chat name from JID
+func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types.JID, fallbackJID string, info *types.GroupInfo, pushName string) string {
+	switch classifyJID(jid) {
+	case jidGroup:
+		if info != nil {
+			return info.Name
+		}
+		// Try to get group info
+		groupInfo, err := client.GetGroupInfo(jid)
+		if err == nil && groupInfo != nil {
+			return groupInfo.Name
+		}
+		return fmt.Sprintf("Group %s", jid.User)
+	case jidBroadcast:
+		return "Broadcast"
+	case jidStatus:
+		return "Status"
+	default:
+		if pushName != "" {
+			return pushName
+		}
+		// Try to get contact info
+		contact, err := client.Store.Contacts.GetContact(context.Background(), jid)
+		if err == nil && contact.FullName != "" {
+			return contact.FullName
+		}
+		return fmt.Sprintf("+%s", jid.User)
+	}
+}
+
+// isFallbackChatName reports whether name is one of the placeholders
+// GetChatName uses when it couldn't resolve a real name
+func isFallbackChatName(jid types.JID, name string) bool {
+	switch name {
+	case "", jid.String(), jid.User, "+" + jid.User, "Group " + jid.User:
+		return true
+	}
+	return false
+}
+
+// chatNameRefresh tracks the background pass started by /api/chats/refresh-names
+var chatNameRefresh struct {
+	sync.Mutex
+	running    bool
+	candidates int
+	updated    int
+}
+
+// refreshChatNames re-resolves the names of chats that are still stored
+// under a placeholder, waiting interval between lookups so we don't flood
+// WhatsApp with group info requests
+func refreshChatNames(client *whatsmeow.Client, messageStore *MessageStore, interval time.Duration) (int, error) {
+	names, err := messageStore.GetChatNames()
+	if err != nil {
+		return 0, err
+	}
+
+	var candidates []types.JID
+	for jid, name := range names {
+		parsedJID, err := types.ParseJID(jid)
+		if err != nil {
+			continue
+		}
+		if isFallbackChatName(parsedJID, name) {
+			candidates = append(candidates, parsedJID)
+		}
+	}
+
+	chatNameRefresh.Lock()
+	chatNameRefresh.candidates = len(candidates)
+	chatNameRefresh.updated = 0
+	chatNameRefresh.Unlock()
+
+	updated := 0
+	for i, jid := range candidates {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+
+		name := GetChatName(client, messageStore, jid, jid.String(), nil, "")
+		if isFallbackChatName(jid, name) {
+			continue
+		}
+		if err := messageStore.UpdateChatName(jid.String(), name); err != nil {
+			log.Printf("Failed to update name of chat %s: %v", jid, err)
+			continue
+		}
+
+		updated++
+		chatNameRefresh.Lock()
+		chatNameRefresh.updated = updated
+		chatNameRefresh.Unlock()
+	}
+
+	return updated, nil
+}
+
+// handleMessage stores an incoming message, or applies it to an already
+// stored message when it's a protocol message such as a pin
+func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, v *events.Message) {
+	fileBroadcastMessage(messageStore, &v.Info)
+	if pin := v.Message.GetPinInChatMessage(); pin != nil {
+		handlePinMessage(messageStore, v, pin)
+		return
+	}
+	// REVOKE is the zero type, so only actual protocol messages are checked
+	if protocol := v.Message.GetProtocolMessage(); protocol != nil {
+		switch protocol.GetType() {
+		case waE2E.ProtocolMessage_EPHEMERAL_SETTING:
+			saveChatEphemeral(messageStore, v.Info.Chat, protocol.GetEphemeralExpiration())
+			return
+		case waE2E.ProtocolMessage_REVOKE:
+			handleRevoke(messageStore, v, protocol)
+			return
+		case waE2E.ProtocolMessage_MESSAGE_EDIT:
+			handleEdit(messageStore, v, protocol)
+			return
+		}
+	}
+	if v.Message.GetPollUpdateMessage() != nil {
+		handlePollVote(client, messageStore, v)
+		return
+	}
+	if reaction := v.Message.GetReactionMessage(); reaction != nil {
+		handleReaction(messageStore, v, reaction)
+		return
+	}
+
+	if classifyJID(v.Info.Chat) == jidUnknown {
+		log.Printf("Message %s is in a chat on an unrecognized server: %s", v.Info.ID, v.Info.Chat)
+	}
+
+	// Process message
+	mediaType, filename, viewOnce := extractMediaInfo(v.Message)
+	mimeType, fileLength := extractMediaMeta(v.Message)
+	msg := &Message{
+		ID:         v.Info.ID,
+		Sender:     v.Info.Sender.ToNonAD().String(),
+		SenderName: resolveSenderName(client, v.Info.Sender, v.Info.PushName),
+		Content:    extractTextContent(v.Message),
+		Timestamp:  v.Info.Timestamp,
+		ChatJID:    v.Info.Chat.String(),
+		Type:       "text",
+		IsFromMe:   v.Info.IsFromMe,
+		// Our own messages sent from another device came through the server
+		ServerAcked: v.Info.IsFromMe,
+		MediaType:   mediaType,
+		Filename:    filename,
+		MimeType:    mimeType,
+		FileLength:  fileLength,
+		ViewOnce:    viewOnce || v.IsViewOnce,
+	}
+	msg.IsForwarded, msg.ForwardingScore = forwardingInfo(v.Message)
+	applyMediaKeys(msg, v.Message)
+	if mediaType != "" {
+		msg.Type = mediaType
+	}
+	poll := pollCreation(v.Message)
+	if poll != nil {
+		msg.Type = "poll"
+		msg.Content = poll.GetName()
+	}
+	applyLocation(msg, v.Message)
+	applyContacts(msg, v.Message)
+
+	// Save message (messages we sent through the API are already
+	// stored under the same ID, so the echo just replaces them)
+	if err := messageStore.SaveMessage(msg); err != nil {
+		log.Printf("Failed to save message: %v", err)
+	} else {
+		dispatchWebhooks(messageStore, msg)
+		stream.Publish(streamMessage, msg)
+		if autoDownloads != nil {
+			autoDownloads.Submit(msg)
+		}
+	}
+	if poll != nil {
+		savePoll(client, messageStore, &v.Info, poll)
+	}
+
+	// Save chat info
+	chatName := GetChatName(client, messageStore, v.Info.Chat, v.Info.Chat.String(), nil, "")
+	if err := messageStore.SaveChat(v.Info.Chat.String(), chatName); err != nil {
+		log.Printf("Failed to save chat: %v", err)
+	}
+
+	// Messages in a disappearing chat carry its timer
+	if contextInfo := messageContextInfo(v.Message); contextInfo != nil {
+		saveChatEphemeral(messageStore, v.Info.Chat, contextInfo.GetExpiration())
+	}
+
+	log.Printf("Message from %s: %s", msg.Sender, msg.Content)
+}
+
+// defaultPinDuration is how long WhatsApp keeps a message pinned when the
+// pin doesn't say otherwise
+const defaultPinDuration = 7 * 24 * time.Hour
+
+// pinDurations are the pin durations WhatsApp clients offer
+var pinDurations = map[time.Duration]bool{
+	24 * time.Hour:      true,
+	7 * 24 * time.Hour:  true,
+	30 * 24 * time.Hour: true,
+}
+
+// handlePinMessage records a pin or unpin of a stored message
+func handlePinMessage(messageStore *MessageStore, v *events.Message, pin *waE2E.PinInChatMessage) {
+	targetID := pin.GetKey().GetID()
+	if targetID == "" {
+		return
+	}
+
+	chatJID := v.Info.Chat.String()
+	var err error
+	switch pin.GetType() {
+	case waE2E.PinInChatMessage_PIN_FOR_ALL:
+		duration := time.Duration(v.Message.GetMessageContextInfo().GetMessageAddOnDurationInSecs()) * time.Second
+		if duration == 0 {
+			duration = defaultPinDuration
+		}
+		until := v.Info.Timestamp.Add(duration)
+		err = messageStore.SetMessagePinned(chatJID, targetID, true, &until)
+		log.Printf("Message %s in %s pinned until %s", targetID, chatJID, until.Format(time.RFC3339))
+	case waE2E.PinInChatMessage_UNPIN_FOR_ALL:
+		err = messageStore.SetMessagePinned(chatJID, targetID, false, nil)
+		log.Printf("Message %s in %s unpinned", targetID, chatJID)
+	default:
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to update pin state of message %s: %v", targetID, err)
+	}
+}
+
+// buildPinMessage builds the message that pins (or unpins) a message for
+// everyone in the chat
+func buildPinMessage(client *whatsmeow.Client, chat, sender types.JID, id types.MessageID, pin bool, duration time.Duration) *waE2E.Message {
+	pinType := waE2E.PinInChatMessage_UNPIN_FOR_ALL
+	if pin {
+		pinType = waE2E.PinInChatMessage_PIN_FOR_ALL
+	}
+
+	msg := &waE2E.Message{
+		PinInChatMessage: &waE2E.PinInChatMessage{
+			Key:               client.BuildMessageKey(chat, sender, id),
+			Type:              pinType.Enum(),
+			SenderTimestampMS: proto.Int64(time.Now().UnixMilli()),
+		},
+	}
+	if pin {
+		msg.MessageContextInfo = &waE2E.MessageContextInfo{
+			MessageAddOnDurationInSecs: proto.Uint32(uint32(duration.Seconds())),
+		}
+	}
+	return msg
+}
+
+// isReconnecting is set while a reconnection runs. The logout and QR
+// handlers and the event handler can all start one, from different goroutines.
+var isReconnecting atomic.Bool
+
+// Connection states reported in the "state" field of /api/status
+const (
+	stateUnpaired   = "unpaired"
+	stateConnecting = "connecting"
+	stateConnected  = "connected"
+	stateLoggedOut  = "logged_out"
+	stateError      = "error"
+)
+
+var (
+	connectionStateMu sync.RWMutex
+	connectionState   = stateConnecting
+)
+
+// setConnectionState records the current connection state
+func setConnectionState(state string) {
+	connectionStateMu.Lock()
+	changed := connectionState != state
+	connectionState = state
+	connectionStateMu.Unlock()
+
+	if changed {
+		stream.Publish(streamConnection, map[string]interface{}{"state": state})
+	}
+}
+
+// getConnectionState returns the current connection state
+func getConnectionState() string {
+	connectionStateMu.RLock()
+	defer connectionStateMu.RUnlock()
+	return connectionState
+}
+
+const (
+	initialConnectBackoff = 2 * time.Second
+	maxConnectBackoff     = 1 * time.Minute
+)
+
+// connectWithRetry calls connect until it succeeds, doubling the delay
+// between attempts up to max. Finding the client already connected (e.g. by
+// whatsmeow's own auto-reconnect) counts as success.
+func connectWithRetry(connect func() error, initial, max time.Duration) {
+	delay := initial
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil || errors.Is(err, whatsmeow.ErrAlreadyConnected) {
+			return
+		}
+
+		setConnectionState(stateError)
+		recordConnectFailure()
+		log.Printf("Failed to connect (attempt %d): %v, retrying in %s", attempt, err, delay)
+		time.Sleep(delay)
+		setConnectionState(stateConnecting)
+
+		delay *= 2
+		if delay > max {
+			delay = max
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	// Create the database directories
+	paths := loadStorePaths()
+	if err := paths.prepare(); err != nil {
+		log.Fatalf("Failed to prepare database storage: %v", err)
+	}
+
+	// Initialize message store
+	messageStore, err := NewMessageStore(paths.MessageDB)
+	if err != nil {
+		log.Fatalf("Failed to initialize message store: %v", err)
+	}
+
+	// Keep downloaded media within THREADSCRIBE_MEDIA_CACHE_MAX_MB, if set
+	if maxMB := envInt("THREADSCRIBE_MEDIA_CACHE_MAX_MB", 0); maxMB > 0 {
+		go runMediaCacheJanitor(int64(maxMB)*1024*1024, 10*time.Minute)
+	}
+
+	// Initialize WhatsApp client
+	container, err := sqlstore.New(context.Background(), "sqlite3", paths.SessionDB+"?_foreign_keys=1", nil)
+	if err != nil {
+		log.Fatalf("Failed to create database: %v", err)
+	}
+
+	deviceStore, err := container.GetFirstDevice(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to get device: %v", err)
+	}
+
+	client := whatsmeow.NewClient(deviceStore, nil)
+	if client.Store.ID == nil {
+		setConnectionState(stateUnpaired)
+	}
+
+	autoDownloads = startAutoDownloader(client, messageStore)
+	historyLimits := loadHistorySyncLimits()
+	queue := loadEventQueue()
+	qrCodes := newQRManager()
+
+	// Event handler
+	client.AddEventHandler(func(evt interface{}) {
+		recordConnectionEvent(evt)
+
+		switch v := evt.(type) {
+		case *events.Message:
+			queue.Submit(v.Info.Chat.String(), func() {
+				handleMessage(client, messageStore, v)
+			})
+
+		case *events.HistorySync:
+			// History spans many chats, so it is queued under a key of its own
+			queue.Submit("history-sync", func() {
+				handleHistorySync(client, messageStore, v, historyLimits)
+			})
+
+		case *events.Presence:
+			handlePresence(messageStore, v)
+			publishPresence(v)
+
+		case *events.ChatPresence:
+			publishTyping(v)
+
+		case *events.Receipt:
+			handleReceipt(messageStore, v)
+			publishReceipt(v)
+
+		case *events.Blocklist:
+			handleBlocklist(client, messageStore, v)
+
+		case *events.PushName:
+			updateSenderName(client, messageStore, v.JID, v.NewPushName)
+
+		case *events.Contact:
+			if name := v.Action.GetFullName(); name != "" {
+				if _, err := messageStore.SetSenderName(v.JID.ToNonAD().String(), name); err != nil {
+					log.Printf("Failed to update sender name of %s: %v", v.JID, err)
+				}
+			}
+
+		case *events.AppStateSyncComplete:
+			// Name messages stored before the contact list was synced
+			go func() {
+				updated, err := resolveUnnamedSenders(client, messageStore)
+				if err != nil {
+					log.Printf("Failed to resolve sender names: %v", err)
+				} else if updated > 0 {
+					log.Printf("Resolved sender names of %d messages", updated)
+				}
+			}()
+
+		case *events.GroupInfo:
+			handleGroupInfo(messageStore, v)
+
+		case *events.JoinedGroup:
+			if err := messageStore.ReplaceGroupParticipants(v.JID.String(), v.Participants); err != nil {
+				log.Printf("Failed to store participants of %s: %v", v.JID, err)
+			}
+			saveChatEphemeral(messageStore, v.JID, groupEphemeral(v.GroupEphemeral))
+
+		case *events.Pin:
+			handleChatPin(messageStore, v)
+
+		case *events.QR:
+			setConnectionState(stateUnpaired)
+
+		case *events.PairSuccess:
+			setConnectionState(stateConnecting)
+
+		case *events.Connected:
+			setConnectionState(stateConnected)
+			log.Println("Connected to WhatsApp")
+			go func() {
+				if _, err := refreshBlocklist(client, messageStore); err != nil {
+					log.Printf("Failed to refresh blocklist: %v", err)
+				}
+			}()
+
+		case *events.Disconnected:
+			handleDisconnected(client)
+
+		case *events.LoggedOut:
+			setConnectionState(stateLoggedOut)
+			log.Printf("Logged out from WhatsApp: %s", v.Reason)
+			// whatsmeow deletes the device right after sending this event,
+			// give it a moment before asking for a new QR code
+			go func() {
+				time.Sleep(2 * time.Second)
+				reconnectWhatsApp(client, qrCodes)
+			}()
+
+		case *events.ConnectFailure:
+			setConnectionState(stateError)
+			log.Printf("Connection to WhatsApp failed: %s", v.Reason)
+
+		case *events.StreamReplaced:
+			setConnectionState(stateError)
+			log.Println("WhatsApp stream replaced by another connection")
+		}
+	})
+
+	// Set up HTTP handlers
+	http.HandleFunc("/api/status", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var jid string
+		connected := false
+		if client.Store.ID != nil && client.Store.ID.User != "" {
+			jid = client.Store.ID.String()
+			connected = client.IsConnected()
+		}
+		status := map[string]interface{}{
+			"connected":        connected,
+			"jid":              jid,
+			"state":            getConnectionState(),
+			"app_state_synced": appStateSynced(),
+		}
+		writeJSON(w, r, status)
+	}))
+
+	// Identity of the paired account
+	http.HandleFunc("/api/me", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if client.Store.ID == nil {
+			writeErrorCode(w, "Not paired with WhatsApp yet", codeNotPaired, http.StatusConflict)
+			return
+		}
+
+		var lid string
+		if !client.Store.LID.IsEmpty() {
+			lid = client.Store.LID.ToNonAD().String()
+		}
+
+		writeJSON(w, r, map[string]interface{}{
+			"jid":           client.Store.ID.ToNonAD().String(),
+			"lid":           lid,
+			"phone":         "+" + client.Store.ID.User,
+			"push_name":     client.Store.PushName,
+			"platform":      client.Store.Platform,
+			"is_business":   client.Store.BusinessName != "",
+			"business_name": client.Store.BusinessName,
+		})
+	}))
+
+	// Device and connection details for troubleshooting
+	http.HandleFunc("/api/debug", corsMiddleware(adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, r, debugInfo(client, queue))
+	})))
+
+	http.HandleFunc("/api/chats", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		fp, err := messageStore.ChatsFingerprint()
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get chats: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if checkNotModified(w, r, fp) {
+			return
+		}
+
+		query := ChatQuery{IncludeHidden: r.URL.Query().Get("include_hidden") == "true"}
+		if before := r.URL.Query().Get("before"); before != "" {
+			query.Before, err = parseChatCursor(before)
+			if err != nil {
+				writeError(w, "before must be a cursor as given in next_cursor", http.StatusBadRequest)
+				return
+			}
+		}
+		// Without a limit every chat is returned on one page
+		query.Limit, err = parseLimit(r, 0, 500)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		chats, err := messageStore.GetChats(query)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get chats: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, chatsResponse(chats, query.Limit))
+	}))
+
+	// Re-resolve chat names that were stored before contacts synced.
+	// POST starts a background pass, GET reports its progress.
+	http.HandleFunc("/api/chats/refresh-names", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		chatNameRefresh.Lock()
+		defer chatNameRefresh.Unlock()
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if rejectReadOnly(w) {
+				return
+			}
+			if !chatNameRefresh.running {
+				chatNameRefresh.running = true
+				go func() {
+					updated, err := refreshChatNames(client, messageStore, 500*time.Millisecond)
+					if err != nil {
+						log.Printf("Failed to refresh chat names: %v", err)
+					} else {
+						log.Printf("Refreshed %d chat names", updated)
+					}
+
+					chatNameRefresh.Lock()
+					chatNameRefresh.running = false
+					chatNameRefresh.Unlock()
+				}()
+			}
+		default:
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, r, map[string]interface{}{
+			"running":    chatNameRefresh.running,
+			"candidates": chatNameRefresh.candidates,
+			"updated":    chatNameRefresh.updated,
+		})
+	}))
+
+	// Per-chat endpoints: /api/chats/{jid}/media and /api/chats/{jid}/pinned
+	http.HandleFunc("/api/chats/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/chats/")
+		parts := strings.Split(path, "/")
+		if len(parts) != 2 || parts[0] == "" {
+			writeError(w, "Invalid endpoint", http.StatusNotFound)
+			return
+		}
+		chatID := parts[0]
+
+		switch parts[1] {
+		case "media":
+			if r.Method != http.MethodGet {
+				writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			mediaType := ""
+			if filter := r.URL.Query().Get("type"); filter != "" {
+				var ok bool
+				mediaType, ok = mediaTypeFilters[strings.ToLower(filter)]
+				if !ok {
+					writeError(w, fmt.Sprintf("Unknown media type %q", filter), http.StatusBadRequest)
+					return
+				}
+			}
+
+			limit, offset, err := parsePagination(r, 50, 500)
+			if err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			messages, err := messageStore.GetMediaMessages(chatID, mediaType, limit, offset)
+			if err != nil {
+				writeError(w, fmt.Sprintf("Failed to get media: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			now := time.Now()
+			items := make([]MediaItem, 0, len(messages))
+			for _, msg := range messages {
+				_, err := os.Stat(msg.cachePath())
+				downloadable := mediaDownloadable(msg, err == nil, now)
+				msg.Downloadable = &downloadable
+				items = append(items, MediaItem{Message: msg, Cached: err == nil})
+			}
+
+			response := map[string]interface{}{
+				"media": items,
+			}
+			if len(messages) == limit {
+				response["next_offset"] = offset + limit
+			}
+			writeJSON(w, r, response)
+		case "pinned":
+			if r.Method != http.MethodGet {
+				writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			messages, err := messageStore.GetPinnedMessages(chatID)
+			if err != nil {
+				writeError(w, fmt.Sprintf("Failed to get pinned messages: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if messages == nil {
+				messages = []*Message{}
+			}
+			writeJSON(w, r, messages)
+		case "pin":
+			// Pin or unpin the chat itself, {"pinned": false} unpins
+			if r.Method != http.MethodPost {
+				writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if rejectReadOnly(w) {
+				return
+			}
+			if client.Store.ID == nil || !client.IsConnected() {
+				writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+				return
+			}
+
+			req := struct {
+				Pinned bool `json:"pinned"`
+			}{Pinned: true}
+			if r.ContentLength != 0 && !decodeJSONBody(w, r, &req) {
+				return
+			}
+
+			chatJID, err := types.ParseJID(chatID)
+			if err != nil {
+				writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+				return
+			}
+
+			if err := checkChatPin(messageStore, chatJID, req.Pinned); err == errTooManyPinnedChats {
+				writeError(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				writeError(w, fmt.Sprintf("Failed to check pinned chats: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			if err := client.SendAppState(context.Background(), appstate.BuildPin(chatJID, req.Pinned)); err != nil {
+				writeError(w, fmt.Sprintf("Failed to pin chat: %v", err), http.StatusBadGateway)
+				return
+			}
+			// Our own app state changes aren't echoed back as events
+			if err := messageStore.SetChatPinned(chatJID.String(), req.Pinned, time.Now()); err != nil {
+				log.Printf("Failed to save pin state of %s: %v", chatJID, err)
+			}
+
+			writeJSON(w, r, map[string]interface{}{
+				"success": true,
+				"pinned":  req.Pinned,
+			})
+		case "hide", "unhide":
+			// Hide the chat from /api/chats without deleting anything
+			if r.Method != http.MethodPost {
+				writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if rejectReadOnly(w) {
+				return
+			}
+
+			hidden := parts[1] == "hide"
+			if err := messageStore.SetChatHidden(chatID, hidden, time.Now()); err == sql.ErrNoRows {
+				writeError(w, "Chat not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				writeError(w, fmt.Sprintf("Failed to update chat: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			writeJSON(w, r, map[string]interface{}{
+				"success": true,
+				"hidden":  hidden,
+			})
+		default:
+			writeError(w, "Invalid endpoint", http.StatusNotFound)
+		}
+	}))
+
+	// Group participants, served from the local copy unless ?refresh=true
+	http.HandleFunc("/api/group/participants", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		groupID := r.URL.Query().Get("jid")
+		if groupID == "" {
+			writeError(w, "jid parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		groupJID, err := types.ParseJID(groupID)
+		if err != nil || classifyJID(groupJID) != jidGroup {
+			writeErrorCode(w, "Invalid group JID", codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+
+		participants, err := messageStore.GetGroupParticipants(groupJID.String())
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get participants: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		source := "cache"
+		if r.URL.Query().Get("refresh") == "true" || len(participants) == 0 {
+			if !client.IsConnected() {
+				if len(participants) == 0 {
+					writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+					return
+				}
+			} else {
+				info, err := client.GetGroupInfo(groupJID)
+				if err != nil {
+					writeError(w, fmt.Sprintf("Failed to get group info: %v", err), http.StatusBadGateway)
+					return
+				}
+				if err := messageStore.ReplaceGroupParticipants(groupJID.String(), info.Participants); err != nil {
+					log.Printf("Failed to store participants of %s: %v", groupJID, err)
+				}
+				participants, err = messageStore.GetGroupParticipants(groupJID.String())
+				if err != nil {
+					writeError(w, fmt.Sprintf("Failed to get participants: %v", err), http.StatusInternalServerError)
+					return
+				}
+				source = "network"
+			}
+		}
+
+		if participants == nil {
+			participants = []GroupParticipant{}
+		}
+		writeJSON(w, r, map[string]interface{}{
+			"jid":          groupJID.String(),
+			"participants": participants,
+			"source":       source,
+		})
+	}))
+
+	// Create a group. Participants that couldn't be added are listed in the
+	// response, the group is created anyway.
+	http.HandleFunc("/api/group/create", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req CreateGroupRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		req.Subject = strings.TrimSpace(req.Subject)
+		if err := validateGroupSubject(req.Subject); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		participants, err := parseGroupParticipants(req.Participants)
+		if err != nil {
+			writeErrorCode(w, err.Error(), codeInvalidRecipient, http.StatusBadRequest)
+			return
+		}
+
+		resp, err := createGroup(r.Context(), client, messageStore, req, participants)
+		if err != nil {
+			log.Printf("Failed to create group %q: %v", req.Subject, err)
+			writeErrorCode(w, fmt.Sprintf("Failed to create group: %v", err), errorCodeFor(err, http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		log.Printf("Created group %s (%q)", resp.JID, resp.Subject)
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, r, resp)
+	})))
+
+	// Current results of a poll: vote counts and voters per option
+	http.HandleFunc("/api/poll/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+
+		id := strings.TrimPrefix(r.URL.Path, "/api/poll/")
+		if id == "" || strings.Contains(id, "/") {
+			writeError(w, "Poll message ID is required", http.StatusBadRequest)
+			return
+		}
+		// chat_jid tells polls with the same ID in different chats apart
+		chatJID := r.URL.Query().Get("chat_jid")
+
+		poll, err := messageStore.GetPoll(chatJID, id)
+		if err == sql.ErrNoRows {
+			writeError(w, "Poll not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get poll: %v", err), http.StatusInternalServerError)
+			return
+		}
+		votes, err := messageStore.GetPollVotes(poll.ChatJID, poll.ID)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get poll votes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r, tallyPoll(poll, votes))
+	}))
+
+	// Group metadata: name, topic, owner, creation time and participants,
+	// cached for groupInfoTTL. POST /api/group/{jid}/participants adds,
+	// removes, promotes or demotes participants, and
+	// /api/group/{jid}/events lists who joined, left, was promoted or demoted.
+	http.HandleFunc("/api/group/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		jidStr, subpath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/group/"), "/")
+		if jidStr == "" {
+			writeError(w, "Group JID is required", http.StatusBadRequest)
+			return
+		}
+		if subpath != "" && subpath != "participants" && subpath != "events" {
+			writeError(w, "Invalid endpoint", http.StatusNotFound)
+			return
+		}
+
+		groupJID, err := types.ParseJID(jidStr)
+		if err != nil {
+			writeErrorCode(w, "Invalid group JID", codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+		if classifyJID(groupJID) != jidGroup {
+			writeError(w, "Not a group", http.StatusNotFound)
+			return
+		}
+
+		if subpath == "events" {
+			if r.Method != http.MethodGet {
+				writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			limit, err := parseLimit(r, 100, 1000)
+			if err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			changes, err := messageStore.GetGroupEvents(groupJID.String(), limit)
+			if err != nil {
+				writeError(w, fmt.Sprintf("Failed to get group events: %v", err), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, r, map[string]interface{}{
+				"jid":    groupJID.String(),
+				"events": changes,
+			})
+			return
+		}
+
+		if subpath == "participants" {
+			if r.Method != http.MethodPost {
+				writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if rejectReadOnly(w) {
+				return
+			}
+			var req UpdateParticipantsRequest
+			if !decodeJSONBody(w, r, &req) {
+				return
+			}
+			if _, ok := participantChanges[req.Action]; !ok {
+				writeError(w, "action must be add, remove, promote or demote", http.StatusBadRequest)
+				return
+			}
+			if len(req.Participants) == 0 {
+				writeError(w, "participants are required", http.StatusBadRequest)
+				return
+			}
+			participants, err := parseGroupParticipants(req.Participants)
+			if err != nil {
+				writeErrorCode(w, err.Error(), codeInvalidRecipient, http.StatusBadRequest)
+				return
+			}
+			if client.Store.ID == nil || !client.IsConnected() {
+				writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+				return
+			}
+
+			results, err := updateGroupParticipants(client, groupJID, req.Action, req.Participants, participants)
+			if err != nil {
+				status := groupStatusCode(err)
+				writeErrorCode(w, fmt.Sprintf("Failed to %s participants: %v", req.Action, err), errorCodeFor(err, status), status)
+				return
+			}
+			changed := 0
+			for _, result := range results {
+				if result.Success {
+					changed++
+				}
+			}
+			log.Printf("Group %s: %s applied to %d of %d participants", groupJID, req.Action, changed, len(results))
+
+			writeJSON(w, r, UpdateParticipantsResponse{
+				Success:      changed > 0,
+				JID:          groupJID.String(),
+				Action:       req.Action,
+				Participants: results,
+			})
+			return
+		}
+
+		if !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+		info, err := getCachedGroupInfo(client, groupJID)
+		if err != nil {
+			status := groupStatusCode(err)
+			writeErrorCode(w, fmt.Sprintf("Failed to get group info: %v", err), errorCodeFor(err, status), status)
+			return
+		}
+
+		writeJSON(w, r, groupMetadata(r.Context(), client, info))
+	}))
+
+	// Contact details, including when the contact was last seen online.
+	// Looking up a contact subscribes to their presence.
+	http.HandleFunc("/api/contact/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		jidStr := strings.TrimPrefix(r.URL.Path, "/api/contact/")
+		if jidStr == "" {
+			writeError(w, "Contact JID is required", http.StatusBadRequest)
+			return
+		}
+
+		jid, err := types.ParseJID(jidStr)
+		if err != nil || classifyJID(jid) != jidIndividual {
+			writeErrorCode(w, "Invalid contact JID", codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+		jid = jid.ToNonAD()
+
+		contact, err := lookupContact(r.Context(), client, jid)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get contact: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if client.IsConnected() {
+			if err := subscribePresence(client, jid); err != nil {
+				log.Printf("Failed to subscribe to presence of %s: %v", jid, err)
+			}
+		}
+
+		presence, err := messageStore.GetPresence(jid.String())
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get presence: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if presence == nil {
+			presence = &ContactPresence{}
+		}
+
+		writeJSON(w, r, map[string]interface{}{
+			"jid":       jid.String(),
+			"name":      contact.FullName,
+			"push_name": contact.PushName,
+			"number":    jid.User,
+			"online":    presence.Online,
+			"last_seen": presence.LastSeen,
+			// Names may still be missing until the contact list has synced
+			"app_state_synced": appStateSynced(),
+		})
+	}))
+
+	// Serve a cached media file, as linked by download_url in /api/messages?v=2
+	http.HandleFunc("/api/media/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/media/"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			writeError(w, "Expected /api/media/{chat_jid}/{file}", http.StatusBadRequest)
+			return
+		}
+
+		path := mediaCachePath(parts[0], parts[1])
+		if _, err := os.Stat(path); err != nil {
+			writeError(w, "Media not downloaded", http.StatusNotFound)
+			return
+		}
+
+		touchMediaFile(path)
+		http.ServeFile(w, r, path)
+	}))
+
+	// Download the media of a stored message into the media cache. Cached
+	// media is returned without downloading it again. This only fills the
+	// local cache, so it stays available in read-only mode.
+	http.HandleFunc("/api/download", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req DownloadMediaRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		if req.MessageID == "" || req.ChatJID == "" {
+			writeError(w, "message_id and chat_jid are required", http.StatusBadRequest)
+			return
+		}
+
+		msg, err := messageStore.GetMessage(req.ChatJID, req.MessageID)
+		if err == sql.ErrNoRows {
+			writeError(w, "Message not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get message: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		path, err := downloadMedia(client, messageStore, msg)
+		if err != nil {
+			status := downloadStatusCode(err)
+			writeErrorCode(w, err.Error(), errorCodeFor(err, status), status)
+			return
+		}
+
+		writeJSON(w, r, DownloadMediaResponse{
+			Success:   true,
+			Message:   fmt.Sprintf("Downloaded %s media", msg.MediaType),
+			MediaType: msg.MediaType,
+			Filename:  filepath.Base(path),
+			Path:      path,
+		})
+	}))
+
+	// Disk usage of cached media and databases
+	http.HandleFunc("/api/storage", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		usage, err := getStorageUsage(paths.files())
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to compute storage usage: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, usage)
+	}))
+
+	// Delete cached media older than ?older_than= (e.g. 30d or 12h)
+	http.HandleFunc("/api/storage/prune", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		olderThan := r.URL.Query().Get("older_than")
+		if olderThan == "" {
+			writeError(w, "older_than parameter is required", http.StatusBadRequest)
+			return
+		}
+		age, err := parseAge(olderThan)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		deleted, freed, err := pruneMediaCache(time.Now().Add(-age))
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to prune media: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Pruned %d cached media files (%d bytes) older than %s", deleted, freed, olderThan)
+		writeJSON(w, r, map[string]interface{}{
+			"success":       true,
+			"deleted_files": deleted,
+			"freed_bytes":   freed,
+		})
+	})))
+
+	// Pin or unpin a message for everyone in the chat
+	http.HandleFunc("/api/pin", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req struct {
+			ChatJID   string `json:"chat_jid"`
+			MessageID string `json:"message_id"`
+			Unpin     bool   `json:"unpin"`
+			// Duration in seconds: 86400 (24h), 604800 (7 days, the default) or 2592000 (30 days)
+			Duration int64 `json:"duration,omitempty"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		if req.ChatJID == "" || req.MessageID == "" {
+			writeError(w, "chat_jid and message_id are required", http.StatusBadRequest)
+			return
+		}
+
+		duration := defaultPinDuration
+		if req.Duration != 0 {
+			duration = time.Duration(req.Duration) * time.Second
+		}
+		if !req.Unpin && !pinDurations[duration] {
+			writeError(w, "duration must be 86400, 604800 or 2592000 seconds", http.StatusBadRequest)
+			return
+		}
+
+		chatJID, err := types.ParseJID(req.ChatJID)
+		if err != nil {
+			writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+
+		target, err := messageStore.GetMessage(req.ChatJID, req.MessageID)
+		if err == sql.ErrNoRows {
+			writeError(w, "Message not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get message: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		sender, err := types.ParseJID(target.Sender)
+		if err != nil {
+			writeError(w, "Stored message has an invalid sender", http.StatusInternalServerError)
+			return
+		}
+
+		pinMsg := buildPinMessage(client, chatJID, sender.ToNonAD(), req.MessageID, !req.Unpin, duration)
+		resp, err := client.SendMessage(context.Background(), chatJID, pinMsg)
+		if err != nil {
+			log.Printf("Failed to send pin: %v", err)
+			writeSendError(w, fmt.Sprintf("Failed to pin message: %v", err),
+				errorCodeFor(err, http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if req.Unpin {
+			err = messageStore.SetMessagePinned(req.ChatJID, req.MessageID, false, nil)
+		} else {
+			until := resp.Timestamp.Add(duration)
+			err = messageStore.SetMessagePinned(req.ChatJID, req.MessageID, true, &until)
+		}
+		if err != nil {
+			log.Printf("Failed to update pin state of message %s: %v", req.MessageID, err)
+		}
+
+		action := "pinned"
+		if req.Unpin {
+			action = "unpinned"
+		}
+		writeJSON(w, r, SendMessageResponse{
+			Success:   true,
+			Message:   fmt.Sprintf("Message %s", action),
+			ID:        resp.ID,
+			Timestamp: &resp.Timestamp,
+		})
+	})))
+
+	// Ask the phone for messages older than the oldest one stored for a chat.
+	// They arrive later as a history sync event.
+	http.HandleFunc("/api/sync-chat", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req struct {
+			ChatJID string `json:"chat_jid"`
+			Count   int    `json:"count"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		if req.ChatJID == "" {
+			writeError(w, "chat_jid is required", http.StatusBadRequest)
+			return
+		}
+		if req.Count == 0 {
+			req.Count = defaultChatSyncCount
+		}
+		if req.Count < 0 || req.Count > maxChatSyncCount {
+			writeError(w, fmt.Sprintf("count must be between 1 and %d", maxChatSyncCount), http.StatusBadRequest)
+			return
+		}
+
+		chatJID, err := types.ParseJID(req.ChatJID)
+		if err != nil {
+			writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+
+		oldest, err := messageStore.GetOldestMessage(chatJID.String())
+		if err == sql.ErrNoRows {
+			writeError(w, "No stored messages in this chat to sync back from", http.StatusConflict)
+			return
+		} else if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get messages: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		syncReq := buildChatHistoryRequest(client, chatJID, oldest, req.Count)
+		_, err = client.SendMessage(context.Background(), client.Store.ID.ToNonAD(), syncReq, whatsmeow.SendRequestExtra{Peer: true})
+		if err != nil {
+			log.Printf("Failed to request history of %s: %v", chatJID, err)
+			writeError(w, fmt.Sprintf("Failed to request history: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		writeJSON(w, r, map[string]interface{}{
+			"success":   true,
+			"message":   "History requested, messages will arrive in the background",
+			"chat_jid":  chatJID.String(),
+			"anchor_id": oldest.ID,
+			"count":     req.Count,
+		})
+	})))
+
+	// Delete a message for everyone
+	http.HandleFunc("/api/revoke", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req struct {
+			ChatJID   string `json:"chat_jid"`
+			MessageID string `json:"message_id"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		if req.ChatJID == "" || req.MessageID == "" {
+			writeError(w, "chat_jid and message_id are required", http.StatusBadRequest)
+			return
+		}
+
+		chatJID, err := types.ParseJID(req.ChatJID)
+		if err != nil {
+			writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+
+		target, err := messageStore.GetMessage(req.ChatJID, req.MessageID)
+		if err == sql.ErrNoRows {
+			writeError(w, "Message not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get message: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if err := checkRevoke(client, chatJID, target, time.Now()); err != nil {
+			switch err {
+			case errRevokeTooOld:
+				writeError(w, err.Error(), http.StatusUnprocessableEntity)
+			case errRevokeNotAllowed:
+				writeError(w, err.Error(), http.StatusForbidden)
+			case errRevokeNotAdmin:
+				writeErrorCode(w, err.Error(), codeNotAdmin, http.StatusForbidden)
+			default:
+				writeError(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+
+		revoke, err := buildRevokeMessage(client, chatJID, target)
+		if err != nil {
+			writeError(w, "Stored message has an invalid sender", http.StatusInternalServerError)
+			return
+		}
+
+		resp, err := client.SendMessage(context.Background(), chatJID, revoke)
+		if err != nil {
+			log.Printf("Failed to send revoke: %v", err)
+			writeSendError(w, fmt.Sprintf("Failed to delete message: %v", err),
+				errorCodeFor(err, http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err := messageStore.SetMessageRevoked(req.ChatJID, req.MessageID, resp.Timestamp); err != nil {
+			log.Printf("Failed to mark message %s revoked: %v", req.MessageID, err)
+		}
+
+		writeJSON(w, r, SendMessageResponse{
+			Success:   true,
+			Message:   "Message deleted for everyone",
+			ID:        resp.ID,
+			Timestamp: &resp.Timestamp,
+		})
+	})))
+
+	// Edit the text of one of our own recent messages
+	http.HandleFunc("/api/edit", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req struct {
+			ChatJID   string `json:"chat_jid"`
+			MessageID string `json:"message_id"`
+			NewText   string `json:"new_text"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		if req.ChatJID == "" || req.MessageID == "" || req.NewText == "" {
+			writeError(w, "chat_jid, message_id and new_text are required", http.StatusBadRequest)
+			return
+		}
+
+		chatJID, err := types.ParseJID(req.ChatJID)
+		if err != nil {
+			writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+
+		target, err := messageStore.GetMessage(req.ChatJID, req.MessageID)
+		if err == sql.ErrNoRows {
+			writeError(w, "Message not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get message: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if err := checkEdit(target, time.Now()); err != nil {
+			if err == errEditNotOwn {
+				writeError(w, err.Error(), http.StatusForbidden)
+			} else {
+				writeError(w, err.Error(), http.StatusUnprocessableEntity)
+			}
+			return
+		}
+
+		resp, err := client.SendMessage(context.Background(), chatJID, buildEditMessage(client, chatJID, req.MessageID, req.NewText))
+		if err != nil {
+			log.Printf("Failed to send edit: %v", err)
+			writeSendError(w, fmt.Sprintf("Failed to edit message: %v", err),
+				errorCodeFor(err, http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err := messageStore.SetMessageEdited(req.ChatJID, req.MessageID, req.NewText, resp.Timestamp); err != nil {
+			log.Printf("Failed to save edit of message %s: %v", req.MessageID, err)
+		}
+
+		writeJSON(w, r, SendMessageResponse{
+			Success:   true,
+			Message:   "Message edited",
+			ID:        resp.ID,
+			Timestamp: &resp.Timestamp,
+		})
+	})))
+
+	// React to a message with an emoji, an empty emoji removes our reaction
+	http.HandleFunc("/api/react", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req struct {
+			ChatJID   string `json:"chat_jid"`
+			MessageID string `json:"message_id"`
+			Emoji     string `json:"emoji"`
+			// Sender is who sent the message, defaulting to the stored sender
+			Sender string `json:"sender"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		if req.ChatJID == "" || req.MessageID == "" {
+			writeError(w, "chat_jid and message_id are required", http.StatusBadRequest)
+			return
+		}
+
+		chatJID, err := types.ParseJID(req.ChatJID)
+		if err != nil {
+			writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+
+		target, err := messageStore.GetMessage(req.ChatJID, req.MessageID)
+		if err == sql.ErrNoRows {
+			writeError(w, "Message not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get message: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if req.Sender == "" {
+			req.Sender = target.Sender
+		}
+		sender, err := types.ParseJID(req.Sender)
+		if err != nil {
+			writeErrorCode(w, "Invalid sender JID", codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+
+		resp, err := sendReaction(client, messageStore, chatJID, sender, req.MessageID, req.Emoji)
+		if err != nil {
+			log.Printf("Failed to send reaction: %v", err)
+			writeSendError(w, fmt.Sprintf("Failed to react to message: %v", err),
+				errorCodeFor(err, http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		message := "Reaction sent"
+		if req.Emoji == "" {
+			message = "Reaction removed"
+		}
+		writeJSON(w, r, SendMessageResponse{
+			Success:   true,
+			Message:   message,
+			ID:        resp.ID,
+			Timestamp: &resp.Timestamp,
+		})
+	})))
+
+	// Mark every unread message of a chat, or of all chats without
+	// ?chatId=, as read
+	http.HandleFunc("/api/mark-all-read", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		chats := []string{r.URL.Query().Get("chatId")}
+		if chats[0] == "" {
+			var err error
+			chats, err = messageStore.GetUnreadChats()
+			if err != nil {
+				writeError(w, fmt.Sprintf("Failed to get unread chats: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		marked := 0
+		for _, chatJID := range chats {
+			n, err := markChatRead(client.MarkRead, messageStore, chatJID)
+			if err != nil {
+				writeError(w, fmt.Sprintf("Failed to mark %s as read: %v", chatJID, err), http.StatusBadGateway)
+				return
+			}
+			marked += n
+		}
+
+		writeJSON(w, r, map[string]interface{}{
+			"success":  true,
+			"chats":    len(chats),
+			"messages": marked,
+		})
+	})))
+
+	// Block or unblock a contact
+	blockHandler := func(block bool) http.HandlerFunc {
+		return corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+
+			var req BlockRequest
+			if !decodeJSONBody(w, r, &req) {
+				return
+			}
+			if req.JID == "" {
+				writeError(w, "jid is required", http.StatusBadRequest)
+				return
+			}
+			jid, err := parseRecipient(req.JID)
+			if kind := classifyJID(jid); err != nil || (kind != jidIndividual && kind != jidLID) {
+				writeErrorCode(w, "Invalid contact JID", codeInvalidJID, http.StatusBadRequest)
+				return
+			}
+
+			if client.Store.ID == nil || !client.IsConnected() {
+				writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+				return
+			}
+			if err := updateBlocklist(client, messageStore, jid.ToNonAD(), block); err != nil {
+				writeErrorCode(w, fmt.Sprintf("Failed to update blocklist: %v", err), errorCodeFor(err, http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+
+			writeJSON(w, r, map[string]interface{}{
+				"success": true,
+				"jid":     jid.ToNonAD().String(),
+				"blocked": block,
+			})
+		}))
+	}
+	http.HandleFunc("/api/block", blockHandler(true))
+	http.HandleFunc("/api/unblock", blockHandler(false))
+
+	// Blocked contacts, from WhatsApp when connected and from the local
+	// copy otherwise
+	http.HandleFunc("/api/blocklist", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		source := "cache"
+		var jids []string
+		var err error
+		if client.IsConnected() {
+			jids, err = refreshBlocklist(client, messageStore)
+			if err != nil {
+				writeErrorCode(w, fmt.Sprintf("Failed to get blocklist: %v", err), errorCodeFor(err, http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+			source = "network"
+		} else {
+			jids, err = messageStore.GetBlocklist()
+			if err != nil {
+				writeError(w, fmt.Sprintf("Failed to get blocklist: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		writeJSON(w, r, map[string]interface{}{
+			"blocked": jids,
+			"source":  source,
+		})
+	}))
+
+	// Show us typing in a chat, or online or offline
+	http.HandleFunc("/api/presence", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		var req SetPresenceRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		var chat types.JID
+		if req.ChatJID != "" {
+			var err error
+			chat, err = parseRecipient(req.ChatJID)
+			if err != nil || classifyJID(chat) == jidUnknown {
+				writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+				return
+			}
+		}
+		if err := validatePresenceState(chat, req.State); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+		if err := sendPresenceState(client, chat, req.State); err != nil {
+			writeErrorCode(w, fmt.Sprintf("Failed to send presence: %v", err), errorCodeFor(err, http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		writeJSON(w, r, map[string]interface{}{
+			"success": true,
+			"state":   req.State,
+		})
+	})))
+
+	// Mark some received messages of a chat read, which turns their ticks
+	// blue for the sender
+	http.HandleFunc("/api/markread", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req MarkReadRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		if req.ChatJID == "" || len(req.MessageIDs) == 0 {
+			writeError(w, "chat_jid and message_ids are required", http.StatusBadRequest)
+			return
+		}
+		chat, err := types.ParseJID(req.ChatJID)
+		if err != nil {
+			writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+
+		resp, err := markMessagesRead(client.MarkRead, messageStore, chat, req.MessageIDs)
+		if err != nil {
+			writeErrorCode(w, fmt.Sprintf("Failed to mark messages read: %v", err), errorCodeFor(err, http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		writeJSON(w, r, resp)
+	})))
+
+	// Per-chat webhooks: list (optionally ?chat_jid=) and create
+	http.HandleFunc("/api/webhooks", corsMiddleware(adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			hooks, err := messageStore.GetWebhooks(r.URL.Query().Get("chat_jid"))
+			if err != nil {
+				writeError(w, fmt.Sprintf("Failed to get webhooks: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if hooks == nil {
+				hooks = []*Webhook{}
+			}
+			writeJSON(w, r, hooks)
+		case http.MethodPost:
+			if rejectReadOnly(w) {
+				return
+			}
+			var req struct {
+				ChatJID string `json:"chat_jid"`
+				URL     string `json:"url"`
+				Secret  string `json:"secret"`
+			}
+			if !decodeJSONBody(w, r, &req) {
+				return
+			}
+			if req.ChatJID == "" || req.URL == "" {
+				writeError(w, "chat_jid and url are required", http.StatusBadRequest)
+				return
+			}
+			if _, err := types.ParseJID(req.ChatJID); err != nil {
+				writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+				return
+			}
+			if err := validateWebhookURL(req.URL); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			hook := &Webhook{ChatJID: req.ChatJID, URL: req.URL, Secret: req.Secret}
+			if err := messageStore.CreateWebhook(hook); err != nil {
+				writeError(w, fmt.Sprintf("Failed to create webhook: %v", err), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			writeJSON(w, r, hook)
+		default:
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+
+	// A single webhook: get, update or delete by ID
+	http.HandleFunc("/api/webhooks/", corsMiddleware(adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Send a sample message to a stored webhook, or to a URL that
+		// isn't stored yet. Nothing is stored, so it's allowed read-only.
+		if r.URL.Path == "/api/webhooks/test" {
+			if r.Method != http.MethodPost {
+				writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			var req struct {
+				ID      int64  `json:"id"`
+				ChatJID string `json:"chat_jid"`
+				URL     string `json:"url"`
+				Secret  string `json:"secret"`
+			}
+			if !decodeJSONBody(w, r, &req) {
+				return
+			}
+
+			hook := &Webhook{ChatJID: req.ChatJID, URL: req.URL, Secret: req.Secret}
+			switch {
+			case req.ID != 0:
+				var err error
+				hook, err = messageStore.GetWebhook(req.ID)
+				if err == sql.ErrNoRows {
+					writeError(w, "Webhook not found", http.StatusNotFound)
+					return
+				} else if err != nil {
+					writeError(w, fmt.Sprintf("Failed to get webhook: %v", err), http.StatusInternalServerError)
+					return
+				}
+			case req.URL != "":
+				if err := validateWebhookURL(req.URL); err != nil {
+					writeError(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			default:
+				writeError(w, "id or url is required", http.StatusBadRequest)
+				return
+			}
+
+			var sender string
+			if client.Store.ID != nil {
+				sender = client.Store.ID.ToNonAD().String()
+			}
+			writeJSON(w, r, testWebhook(hook, sender))
+			return
+		}
+
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/webhooks/"), 10, 64)
+		if err != nil {
+			writeError(w, "Invalid webhook ID", http.StatusNotFound)
+			return
+		}
+
+		hook, err := messageStore.GetWebhook(id)
+		if err == sql.ErrNoRows {
+			writeError(w, "Webhook not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get webhook: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method != http.MethodGet && rejectReadOnly(w) {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, r, hook)
+		case http.MethodPut:
+			// Omitted fields keep their current value
+			var req struct {
+				ChatJID *string `json:"chat_jid"`
+				URL     *string `json:"url"`
+				Secret  *string `json:"secret"`
+			}
+			if !decodeJSONBody(w, r, &req) {
+				return
+			}
+			if req.ChatJID != nil {
+				if _, err := types.ParseJID(*req.ChatJID); err != nil || *req.ChatJID == "" {
+					writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+					return
+				}
+				hook.ChatJID = *req.ChatJID
+			}
+			if req.URL != nil {
+				if err := validateWebhookURL(*req.URL); err != nil {
+					writeError(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				hook.URL = *req.URL
+			}
+			if req.Secret != nil {
+				hook.Secret = *req.Secret
+			}
+
+			if err := messageStore.UpdateWebhook(hook); err != nil {
+				writeError(w, fmt.Sprintf("Failed to update webhook: %v", err), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, r, hook)
+		case http.MethodDelete:
+			if err := messageStore.DeleteWebhook(id); err != nil {
+				writeError(w, fmt.Sprintf("Failed to delete webhook: %v", err), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, r, map[string]interface{}{
+				"success": true,
+			})
+		default:
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+
+	// Deliver a chat's stored messages to its webhooks again, e.g. after
+	// fixing a receiver that missed them
+	http.HandleFunc("/api/replay", corsMiddleware(adminOnly(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		chatJID := r.URL.Query().Get("chatId")
+		if chatJID == "" {
+			writeError(w, "chatId parameter is required", http.StatusBadRequest)
+			return
+		}
+		var since time.Time
+		if value := r.URL.Query().Get("since"); value != "" {
+			var err error
+			since, err = parseSince(value, time.Now())
+			if err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		hooks, err := messageStore.GetWebhooks(chatJID)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get webhooks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if len(hooks) == 0 {
+			writeError(w, "No webhooks are configured for this chat", http.StatusNotFound)
+			return
+		}
+
+		messages, err := messageStore.GetMessagesSince(chatJID, since)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get messages: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		replayWebhooks(hooks, messages)
+
+		log.Printf("Replaying %d messages of %s to %d webhooks", len(messages), chatJID, len(hooks))
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, r, map[string]interface{}{
+			"success":  true,
+			"messages": len(messages),
+			"webhooks": len(hooks),
+		})
+	}))))
 
-	deviceStore, err := container.GetFirstDevice(context.Background())
-	if err != nil {
-		log.Fatalf("Failed to get device: %v", err)
-	}
+	// Search message text across chats, or in one chat with ?chatId=
+	http.HandleFunc("/api/search", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	client := whatsmeow.NewClient(deviceStore, nil)
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if q == "" {
+			writeError(w, "q is required", http.StatusBadRequest)
+			return
+		}
+		limit, err := parseLimit(r, 50, 500)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-	// Event handler
-	client.AddEventHandler(func(evt interface{}) {
-		switch v := evt.(type) {
-		case *events.Message:
-			// Process message
-			msg := &Message{
-				ID:        v.Info.ID,
-				Sender:    v.Info.Sender.String(),
-				Content:   v.Message.GetConversation(),
-				Timestamp: v.Info.Timestamp,
-				ChatJID:   v.Info.Chat.String(),
-				Type:      "text",
-			}
+		messages, total, err := messageStore.SearchMessages(q, r.URL.Query().Get("chatId"), limit)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to search messages: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if messages == nil {
+			messages = []*Message{}
+		}
+		setDownloadable(messages)
 
-			// Save message
-			if err := messageStore.SaveMessage(msg); err != nil {
-				log.Printf("Failed to save message: %v", err)
-			}
+		writeJSON(w, r, map[string]interface{}{
+			"messages": messages,
+			"total":    total,
+		})
+	}))
 
-			// Save chat info
-			chatName := GetChatName(client, messageStore, v.Info.Chat, v.Info.Chat.String(), nil, "")
-			if err := messageStore.SaveChat(v.Info.Chat.String(), chatName); err != nil {
-				log.Printf("Failed to save chat: %v", err)
-			}
+	// Unified inbox: the latest messages of every chat, newest first.
+	// Pass next_cursor back as ?cursor= for the next page.
+	http.HandleFunc("/api/inbox", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-			log.Printf("Message from %s: %s", msg.Sender, msg.Content)
+		limit, err := parseLimit(r, 50, 500)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var before *inboxCursor
+		if value := r.URL.Query().Get("cursor"); value != "" {
+			if before, err = parseInboxCursor(value); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 
-		case *events.Connected:
-			log.Println("Connected to WhatsApp")
+		items, err := messageStore.GetInbox(before, limit)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get inbox: %v", err), http.StatusInternalServerError)
+			return
+		}
 
-		case *events.Disconnected:
-			log.Println("Disconnected from WhatsApp")
+		if items == nil {
+			items = []*InboxMessage{}
 		}
-	})
+		messages := make([]*Message, len(items))
+		for i, item := range items {
+			messages[i] = item.Message
+		}
+		setDownloadable(messages)
 
-	// Set up HTTP handlers
-	http.HandleFunc("/api/status", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var jid string
-		connected := false
-		if client.Store.ID != nil && client.Store.ID.User != "" {
-			jid = client.Store.ID.String()
-			connected = client.IsConnected()
+		response := map[string]interface{}{
+			"messages": items,
 		}
-		status := map[string]interface{}{
-			"connected": connected,
-			"jid":       jid,
+		if len(items) == limit {
+			last := items[len(items)-1]
+			response["next_cursor"] = inboxCursor{Timestamp: last.Timestamp, ChatJID: last.ChatJID, ID: last.ID}.encode()
 		}
-		json.NewEncoder(w).Encode(status)
+		writeJSON(w, r, response)
 	}))
 
-	http.HandleFunc("/api/chats", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		chats, err := messageStore.GetChats()
+	// Live stream of events as Server-Sent Events. ?events= picks the event
+	// types (message, receipt, presence, typing, connection), messages only
+	// by default.
+	http.HandleFunc("/api/stream", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		wanted, err := parseStreamEvents(r.URL.Query().Get("events"))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get chats: %v", err), http.StatusInternalServerError)
+			writeError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Convert to ChatInfo format
-		chatInfos := make(map[string]ChatInfo)
-		for jid, timestamp := range chats {
-			parsedJID, err := types.ParseJID(jid)
+		sub := stream.Subscribe(wanted, "")
+		defer stream.Unsubscribe(sub)
+		serveStream(w, r, sub)
+	}))
+
+	// New messages and connection state changes as Server-Sent Events, for
+	// clients that can't use the WebSocket. The current state comes first.
+	http.HandleFunc("/api/events", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		current := streamEvent{Type: streamConnection, Data: map[string]interface{}{"state": getConnectionState()}}
+		sub := stream.Subscribe(map[string]bool{streamMessage: true, streamConnection: true}, "", current)
+		defer stream.Unsubscribe(sub)
+		serveStream(w, r, sub)
+	}))
+
+	// Live incoming and sent messages over a WebSocket, of one chat with
+	// ?chatId=
+	http.HandleFunc("/api/ws", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		chatJID := r.URL.Query().Get("chatId")
+		if chatJID != "" {
+			jid, err := types.ParseJID(chatJID)
 			if err != nil {
-				continue
-			}
-			name := GetChatName(client, messageStore, parsedJID, jid, nil, "")
-			chatInfos[jid] = ChatInfo{
-				Name:      name,
-				Timestamp: timestamp,
+				writeErrorCode(w, "Invalid chat JID", codeInvalidJID, http.StatusBadRequest)
+				return
 			}
+			chatJID = jid.String()
 		}
 
-		json.NewEncoder(w).Encode(chatInfos)
+		// The upgrader answers failed handshakes itself
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sub := stream.Subscribe(map[string]bool{streamMessage: true}, chatJID)
+		defer stream.Unsubscribe(sub)
+		serveWebSocket(conn, sub)
 	}))
 
 	http.HandleFunc("/api/messages", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		chatID := r.URL.Query().Get("chatId")
 		if chatID == "" {
-			http.Error(w, "chatId parameter is required", http.StatusBadRequest)
+			writeError(w, "chatId parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		query, err := parseMessageQuery(r, time.Now())
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fp, err := messageStore.MessagesFingerprint(chatID)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to get messages: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if checkNotModified(w, r, fp) {
 			return
 		}
 
-		messages, err := messageStore.GetMessages(chatID)
+		messages, err := messageStore.GetMessages(chatID, query)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get messages: %v", err), http.StatusInternalServerError)
+			writeError(w, fmt.Sprintf("Failed to get messages: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := setReactions(messageStore, chatID, messages, ownJIDs(client)); err != nil {
+			writeError(w, fmt.Sprintf("Failed to get reactions: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := setReceipts(messageStore, chatID, messages); err != nil {
+			writeError(w, fmt.Sprintf("Failed to get receipts: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		json.NewEncoder(w).Encode(messages)
+		// ?v=2 nests the media fields under a media object
+		if r.URL.Query().Get("v") == "2" {
+			writeJSON(w, r, messagesV2(messages))
+			return
+		}
+		setDownloadable(messages)
+		writeJSON(w, r, messages)
 	}))
 
 	// Send message endpoint
-	http.HandleFunc("/api/chat/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/chat/", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Extract chatId from URL path
 		path := strings.TrimPrefix(r.URL.Path, "/api/chat/")
 		parts := strings.Split(path, "/")
 		if len(parts) < 2 || parts[1] != "send" {
-			http.Error(w, "Invalid endpoint", http.StatusNotFound)
+			writeError(w, "Invalid endpoint", http.StatusNotFound)
 			return
 		}
 
 		chatID := parts[0]
 		if chatID == "" {
-			http.Error(w, "chatId is required", http.StatusBadRequest)
+			writeError(w, "chatId is required", http.StatusBadRequest)
 			return
 		}
 
 		// Check if client is connected
 		if client.Store.ID == nil || client.Store.ID.User == "" {
-			http.Error(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
 			return
 		}
 
@@ -350,36 +3690,28 @@ func main() {
 			Message string `json:"message"`
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if !decodeJSONBody(w, r, &requestBody) {
 			return
 		}
 
 		if requestBody.Message == "" {
-			http.Error(w, "Message is required", http.StatusBadRequest)
+			writeError(w, "Message is required", http.StatusBadRequest)
 			return
 		}
 
 		// Parse chat JID
 		parsedJID, err := types.ParseJID(chatID)
 		if err != nil {
-			http.Error(w, "Invalid chat JID", http.StatusBadRequest)
+			writeErrorCode(w, "Invalid chat JID", codeInvalidRecipient, http.StatusBadRequest)
 			return
 		}
 
 		// Send message using whatsmeow
-		_, err = client.SendMessage(context.Background(), parsedJID, &waE2E.Message{
-			Conversation: &requestBody.Message,
-		}, whatsmeow.SendRequestExtra{})
+		sent, _, err := sendWhatsAppMessage(client, messageStore, parsedJID, &SendMessageRequest{Message: requestBody.Message})
 		if err != nil {
 			log.Printf("Failed to send message: %v", err)
-			response := map[string]interface{}{
-				"success": false,
-				"message": "Failed to send message",
-				"error":   err.Error(),
-			}
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(response)
+			status := sendStatusCode(err)
+			writeSendError(w, fmt.Sprintf("Failed to send message: %v", err), errorCodeFor(err, status), status)
 			return
 		}
 
@@ -389,9 +3721,178 @@ func main() {
 		response := map[string]interface{}{
 			"success": true,
 			"message": "Message sent successfully",
+			"id":      sent.ID,
+		}
+		writeJSON(w, r, response)
+	})))
+
+	// Send message to a recipient given as a JID or phone number
+	http.HandleFunc("/api/send", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if client is connected
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req SendMessageRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		if req.Recipient == "" {
+			writeError(w, "Recipient is required", http.StatusBadRequest)
+			return
+		}
+		if req.Message == "" && req.MediaPath == "" && req.Location == nil && req.VCard == "" && req.Poll == nil {
+			writeError(w, "Message, media path, location, vcard or poll is required", http.StatusBadRequest)
+			return
+		}
+		if req.ClientMessageID != "" {
+			if err := validateClientMessageID(req.ClientMessageID); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		recipientJID, err := parseRecipient(req.Recipient)
+		if err != nil {
+			writeErrorCode(w, fmt.Sprintf("Invalid recipient: %v", err), codeInvalidRecipient, http.StatusBadRequest)
+			return
+		}
+
+		if typingBeforeSend && req.Message != "" && req.MediaPath == "" && req.Location == nil && req.VCard == "" && req.Poll == nil {
+			showTyping(client, recipientJID, req.Message)
+		}
+
+		sent, upload, err := sendWhatsAppMessage(client, messageStore, recipientJID, &req)
+		if err != nil {
+			log.Printf("Failed to send message: %v", err)
+			status := sendStatusCode(err)
+			writeSendError(w, fmt.Sprintf("Failed to send message: %v", err), errorCodeFor(err, status), status)
+			return
+		}
+
+		log.Printf("Message sent to %s: %s", recipientJID, req.Message)
+
+		writeJSON(w, r, SendMessageResponse{
+			Success:         true,
+			Message:         fmt.Sprintf("Message sent to %s", req.Recipient),
+			ID:              sent.ID,
+			Timestamp:       &sent.Timestamp,
+			Media:           upload,
+			ClientMessageID: req.ClientMessageID,
+		})
+	})))
+
+	http.HandleFunc("/api/forward", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-		json.NewEncoder(w).Encode(response)
-	}))
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req ForwardMessageRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		if req.SourceChatJID == "" || req.MessageID == "" || req.Target == "" {
+			writeError(w, "source_chat_jid, message_id and target are required", http.StatusBadRequest)
+			return
+		}
+		source, err := types.ParseJID(req.SourceChatJID)
+		if err != nil {
+			writeErrorCode(w, fmt.Sprintf("Invalid source_chat_jid: %v", err), codeInvalidJID, http.StatusBadRequest)
+			return
+		}
+		target, err := parseRecipient(req.Target)
+		if err != nil {
+			writeErrorCode(w, fmt.Sprintf("Invalid target: %v", err), codeInvalidRecipient, http.StatusBadRequest)
+			return
+		}
+
+		sent, err := forwardMessage(client, messageStore, source, req.MessageID, target)
+		if err != nil {
+			log.Printf("Failed to forward message %s: %v", req.MessageID, err)
+			status := sendStatusCode(err)
+			writeSendError(w, fmt.Sprintf("Failed to forward message: %v", err), errorCodeFor(err, status), status)
+			return
+		}
+
+		writeJSON(w, r, SendMessageResponse{
+			Success:   true,
+			Message:   fmt.Sprintf("Message forwarded to %s", req.Target),
+			ID:        sent.ID,
+			Timestamp: &sent.Timestamp,
+		})
+	})))
+
+	http.HandleFunc("/api/send-broadcast", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if client.Store.ID == nil || !client.IsConnected() {
+			writeError(w, "WhatsApp not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req SendBroadcastRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		if req.ListJID == "" || req.Message == "" {
+			writeError(w, "list_jid and message are required", http.StatusBadRequest)
+			return
+		}
+		list, err := types.ParseJID(req.ListJID)
+		if err != nil {
+			writeErrorCode(w, fmt.Sprintf("Invalid list_jid: %v", err), codeInvalidRecipient, http.StatusBadRequest)
+			return
+		}
+		if err := validateBroadcastList(list); err != nil {
+			writeErrorCode(w, err.Error(), codeInvalidRecipient, http.StatusBadRequest)
+			return
+		}
+
+		deliveries, err := sendBroadcast(client, messageStore, list, req.Message)
+		if errors.Is(err, errUnknownBroadcastRecipients) {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to send broadcast to %s: %v", list, err)
+			writeError(w, fmt.Sprintf("Failed to send broadcast: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		sent := 0
+		for _, delivery := range deliveries {
+			if delivery.Success {
+				sent++
+			}
+		}
+		log.Printf("Broadcast to %s delivered to %d of %d recipients", list, sent, len(deliveries))
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, r, map[string]interface{}{
+			"success":    sent > 0,
+			"list_jid":   list.String(),
+			"sent":       sent,
+			"deliveries": deliveries,
+		})
+	})))
 
 	http.HandleFunc("/api/qr", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -399,44 +3900,39 @@ func main() {
 		w.Header().Set("Pragma", "no-cache")
 		w.Header().Set("Expires", "0")
 
-		// Check if QR code file exists
-		if _, err := os.Stat("qr.png"); err == nil {
-			// Read the QR code file and convert to base64
-			qrData, err := os.ReadFile("qr.png")
-			if err != nil {
-				response := map[string]interface{}{
-					"error": "Failed to read QR code",
-				}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
+		qrData := qrCodes.PNG()
+		if qrData == nil {
+			writeErrorCode(w, "QR code not available", codeNotFound, http.StatusNotFound)
+			return
+		}
 
-			// Convert to base64 data URL
-			base64QR := "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrData)
+		// Convert to base64 data URL
+		base64QR := "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrData)
 
-			response := map[string]interface{}{
-				"qr": base64QR,
-			}
-			json.NewEncoder(w).Encode(response)
-		} else {
-			response := map[string]interface{}{
-				"error": "QR code not available",
-			}
-			json.NewEncoder(w).Encode(response)
+		response := map[string]interface{}{
+			"qr": base64QR,
 		}
+		writeJSON(w, r, response)
 	}))
 
 	// Serve QR code image directly
 	http.HandleFunc("/qr.png", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		qrData := qrCodes.PNG()
+		if qrData == nil {
+			writeError(w, "QR code not available", http.StatusNotFound)
+			return
+		}
 		w.Header().Set("Content-Type", "image/png")
 		w.Header().Set("Cache-Control", "no-cache")
-		http.ServeFile(w, r, "qr.png")
+		if _, err := w.Write(qrData); err != nil {
+			log.Printf("Failed to write response to %s %s: %v", r.Method, r.URL.Path, err)
+		}
 	}))
 
 	// Logout/Disconnect endpoint
-	http.HandleFunc("/api/logout", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/logout", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
@@ -454,133 +3950,101 @@ func main() {
 					log.Printf("Error deleting device store: %v", err)
 				}
 			}
+			setConnectionState(stateLoggedOut)
 
-			// Remove QR code file if it exists
-			os.Remove("qr.png")
+			qrCodes.Clear()
 
 			response := map[string]interface{}{
 				"success": true,
 				"message": "Successfully disconnected from WhatsApp. New QR code will be generated shortly.",
 			}
-			json.NewEncoder(w).Encode(response)
+			writeJSON(w, r, response)
 			log.Println("User logged out from WhatsApp")
 
 			// Start reconnection process in a goroutine after a short delay
 			go func() {
 				time.Sleep(2 * time.Second) // Wait 2 seconds before generating new QR
-				reconnectWhatsApp(client)
+				reconnectWhatsApp(client, qrCodes)
 			}()
 		} else {
 			// If not connected, just generate a new QR code
-			os.Remove("qr.png")
 			go func() {
 				time.Sleep(1 * time.Second)
-				reconnectWhatsApp(client)
+				reconnectWhatsApp(client, qrCodes)
 			}()
 
 			response := map[string]interface{}{
 				"success": true,
 				"message": "Generating new QR code for connection.",
 			}
-			json.NewEncoder(w).Encode(response)
+			writeJSON(w, r, response)
 		}
-	}))
+	})))
+
+	if readOnly {
+		log.Println("Running read-only: sending and account changes are disabled")
+	}
 
 	// Start HTTP server in a goroutine
+	server := &http.Server{Addr: ":8081", Handler: accessLog(loadAccessLogConfig(), http.DefaultServeMux)}
+	// Live streams never finish on their own, so end them when shutting down
+	server.RegisterOnShutdown(stream.Close)
 	go func() {
 		fmt.Println("Starting WhatsApp bridge server on :8081...")
-		log.Fatal(http.ListenAndServe(":8081", nil))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
 	}()
 
-	// Connect to WhatsApp
-	if client.Store.ID == nil {
-		// No ID stored, need to pair with phone
-		qrChan, _ := client.GetQRChannel(context.Background())
-		err = client.Connect()
-		if err != nil {
-			log.Printf("Failed to connect: %v", err)
-			return
-		}
+	// Shut down on Ctrl+C, on SIGTERM from a service manager, and on /api/restart
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
-		// Print QR code
-		go func() {
-			for evt := range qrChan {
-				if evt.Event == "code" {
-					fmt.Println("\nScan this QR code with your WhatsApp app:")
-					// Remove old QR code file
-					os.Remove("qr.png")
-					// Generate new QR code
-					qrcode.WriteFile(evt.Code, qrcode.Medium, 256, "qr.png")
-					fmt.Println("QR code saved as qr.png")
-				} else if evt.Event == "success" {
-					fmt.Println("\nSuccessfully connected!")
-					break
-				}
-			}
-		}()
+	// Connect to WhatsApp in the background so the HTTP server keeps
+	// serving /api/status while we retry an unreachable WhatsApp.
+	if client.Store.ID == nil {
+		// No ID stored, need to pair with phone. The QR channel has to be
+		// open before connecting, so the manager starts the connection.
+		qrCodes.Start("pairing", client.GetQRChannel, func() error {
+			go connectWithRetry(client.Connect, initialConnectBackoff, maxConnectBackoff)
+			return nil
+		}, nil)
 	} else {
 		// Already paired, just connect
-		err = client.Connect()
-		if err != nil {
-			log.Printf("Failed to connect: %v", err)
-			return
-		}
+		go connectWithRetry(client.Connect, initialConnectBackoff, maxConnectBackoff)
 	}
 
 	// QR regeneration endpoint
-	http.HandleFunc("/api/regenerate-qr", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/regenerate-qr", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 
 		if !client.IsConnected() || client.Store.ID == nil {
-			// Remove old QR code file
-			os.Remove("qr.png")
-
-			// Generate new QR code
-			go func() {
-				log.Println("Regenerating QR code...")
-				qrChan, _ := client.GetQRChannel(context.Background())
-				err := client.Connect()
-				if err != nil {
-					log.Printf("Failed to connect during QR regeneration: %v", err)
-					return
-				}
-
-				for evt := range qrChan {
-					if evt.Event == "code" {
-						fmt.Println("\nNew QR code generated:")
-						qrcode.WriteFile(evt.Code, qrcode.Medium, 256, "qr.png")
-						fmt.Println("QR code saved as qr.png")
-						break
-					} else if evt.Event == "success" {
-						fmt.Println("\nSuccessfully connected!")
-						break
-					}
-				}
-			}()
+			log.Println("Regenerating QR code...")
+			qrCodes.Start("QR regeneration", client.GetQRChannel, client.Connect, nil)
 
 			response := map[string]interface{}{
 				"success": true,
 				"message": "QR code regeneration initiated",
 			}
-			json.NewEncoder(w).Encode(response)
+			writeJSON(w, r, response)
 		} else {
 			response := map[string]interface{}{
 				"success": false,
 				"message": "Already connected to WhatsApp",
 			}
-			json.NewEncoder(w).Encode(response)
+			writeJSON(w, r, response)
 		}
-	}))
+	})))
 
 	// Restart endpoint
-	http.HandleFunc("/api/restart", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/restart", corsMiddleware(mutating(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
@@ -590,65 +4054,124 @@ func main() {
 			"success": true,
 			"message": "Bridge restart initiated",
 		}
-		json.NewEncoder(w).Encode(response)
+		writeJSON(w, r, response)
 
-		// Restart the bridge in a goroutine
-		go func() {
-			log.Println("Restarting bridge...")
-			// Give time for response to be sent
-			time.Sleep(1 * time.Second)
-			// Exit the current process - the system will restart it
-			os.Exit(0)
-		}()
-	}))
+		// Shut down like on SIGTERM, the system will restart the process.
+		// Shutting down waits for this response to be sent.
+		log.Println("Restarting bridge...")
+		select {
+		case stop <- syscall.SIGTERM:
+		default:
+			// Already shutting down
+		}
+	})))
+
+	sig := <-stop
+	log.Printf("Received %v, shutting down...", sig)
+	shutdown(server, client, queue, messageStore)
+}
+
+// shutdownTimeout is how long in-flight requests get to finish on shutdown
+const shutdownTimeout = 5 * time.Second
+
+// shutdown stops taking requests and lets the ones in flight finish, then
+// disconnects from WhatsApp. The queued events, media downloads and webhook
+// deliveries are finished before the message database is closed, so none
+// of them writes to it once it's closed.
+func shutdown(server *http.Server, client *whatsmeow.Client, queue *eventQueue, messageStore *MessageStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to finish in-flight requests: %v", err)
+	}
+
+	client.Disconnect()
+
+	// The workers get their own time, the requests may have used it all up
+	ctx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := queue.Close(ctx); err != nil {
+		log.Printf("Failed to handle queued events: %v", err)
+	}
+	if autoDownloads != nil {
+		if err := autoDownloads.Close(ctx); err != nil {
+			log.Printf("Failed to finish media downloads: %v", err)
+		}
+	}
+	if err := stopWebhookDeliveries(ctx); err != nil {
+		log.Printf("Failed to finish webhook deliveries: %v", err)
+	}
+
+	if err := messageStore.Close(); err != nil {
+		log.Printf("Failed to close message store: %v", err)
+	}
+	log.Println("Bridge stopped")
+}
+
+// waitGroupContext waits for wg, or returns the error of ctx once it's done
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	// Keep the main goroutine alive
-	select {}
+// handleDisconnected records a dropped socket. A paired device keeps its
+// session, and whatsmeow reconnects it on its own.
+func handleDisconnected(client *whatsmeow.Client) {
+	if client.Store.ID == nil {
+		setConnectionState(stateUnpaired)
+	} else {
+		setConnectionState(stateConnecting)
+	}
+	resetPresenceSubscriptions()
+	log.Println("Disconnected from WhatsApp")
 }
 
 // Reconnect function to generate new QR code after logout
-func reconnectWhatsApp(client *whatsmeow.Client) {
-	if isReconnecting {
+func reconnectWhatsApp(client *whatsmeow.Client, qrCodes *qrManager) {
+	reconnectWith(client, qrCodes, client.Connect)
+}
+
+// reconnectWith reconnects the client using connect, which only differs
+// from client.Connect in tests
+func reconnectWith(client *whatsmeow.Client, qrCodes *qrManager, connect func() error) {
+	// Claim the reconnection, so concurrent callers can't both start one
+	if !isReconnecting.CompareAndSwap(false, true) {
 		log.Println("Reconnection already in progress, skipping...")
 		return
 	}
 
-	isReconnecting = true
+	recordManualReconnect()
 	log.Println("Starting reconnection process...")
 
-	// Only generate QR code if not already connected
-	if !client.IsConnected() {
-		// Disconnect first to ensure clean state
-		client.Disconnect()
-
-		// Get QR channel
-		qrChan, _ := client.GetQRChannel(context.Background())
-		err := client.Connect()
-		if err != nil {
-			log.Printf("Failed to connect during reconnection: %v", err)
-			isReconnecting = false
-			return
-		}
+	if client.IsConnected() {
+		isReconnecting.Store(false)
+		return
+	}
 
-		// Generate QR code once
+	// Still paired: the socket merely dropped (e.g. after a network change),
+	// so reconnect with the existing session. Only a logout needs a new QR
+	// code, and whatsmeow has already deleted the device by then.
+	if client.Store.ID != nil {
+		log.Println("Reconnecting with the existing session...")
 		go func() {
-			defer func() { isReconnecting = false }()
-			for evt := range qrChan {
-				if evt.Event == "code" {
-					fmt.Println("\nNew QR code generated for reconnection:")
-					// Remove old QR code file
-					os.Remove("qr.png")
-					// Generate new QR code
-					qrcode.WriteFile(evt.Code, qrcode.Medium, 256, "qr.png")
-					fmt.Println("QR code saved as qr.png")
-					break // Only generate one QR code
-				} else if evt.Event == "success" {
-					fmt.Println("\nSuccessfully reconnected!")
-					break
-				}
-			}
+			defer isReconnecting.Store(false)
+			connectWithRetry(connect, initialConnectBackoff, maxConnectBackoff)
 		}()
-	} else {
-		isReconnecting = false
+		return
 	}
+
+	// Disconnect first to ensure clean state
+	client.Disconnect()
+
+	// Show each rotated QR code until paired
+	qrCodes.Start("reconnection", client.GetQRChannel, connect, func() { isReconnecting.Store(false) })
 }
@@ -0,0 +1,894 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waAdv"
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestStore opens a message store in a temporary directory, closed when
+// the test ends
+func newTestStore(t testing.TB) *MessageStore {
+	t.Helper()
+	ms, err := NewMessageStore(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("NewMessageStore: %v", err)
+	}
+	t.Cleanup(func() { ms.Close() })
+	return ms
+}
+
+// inTempDir runs the rest of a test in a temporary working directory, for
+// code that writes files relative to it
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// testMessage returns a stored-shape text message in a direct chat
+func testMessage(id, content string, timestamp time.Time) *Message {
+	return &Message{
+		ID:        id,
+		Sender:    "111@s.whatsapp.net",
+		Content:   content,
+		Timestamp: timestamp,
+		ChatJID:   "111@s.whatsapp.net",
+		Type:      "text",
+	}
+}
+
+func TestSaveMessageKeepsRevokedPinnedAndExpired(t *testing.T) {
+	ms := newTestStore(t)
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := testMessage("AAA", "hello", ts)
+	msg.MediaType = "image"
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	until := ts.Add(24 * time.Hour)
+	if err := ms.SetMessagePinned(msg.ChatJID, msg.ID, true, &until); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SetMessageRevoked(msg.ChatJID, msg.ID, ts.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SetMediaExpired(msg.ChatJID, msg.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// An echo or history sync re-delivery stores the message again
+	if err := ms.SaveMessage(testMessage("AAA", "hello", ts)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ms.GetMessage(msg.ChatJID, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Revoked {
+		t.Error("revoked was reset by saving the message again")
+	}
+	if !got.Pinned || got.PinnedUntil == nil || !got.PinnedUntil.Equal(until) {
+		t.Errorf("pin was reset by saving the message again: pinned=%v until=%v", got.Pinned, got.PinnedUntil)
+	}
+	if !got.MediaExpired {
+		t.Error("media_expired was reset by saving the message again")
+	}
+}
+
+func TestSaveMessageDefaultsForNewMessage(t *testing.T) {
+	ms := newTestStore(t)
+	msg := testMessage("BBB", "hi", time.Now())
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ms.GetMessage(msg.ChatJID, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Revoked || got.Pinned || got.PinnedUntil != nil || got.MediaExpired {
+		t.Errorf("new message has state set: %+v", got)
+	}
+}
+
+func TestConnectWithRetryRetriesUntilConnected(t *testing.T) {
+	attempts := 0
+	var delays []time.Duration
+	last := time.Now()
+	connectWithRetry(func() error {
+		now := time.Now()
+		if attempts > 0 {
+			delays = append(delays, now.Sub(last))
+		}
+		last = now
+		attempts++
+		if attempts < 4 {
+			return errors.New("dial tcp: connection refused")
+		}
+		return nil
+	}, time.Millisecond, 4*time.Millisecond)
+
+	if attempts != 4 {
+		t.Fatalf("connect called %d times, want 4", attempts)
+	}
+	// Delays double from 1ms and are capped at 4ms
+	for i, min := range []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond} {
+		if delays[i] < min {
+			t.Errorf("delay %d = %s, want at least %s", i+1, delays[i], min)
+		}
+	}
+	if state := getConnectionState(); state != stateConnecting {
+		t.Errorf("state after retrying = %q, want %q", state, stateConnecting)
+	}
+}
+
+func TestConnectWithRetryStopsWhenAlreadyConnected(t *testing.T) {
+	attempts := 0
+	connectWithRetry(func() error {
+		attempts++
+		return whatsmeow.ErrAlreadyConnected
+	}, time.Millisecond, time.Millisecond)
+	if attempts != 1 {
+		t.Fatalf("connect called %d times, want 1", attempts)
+	}
+}
+
+func TestDecodeJSONBodyRejectsMalformedJSON(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`{"recipient": "123", "message": "hi"`,
+		`{"recipient": }`,
+		`garbage`,
+		`{"recipient": "123"} {"recipient": "456"}`,
+		`["not", "an", "object"]`,
+	} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/send", strings.NewReader(body))
+		var req SendMessageRequest
+		if decodeJSONBody(rec, r, &req) {
+			t.Errorf("decodeJSONBody(%q) accepted malformed JSON", body)
+			continue
+		}
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("decodeJSONBody(%q) status = %d, want 400", body, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), "Invalid JSON") {
+			t.Errorf("decodeJSONBody(%q) body = %s, want an invalid JSON error", body, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/send", strings.NewReader(`{"recipient": "123", "message": "hi"}`))
+	var req SendMessageRequest
+	if !decodeJSONBody(rec, r, &req) || req.Recipient != "123" || req.Message != "hi" {
+		t.Fatalf("decodeJSONBody rejected valid JSON: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// TestHandlersStopOnMalformedJSON checks every handler reads its body
+// through decodeJSONBody and returns when it fails, since the handlers are
+// registered inline in main and can't be called one by one
+func TestHandlersStopOnMalformedJSON(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	for _, file := range pkgs["main"].Files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				// The helper itself is the one place that may decode bodies
+				return n.Name.Name != "decodeJSONBody"
+			case *ast.IfStmt:
+				if checksDecode(n.Cond) {
+					calls++
+					if len(n.Body.List) == 0 {
+						t.Errorf("%s: empty body after a failed decodeJSONBody", fset.Position(n.Pos()))
+					} else if _, ok := n.Body.List[len(n.Body.List)-1].(*ast.ReturnStmt); !ok {
+						t.Errorf("%s: handler doesn't return after a failed decodeJSONBody", fset.Position(n.Pos()))
+					}
+					return false
+				}
+			case *ast.CallExpr:
+				if isCallTo(n, "decodeJSONBody") {
+					t.Errorf("%s: decodeJSONBody result isn't checked with if !decodeJSONBody(...) { return }", fset.Position(n.Pos()))
+				}
+				if sel, ok := n.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "NewDecoder" && len(n.Args) == 1 {
+					if arg, ok := n.Args[0].(*ast.SelectorExpr); ok && arg.Sel.Name == "Body" {
+						t.Errorf("%s: request body decoded without decodeJSONBody", fset.Position(n.Pos()))
+					}
+				}
+			}
+			return true
+		})
+	}
+	if calls == 0 {
+		t.Fatal("found no decodeJSONBody calls")
+	}
+}
+
+// checksDecode reports whether an if condition is !decodeJSONBody(...),
+// possibly behind other conditions, as in a body that's optional
+func checksDecode(cond ast.Expr) bool {
+	if and, ok := cond.(*ast.BinaryExpr); ok && and.Op == token.LAND {
+		return checksDecode(and.Y)
+	}
+	not, ok := cond.(*ast.UnaryExpr)
+	return ok && not.Op == token.NOT && isCallTo(not.X, "decodeJSONBody")
+}
+
+// isCallTo reports whether expr calls the function name
+func isCallTo(expr ast.Expr, name string) bool {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := call.Fun.(*ast.Ident)
+	return ok && ident.Name == name
+}
+
+// BenchmarkGetMediaMessages lists one chat's images from a large table, with
+// and without the (chat_jid, media_type, timestamp) index
+func BenchmarkGetMediaMessages(b *testing.B) {
+	ms := newTestStore(b)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var msgs []*Message
+	for i := 0; i < 100000; i++ {
+		msg := testMessage(fmt.Sprintf("MSG%06d", i), "hello", start.Add(time.Duration(i)*time.Second))
+		// Spread the messages over 10 chats, with one in 50 being an image
+		msg.ChatJID = fmt.Sprintf("%d@s.whatsapp.net", i%10)
+		if i%50 == 0 {
+			msg.Type = "image"
+			msg.MediaType = "image"
+		}
+		msgs = append(msgs, msg)
+	}
+	if _, err := ms.SaveMessages(msgs); err != nil {
+		b.Fatal(err)
+	}
+
+	run := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := ms.GetMediaMessages("0@s.whatsapp.net", "image", 50, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("indexed", run)
+	if _, err := ms.db.Exec("DROP INDEX idx_messages_chat_media"); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("unindexed", run)
+}
+
+// pinEvent builds an incoming pin or unpin of the message id
+func pinEvent(chat types.JID, id string, pinType waE2E.PinInChatMessage_Type, seconds uint32, at time.Time) *events.Message {
+	msg := &waE2E.Message{PinInChatMessage: &waE2E.PinInChatMessage{
+		Key:  &waCommon.MessageKey{ID: proto.String(id)},
+		Type: pinType.Enum(),
+	}}
+	if seconds != 0 {
+		msg.MessageContextInfo = &waE2E.MessageContextInfo{MessageAddOnDurationInSecs: proto.Uint32(seconds)}
+	}
+	return &events.Message{
+		Info:    types.MessageInfo{MessageSource: types.MessageSource{Chat: chat}, Timestamp: at},
+		Message: msg,
+	}
+}
+
+func TestHandlePinAndUnpin(t *testing.T) {
+	ms := newTestStore(t)
+	now := time.Now().Truncate(time.Second)
+	msg := testMessage("PIN1", "pin me", now.Add(-time.Hour))
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	chat := types.NewJID("111", types.DefaultUserServer)
+
+	pin := pinEvent(chat, "PIN1", waE2E.PinInChatMessage_PIN_FOR_ALL, 7*24*3600, now)
+	handlePinMessage(ms, pin, pin.Message.PinInChatMessage)
+	got, err := ms.GetMessage(msg.ChatJID, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(7 * 24 * time.Hour); !got.Pinned || got.PinnedUntil == nil || !got.PinnedUntil.Equal(want) {
+		t.Fatalf("after pin: pinned=%v until=%v, want until %s", got.Pinned, got.PinnedUntil, want)
+	}
+	pinned, err := ms.GetPinnedMessages(msg.ChatJID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pinned) != 1 || pinned[0].ID != "PIN1" {
+		t.Fatalf("pinned messages = %v, want PIN1", pinned)
+	}
+
+	unpin := pinEvent(chat, "PIN1", waE2E.PinInChatMessage_UNPIN_FOR_ALL, 0, now.Add(time.Minute))
+	handlePinMessage(ms, unpin, unpin.Message.PinInChatMessage)
+	got, err = ms.GetMessage(msg.ChatJID, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Pinned || got.PinnedUntil != nil {
+		t.Fatalf("after unpin: pinned=%v until=%v", got.Pinned, got.PinnedUntil)
+	}
+	if pinned, _ := ms.GetPinnedMessages(msg.ChatJID); len(pinned) != 0 {
+		t.Fatalf("unpinned message still listed: %v", pinned)
+	}
+}
+
+func TestPinWithoutDurationUsesDefault(t *testing.T) {
+	ms := newTestStore(t)
+	now := time.Now().Truncate(time.Second)
+	msg := testMessage("PIN2", "pin me", now)
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	pin := pinEvent(types.NewJID("111", types.DefaultUserServer), "PIN2", waE2E.PinInChatMessage_PIN_FOR_ALL, 0, now)
+	handlePinMessage(ms, pin, pin.Message.PinInChatMessage)
+	got, err := ms.GetMessage(msg.ChatJID, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(defaultPinDuration); got.PinnedUntil == nil || !got.PinnedUntil.Equal(want) {
+		t.Fatalf("pinned_until = %v, want %s", got.PinnedUntil, want)
+	}
+}
+
+func TestExpiredPinIsNotListed(t *testing.T) {
+	ms := newTestStore(t)
+	msg := testMessage("PIN3", "old pin", time.Now().Add(-48*time.Hour))
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(-time.Hour)
+	if err := ms.SetMessagePinned(msg.ChatJID, msg.ID, true, &until); err != nil {
+		t.Fatal(err)
+	}
+	if pinned, _ := ms.GetPinnedMessages(msg.ChatJID); len(pinned) != 0 {
+		t.Fatalf("expired pin still listed: %v", pinned)
+	}
+}
+
+// newTestClient returns a client for a device stored as paired but never
+// connected, for code that only reads its stores
+func newTestClient(t testing.TB) *whatsmeow.Client {
+	t.Helper()
+	return newTestClientFor(t, "999")
+}
+
+// newTestClientFor is newTestClient for the account with phone number user
+func newTestClientFor(t testing.TB, user string) *whatsmeow.Client {
+	t.Helper()
+	container, err := sqlstore.New(context.Background(), "sqlite3", "file:"+filepath.Join(t.TempDir(), "session.db")+"?_foreign_keys=1", nil)
+	if err != nil {
+		t.Fatalf("sqlstore.New: %v", err)
+	}
+	t.Cleanup(func() { container.Close() })
+	device := container.NewDevice()
+	device.ID = &types.JID{User: user, Device: 1, Server: types.DefaultUserServer}
+	device.PushName = "Me"
+	device.Account = &waAdv.ADVSignedDeviceIdentity{
+		Details:             []byte{},
+		AccountSignature:    make([]byte, 64),
+		AccountSignatureKey: make([]byte, 32),
+		DeviceSignature:     make([]byte, 64),
+	}
+	if err := container.PutDevice(context.Background(), device); err != nil {
+		t.Fatalf("PutDevice: %v", err)
+	}
+	return whatsmeow.NewClient(device, nil)
+}
+
+func TestTransientDisconnectReconnectsWithSession(t *testing.T) {
+	client := newTestClient(t)
+	qrCodes := &qrManager{requests: make(chan qrRequest, 1)}
+
+	handleDisconnected(client)
+	if state := getConnectionState(); state != stateConnecting {
+		t.Fatalf("state after a transient disconnect = %q, want %q", state, stateConnecting)
+	}
+
+	connected := make(chan struct{})
+	reconnectWith(client, qrCodes, func() error {
+		close(connected)
+		return nil
+	})
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("paired client wasn't reconnected")
+	}
+	for isReconnecting.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(qrCodes.requests) != 0 {
+		t.Error("a transient disconnect asked for a QR code")
+	}
+	if client.Store.ID == nil {
+		t.Fatal("a transient disconnect cleared the device")
+	}
+	device, err := client.Store.Container.(*sqlstore.Container).GetDevice(context.Background(), *client.Store.ID)
+	if err != nil || device == nil {
+		t.Fatalf("device no longer stored after reconnecting: %v", err)
+	}
+}
+
+func TestReconnectAfterLogoutAsksForQR(t *testing.T) {
+	client := newTestClient(t)
+	client.Store.ID = nil
+	qrCodes := &qrManager{requests: make(chan qrRequest, 1)}
+
+	handleDisconnected(client)
+	if state := getConnectionState(); state != stateUnpaired {
+		t.Fatalf("state after disconnecting unpaired = %q, want %q", state, stateUnpaired)
+	}
+
+	reconnectWith(client, qrCodes, func() error {
+		t.Error("unpaired client connected without a QR code")
+		return nil
+	})
+	select {
+	case req := <-qrCodes.requests:
+		if req.flow != "reconnection" {
+			t.Errorf("QR flow = %q, want reconnection", req.flow)
+		}
+		req.done()
+	default:
+		t.Fatal("logged out client didn't ask for a QR code")
+	}
+	if isReconnecting.Load() {
+		t.Error("reconnection still claimed after the QR flow finished")
+	}
+}
+
+func TestConcurrentReconnectsStartOnce(t *testing.T) {
+	client := newTestClient(t)
+	qrCodes := &qrManager{requests: make(chan qrRequest, 1)}
+
+	var connects atomic.Int32
+	release := make(chan struct{})
+	connect := func() error {
+		connects.Add(1)
+		<-release
+		return nil
+	}
+
+	// The logout and QR handlers and the event handler may all try at once
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			reconnectWith(client, qrCodes, connect)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	// The one that proceeded connects in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for connects.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !isReconnecting.Load() {
+		t.Fatal("reconnection not claimed while connecting")
+	}
+	close(release)
+	for isReconnecting.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if n := connects.Load(); n != 1 {
+		t.Fatalf("%d of 20 concurrent reconnects proceeded, want exactly 1", n)
+	}
+
+	// Once it's done, the next reconnection may start
+	reconnectWith(client, qrCodes, connect)
+	for isReconnecting.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if n := connects.Load(); n != 2 {
+		t.Fatalf("reconnect after the first finished connected %d times in total, want 2", n)
+	}
+}
+
+// messageShapes encodes a list of messages like /api/messages does and
+// decodes it back into generic maps
+func messageShapes(t *testing.T, v any) []map[string]any {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []map[string]any
+	if err := json.Unmarshal(raw, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMessagesResponseShapes(t *testing.T) {
+	ms := newTestStore(t)
+	image := testMessage("IMG1", "look", time.Now())
+	image.Type, image.MediaType = "image", "image"
+	image.Filename = "image_20240501_120000.jpg"
+	image.MimeType = "image/jpeg"
+	image.FileLength = 2048
+	text := testMessage("TXT1", "hello", time.Now().Add(time.Second))
+	for _, msg := range []*Message{image, text} {
+		if err := ms.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func() []*Message {
+		messages, err := ms.GetMessages(image.ChatJID, MessageQuery{})
+		if err != nil || len(messages) != 2 {
+			t.Fatalf("GetMessages = %d messages, %v", len(messages), err)
+		}
+		if messages[0].ID != "IMG1" {
+			messages[0], messages[1] = messages[1], messages[0]
+		}
+		return messages
+	}
+
+	t.Run("v1", func(t *testing.T) {
+		messages := load()
+		setDownloadable(messages)
+		shapes := messageShapes(t, messages)
+		img := shapes[0]
+		if img["media_type"] != "image" || img["filename"] != image.Filename || img["mime_type"] != "image/jpeg" || img["file_length"] != 2048.0 || img["downloadable"] != true {
+			t.Errorf("v1 image = %v, want the media fields inlined", img)
+		}
+		if _, ok := img["media"]; ok {
+			t.Errorf("v1 image has a media object: %v", img)
+		}
+		if _, ok := shapes[1]["downloadable"]; ok {
+			t.Errorf("v1 text message has a downloadable hint: %v", shapes[1])
+		}
+	})
+
+	t.Run("v2", func(t *testing.T) {
+		shapes := messageShapes(t, messagesV2(load()))
+		img := shapes[0]
+		for _, inlined := range []string{"media_type", "filename", "mime_type", "file_length", "downloadable"} {
+			if _, ok := img[inlined]; ok {
+				t.Errorf("v2 image still has %s inlined: %v", inlined, img)
+			}
+		}
+		media, ok := img["media"].(map[string]any)
+		if !ok {
+			t.Fatalf("v2 image has no media object: %v", img)
+		}
+		want := map[string]any{
+			"type":         "image",
+			"filename":     image.Filename,
+			"mime":         "image/jpeg",
+			"size":         2048.0,
+			"cached":       false,
+			"downloadable": true,
+			"download_url": "/api/media/111@s.whatsapp.net/IMG1.jpg",
+		}
+		for key, value := range want {
+			if media[key] != value {
+				t.Errorf("v2 media.%s = %v, want %v", key, media[key], value)
+			}
+		}
+		if img["id"] != "IMG1" || img["content"] != "look" {
+			t.Errorf("v2 image lost its other fields: %v", img)
+		}
+		if media, ok := shapes[1]["media"]; !ok || media != nil {
+			t.Errorf("v2 text message media = %v, want null", media)
+		}
+	})
+}
+
+func TestValidateClientMessageID(t *testing.T) {
+	for _, id := range []string{"3EB0C767D26A1D5B7F3A", "ABCDEFGHIJ", "3EB0" + strings.Repeat("A", 60)} {
+		if err := validateClientMessageID(id); err != nil {
+			t.Errorf("validateClientMessageID(%q) = %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "SHORT", "3eb0c767d26a1d5b7f3a", "3EB0-C767-D26A", "3EB0" + strings.Repeat("A", 61), "../../etc"} {
+		if err := validateClientMessageID(id); err == nil {
+			t.Errorf("validateClientMessageID(%q) accepted", id)
+		}
+	}
+}
+
+func TestSendAndStoreUsesClientMessageID(t *testing.T) {
+	ms := newTestStore(t)
+	client := newTestClient(t)
+	to := types.NewJID("111", types.DefaultUserServer)
+
+	// The client isn't connected, so the send itself fails after the ID
+	// has been chosen
+	msg := &Message{ID: "3EB0C767D26A1D5B7F3A", Content: "hi", ChatJID: to.String(), Type: "text", IsFromMe: true}
+	if err := sendAndStore(client, ms, to, msg, &waE2E.Message{Conversation: proto.String("hi")}); err == nil {
+		t.Fatal("send on a disconnected client succeeded")
+	}
+	if msg.ID != "3EB0C767D26A1D5B7F3A" {
+		t.Errorf("message ID = %q, want the client_message_id", msg.ID)
+	}
+	if _, err := ms.GetMessage(to.String(), msg.ID); err == nil {
+		t.Error("unsent message was left stored")
+	}
+
+	generated := &Message{Content: "hi", ChatJID: to.String(), Type: "text", IsFromMe: true}
+	sendAndStore(client, ms, to, generated, &waE2E.Message{Conversation: proto.String("hi")})
+	if generated.ID == "" || validateClientMessageID(generated.ID) != nil {
+		t.Errorf("generated message ID = %q", generated.ID)
+	}
+}
+
+func TestSendWithClientMessageIDIsIdempotent(t *testing.T) {
+	ms := newTestStore(t)
+	client := newTestClient(t)
+	to := types.NewJID("111", types.DefaultUserServer)
+
+	sent := testMessage("3EB0C767D26A1D5B7F3A", "hi", time.Now())
+	sent.IsFromMe, sent.ServerAcked = true, true
+	if err := ms.SaveMessage(sent); err != nil {
+		t.Fatal(err)
+	}
+	// Repeating the request returns the stored message without sending
+	msg, _, err := sendWhatsAppMessage(client, ms, to, &SendMessageRequest{Message: "hi", ClientMessageID: sent.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != sent.ID || !msg.ServerAcked {
+		t.Fatalf("repeated send = %+v, want the stored message", msg)
+	}
+
+	// A message still waiting for its acknowledgement is being sent
+	pending := testMessage("3EB0AAAAAAAAAAAAAAAA", "hi", time.Now())
+	pending.IsFromMe = true
+	if err := ms.SaveMessage(pending); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sendWhatsAppMessage(client, ms, to, &SendMessageRequest{Message: "hi", ClientMessageID: pending.ID}); !errors.Is(err, errMessageIDInUse) {
+		t.Fatalf("send while pending = %v, want errMessageIDInUse", err)
+	}
+	if code := sendStatusCode(errMessageIDInUse); code != http.StatusConflict {
+		t.Errorf("status for an ID in use = %d, want 409", code)
+	}
+}
+
+// disconnectedWriter is a response writer whose client went away
+type disconnectedWriter struct {
+	header http.Header
+}
+
+func (w *disconnectedWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+func (w *disconnectedWriter) Write([]byte) (int, error) { return 0, errors.New("write: broken pipe") }
+func (w *disconnectedWriter) WriteHeader(int)           {}
+
+func TestWriteJSONToCanceledRequest(t *testing.T) {
+	ms := newTestStore(t)
+	var msgs []*Message
+	for i := 0; i < 200; i++ {
+		msgs = append(msgs, testMessage(fmt.Sprintf("M%03d", i), strings.Repeat("x", 100), time.Now().Add(time.Duration(i)*time.Second)))
+	}
+	if _, err := ms.SaveMessages(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/api/messages?chat_jid=111@s.whatsapp.net", nil).WithContext(ctx)
+	buf := captureLog(t)
+
+	messages, err := ms.GetMessages("111@s.whatsapp.net", MessageQuery{Limit: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeJSON(&disconnectedWriter{}, r, messages)
+
+	if !strings.Contains(buf.String(), "Failed to write response to GET /api/messages") {
+		t.Errorf("failed write wasn't logged: %q", buf.String())
+	}
+	// Every query's rows were closed, so no connection is left in use
+	if stats := ms.db.Stats(); stats.InUse != 0 {
+		t.Errorf("%d database connections still in use", stats.InUse)
+	}
+}
+
+func TestMessageTypeFilter(t *testing.T) {
+	tests := []struct{ filter, want string }{
+		{"text", "text"}, {"TEXT", "text"},
+		{"image", "image"}, {"images", "image"},
+		{"video", "video"}, {"videos", "video"},
+		{"audio", "audio"},
+		{"document", "document"}, {"docs", "document"},
+		{"sticker", "sticker"}, {"stickers", "sticker"},
+		{"location", "location"}, {"locations", "location"},
+		{"contact", "contact"}, {"contacts", "contact"},
+		{"poll", "poll"}, {"polls", "poll"},
+	}
+	for _, tt := range tests {
+		if got, ok := messageTypeFilter(tt.filter); !ok || got != tt.want {
+			t.Errorf("messageTypeFilter(%q) = %q, %v, want %q", tt.filter, got, ok, tt.want)
+		}
+	}
+	for _, filter := range []string{"", "gif", "voice note", "text'--"} {
+		if _, ok := messageTypeFilter(filter); ok {
+			t.Errorf("messageTypeFilter(%q) accepted", filter)
+		}
+	}
+}
+
+func TestGetMessagesByType(t *testing.T) {
+	ms := newTestStore(t)
+	msgTypes := []string{"text", "image", "video", "audio", "document", "sticker", "location", "contact", "poll"}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, msgType := range msgTypes {
+		// Two of each, so pagination can be checked too
+		for j := 0; j < 2; j++ {
+			msg := testMessage(fmt.Sprintf("%s%d", msgType, j), msgType, start.Add(time.Duration(i*2+j)*time.Minute))
+			msg.Type = msgType
+			if _, ok := mediaTypeFilters[msgType]; ok {
+				msg.MediaType = msgType
+			}
+			if err := ms.SaveMessage(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, msgType := range msgTypes {
+		messages, err := ms.GetMessages("111@s.whatsapp.net", MessageQuery{Type: msgType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 2 {
+			t.Errorf("type %s matched %d messages, want 2", msgType, len(messages))
+		}
+		for _, msg := range messages {
+			if msg.Type != msgType {
+				t.Errorf("type %s matched a %s message", msgType, msg.Type)
+			}
+		}
+
+		page, err := ms.GetMessages("111@s.whatsapp.net", MessageQuery{Type: msgType, Limit: 1, Offset: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 1 || page[0].Type != msgType {
+			t.Errorf("second page of type %s = %v", msgType, page)
+		}
+	}
+}
+
+// messageIDsOf lists the IDs of messages in order
+func messageIDsOf(messages []*Message) string {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestGetMessagesWindowAndPagination(t *testing.T) {
+	ms := newTestStore(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// One message a day for ten days, M0 to M9
+	for i := 0; i < 10; i++ {
+		if err := ms.SaveMessage(testMessage(fmt.Sprintf("M%d", i), "hello", start.AddDate(0, 0, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A message from long ago, which the old three-week window hid
+	if err := ms.SaveMessage(testMessage("OLD", "hello", start.AddDate(-1, 0, 0))); err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(i int) time.Time { return start.AddDate(0, 0, i) }
+	tests := []struct {
+		name string
+		q    MessageQuery
+		want string
+	}{
+		{"no filter", MessageQuery{}, "OLD,M0,M1,M2,M3,M4,M5,M6,M7,M8,M9"},
+		// after is inclusive and before exclusive
+		{"after", MessageQuery{After: day(7)}, "M7,M8,M9"},
+		{"before", MessageQuery{Before: day(1)}, "OLD,M0"},
+		{"window", MessageQuery{After: day(3), Before: day(6)}, "M3,M4,M5"},
+		{"just after", MessageQuery{After: day(3).Add(time.Nanosecond), Before: day(6).Add(time.Nanosecond)}, "M4,M5,M6"},
+		{"empty window", MessageQuery{After: day(5), Before: day(5)}, ""},
+		{"limit", MessageQuery{Limit: 3}, "OLD,M0,M1"},
+		{"offset", MessageQuery{Limit: 3, Offset: 3}, "M2,M3,M4"},
+		{"offset without limit", MessageQuery{Offset: 9}, "M8,M9"},
+		{"past the end", MessageQuery{Limit: 3, Offset: 20}, ""},
+		{"newest first", MessageQuery{Newest: true, Limit: 3}, "M9,M8,M7"},
+		{"newest first, second page", MessageQuery{Newest: true, Limit: 3, Offset: 3}, "M6,M5,M4"},
+		{"window newest first", MessageQuery{After: day(3), Before: day(6), Newest: true, Limit: 2}, "M5,M4"},
+	}
+	for _, tt := range tests {
+		messages, err := ms.GetMessages("111@s.whatsapp.net", tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := messageIDsOf(messages); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseMessageQuery(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		params string
+		want   MessageQuery
+	}{
+		{"", MessageQuery{}},
+		{"after=2024-05-01T00:00:00Z&before=2024-05-02T00:00:00Z", MessageQuery{
+			After:  time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+			Before: time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC),
+		}},
+		{"after=2d", MessageQuery{After: now.Add(-48 * time.Hour)}},
+		{"limit=50&offset=100&order=desc", MessageQuery{Limit: 50, Offset: 100, Newest: true}},
+		{"limit=100000", MessageQuery{Limit: 5000}},
+		{"order=asc&type=image", MessageQuery{Type: "image"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/messages?chatId=111@s.whatsapp.net&"+tt.params, nil)
+		got, err := parseMessageQuery(r, now)
+		if err != nil {
+			t.Errorf("parseMessageQuery(%q): %v", tt.params, err)
+			continue
+		}
+		if !got.After.Equal(tt.want.After) || !got.Before.Equal(tt.want.Before) ||
+			got.Limit != tt.want.Limit || got.Offset != tt.want.Offset || got.Newest != tt.want.Newest || got.Type != tt.want.Type {
+			t.Errorf("parseMessageQuery(%q) = %+v, want %+v", tt.params, got, tt.want)
+		}
+	}
+
+	for _, params := range []string{"after=yesterday", "before=2024-13-01", "limit=-1", "offset=x", "order=random", "type=gif"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/messages?chatId=111@s.whatsapp.net&"+params, nil)
+		if _, err := parseMessageQuery(r, now); err == nil {
+			t.Errorf("parseMessageQuery(%q) accepted", params)
+		}
+	}
+}
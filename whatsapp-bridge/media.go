@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+// mediaTypeForExtension determines the WhatsApp media type and mime type
+// for a file based on its extension
+func mediaTypeForExtension(fileExt string) (whatsmeow.MediaType, string) {
+	switch strings.ToLower(fileExt) {
+	// Image types
+	case "jpg", "jpeg":
+		return whatsmeow.MediaImage, "image/jpeg"
+	case "png":
+		return whatsmeow.MediaImage, "image/png"
+	case "gif":
+		return whatsmeow.MediaImage, "image/gif"
+	case "webp":
+		return whatsmeow.MediaImage, "image/webp"
+
+	// Audio types
+	case "ogg":
+		return whatsmeow.MediaAudio, "audio/ogg; codecs=opus"
+
+	// Video types
+	case "mp4":
+		return whatsmeow.MediaVideo, "video/mp4"
+	case "avi":
+		return whatsmeow.MediaVideo, "video/avi"
+	case "mov":
+		return whatsmeow.MediaVideo, "video/quicktime"
+
+	// Document types (for any other file type)
+	default:
+		return whatsmeow.MediaDocument, "application/octet-stream"
+	}
+}
+
+// mediaExtensions are the extensions cached media gets for the mime types
+// WhatsApp media usually has
+var mediaExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"video/avi":       ".avi",
+	"audio/ogg":       ".ogg",
+	"audio/mpeg":      ".mp3",
+	"audio/mp4":       ".m4a",
+	"audio/aac":       ".aac",
+	"application/pdf": ".pdf",
+}
+
+// mediaExtension picks the extension of a cached media file from its mime
+// type. Other types keep the extension of their filename, as documents do,
+// or fall back to what the system knows of the type.
+func mediaExtension(mimeType, filename string) string {
+	base, _, _ := strings.Cut(mimeType, ";")
+	base = strings.ToLower(strings.TrimSpace(base))
+	if ext, ok := mediaExtensions[base]; ok {
+		return ext
+	}
+	if ext := filepath.Ext(filename); ext != "" && !strings.ContainsAny(ext, `/\`) {
+		return strings.ToLower(ext)
+	}
+	if exts, err := mime.ExtensionsByType(base); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// sniffLength is how much of a file http.DetectContentType looks at
+const sniffLength = 512
+
+// mediaTypeForContent determines the WhatsApp media type and mime type of a
+// file from its first bytes, so a file without an extension, or with the
+// wrong one, still goes out as what it is. The extension only decides when
+// the content isn't recognized.
+func mediaTypeForContent(head []byte, fileExt string) (whatsmeow.MediaType, string) {
+	extType, extMime := mediaTypeForExtension(fileExt)
+	sniffed := http.DetectContentType(head)
+	mimeType, _, _ := strings.Cut(sniffed, ";")
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return whatsmeow.MediaImage, mimeType
+	case "video/mp4", "video/avi":
+		return whatsmeow.MediaVideo, mimeType
+	case "application/ogg", "audio/ogg":
+		// Only Ogg Opus can be sent as a voice message
+		return whatsmeow.MediaAudio, "audio/ogg; codecs=opus"
+	case "application/octet-stream":
+		// Unrecognized content, e.g. QuickTime video
+		return extType, extMime
+	}
+	// Anything else, even when named like an image, goes out as a document
+	return whatsmeow.MediaDocument, sniffed
+}
+
+// sniffFile reads the first bytes of a file for mediaTypeForContent
+func sniffFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// chooseMediaType picks the media type to send a file as from its first
+// bytes. Images can be forced to go out as documents, which WhatsApp
+// doesn't recompress.
+func chooseMediaType(mediaPath string, head []byte, sendAsDocument bool) (whatsmeow.MediaType, string) {
+	mediaType, mimeType := mediaTypeForContent(head, strings.TrimPrefix(filepath.Ext(mediaPath), "."))
+	if sendAsDocument && mediaType == whatsmeow.MediaImage {
+		mediaType = whatsmeow.MediaDocument
+	}
+	return mediaType, mimeType
+}
+
+// UploadedMedia describes a file uploaded to WhatsApp's media servers
+type UploadedMedia struct {
+	// Type is the stored media type: "image", "audio", "video" or "document"
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	DirectPath  string `json:"direct_path"`
+	Size        uint64 `json:"size"`
+	HasMediaKey bool   `json:"has_media_key"`
+}
+
+// buildMediaMessage uploads the file at mediaPath and wraps it in the
+// matching message type. It returns the message along with what was uploaded.
+func buildMediaMessage(client *whatsmeow.Client, mediaPath, caption, filename string, sendAsDocument bool) (*waE2E.Message, *UploadedMedia, error) {
+	// Read media file
+	mediaData, err := os.ReadFile(mediaPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading media file: %v", err)
+	}
+
+	if filename == "" {
+		filename = filepath.Base(mediaPath)
+	}
+
+	mediaType, mimeType := chooseMediaType(mediaPath, mediaData, sendAsDocument)
+
+	// Upload media to WhatsApp servers
+	resp, err := client.Upload(context.Background(), mediaData, mediaType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error uploading media: %v", err)
+	}
+
+	// Create the appropriate message type based on media type
+	msg := &waE2E.Message{}
+	var kind string
+	switch mediaType {
+	case whatsmeow.MediaImage:
+		kind = "image"
+		// Without a thumbnail the chat shows a blank box until the image
+		// is downloaded
+		thumbnail, err := imageThumbnail(mediaData)
+		if err != nil {
+			log.Printf("Sending %s without a thumbnail: %v", filename, err)
+		}
+		msg.ImageMessage = &waE2E.ImageMessage{
+			JPEGThumbnail: thumbnail,
+			Caption:       proto.String(caption),
+			Mimetype:      proto.String(mimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+		}
+	case whatsmeow.MediaAudio:
+		kind = "audio"
+		seconds, waveform, err := analyzeOggOpus(mediaData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to analyze Ogg Opus file: %v", err)
+		}
+
+		msg.AudioMessage = &waE2E.AudioMessage{
+			Mimetype:      proto.String(mimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+			Seconds:       proto.Uint32(seconds),
+			PTT:           proto.Bool(true),
+			Waveform:      normalizeWaveform(waveform),
+		}
+	case whatsmeow.MediaVideo:
+		kind = "video"
+		thumbnail, err := videoThumbnail(mediaPath)
+		if err != nil {
+			log.Printf("Sending %s without a thumbnail: %v", filename, err)
+		}
+		msg.VideoMessage = &waE2E.VideoMessage{
+			JPEGThumbnail: thumbnail,
+			Caption:       proto.String(caption),
+			Mimetype:      proto.String(mimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+		}
+		// The length and shape are shown before the video is downloaded,
+		// but it can be sent without them
+		if info, err := analyzeVideo(mediaData); err != nil {
+			log.Printf("Sending %s without its duration and size: %v", filename, err)
+		} else {
+			msg.VideoMessage.Seconds = proto.Uint32(info.Seconds)
+			msg.VideoMessage.Width = proto.Uint32(info.Width)
+			msg.VideoMessage.Height = proto.Uint32(info.Height)
+		}
+	case whatsmeow.MediaDocument:
+		kind = "document"
+		// The filename is what recipients see on the document bubble, the
+		// caption is shown as a separate line of text underneath it
+		msg.DocumentMessage = &waE2E.DocumentMessage{
+			FileName:      proto.String(filename),
+			Title:         proto.String(filename),
+			Mimetype:      proto.String(mimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+		}
+		if caption != "" {
+			msg.DocumentMessage.Caption = proto.String(caption)
+		}
+	}
+
+	return msg, &UploadedMedia{
+		Type:        kind,
+		Filename:    filename,
+		DirectPath:  resp.DirectPath,
+		Size:        resp.FileLength,
+		HasMediaKey: len(resp.MediaKey) > 0,
+	}, nil
+}
+
+// extractTextContent extracts the text (or media caption) from a message
+func extractTextContent(msg *waE2E.Message) string {
+	if msg == nil {
+		return ""
+	}
+
+	if text := msg.GetConversation(); text != "" {
+		return text
+	} else if extendedText := msg.GetExtendedTextMessage(); extendedText != nil {
+		return extendedText.GetText()
+	} else if img := msg.GetImageMessage(); img != nil {
+		return img.GetCaption()
+	} else if vid := msg.GetVideoMessage(); vid != nil {
+		return vid.GetCaption()
+	} else if doc := msg.GetDocumentMessage(); doc != nil {
+		return doc.GetCaption()
+	} else if loc := messageLocation(msg); loc != nil {
+		return loc.text()
+	} else if contacts := messageContacts(msg); contacts != nil {
+		return contactNames(contacts)
+	}
+
+	return ""
+}
+
+// extractMediaMeta returns the MIME type and size in bytes of a media message
+func extractMediaMeta(msg *waE2E.Message) (mimeType string, fileLength uint64) {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetMimetype(), msg.GetImageMessage().GetFileLength()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetMimetype(), msg.GetVideoMessage().GetFileLength()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetMimetype(), msg.GetAudioMessage().GetFileLength()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetMimetype(), msg.GetDocumentMessage().GetFileLength()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetMimetype(), msg.GetStickerMessage().GetFileLength()
+	}
+	return "", 0
+}
+
+// mediaMessage is what the media message types have in common
+type mediaMessage interface {
+	whatsmeow.DownloadableMessage
+	GetURL() string
+}
+
+// messageMedia returns the media of a message, nil for other messages
+func messageMedia(msg *waE2E.Message) mediaMessage {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage()
+	}
+	return nil
+}
+
+// applyMediaKeys keeps what's needed to download the media of waMsg later
+func applyMediaKeys(msg *Message, waMsg *waE2E.Message) {
+	media := messageMedia(waMsg)
+	if media == nil {
+		return
+	}
+	msg.URL = media.GetURL()
+	msg.DirectPath = media.GetDirectPath()
+	msg.MediaKey = media.GetMediaKey()
+	msg.FileSHA256 = media.GetFileSHA256()
+	msg.FileEncSHA256 = media.GetFileEncSHA256()
+}
+
+// extractMediaInfo returns the media type and filename of a media message,
+// and whether the media can only be viewed once
+func extractMediaInfo(msg *waE2E.Message) (mediaType string, filename string, viewOnce bool) {
+	if msg == nil {
+		return "", "", false
+	}
+	msg, viewOnce = unwrapViewOnce(msg)
+	viewOnce = viewOnce || msg.GetImageMessage().GetViewOnce() || msg.GetVideoMessage().GetViewOnce() || msg.GetAudioMessage().GetViewOnce()
+
+	if msg.GetImageMessage() != nil {
+		return "image", "image_" + time.Now().Format("20060102_150405") + ".jpg", viewOnce
+	}
+
+	if msg.GetVideoMessage() != nil {
+		return "video", "video_" + time.Now().Format("20060102_150405") + ".mp4", viewOnce
+	}
+
+	if msg.GetAudioMessage() != nil {
+		return "audio", "audio_" + time.Now().Format("20060102_150405") + ".ogg", viewOnce
+	}
+
+	if doc := msg.GetDocumentMessage(); doc != nil {
+		filename := doc.GetFileName()
+		if filename == "" {
+			filename = doc.GetTitle()
+		}
+		if filename == "" {
+			filename = "document_" + time.Now().Format("20060102_150405")
+		}
+		return "document", filename, viewOnce
+	}
+
+	if msg.GetStickerMessage() != nil {
+		return "sticker", "sticker_" + time.Now().Format("20060102_150405") + ".webp", viewOnce
+	}
+
+	return "", "", false
+}
+
+// unsupportedMediaError is returned when asked to download a stored media
+// type we have no way of downloading
+type unsupportedMediaError struct {
+	MediaType string
+}
+
+func (e *unsupportedMediaError) Error() string {
+	return fmt.Sprintf("unsupported media type: %q", e.MediaType)
+}
+
+// mediaDownloadInfo is what's needed to download and decrypt stored media
+type mediaDownloadInfo struct {
+	URL           string
+	DirectPath    string
+	MediaKey      []byte
+	FileSHA256    []byte
+	FileEncSHA256 []byte
+	FileLength    uint64
+}
+
+// downloadableMessage rebuilds the media message of a stored media type
+// for client.Download. Unknown types return an *unsupportedMediaError.
+func downloadableMessage(mediaType string, info mediaDownloadInfo) (whatsmeow.DownloadableMessage, error) {
+	switch mediaType {
+	case "image":
+		return &waE2E.ImageMessage{
+			URL:           proto.String(info.URL),
+			DirectPath:    proto.String(info.DirectPath),
+			MediaKey:      info.MediaKey,
+			FileSHA256:    info.FileSHA256,
+			FileEncSHA256: info.FileEncSHA256,
+			FileLength:    proto.Uint64(info.FileLength),
+		}, nil
+	case "video":
+		return &waE2E.VideoMessage{
+			URL:           proto.String(info.URL),
+			DirectPath:    proto.String(info.DirectPath),
+			MediaKey:      info.MediaKey,
+			FileSHA256:    info.FileSHA256,
+			FileEncSHA256: info.FileEncSHA256,
+			FileLength:    proto.Uint64(info.FileLength),
+		}, nil
+	case "audio":
+		return &waE2E.AudioMessage{
+			URL:           proto.String(info.URL),
+			DirectPath:    proto.String(info.DirectPath),
+			MediaKey:      info.MediaKey,
+			FileSHA256:    info.FileSHA256,
+			FileEncSHA256: info.FileEncSHA256,
+			FileLength:    proto.Uint64(info.FileLength),
+		}, nil
+	case "document":
+		return &waE2E.DocumentMessage{
+			URL:           proto.String(info.URL),
+			DirectPath:    proto.String(info.DirectPath),
+			MediaKey:      info.MediaKey,
+			FileSHA256:    info.FileSHA256,
+			FileEncSHA256: info.FileEncSHA256,
+			FileLength:    proto.Uint64(info.FileLength),
+		}, nil
+	case "sticker":
+		return &waE2E.StickerMessage{
+			URL:           proto.String(info.URL),
+			DirectPath:    proto.String(info.DirectPath),
+			MediaKey:      info.MediaKey,
+			FileSHA256:    info.FileSHA256,
+			FileEncSHA256: info.FileEncSHA256,
+			FileLength:    proto.Uint64(info.FileLength),
+		}, nil
+	}
+	return nil, &unsupportedMediaError{MediaType: mediaType}
+}
+
+// mediaRetention is roughly how long WhatsApp keeps media on its servers.
+// Older media can only be fetched again if the sender's phone still has it.
+const mediaRetention = 30 * 24 * time.Hour
+
+// isMediaExpiredError reports whether a download failed because the media
+// is gone for good rather than for a passing reason
+func isMediaExpiredError(err error) bool {
+	return errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) ||
+		errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410) ||
+		errors.Is(err, whatsmeow.ErrMediaNotAvailableOnPhone)
+}
+
+// SetMediaLocalPath records where a message's media was downloaded to
+func (ms *MessageStore) SetMediaLocalPath(chatJID, id, path string) error {
+	_, err := ms.db.Exec("UPDATE messages SET local_path = ?, updated_at = ? WHERE chat_jid = ? AND id = ?",
+		path, time.Now(), chatJID, id)
+	return err
+}
+
+// SetMediaExpired records that a message's media can no longer be downloaded
+func (ms *MessageStore) SetMediaExpired(chatJID, id string) error {
+	_, err := ms.db.Exec("UPDATE messages SET media_expired = 1, updated_at = ? WHERE chat_jid = ? AND id = ?",
+		time.Now(), chatJID, id)
+	return err
+}
+
+// mediaDownloadable guesses whether a message's media can still be
+// fetched: it's cached, or it's recent enough and no download has failed
+// with an expiry error yet
+func mediaDownloadable(msg *Message, cached bool, now time.Time) bool {
+	if cached {
+		return true
+	}
+	return !msg.MediaExpired && now.Sub(msg.Timestamp) < mediaRetention
+}
+
+// setDownloadable fills in the downloadable hint of media messages
+func setDownloadable(messages []*Message) {
+	now := time.Now()
+	for _, msg := range messages {
+		if msg.MediaType == "" {
+			continue
+		}
+		_, err := os.Stat(msg.cachePath())
+		downloadable := mediaDownloadable(msg, err == nil, now)
+		msg.Downloadable = &downloadable
+	}
+}
+
+// opusGranuleRate is the rate of Ogg Opus granule positions, which is
+// always 48 kHz regardless of the input sample rate in the OpusHead
+const opusGranuleRate = 48000.0
+
+// analyzeOggOpus tries to extract duration and a waveform from an Ogg Opus file
+func analyzeOggOpus(data []byte) (duration uint32, waveform []byte, err error) {
+	// Try to detect if this is a valid Ogg file by checking for the "OggS" signature
+	// at the beginning of the file
+	if len(data) < 4 || string(data[0:4]) != "OggS" {
+		return 0, nil, fmt.Errorf("not a valid Ogg file (missing OggS signature)")
+	}
+
+	// Parse Ogg pages to find the last page with a valid granule position
+	var lastGranule uint64
+	var preSkip uint16 = 0
+	var foundOpusHead bool
+
+	// Scan through the file looking for Ogg pages
+	for i := 0; i < len(data); {
+		// Check if we have enough data to read Ogg page header
+		if i+27 >= len(data) {
+			break
+		}
+
+		// Verify Ogg page signature
+		if string(data[i:i+4]) != "OggS" {
+			// Skip until next potential page
+			i++
+			continue
+		}
+
+		// Extract header fields
+		granulePos := binary.LittleEndian.Uint64(data[i+6 : i+14])
+		pageSeqNum := binary.LittleEndian.Uint32(data[i+18 : i+22])
+		numSegments := int(data[i+26])
+
+		// Extract segment table
+		if i+27+numSegments >= len(data) {
+			break
+		}
+		segmentTable := data[i+27 : i+27+numSegments]
+
+		// Calculate page size
+		pageSize := 27 + numSegments
+		for _, segLen := range segmentTable {
+			pageSize += int(segLen)
+		}
+		if i+pageSize > len(data) {
+			break
+		}
+
+		// Check if we're looking at an OpusHead packet (should be in first few pages)
+		if !foundOpusHead && pageSeqNum <= 1 {
+			// Look for "OpusHead" marker in this page
+			pageData := data[i : i+pageSize]
+			headPos := bytes.Index(pageData, []byte("OpusHead"))
+			// OpusHead format: Magic(8) + Version(1) + Channels(1) + PreSkip(2) + SampleRate(4) + ...
+			// so the header is at least 16 bytes from the start of the magic
+			if headPos >= 0 && headPos+16 <= len(pageData) {
+				head := pageData[headPos:]
+				// The channel count is only validated: granule positions
+				// count samples per channel, so a stereo or multichannel
+				// stream has the same duration as a mono one
+				if channels := head[9]; channels == 0 {
+					return 0, nil, fmt.Errorf("invalid OpusHead: zero channels")
+				}
+				preSkip = binary.LittleEndian.Uint16(head[10:12])
+				foundOpusHead = true
+			}
+		}
+
+		// Keep track of last valid granule position
+		if granulePos != 0 {
+			lastGranule = granulePos
+		}
+
+		// Move to next page
+		i += pageSize
+	}
+
+	if !foundOpusHead {
+		log.Printf("OpusHead not found in Ogg file, assuming its defaults")
+	}
+
+	// Calculate duration based on granule position
+	if lastGranule > uint64(preSkip) {
+		// The granule position counts samples per channel at 48 kHz, whatever
+		// the channel count or input sample rate, so stereo and multichannel
+		// files use the same formula: (lastGranule - preSkip) / 48000
+		durationSeconds := float64(lastGranule-uint64(preSkip)) / opusGranuleRate
+		duration = uint32(math.Ceil(durationSeconds))
+	} else {
+		// Fallback to rough estimation if granule position not found
+		log.Printf("No granule position found in Ogg file, estimating its duration from the size")
+		durationEstimate := float64(len(data)) / 2000.0 // Very rough approximation
+		duration = uint32(durationEstimate)
+	}
+
+	// Make sure we have a reasonable duration (at least 1 second, at most 300 seconds)
+	if duration < 1 {
+		duration = 1
+	} else if duration > 300 {
+		duration = 300
+	}
+
+	// Draw the waveform from the decoded audio, or make one up when it
+	// can't be decoded
+	waveform, err = pcmWaveform(data)
+	if err != nil {
+		log.Printf("Using a placeholder waveform: %v", err)
+		waveform = placeholderWaveform(duration)
+	}
+
+	return duration, waveform, nil
+}
+
+// waveformLength is the waveform size WhatsApp expects for voice messages
+const waveformLength = 64
+
+// normalizeWaveform pads (with silence) or truncates a waveform to
+// waveformLength bytes
+func normalizeWaveform(waveform []byte) []byte {
+	if len(waveform) == waveformLength {
+		return waveform
+	}
+
+	normalized := make([]byte, waveformLength)
+	copy(normalized, waveform)
+	return normalized
+}
+
+// placeholderWaveform generates a synthetic waveform for WhatsApp voice messages
+// that appears natural with some variability based on the duration
+func placeholderWaveform(duration uint32) []byte {
+	waveform := make([]byte, waveformLength)
+
+	// Seed a local generator for consistent results with the same duration,
+	// without touching the global one
+	rng := rand.New(rand.NewSource(int64(duration)))
+
+	// Create a more natural looking waveform with some patterns and variability
+	// rather than completely random values
+
+	// Base amplitude and frequency - longer messages get faster frequency
+	baseAmplitude := 35.0
+	frequencyFactor := float64(min(int(duration), 120)) / 30.0
+
+	for i := range waveform {
+		// Position in the waveform (normalized 0-1)
+		pos := float64(i) / float64(waveformLength)
+
+		// Create a wave pattern with some randomness
+		// Use multiple sine waves of different frequencies for more natural look
+		val := baseAmplitude * math.Sin(pos*math.Pi*frequencyFactor*8)
+		val += (baseAmplitude / 2) * math.Sin(pos*math.Pi*frequencyFactor*16)
+
+		// Add some randomness to make it look more natural
+		val += (rng.Float64() - 0.5) * 15
+
+		// Add some fade-in and fade-out effects
+		fadeInOut := math.Sin(pos * math.Pi)
+		val = val * (0.7 + 0.3*fadeInOut)
+
+		// Center around 50 (typical voice baseline)
+		val = val + 50
+
+		// Ensure values stay within WhatsApp's expected range (0-100)
+		if val < 0 {
+			val = 0
+		} else if val > 100 {
+			val = 100
+		}
+
+		waveform[i] = byte(val)
+	}
+
+	return waveform
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCaptionedDocumentRoundTrip(t *testing.T) {
+	ms := newTestStore(t)
+	waMsg := &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{
+		FileName:   proto.String("invoice.pdf"),
+		Title:      proto.String("invoice.pdf"),
+		Caption:    proto.String("March invoice"),
+		Mimetype:   proto.String("application/pdf"),
+		FileLength: proto.Uint64(1234),
+	}}
+
+	mediaType, filename, _ := extractMediaInfo(waMsg)
+	mimeType, fileLength := extractMediaMeta(waMsg)
+	msg := testMessage("DOC1", extractTextContent(waMsg), time.Now())
+	msg.Type = mediaType
+	msg.MediaType = mediaType
+	msg.Filename = filename
+	msg.MimeType = mimeType
+	msg.FileLength = fileLength
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := ms.GetMessages(msg.ChatJID, MessageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	raw, err := json.Marshal(messages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Content   string `json:"content"`
+		Filename  string `json:"filename"`
+		MediaType string `json:"media_type"`
+	}
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "March invoice" || got.Filename != "invoice.pdf" || got.MediaType != "document" {
+		t.Fatalf("/api/messages shape = %s", raw)
+	}
+}
+
+// pngHeader is enough of a PNG file for content sniffing
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestChooseMediaTypeSendAsDocument(t *testing.T) {
+	tests := []struct {
+		path           string
+		head           []byte
+		sendAsDocument bool
+		want           whatsmeow.MediaType
+	}{
+		{"photo.png", pngHeader, false, whatsmeow.MediaImage},
+		{"photo.png", pngHeader, true, whatsmeow.MediaDocument},
+		// Only images are affected by the flag
+		{"notes.txt", []byte("plain text"), false, whatsmeow.MediaDocument},
+		{"notes.txt", []byte("plain text"), true, whatsmeow.MediaDocument},
+	}
+	for _, tt := range tests {
+		got, mimeType := chooseMediaType(tt.path, tt.head, tt.sendAsDocument)
+		if got != tt.want {
+			t.Errorf("chooseMediaType(%s, send_as_document=%v) = %s, want %s", tt.path, tt.sendAsDocument, got, tt.want)
+		}
+		if tt.path == "photo.png" && mimeType != "image/png" {
+			t.Errorf("chooseMediaType(%s) mime = %s, want image/png", tt.path, mimeType)
+		}
+	}
+}
+
+func TestChooseMediaTypeFromContent(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		data     []byte
+		want     whatsmeow.MediaType
+		wantMime string
+	}{
+		// A PNG renamed to .txt is still sent as an image
+		{"photo.txt", pngHeader, whatsmeow.MediaImage, "image/png"},
+		{"notes.txt", []byte("Meeting notes\n\n- agenda\n- budget\n"), whatsmeow.MediaDocument, "text/plain"},
+		// A PDF named like a photo goes out as a document
+		{"scan.jpg", []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n"), whatsmeow.MediaDocument, "application/pdf"},
+		{"photo", pngHeader, whatsmeow.MediaImage, "image/png"},
+		{"voice", []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00"), whatsmeow.MediaAudio, "audio/ogg; codecs=opus"},
+		// Content that can't be sniffed falls back to the extension
+		{"clip.mov", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00qt  "), whatsmeow.MediaVideo, "video/quicktime"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		head, err := sniffFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, mimeType := chooseMediaType(path, head, false)
+		if got != tt.want || !strings.HasPrefix(mimeType, tt.wantMime) {
+			t.Errorf("chooseMediaType(%s) = %s, %s, want %s, %s", tt.name, got, mimeType, tt.want, tt.wantMime)
+		}
+	}
+
+	// Only the first bytes are read for sniffing
+	big := filepath.Join(dir, "big.bin")
+	if err := os.WriteFile(big, make([]byte, 10*sniffLength), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := sniffFile(big); err != nil || len(head) != sniffLength {
+		t.Errorf("sniffFile read %d bytes, %v, want %d", len(head), err, sniffLength)
+	}
+	if _, err := sniffFile(filepath.Join(dir, "missing.png")); err == nil {
+		t.Error("sniffFile of a missing file succeeded")
+	}
+}
+
+func TestNormalizeWaveform(t *testing.T) {
+	for _, n := range []int{0, 1, 32, waveformLength - 1, waveformLength, waveformLength + 1, 200} {
+		in := make([]byte, n)
+		for i := range in {
+			in[i] = byte(i%100 + 1)
+		}
+		got := normalizeWaveform(in)
+		if len(got) != waveformLength {
+			t.Errorf("normalizeWaveform(%d bytes) has %d bytes, want %d", n, len(got), waveformLength)
+			continue
+		}
+		for i, v := range got {
+			want := byte(0)
+			if i < n {
+				want = in[i]
+			}
+			if v != want {
+				t.Errorf("normalizeWaveform(%d bytes)[%d] = %d, want %d", n, i, v, want)
+				break
+			}
+		}
+	}
+	if got := normalizeWaveform(nil); len(got) != waveformLength {
+		t.Errorf("normalizeWaveform(nil) has %d bytes, want %d", len(got), waveformLength)
+	}
+}
+
+// oggPage builds an Ogg page carrying payload, which must fit in one segment
+func oggPage(seq uint32, granule uint64, payload []byte) []byte {
+	page := make([]byte, 27, 28+len(payload))
+	copy(page, "OggS")
+	binary.LittleEndian.PutUint64(page[6:14], granule)
+	binary.LittleEndian.PutUint32(page[18:22], seq)
+	page[26] = 1
+	page = append(page, byte(len(payload)))
+	return append(page, payload...)
+}
+
+func TestAnalyzeOggOpusTruncatedOpusHead(t *testing.T) {
+	// The OpusHead stops right after the pre-skip, at the end of the file,
+	// which used to read the sample rate out of bounds
+	head := append([]byte("OpusHead"), 1, 2, 0x38, 0x01)
+	data := append(oggPage(2, 3*48000, nil), oggPage(0, 0, head)...)
+	duration, waveform, err := analyzeOggOpus(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration != 3 {
+		t.Errorf("duration = %d, want 3", duration)
+	}
+	if len(waveform) != waveformLength {
+		t.Errorf("waveform has %d bytes, want %d", len(waveform), waveformLength)
+	}
+
+	// An OpusHead cut off anywhere must not panic either
+	full := opusHead(2, 312)
+	for n := 0; n <= len(full); n++ {
+		analyzeOggOpus(oggPage(0, 0, full[:n]))
+	}
+}
+
+// opusHead builds an OpusHead packet for an input sampled at 48 kHz
+func opusHead(channels byte, preSkip uint16) []byte {
+	head := append([]byte("OpusHead"), 1, channels, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint16(head[10:12], preSkip)
+	binary.LittleEndian.PutUint32(head[12:16], 48000)
+	return head
+}
+
+func TestAnalyzeOggOpusRejectsZeroChannels(t *testing.T) {
+	data := oggPage(0, 0, opusHead(0, 312))
+	data = append(data, oggPage(1, 312+5*48000, make([]byte, 100))...)
+	if _, _, err := analyzeOggOpus(data); err == nil {
+		t.Fatal("accepted an OpusHead without channels")
+	}
+}
+
+func TestAnalyzeOggOpusMultichannelDuration(t *testing.T) {
+	tests := []struct {
+		channels byte
+		preSkip  uint16
+		seconds  float64
+		want     uint32
+	}{
+		{1, 312, 5, 5},
+		{2, 312, 5, 5},
+		{2, 3840, 12.5, 13},
+		{6, 312, 60, 60},
+		{8, 0, 0.2, 1},
+	}
+	for _, tt := range tests {
+		// Granule positions count samples per channel at 48 kHz, so the
+		// channel count mustn't change the duration
+		granule := uint64(tt.preSkip) + uint64(tt.seconds*48000)
+		data := oggPage(0, 0, opusHead(tt.channels, tt.preSkip))
+		data = append(data, oggPage(1, 0, []byte("OpusTags"))...)
+		data = append(data, oggPage(2, granule/2, make([]byte, 100))...)
+		data = append(data, oggPage(3, granule, make([]byte, 100))...)
+		duration, _, err := analyzeOggOpus(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if duration != tt.want {
+			t.Errorf("%d channels, %gs: duration = %d, want %d", tt.channels, tt.seconds, duration, tt.want)
+		}
+	}
+}
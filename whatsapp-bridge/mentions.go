@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+)
+
+var (
+	// errInvalidMention is returned for a mention that isn't a user JID or
+	// phone number
+	errInvalidMention = errors.New("invalid mention")
+	// errMentionNotMember is returned for a mention of someone who isn't in
+	// the group
+	errMentionNotMember = errors.New("mentioned user is not a member of this group")
+	// errMentionsNotGroup is returned for mentions outside of groups
+	errMentionsNotGroup = errors.New("mentions are only supported in groups")
+)
+
+// resolveMentions checks that everyone mentioned in a message to a group
+// is a member of it, and returns their JIDs. The text still has to contain
+// @ and the number of each, that's where WhatsApp draws the tag.
+func resolveMentions(client *whatsmeow.Client, group types.JID, mentions []string) ([]string, error) {
+	if len(mentions) == 0 {
+		return nil, nil
+	}
+	if classifyJID(group) != jidGroup {
+		return nil, errMentionsNotGroup
+	}
+
+	jids := make([]types.JID, len(mentions))
+	for i, mention := range mentions {
+		jid, err := parseRecipient(mention)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %v", errInvalidMention, mention, err)
+		}
+		if kind := classifyJID(jid); kind != jidIndividual && kind != jidLID {
+			return nil, fmt.Errorf("%w %q: not a user", errInvalidMention, mention)
+		}
+		jids[i] = jid.ToNonAD()
+	}
+
+	info, err := getCachedGroupInfo(client, group)
+	if errors.Is(err, whatsmeow.ErrNotInGroup) || errors.Is(err, whatsmeow.ErrGroupNotFound) {
+		return nil, errNotGroupMember
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get group members: %w", err)
+	}
+	members := make(map[types.JID]bool)
+	for _, p := range info.Participants {
+		for _, jid := range []types.JID{p.JID, p.PhoneNumber, p.LID} {
+			if !jid.IsEmpty() {
+				members[jid.ToNonAD()] = true
+			}
+		}
+	}
+
+	mentioned := make([]string, len(jids))
+	for i, jid := range jids {
+		if !members[jid] {
+			return nil, fmt.Errorf("%w: %s", errMentionNotMember, mentions[i])
+		}
+		mentioned[i] = jid.String()
+	}
+	return mentioned, nil
+}
+
+// applyMentions tags users in an outgoing message. Plain text becomes an
+// extended text message, since only that carries the mentions.
+func applyMentions(msg *waE2E.Message, mentioned []string) {
+	if contextInfo := outgoingContextInfo(msg); contextInfo != nil {
+		contextInfo.MentionedJID = mentioned
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// maxPinnedChats is how many chats WhatsApp lets you pin to the top
+const maxPinnedChats = 3
+
+// errTooManyPinnedChats is returned when pinning a chat while the maximum
+// number of chats is already pinned
+var errTooManyPinnedChats = errors.New("only 3 chats can be pinned, unpin one first")
+
+// Chat is a stored chat, as listed by GetChats
+type Chat struct {
+	JID       string
+	Name      string
+	Timestamp time.Time
+	Pinned    bool
+	Hidden    bool
+	// sortKey is the chat's position in the list, see chatCursor
+	sortKey int64
+}
+
+// SetChatPinned records whether a chat is pinned. The time of the change is
+// kept even when unpinning, so pinned chats can be ordered the way WhatsApp
+// does (most recently pinned first) and pin changes show up in /api/chats.
+func (ms *MessageStore) SetChatPinned(jid string, pinned bool, at time.Time) error {
+	_, err := ms.db.Exec("UPDATE chats SET pinned = ?, pinned_at = ? WHERE jid = ?", pinned, at, jid)
+	return err
+}
+
+// CountPinnedChats returns how many chats are pinned, not counting exclude
+func (ms *MessageStore) CountPinnedChats(exclude string) (int, error) {
+	var count int
+	err := ms.db.QueryRow("SELECT COUNT(*) FROM chats WHERE pinned = 1 AND jid != ?", exclude).Scan(&count)
+	return count, err
+}
+
+// latestPinChange returns when a chat was last pinned or unpinned
+func (ms *MessageStore) latestPinChange() (time.Time, error) {
+	var at time.Time
+	err := ms.db.QueryRow("SELECT pinned_at FROM chats WHERE pinned_at IS NOT NULL ORDER BY pinned_at DESC LIMIT 1").Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return at, err
+}
+
+// handleChatPin stores a chat pin or unpin made on another device
+func handleChatPin(messageStore *MessageStore, v *events.Pin) {
+	if err := messageStore.SetChatPinned(v.JID.String(), v.Action.GetPinned(), v.Timestamp); err != nil {
+		log.Printf("Failed to save pin state of %s: %v", v.JID, err)
+	}
+}
+
+// checkChatPin returns errTooManyPinnedChats if pinning chat would go over
+// the limit. Unpinning is always allowed.
+func checkChatPin(messageStore *MessageStore, chat types.JID, pin bool) error {
+	if !pin {
+		return nil
+	}
+	count, err := messageStore.CountPinnedChats(chat.String())
+	if err != nil {
+		return err
+	}
+	if count >= maxPinnedChats {
+		return errTooManyPinnedChats
+	}
+	return nil
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Poll is a poll created in a chat, by us or anyone else
+type Poll struct {
+	ID              string    `json:"id"`
+	ChatJID         string    `json:"chat_jid"`
+	Sender          string    `json:"sender"`
+	Question        string    `json:"question"`
+	Options         []string  `json:"options"`
+	SelectableCount uint32    `json:"selectable_count"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// PollRequest is a poll to send through /api/send
+type PollRequest struct {
+	Name    string   `json:"name"`
+	Options []string `json:"options"`
+	// SelectableCount is how many options a voter may pick, 0 for any number
+	SelectableCount int `json:"selectable_count,omitempty"`
+}
+
+// PollOptionResult is how many voted for one option of a poll, and who
+type PollOptionResult struct {
+	Option string   `json:"option"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters"`
+}
+
+// PollTally is a poll with its current results
+type PollTally struct {
+	Poll
+	Results []PollOptionResult `json:"results"`
+	// TotalVoters counts everyone with at least one option picked
+	TotalVoters int `json:"total_voters"`
+}
+
+// WhatsApp accepts between 2 and 12 options in a poll
+const (
+	minPollOptions = 2
+	maxPollOptions = 12
+)
+
+// errInvalidPoll is returned for a poll WhatsApp wouldn't accept
+var errInvalidPoll = errors.New("invalid poll")
+
+// validate checks that a poll to send has a name and 2 to 12 distinct
+// options, and doesn't allow picking more options than it has
+func (p *PollRequest) validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("%w: name is required", errInvalidPoll)
+	}
+	if len(p.Options) < minPollOptions || len(p.Options) > maxPollOptions {
+		return fmt.Errorf("%w: needs %d to %d options", errInvalidPoll, minPollOptions, maxPollOptions)
+	}
+	seen := make(map[string]bool, len(p.Options))
+	for _, option := range p.Options {
+		if strings.TrimSpace(option) == "" {
+			return fmt.Errorf("%w: options can't be empty", errInvalidPoll)
+		}
+		if seen[option] {
+			return fmt.Errorf("%w: option %q is listed twice", errInvalidPoll, option)
+		}
+		seen[option] = true
+	}
+	if p.SelectableCount < 0 || p.SelectableCount > len(p.Options) {
+		return fmt.Errorf("%w: selectable_count must be between 0 and the number of options", errInvalidPoll)
+	}
+	return nil
+}
+
+// pendingPollVote is a vote that arrived before we had its poll's key. The
+// raw message is kept so decryption can be retried once the poll arrives.
+type pendingPollVote struct {
+	ID        string
+	ChatJID   string
+	PollID    string
+	Sender    string
+	IsFromMe  bool
+	Timestamp time.Time
+	Raw       []byte
+}
+
+// pollCreation returns the poll a message creates, whichever of the poll
+// message versions it uses
+func pollCreation(msg *waE2E.Message) *waE2E.PollCreationMessage {
+	switch {
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage()
+	case msg.GetPollCreationMessageV2() != nil:
+		return msg.GetPollCreationMessageV2()
+	case msg.GetPollCreationMessageV3() != nil:
+		return msg.GetPollCreationMessageV3()
+	case msg.GetPollCreationMessageV5() != nil:
+		return msg.GetPollCreationMessageV5()
+	}
+	return nil
+}
+
+// SavePoll stores a poll, replacing an earlier copy of it
+func (ms *MessageStore) SavePoll(poll *Poll) error {
+	options, err := json.Marshal(poll.Options)
+	if err != nil {
+		return err
+	}
+	_, err = ms.db.Exec(
+		`INSERT OR REPLACE INTO polls (chat_jid, id, sender, question, options, selectable_count, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		poll.ChatJID, poll.ID, poll.Sender, poll.Question, string(options), poll.SelectableCount, poll.Timestamp,
+	)
+	return err
+}
+
+// GetPoll returns a stored poll, or sql.ErrNoRows. With an empty chatJID
+// the poll is looked up by its ID alone.
+func (ms *MessageStore) GetPoll(chatJID, id string) (*Poll, error) {
+	query := "SELECT chat_jid, id, sender, question, options, selectable_count, timestamp FROM polls WHERE id = ?"
+	args := []any{id}
+	if chatJID != "" {
+		query += " AND chat_jid = ?"
+		args = append(args, chatJID)
+	}
+	query += " ORDER BY timestamp DESC LIMIT 1"
+
+	var poll Poll
+	var options string
+	err := ms.db.QueryRow(query, args...).Scan(
+		&poll.ChatJID, &poll.ID, &poll.Sender, &poll.Question, &options, &poll.SelectableCount, &poll.Timestamp,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(options), &poll.Options); err != nil {
+		return nil, err
+	}
+	return &poll, nil
+}
+
+// GetPollVotes returns each voter's current choice in a poll
+func (ms *MessageStore) GetPollVotes(chatJID, pollID string) (map[string][]string, error) {
+	rows, err := ms.db.Query(
+		"SELECT voter, options FROM poll_votes WHERE chat_jid = ? AND poll_id = ? ORDER BY timestamp",
+		chatJID, pollID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	votes := make(map[string][]string)
+	for rows.Next() {
+		var voter, raw string
+		if err := rows.Scan(&voter, &raw); err != nil {
+			return nil, err
+		}
+		var options []string
+		if err := json.Unmarshal([]byte(raw), &options); err != nil {
+			return nil, err
+		}
+		votes[voter] = options
+	}
+	return votes, rows.Err()
+}
+
+// GetPollOptions returns the option names of a stored poll, or nil if the
+// poll isn't stored
+func (ms *MessageStore) GetPollOptions(chatJID, pollID string) ([]string, error) {
+	var raw string
+	err := ms.db.QueryRow("SELECT options FROM polls WHERE chat_jid = ? AND id = ?", chatJID, pollID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var options []string
+	if err := json.Unmarshal([]byte(raw), &options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// SavePollVote stores a voter's current choice in a poll. A vote replaces
+// the voter's earlier ones, unless it's older than the stored vote.
+func (ms *MessageStore) SavePollVote(chatJID, pollID, voter string, options []string, timestamp time.Time) error {
+	selected, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	_, err = ms.db.Exec(
+		`INSERT INTO poll_votes (chat_jid, poll_id, voter, options, timestamp) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(chat_jid, poll_id, voter) DO UPDATE SET options = excluded.options, timestamp = excluded.timestamp
+		WHERE excluded.timestamp >= poll_votes.timestamp`,
+		chatJID, pollID, voter, string(selected), timestamp,
+	)
+	return err
+}
+
+// SavePendingPollVote stores a vote that can't be decrypted yet
+func (ms *MessageStore) SavePendingPollVote(vote *pendingPollVote) error {
+	_, err := ms.db.Exec(
+		`INSERT OR REPLACE INTO pending_poll_votes (chat_jid, id, poll_id, sender, is_from_me, timestamp, raw)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		vote.ChatJID, vote.ID, vote.PollID, vote.Sender, vote.IsFromMe, vote.Timestamp, vote.Raw,
+	)
+	return err
+}
+
+// GetPendingPollVotes returns the undecrypted votes in a poll, oldest first
+func (ms *MessageStore) GetPendingPollVotes(chatJID, pollID string) ([]*pendingPollVote, error) {
+	rows, err := ms.db.Query(
+		`SELECT chat_jid, id, poll_id, sender, is_from_me, timestamp, raw
+		FROM pending_poll_votes WHERE chat_jid = ? AND poll_id = ? ORDER BY timestamp`,
+		chatJID, pollID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var votes []*pendingPollVote
+	for rows.Next() {
+		var vote pendingPollVote
+		if err := rows.Scan(&vote.ChatJID, &vote.ID, &vote.PollID, &vote.Sender, &vote.IsFromMe, &vote.Timestamp, &vote.Raw); err != nil {
+			return nil, err
+		}
+		votes = append(votes, &vote)
+	}
+	return votes, rows.Err()
+}
+
+// DeletePendingPollVote removes a vote once it has been decrypted
+func (ms *MessageStore) DeletePendingPollVote(chatJID, id string) error {
+	_, err := ms.db.Exec("DELETE FROM pending_poll_votes WHERE chat_jid = ? AND id = ?", chatJID, id)
+	return err
+}
+
+// pollOptionNames maps the option hashes of a vote to the poll's option
+// names. Hashes of options we don't know are kept in hex.
+func pollOptionNames(options []string, hashes [][]byte) []string {
+	byHash := make(map[string]string, len(options))
+	for _, option := range options {
+		hash := sha256.Sum256([]byte(option))
+		byHash[string(hash[:])] = option
+	}
+
+	names := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		if name, ok := byHash[string(hash)]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, hex.EncodeToString(hash))
+		}
+	}
+	return names
+}
+
+// storePollVote records a decrypted vote under the poll's option names
+func storePollVote(messageStore *MessageStore, chatJID, pollID string, voter types.JID, vote *waE2E.PollVoteMessage, timestamp time.Time) error {
+	options, err := messageStore.GetPollOptions(chatJID, pollID)
+	if err != nil {
+		return err
+	}
+	names := pollOptionNames(options, vote.GetSelectedOptions())
+	return messageStore.SavePollVote(chatJID, pollID, voter.ToNonAD().String(), names, timestamp)
+}
+
+// savePoll stores a poll created by a message and decrypts the votes that
+// arrived before it
+func savePoll(client *whatsmeow.Client, messageStore *MessageStore, info *types.MessageInfo, creation *waE2E.PollCreationMessage) {
+	poll := &Poll{
+		ID:              info.ID,
+		ChatJID:         info.Chat.String(),
+		Sender:          info.Sender.ToNonAD().String(),
+		Question:        creation.GetName(),
+		SelectableCount: creation.GetSelectableOptionsCount(),
+		Timestamp:       info.Timestamp,
+	}
+	for _, option := range creation.GetOptions() {
+		poll.Options = append(poll.Options, option.GetOptionName())
+	}
+	if err := messageStore.SavePoll(poll); err != nil {
+		log.Printf("Failed to save poll %s: %v", poll.ID, err)
+		return
+	}
+	retryPendingPollVotes(client, messageStore, poll.ChatJID, poll.ID)
+}
+
+// handlePollVote decrypts and stores an incoming vote. Votes in polls whose
+// key we don't have yet, e.g. polls created before the bridge was paired,
+// are stored encrypted until the poll arrives through history sync.
+func handlePollVote(client *whatsmeow.Client, messageStore *MessageStore, v *events.Message) {
+	pollID := v.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetID()
+	if pollID == "" {
+		return
+	}
+
+	vote, err := client.DecryptPollVote(context.Background(), v)
+	if errors.Is(err, whatsmeow.ErrOriginalMessageSecretNotFound) {
+		raw, err := proto.Marshal(v.Message)
+		if err != nil {
+			log.Printf("Failed to encode poll vote %s: %v", v.Info.ID, err)
+			return
+		}
+		pending := &pendingPollVote{
+			ID:        v.Info.ID,
+			ChatJID:   v.Info.Chat.String(),
+			PollID:    pollID,
+			Sender:    v.Info.Sender.String(),
+			IsFromMe:  v.Info.IsFromMe,
+			Timestamp: v.Info.Timestamp,
+			Raw:       raw,
+		}
+		if err := messageStore.SavePendingPollVote(pending); err != nil {
+			log.Printf("Failed to save pending poll vote %s: %v", v.Info.ID, err)
+		}
+		return
+	} else if err != nil {
+		log.Printf("Failed to decrypt poll vote %s: %v", v.Info.ID, err)
+		return
+	}
+
+	if err := storePollVote(messageStore, v.Info.Chat.String(), pollID, v.Info.Sender, vote, v.Info.Timestamp); err != nil {
+		log.Printf("Failed to save poll vote %s: %v", v.Info.ID, err)
+	}
+}
+
+// retryPendingPollVotes decrypts the stored votes of a poll whose key has
+// just become available
+func retryPendingPollVotes(client *whatsmeow.Client, messageStore *MessageStore, chatJID, pollID string) {
+	pending, err := messageStore.GetPendingPollVotes(chatJID, pollID)
+	if err != nil {
+		log.Printf("Failed to load pending votes of poll %s: %v", pollID, err)
+		return
+	}
+
+	for _, p := range pending {
+		evt, err := p.event()
+		if err != nil {
+			log.Printf("Failed to decode pending poll vote %s: %v", p.ID, err)
+			continue
+		}
+		vote, err := client.DecryptPollVote(context.Background(), evt)
+		if errors.Is(err, whatsmeow.ErrOriginalMessageSecretNotFound) {
+			continue
+		} else if err != nil {
+			// The vote will never decrypt, so there's no point keeping it
+			log.Printf("Failed to decrypt pending poll vote %s: %v", p.ID, err)
+		} else if err := storePollVote(messageStore, chatJID, pollID, evt.Info.Sender, vote, p.Timestamp); err != nil {
+			log.Printf("Failed to save poll vote %s: %v", p.ID, err)
+			continue
+		}
+		if err := messageStore.DeletePendingPollVote(chatJID, p.ID); err != nil {
+			log.Printf("Failed to delete pending poll vote %s: %v", p.ID, err)
+		}
+	}
+}
+
+// event rebuilds the message event a pending vote arrived in
+func (p *pendingPollVote) event() (*events.Message, error) {
+	chat, err := types.ParseJID(p.ChatJID)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := types.ParseJID(p.Sender)
+	if err != nil {
+		return nil, err
+	}
+	var msg waE2E.Message
+	if err := proto.Unmarshal(p.Raw, &msg); err != nil {
+		return nil, err
+	}
+	return &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:     chat,
+				Sender:   sender,
+				IsFromMe: p.IsFromMe,
+				IsGroup:  classifyJID(chat) == jidGroup,
+			},
+			ID:        p.ID,
+			Timestamp: p.Timestamp,
+		},
+		Message: &msg,
+	}, nil
+}
+
+// saveHistoryPoll stores a poll from history sync along with the votes the
+// sync carries, which WhatsApp sends already decrypted
+func saveHistoryPoll(client *whatsmeow.Client, messageStore *MessageStore, chat types.JID, msg *Message, webMsg *waWeb.WebMessageInfo) {
+	creation := pollCreation(webMsg.GetMessage())
+	if creation == nil {
+		return
+	}
+	sender, err := types.ParseJID(msg.Sender)
+	if err != nil {
+		return
+	}
+	info := &types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsFromMe: msg.IsFromMe},
+		ID:            msg.ID,
+		Timestamp:     msg.Timestamp,
+	}
+	savePoll(client, messageStore, info, creation)
+
+	for _, update := range webMsg.GetPollUpdates() {
+		voter, ok := historyVoter(client, chat, update.GetPollUpdateMessageKey().GetFromMe(), update.GetPollUpdateMessageKey().GetParticipant())
+		if !ok {
+			continue
+		}
+		timestamp := time.UnixMilli(update.GetSenderTimestampMS())
+		if err := storePollVote(messageStore, chat.String(), msg.ID, voter, update.GetVote(), timestamp); err != nil {
+			log.Printf("Failed to save history poll vote in %s: %v", msg.ID, err)
+		}
+	}
+}
+
+// historyVoter works out who cast a vote from history sync
+func historyVoter(client *whatsmeow.Client, chat types.JID, fromMe bool, participant string) (types.JID, bool) {
+	switch {
+	case fromMe && client.Store.ID != nil:
+		return *client.Store.ID, true
+	case fromMe:
+		return types.EmptyJID, false
+	case participant != "":
+		jid, err := types.ParseJID(participant)
+		return jid, err == nil
+	}
+	return chat, true
+}
+
+// tallyPoll counts the current votes for each option of a poll. A voter
+// who unpicked everything no longer counts, and picks of options the poll
+// doesn't list are left out.
+func tallyPoll(poll *Poll, votes map[string][]string) *PollTally {
+	tally := &PollTally{Poll: *poll, Results: make([]PollOptionResult, len(poll.Options))}
+	index := make(map[string]int, len(poll.Options))
+	for i, option := range poll.Options {
+		tally.Results[i] = PollOptionResult{Option: option, Voters: []string{}}
+		index[option] = i
+	}
+
+	voters := make([]string, 0, len(votes))
+	for voter := range votes {
+		voters = append(voters, voter)
+	}
+	sort.Strings(voters)
+	for _, voter := range voters {
+		if len(votes[voter]) > 0 {
+			tally.TotalVoters++
+		}
+		for _, option := range votes[voter] {
+			if i, ok := index[option]; ok {
+				tally.Results[i].Votes++
+				tally.Results[i].Voters = append(tally.Results[i].Voters, voter)
+			}
+		}
+	}
+	return tally
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPollVoteDecryptedOncePollArrives(t *testing.T) {
+	ctx := context.Background()
+	ms := newTestStore(t)
+	bridge := newTestClient(t)
+	voter := newTestClientFor(t, "222")
+
+	// The poll was created in a group before the bridge was paired, so only
+	// the voter knows its secret
+	chat := types.NewJID("123-456", types.GroupServer)
+	creator := types.NewJID("333", types.DefaultUserServer)
+	pollInfo := &types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: chat, Sender: creator, IsGroup: true},
+		ID:            "POLL1",
+		Timestamp:     time.Now().Add(-time.Hour),
+	}
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := voter.Store.MsgSecrets.PutMessageSecret(ctx, chat, creator, pollInfo.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	voteMsg, err := voter.BuildPollVote(ctx, pollInfo, []string{"Tuesday"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handlePollVote(bridge, ms, &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: chat, Sender: voter.Store.ID.ToNonAD(), IsGroup: true},
+			ID:            "VOTE1",
+			Timestamp:     time.Now(),
+		},
+		Message: voteMsg,
+	})
+	pending, err := ms.GetPendingPollVotes(chat.String(), pollInfo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].ID != "VOTE1" {
+		t.Fatalf("pending votes = %v, want VOTE1 stored encrypted", pending)
+	}
+
+	// The poll arrives through history sync, and whatsmeow stores its
+	// secret along with it
+	if err := bridge.Store.MsgSecrets.PutMessageSecret(ctx, chat, creator, pollInfo.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	savePoll(bridge, ms, pollInfo, &waE2E.PollCreationMessage{
+		Name: proto.String("Which day?"),
+		Options: []*waE2E.PollCreationMessage_Option{
+			{OptionName: proto.String("Monday")},
+			{OptionName: proto.String("Tuesday")},
+		},
+		SelectableOptionsCount: proto.Uint32(1),
+	})
+
+	votes, err := ms.GetPollVotes(chat.String(), pollInfo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := votes["222@s.whatsapp.net"]; len(got) != 1 || got[0] != "Tuesday" {
+		t.Fatalf("votes = %v, want 222 voting Tuesday", votes)
+	}
+	if pending, _ := ms.GetPendingPollVotes(chat.String(), pollInfo.ID); len(pending) != 0 {
+		t.Fatalf("decrypted vote still pending: %v", pending)
+	}
+}
+
+func TestPollOptionNames(t *testing.T) {
+	options := []string{"Monday", "Tuesday"}
+	hashes := append(whatsmeow.HashPollOptions([]string{"Tuesday"}), []byte{0xab, 0xcd})
+	got := pollOptionNames(options, hashes)
+	if len(got) != 2 || got[0] != "Tuesday" || got[1] != "abcd" {
+		t.Fatalf("pollOptionNames = %v, want [Tuesday abcd]", got)
+	}
+}
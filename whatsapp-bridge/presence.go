@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// ContactPresence is the last known presence of a contact
+type ContactPresence struct {
+	Online bool `json:"online"`
+	// LastSeen is nil when the contact hides their last seen time
+	LastSeen *time.Time `json:"last_seen"`
+}
+
+// SavePresence records a presence update. A nil lastSeen keeps the last
+// time we saw the contact ourselves.
+func (ms *MessageStore) SavePresence(jid string, online bool, lastSeen *time.Time) error {
+	query := `
+	INSERT INTO contact_presence (jid, online, last_seen, updated_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(jid) DO UPDATE SET
+		online = excluded.online,
+		last_seen = COALESCE(excluded.last_seen, contact_presence.last_seen),
+		updated_at = excluded.updated_at
+	`
+	_, err := ms.db.Exec(query, jid, online, lastSeen, time.Now())
+	return err
+}
+
+// GetPresence returns the stored presence of a contact, or nil if we never
+// received any
+func (ms *MessageStore) GetPresence(jid string) (*ContactPresence, error) {
+	var presence ContactPresence
+	var lastSeen sql.NullTime
+	err := ms.db.QueryRow("SELECT online, last_seen FROM contact_presence WHERE jid = ?", jid).Scan(&presence.Online, &lastSeen)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lastSeen.Valid {
+		presence.LastSeen = &lastSeen.Time
+	}
+	return &presence, nil
+}
+
+// handlePresence stores a presence update from a subscribed contact
+func handlePresence(messageStore *MessageStore, v *events.Presence) {
+	var lastSeen *time.Time
+	if !v.Unavailable {
+		// Online right now
+		now := time.Now()
+		lastSeen = &now
+	} else if !v.LastSeen.IsZero() {
+		lastSeen = &v.LastSeen
+	}
+
+	if err := messageStore.SavePresence(v.From.ToNonAD().String(), !v.Unavailable, lastSeen); err != nil {
+		log.Printf("Failed to save presence of %s: %v", v.From, err)
+	}
+}
+
+// presenceSubscriptions tracks which contacts we asked WhatsApp for
+// presence updates on. Subscriptions don't survive a reconnect.
+var presenceSubscriptions = struct {
+	sync.Mutex
+	available  bool
+	subscribed map[types.JID]bool
+}{subscribed: make(map[types.JID]bool)}
+
+// resetPresenceSubscriptions forgets all subscriptions after a disconnect
+func resetPresenceSubscriptions() {
+	presenceSubscriptions.Lock()
+	defer presenceSubscriptions.Unlock()
+	presenceSubscriptions.available = false
+	presenceSubscriptions.subscribed = make(map[types.JID]bool)
+}
+
+// subscribePresence asks WhatsApp for presence updates of a contact unless
+// we already did on this connection
+func subscribePresence(client *whatsmeow.Client, jid types.JID) error {
+	presenceSubscriptions.Lock()
+	defer presenceSubscriptions.Unlock()
+
+	jid = jid.ToNonAD()
+	if presenceSubscriptions.subscribed[jid] {
+		return nil
+	}
+
+	// WhatsApp only sends presence updates to clients that are online themselves
+	if !presenceSubscriptions.available {
+		if err := client.SendPresence(types.PresenceAvailable); err != nil {
+			return err
+		}
+		presenceSubscriptions.available = true
+	}
+
+	if err := client.SubscribePresence(jid); err != nil {
+		return err
+	}
+	presenceSubscriptions.subscribed[jid] = true
+	return nil
+}
+
+// typingBeforeSend shows "typing…" in the chat for a moment before each
+// text message sent through /api/send, so replies don't look instant
+var typingBeforeSend = envBool("THREADSCRIBE_TYPING_BEFORE_SEND", false)
+
+const (
+	// typingPerChar is how long typing a character is made to take before
+	// sending, within typingMin and typingMax
+	typingPerChar = 30 * time.Millisecond
+	typingMin     = 500 * time.Millisecond
+	typingMax     = 3 * time.Second
+)
+
+// SetPresenceRequest is the body of /api/presence
+type SetPresenceRequest struct {
+	// ChatJID is the chat to show typing in, only needed for composing
+	// and paused
+	ChatJID string `json:"chat_jid"`
+	// State is composing, paused, available or unavailable
+	State string `json:"state"`
+}
+
+var (
+	// errInvalidPresenceState is returned for a state /api/presence doesn't know
+	errInvalidPresenceState = errors.New("state must be composing, paused, available or unavailable")
+	// errPresenceNeedsChat is returned for typing states without a chat
+	errPresenceNeedsChat = errors.New("chat_jid is required for composing and paused")
+)
+
+// validatePresenceState checks a state of /api/presence and that typing
+// states come with a chat
+func validatePresenceState(chat types.JID, state string) error {
+	switch state {
+	case string(types.ChatPresenceComposing), string(types.ChatPresencePaused):
+		if chat.IsEmpty() {
+			return errPresenceNeedsChat
+		}
+		return nil
+	case string(types.PresenceAvailable), string(types.PresenceUnavailable):
+		return nil
+	}
+	return errInvalidPresenceState
+}
+
+// sendPresenceState shows us typing or having stopped in a chat, or online
+// or offline to everyone. Going offline also stops the presence updates of
+// subscribed contacts, since WhatsApp only sends them to online clients.
+func sendPresenceState(client *whatsmeow.Client, chat types.JID, state string) error {
+	if err := validatePresenceState(chat, state); err != nil {
+		return err
+	}
+	switch state {
+	case string(types.ChatPresenceComposing), string(types.ChatPresencePaused):
+		return client.SendChatPresence(chat, types.ChatPresence(state), types.ChatPresenceMediaText)
+	default:
+		presenceSubscriptions.Lock()
+		defer presenceSubscriptions.Unlock()
+		if err := client.SendPresence(types.Presence(state)); err != nil {
+			return err
+		}
+		presenceSubscriptions.available = state == string(types.PresenceAvailable)
+		return nil
+	}
+}
+
+// typingDelay is how long typing text is made to take
+func typingDelay(text string) time.Duration {
+	return min(max(time.Duration(len([]rune(text)))*typingPerChar, typingMin), typingMax)
+}
+
+// showTyping shows us typing text in a chat and waits as long as that
+// would take. Sending the message afterwards ends the typing. Failures
+// are only logged, the message is sent regardless.
+func showTyping(client *whatsmeow.Client, chat types.JID, text string) {
+	if err := client.SendChatPresence(chat, types.ChatPresenceComposing, types.ChatPresenceMediaText); err != nil {
+		log.Printf("Failed to show typing in %s: %v", chat, err)
+		return
+	}
+	time.Sleep(typingDelay(text))
+}
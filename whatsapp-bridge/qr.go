@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/skip2/go-qrcode"
+	"go.mau.fi/whatsmeow"
+)
+
+// qrTerminal also prints pairing codes to stdout, for headless setups
+// where qr.png can't easily be fetched
+var qrTerminal = flag.Bool("qr-terminal", envBool("THREADSCRIBE_QR_TERMINAL", false),
+	"also print the pairing QR code to the terminal (or set THREADSCRIBE_QR_TERMINAL=true)")
+
+const (
+	minQRSize     = 128
+	maxQRSize     = 2048
+	defaultQRSize = 256
+)
+
+// qrLevels maps THREADSCRIBE_QR_LEVEL values to error correction levels.
+// Higher levels survive glare and poor cameras better but make denser codes.
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"low":     qrcode.Low,
+	"l":       qrcode.Low,
+	"medium":  qrcode.Medium,
+	"m":       qrcode.Medium,
+	"high":    qrcode.High,
+	"q":       qrcode.High,
+	"highest": qrcode.Highest,
+	"h":       qrcode.Highest,
+}
+
+// qrSize and qrLevel configure qr.png, falling back to 256 pixels and
+// medium error correction
+var (
+	qrSize  = loadQRSize()
+	qrLevel = loadQRLevel()
+)
+
+// loadQRSize reads THREADSCRIBE_QR_SIZE, the width of qr.png in pixels
+func loadQRSize() int {
+	size := envInt("THREADSCRIBE_QR_SIZE", defaultQRSize)
+	if size < minQRSize || size > maxQRSize {
+		log.Printf("Ignoring THREADSCRIBE_QR_SIZE=%d, it must be between %d and %d", size, minQRSize, maxQRSize)
+		return defaultQRSize
+	}
+	return size
+}
+
+// loadQRLevel reads THREADSCRIBE_QR_LEVEL, the QR error correction level
+func loadQRLevel() qrcode.RecoveryLevel {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("THREADSCRIBE_QR_LEVEL")))
+	if value == "" {
+		return qrcode.Medium
+	}
+	level, ok := qrLevels[value]
+	if !ok {
+		log.Printf("Ignoring invalid THREADSCRIBE_QR_LEVEL=%q, use low, medium, high or highest", value)
+		return qrcode.Medium
+	}
+	return level
+}
+
+// qrFile is where the current pairing code is written for people to scan
+const qrFile = "qr.png"
+
+// qrManager owns the pairing flow: the whatsmeow QR channel, qr.png and the
+// current code. Only its run goroutine touches them, everything else asks it
+// to start or clear a flow, so two flows can never write qr.png at once.
+type qrManager struct {
+	requests chan qrRequest
+
+	mu  sync.Mutex
+	png []byte
+}
+
+// qrRequest asks the manager to start a pairing flow, or to drop the
+// current one when clear is set
+type qrRequest struct {
+	flow         string
+	getQRChannel func(context.Context) (<-chan whatsmeow.QRChannelItem, error)
+	// connect is called once the channel is open, nil when the caller
+	// connects by itself
+	connect func() error
+	// done is called when the flow ends or couldn't start
+	done  func()
+	clear bool
+}
+
+// newQRManager starts the goroutine that runs pairing flows
+func newQRManager() *qrManager {
+	m := &qrManager{requests: make(chan qrRequest, 8)}
+	go m.run()
+	return m
+}
+
+// Start asks for a new pairing flow. It's skipped while another flow is
+// still rotating codes, since that one already shows a valid code.
+func (m *qrManager) Start(flow string, getQRChannel func(context.Context) (<-chan whatsmeow.QRChannelItem, error), connect func() error, done func()) {
+	m.requests <- qrRequest{flow: flow, getQRChannel: getQRChannel, connect: connect, done: done}
+}
+
+// Clear removes the current code, e.g. after logging out
+func (m *qrManager) Clear() {
+	m.requests <- qrRequest{clear: true}
+}
+
+// PNG returns the current code as a PNG image, or nil when there is none
+func (m *qrManager) PNG() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.png
+}
+
+func (m *qrManager) run() {
+	var active <-chan whatsmeow.QRChannelItem
+	var flow string
+	var done func()
+	finish := func() {
+		active = nil
+		m.setCode("")
+		if done != nil {
+			done()
+			done = nil
+		}
+	}
+
+	for {
+		select {
+		case req := <-m.requests:
+			if req.clear {
+				finish()
+				continue
+			}
+			if active != nil {
+				log.Printf("Skipping QR %s, the %s flow is still running", req.flow, flow)
+				if req.done != nil {
+					req.done()
+				}
+				continue
+			}
+			qrChan, ok := openQRChannel(req.getQRChannel, req.flow)
+			if !ok {
+				if req.done != nil {
+					req.done()
+				}
+				continue
+			}
+			if req.connect != nil {
+				if err := req.connect(); err != nil {
+					log.Printf("Failed to connect during %s: %v", req.flow, err)
+					if req.done != nil {
+						req.done()
+					}
+					continue
+				}
+			}
+			active, flow, done = qrChan, req.flow, req.done
+
+		case evt, ok := <-active:
+			if !ok {
+				finish()
+				continue
+			}
+			switch evt.Event {
+			case whatsmeow.QRChannelEventCode:
+				fmt.Printf("\nScan this QR code with your WhatsApp app (%s):\n", flow)
+				m.setCode(evt.Code)
+			case whatsmeow.QRChannelSuccess.Event:
+				fmt.Println("\nSuccessfully connected!")
+			default:
+				log.Printf("QR %s ended: %s", flow, evt.Event)
+			}
+		}
+	}
+}
+
+// setCode writes a pairing code to qr.png, replacing the previous one, and
+// prints it to the terminal when -qr-terminal is set. WhatsApp rotates the
+// code every 20 seconds or so, so this is called for each new one. An
+// empty code removes qr.png.
+func (m *qrManager) setCode(code string) {
+	var png []byte
+	if code != "" {
+		var err error
+		png, err = qrcode.Encode(code, qrLevel, qrSize)
+		if err != nil {
+			log.Printf("Failed to render QR code: %v", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.png = png
+	m.mu.Unlock()
+
+	if png == nil {
+		os.Remove(qrFile)
+		return
+	}
+	// Write a temporary file and rename it over qr.png, so readers never
+	// see a half written image
+	tmp := qrFile + ".tmp"
+	if err := os.WriteFile(tmp, png, 0644); err != nil {
+		log.Printf("Failed to write QR code: %v", err)
+	} else if err := os.Rename(tmp, qrFile); err != nil {
+		log.Printf("Failed to write QR code: %v", err)
+	} else {
+		fmt.Println("QR code saved as qr.png")
+	}
+
+	if *qrTerminal {
+		printQRCode(code)
+	}
+}
+
+// printQRCode renders a code with half block characters, two modules per
+// character row, so it fits a regular terminal
+func printQRCode(code string) {
+	qr, err := qrcode.New(code, qrLevel)
+	if err != nil {
+		log.Printf("Failed to render QR code: %v", err)
+		return
+	}
+	fmt.Println(qr.ToSmallString(false))
+}
+
+// openQRChannel gets the channel of pairing codes for a QR flow. When
+// whatsmeow refuses, e.g. because the device is already paired or
+// connected, the failure is logged and ok is false so the flow is skipped
+// instead of ranging over a nil channel forever.
+func openQRChannel(getQRChannel func(context.Context) (<-chan whatsmeow.QRChannelItem, error), flow string) (qrChan <-chan whatsmeow.QRChannelItem, ok bool) {
+	qrChan, err := getQRChannel(context.Background())
+	if err != nil {
+		log.Printf("Failed to get QR channel for %s: %v", flow, err)
+		return nil, false
+	}
+	return qrChan, true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+func TestQRFlowAbortsWhenGetQRChannelFails(t *testing.T) {
+	inTempDir(t)
+	m := newQRManager()
+	isReconnecting.Store(true)
+	done := make(chan struct{})
+	m.Start("reconnection", func(context.Context) (<-chan whatsmeow.QRChannelItem, error) {
+		return nil, whatsmeow.ErrQRStoreContainsID
+	}, func() error {
+		t.Error("connected although the QR channel couldn't be opened")
+		return nil
+	}, func() {
+		isReconnecting.Store(false)
+		close(done)
+	})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("QR flow didn't end after GetQRChannel failed")
+	}
+	if isReconnecting.Load() {
+		t.Error("reconnection still claimed after the QR flow was aborted")
+	}
+	if m.PNG() != nil {
+		t.Error("QR code shown although the flow was aborted")
+	}
+
+	// The manager is free to run the next flow
+	next := make(chan whatsmeow.QRChannelItem, 1)
+	next <- whatsmeow.QRChannelItem{Event: whatsmeow.QRChannelEventCode, Code: "2@abc,def,ghi"}
+	m.Start("retry", func(context.Context) (<-chan whatsmeow.QRChannelItem, error) { return next, nil }, nil, nil)
+	// Wait for the file rather than the code, which is set before the file
+	// is written
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := os.Stat(qrFile); err != nil; _, err = os.Stat(qrFile) {
+		if time.Now().After(deadline) {
+			t.Fatal("next QR flow didn't show a code")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQRFlowAbortsWhenConnectFails(t *testing.T) {
+	inTempDir(t)
+	m := newQRManager()
+	done := make(chan struct{})
+	m.Start("login", func(context.Context) (<-chan whatsmeow.QRChannelItem, error) {
+		return make(chan whatsmeow.QRChannelItem), nil
+	}, func() error {
+		return errors.New("dial tcp: network is unreachable")
+	}, func() { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("QR flow didn't end after connecting failed")
+	}
+}
+
+// TestQRManagerConcurrentFlows starts, clears and reads QR flows from many
+// goroutines at once. Run it with -race: only the manager's goroutine may
+// touch the flow state and qr.png.
+func TestQRManagerConcurrentFlows(t *testing.T) {
+	inTempDir(t)
+	m := newQRManager()
+
+	var wg sync.WaitGroup
+	var finished atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			codes := make(chan whatsmeow.QRChannelItem, 2)
+			codes <- whatsmeow.QRChannelItem{Event: whatsmeow.QRChannelEventCode, Code: fmt.Sprintf("2@code%d", i)}
+			close(codes)
+			m.Start(fmt.Sprintf("flow %d", i), func(context.Context) (<-chan whatsmeow.QRChannelItem, error) {
+				return codes, nil
+			}, nil, func() { finished.Add(1) })
+		}()
+		go func() {
+			defer wg.Done()
+			m.Clear()
+		}()
+		go func() {
+			defer wg.Done()
+			m.PNG()
+		}()
+	}
+	wg.Wait()
+
+	// Every flow ends, whether it ran or was skipped for another one
+	deadline := time.Now().Add(5 * time.Second)
+	for finished.Load() != 20 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 20 flows ended", finished.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Requests are handled in order, so once this one is done the Clear
+	// calls are too, and nothing touches qr.png after the test
+	barrier := make(chan struct{})
+	m.Start("barrier", func(context.Context) (<-chan whatsmeow.QRChannelItem, error) {
+		return nil, errors.New("barrier")
+	}, nil, func() { close(barrier) })
+	<-barrier
+}
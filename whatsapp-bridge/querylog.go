@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// loggedDB wraps the message database to log queries slower than a
+// threshold, so slow spots show up without attaching a profiler.
+// Statements run inside transactions aren't timed.
+type loggedDB struct {
+	*sql.DB
+	slowThreshold time.Duration
+}
+
+// loadSlowQueryThreshold reads THREADSCRIBE_SLOW_QUERY_MS, 0 disabling the log
+func loadSlowQueryThreshold() time.Duration {
+	return time.Duration(envInt("THREADSCRIBE_SLOW_QUERY_MS", 500)) * time.Millisecond
+}
+
+// logIfSlow logs a query that took longer than the threshold
+func (db *loggedDB) logIfSlow(start time.Time, query string, args []interface{}) {
+	elapsed := time.Since(start)
+	if db.slowThreshold > 0 && elapsed >= db.slowThreshold {
+		log.Printf("WARN slow query (%s): %s args=%v", elapsed.Round(time.Millisecond), query, args)
+	}
+}
+
+func (db *loggedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer db.logIfSlow(time.Now(), query, args)
+	return db.DB.Exec(query, args...)
+}
+
+func (db *loggedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	defer db.logIfSlow(time.Now(), query, args)
+	return db.DB.Query(query, args...)
+}
+
+func (db *loggedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer db.logIfSlow(time.Now(), query, args)
+	return db.DB.QueryRow(query, args...)
+}
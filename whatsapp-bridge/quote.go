@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+// errQuotedNotFound is returned when a reply quotes a message that isn't
+// stored in the chat
+var errQuotedNotFound = errors.New("quoted message not found in this chat")
+
+// quoteContextInfo builds the ContextInfo that makes a message a reply to
+// quoted. StanzaID and Participant tell WhatsApp which message is meant,
+// QuotedMessage is the preview shown above the reply.
+func quoteContextInfo(quoted *Message) *waE2E.ContextInfo {
+	return &waE2E.ContextInfo{
+		StanzaID:      proto.String(quoted.ID),
+		Participant:   proto.String(quoted.Sender),
+		QuotedMessage: quotedPreview(quoted),
+	}
+}
+
+// quotedPreview rebuilds enough of a stored message to show it in a quote.
+// Only the text and the kind of media are kept, the media itself isn't
+// needed for the preview.
+func quotedPreview(quoted *Message) *waE2E.Message {
+	var mimeType *string
+	if quoted.MimeType != "" {
+		mimeType = proto.String(quoted.MimeType)
+	}
+	switch quoted.MediaType {
+	case "image":
+		return &waE2E.Message{ImageMessage: &waE2E.ImageMessage{Caption: proto.String(quoted.Content), Mimetype: mimeType}}
+	case "video":
+		return &waE2E.Message{VideoMessage: &waE2E.VideoMessage{Caption: proto.String(quoted.Content), Mimetype: mimeType}}
+	case "audio":
+		return &waE2E.Message{AudioMessage: &waE2E.AudioMessage{Mimetype: mimeType}}
+	case "document":
+		return &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{FileName: proto.String(quoted.Filename), Mimetype: mimeType}}
+	case "sticker":
+		return &waE2E.Message{StickerMessage: &waE2E.StickerMessage{Mimetype: mimeType}}
+	}
+	return &waE2E.Message{Conversation: proto.String(quoted.Content)}
+}
+
+// applyQuote turns an outgoing text or media message into a reply to quoted
+func applyQuote(msg *waE2E.Message, quoted *Message) {
+	contextInfo := outgoingContextInfo(msg)
+	if contextInfo == nil {
+		return
+	}
+	quote := quoteContextInfo(quoted)
+	contextInfo.StanzaID = quote.StanzaID
+	contextInfo.Participant = quote.Participant
+	contextInfo.QuotedMessage = quote.QuotedMessage
+}
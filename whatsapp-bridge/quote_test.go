@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestQuoteContextInfoFromStoredMessage(t *testing.T) {
+	ms := newTestStore(t)
+	original := testMessage("3EB0AAA", "are we still on for friday?", time.Now())
+	original.ChatJID = "120363000000000001@g.us"
+	original.Sender = "222@s.whatsapp.net"
+	if err := ms.SaveMessage(original); err != nil {
+		t.Fatal(err)
+	}
+	quoted, err := ms.GetMessage(original.ChatJID, original.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contextInfo := quoteContextInfo(quoted)
+	if contextInfo.GetStanzaID() != "3EB0AAA" {
+		t.Errorf("StanzaID = %q, want 3EB0AAA", contextInfo.GetStanzaID())
+	}
+	if contextInfo.GetParticipant() != "222@s.whatsapp.net" {
+		t.Errorf("Participant = %q, want the sender of the quoted message", contextInfo.GetParticipant())
+	}
+	if got := contextInfo.GetQuotedMessage().GetConversation(); got != original.Content {
+		t.Errorf("quoted text = %q, want %q", got, original.Content)
+	}
+}
+
+func TestQuotedPreviewOfMedia(t *testing.T) {
+	image := quotedPreview(&Message{MediaType: "image", Content: "sunset", MimeType: "image/jpeg"})
+	if image.GetImageMessage().GetCaption() != "sunset" || image.GetImageMessage().GetMimetype() != "image/jpeg" {
+		t.Errorf("image preview = %v", image)
+	}
+	doc := quotedPreview(&Message{MediaType: "document", Filename: "invoice.pdf"})
+	if doc.GetDocumentMessage().GetFileName() != "invoice.pdf" {
+		t.Errorf("document preview = %v", doc)
+	}
+	if audio := quotedPreview(&Message{MediaType: "audio"}); audio.GetAudioMessage() == nil {
+		t.Errorf("audio preview = %v", audio)
+	}
+}
+
+func TestApplyQuote(t *testing.T) {
+	quoted := &Message{ID: "3EB0AAA", Sender: "222@s.whatsapp.net", Content: "hello"}
+
+	// Plain text becomes an extended text message to carry the quote
+	text := &waE2E.Message{Conversation: proto.String("hi back")}
+	applyQuote(text, quoted)
+	if text.Conversation != nil || text.GetExtendedTextMessage().GetText() != "hi back" {
+		t.Fatalf("text reply = %v, want an extended text message", text)
+	}
+	if got := text.GetExtendedTextMessage().GetContextInfo().GetStanzaID(); got != "3EB0AAA" {
+		t.Errorf("text reply quotes %q, want 3EB0AAA", got)
+	}
+
+	// Media keeps what's already in its context info
+	image := &waE2E.Message{ImageMessage: &waE2E.ImageMessage{
+		Caption:     proto.String("look"),
+		ContextInfo: &waE2E.ContextInfo{MentionedJID: []string{"333@s.whatsapp.net"}},
+	}}
+	applyQuote(image, quoted)
+	contextInfo := image.GetImageMessage().GetContextInfo()
+	if contextInfo.GetStanzaID() != "3EB0AAA" || contextInfo.GetParticipant() != "222@s.whatsapp.net" ||
+		contextInfo.GetQuotedMessage().GetConversation() != "hello" {
+		t.Errorf("image reply context = %v", contextInfo)
+	}
+	if len(contextInfo.GetMentionedJID()) != 1 {
+		t.Errorf("image reply lost its mentions: %v", contextInfo)
+	}
+}
+
+func TestSendQuotingUnknownMessage(t *testing.T) {
+	client := newTestClient(t)
+	ms := newTestStore(t)
+	chat := types.NewJID("222", types.DefaultUserServer)
+	elsewhere := testMessage("3EB0AAA", "in another chat", time.Now())
+	if err := ms.SaveMessage(elsewhere); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"3EB0MISSING", elsewhere.ID} {
+		req := &SendMessageRequest{Message: "reply", QuotedMessageID: id}
+		_, _, err := sendWhatsAppMessage(client, ms, chat, req)
+		if !errors.Is(err, errQuotedNotFound) {
+			t.Fatalf("quoting %s: error = %v, want errQuotedNotFound", id, err)
+		}
+		if code := sendStatusCode(err); code != http.StatusNotFound {
+			t.Errorf("quoting %s: status = %d, want 404", id, code)
+		}
+	}
+	if messages, err := ms.GetMessages(chat.String(), MessageQuery{}); err != nil || len(messages) != 0 {
+		t.Errorf("failed replies were stored: %v, %v", messages, err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// ReactionSummary aggregates the reactions to a message
+type ReactionSummary struct {
+	// Counts is how many people reacted with each emoji
+	Counts map[string]int `json:"counts"`
+	// MyReaction is our own reaction, empty if we haven't reacted
+	MyReaction string `json:"my_reaction,omitempty"`
+	// List has each reaction on its own, oldest first
+	List []Reaction `json:"list"`
+}
+
+// Reaction is one person's reaction to a message
+type Reaction struct {
+	Sender    string    `json:"sender"`
+	Emoji     string    `json:"emoji"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// SaveReaction records sender's reaction to a message. Everyone has at most
+// one reaction per message, and an empty emoji removes it.
+func (ms *MessageStore) SaveReaction(chatJID, targetID, sender, emoji string, timestamp time.Time) error {
+	if emoji == "" {
+		_, err := ms.db.Exec("DELETE FROM reactions WHERE chat_jid = ? AND target_message_id = ? AND sender = ?",
+			chatJID, targetID, sender)
+		return err
+	}
+	_, err := ms.db.Exec(
+		`INSERT INTO reactions (chat_jid, target_message_id, sender, emoji, timestamp) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(chat_jid, target_message_id, sender) DO UPDATE SET emoji = excluded.emoji, timestamp = excluded.timestamp
+		WHERE excluded.timestamp >= reactions.timestamp`,
+		chatJID, targetID, sender, emoji, timestamp,
+	)
+	return err
+}
+
+// GetReactionSummaries gathers the reactions to every message of a chat
+// in one query, keyed by message ID. Reactions by any of ownJIDs are
+// reported as ours.
+func (ms *MessageStore) GetReactionSummaries(chatJID string, ownJIDs []string) (map[string]*ReactionSummary, error) {
+	rows, err := ms.db.Query(
+		"SELECT target_message_id, sender, emoji, timestamp FROM reactions WHERE chat_jid = ? ORDER BY timestamp",
+		chatJID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mine := make(map[string]bool, len(ownJIDs))
+	for _, jid := range ownJIDs {
+		mine[jid] = true
+	}
+
+	summaries := make(map[string]*ReactionSummary)
+	for rows.Next() {
+		var targetID string
+		var reaction Reaction
+		if err := rows.Scan(&targetID, &reaction.Sender, &reaction.Emoji, &reaction.Timestamp); err != nil {
+			return nil, err
+		}
+		summary := summaries[targetID]
+		if summary == nil {
+			summary = &ReactionSummary{Counts: make(map[string]int)}
+			summaries[targetID] = summary
+		}
+		summary.Counts[reaction.Emoji]++
+		summary.List = append(summary.List, reaction)
+		if mine[reaction.Sender] {
+			summary.MyReaction = reaction.Emoji
+		}
+	}
+	return summaries, rows.Err()
+}
+
+// handleReaction stores a reaction someone sent, or removes it when its
+// text is empty. Our own reactions from other devices arrive here too.
+func handleReaction(messageStore *MessageStore, v *events.Message, reaction *waE2E.ReactionMessage) {
+	targetID := reaction.GetKey().GetID()
+	if targetID == "" {
+		return
+	}
+	timestamp := v.Info.Timestamp
+	if ms := reaction.GetSenderTimestampMS(); ms > 0 {
+		timestamp = time.UnixMilli(ms)
+	}
+	err := messageStore.SaveReaction(v.Info.Chat.String(), targetID, v.Info.Sender.ToNonAD().String(), reaction.GetText(), timestamp)
+	if err != nil {
+		log.Printf("Failed to save reaction to message %s: %v", targetID, err)
+	}
+}
+
+// ownJIDs returns the JIDs our own reactions can be stored under: our phone
+// number and, once known, our LID
+func ownJIDs(client *whatsmeow.Client) []string {
+	if client.Store.ID == nil {
+		return nil
+	}
+	jids := []string{client.Store.ID.ToNonAD().String()}
+	if !client.Store.LID.IsEmpty() {
+		jids = append(jids, client.Store.LID.ToNonAD().String())
+	}
+	return jids
+}
+
+// sendReaction reacts to the message id from sender with emoji, or removes
+// our reaction if emoji is empty, and stores the reaction as ours so it's
+// still known after a restart
+func sendReaction(client *whatsmeow.Client, messageStore *MessageStore, chat, sender types.JID, id types.MessageID, emoji string) (whatsmeow.SendResponse, error) {
+	resp, err := client.SendMessage(context.Background(), chat, client.BuildReaction(chat, sender, id, emoji))
+	if err != nil {
+		return resp, err
+	}
+	me := client.Store.ID.ToNonAD().String()
+	if err := messageStore.SaveReaction(chat.String(), id, me, emoji, resp.Timestamp); err != nil {
+		log.Printf("Failed to save reaction to message %s: %v", id, err)
+	}
+	return resp, nil
+}
+
+// setReactions fills in the reactions of messages from the same chat
+func setReactions(messageStore *MessageStore, chatJID string, messages []*Message, ownJIDs []string) error {
+	summaries, err := messageStore.GetReactionSummaries(chatJID, ownJIDs)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		msg.Reactions = summaries[msg.ID]
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReactionSummaries(t *testing.T) {
+	ms := newTestStore(t)
+	ts := time.Now().Truncate(time.Second)
+	first := testMessage("MSG1", "hello", ts)
+	second := testMessage("MSG2", "no reactions", ts.Add(time.Second))
+	for _, msg := range []*Message{first, second} {
+		if err := ms.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	me, lid := "999@s.whatsapp.net", "12345@lid"
+	reactions := []struct {
+		sender string
+		emoji  string
+		at     time.Duration
+	}{
+		{"222@s.whatsapp.net", "👍", time.Minute},
+		{"333@s.whatsapp.net", "👍", time.Minute},
+		{"444@s.whatsapp.net", "❤️", time.Minute},
+		{me, "😂", time.Minute},
+		// Reacting again replaces the earlier reaction
+		{me, "👍", 2 * time.Minute},
+		// An older reaction arriving late doesn't
+		{"444@s.whatsapp.net", "😮", 30 * time.Second},
+		// An empty emoji takes the reaction back
+		{"555@s.whatsapp.net", "🙏", time.Minute},
+		{"555@s.whatsapp.net", "", 2 * time.Minute},
+	}
+	for _, r := range reactions {
+		if err := ms.SaveReaction(first.ChatJID, first.ID, r.sender, r.emoji, ts.Add(r.at)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages := []*Message{first, second}
+	if err := setReactions(ms, first.ChatJID, messages, []string{me, lid}); err != nil {
+		t.Fatal(err)
+	}
+	summary := first.Reactions
+	if summary == nil {
+		t.Fatal("first message has no reactions")
+	}
+	if len(summary.Counts) != 2 || summary.Counts["👍"] != 3 || summary.Counts["❤️"] != 1 {
+		t.Errorf("counts = %v, want 3 👍 and 1 ❤️", summary.Counts)
+	}
+	if summary.MyReaction != "👍" {
+		t.Errorf("my_reaction = %q, want 👍", summary.MyReaction)
+	}
+	if len(summary.List) != 4 {
+		t.Errorf("list has %d reactions, want 4", len(summary.List))
+	}
+	if second.Reactions != nil {
+		t.Errorf("second message has reactions %+v, want none", second.Reactions)
+	}
+
+	// Our reaction stored under our LID counts as ours too
+	if err := ms.SaveReaction(first.ChatJID, first.ID, me, "", ts.Add(3*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SaveReaction(first.ChatJID, first.ID, lid, "🔥", ts.Add(3*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	summaries, err := ms.GetReactionSummaries(first.ChatJID, []string{me, lid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summaries[first.ID].MyReaction; got != "🔥" {
+		t.Errorf("my_reaction under our LID = %q, want 🔥", got)
+	}
+	// Nobody's reaction is ours without our JIDs
+	summaries, err = ms.GetReactionSummaries(first.ChatJID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summaries[first.ID].MyReaction; got != "" {
+		t.Errorf("my_reaction without own JIDs = %q, want none", got)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+)
+
+// readOnly disables every endpoint that sends to WhatsApp or changes the
+// account, for deployments that only archive
+var readOnly = envBool("THREADSCRIBE_READ_ONLY", false)
+
+// mutating rejects requests to an endpoint that changes something while
+// the bridge runs read-only
+func mutating(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rejectReadOnly(w) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rejectReadOnly answers 403 when the bridge runs read-only, for endpoints
+// that only change something on some methods or subpaths. It returns true
+// when the response has been written.
+func rejectReadOnly(w http.ResponseWriter) bool {
+	if readOnly {
+		writeErrorCode(w, "The bridge is read-only (THREADSCRIBE_READ_ONLY)", codeReadOnly, http.StatusForbidden)
+		return true
+	}
+	return false
+}
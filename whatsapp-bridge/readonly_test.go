@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setReadOnly switches read-only mode for the length of a test
+func setReadOnly(t *testing.T, on bool) {
+	t.Helper()
+	prev := readOnly
+	readOnly = on
+	t.Cleanup(func() { readOnly = prev })
+}
+
+func TestMutatingRejectsWhenReadOnly(t *testing.T) {
+	setReadOnly(t, true)
+	called := false
+	handler := mutating(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/download", nil))
+	if called {
+		t.Fatal("handler ran while read-only")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+	var body struct {
+		Code errorCode `json:"code"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != codeReadOnly {
+		t.Fatalf("code = %q, want %q", body.Code, codeReadOnly)
+	}
+}
+
+func TestMutatingPassesThroughWhenWritable(t *testing.T) {
+	setReadOnly(t, false)
+	called := false
+	handler := mutating(func(w http.ResponseWriter, r *http.Request) { called = true })
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/download", nil))
+	if !called {
+		t.Fatal("handler didn't run while writable")
+	}
+}
+
+func TestRejectReadOnly(t *testing.T) {
+	setReadOnly(t, false)
+	if rejectReadOnly(httptest.NewRecorder()) {
+		t.Fatal("rejected while writable")
+	}
+	setReadOnly(t, true)
+	rec := httptest.NewRecorder()
+	if !rejectReadOnly(rec) || rec.Code != http.StatusForbidden {
+		t.Fatalf("not rejected while read-only: %d", rec.Code)
+	}
+}
+
+// Routes that change something, and must answer 403 in read-only mode
+var mutatingRoutes = []string{
+	"/api/chats/refresh-names", "/api/group/create", "/api/storage/prune",
+	"/api/pin", "/api/sync-chat", "/api/revoke", "/api/edit", "/api/react", "/api/mark-all-read",
+	"/api/block", "/api/unblock", "/api/presence", "/api/markread", "/api/webhooks", "/api/webhooks/",
+	"/api/replay", "/api/chat/", "/api/send", "/api/forward", "/api/send-broadcast", "/api/logout",
+	"/api/regenerate-qr", "/api/restart",
+	// Only some methods or subpaths of these change something
+	"/api/chats/", "/api/group/",
+}
+
+// Routes that only read, and stay live in read-only mode
+var readRoutes = []string{
+	"/api/status", "/api/me", "/api/debug", "/api/chats", "/api/group/participants", "/api/poll/",
+	"/api/contact/", "/api/media/", "/api/storage", "/api/blocklist", "/api/search", "/api/inbox",
+	"/api/stream", "/api/events", "/api/ws", "/api/messages", "/api/qr", "/qr.png", "/api/download",
+}
+
+// TestMutatingRoutesAreGuarded checks how each route registered in main
+// handles read-only mode, since the handlers can't be called one by one
+func TestMutatingRoutesAreGuarded(t *testing.T) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mainBody *ast.BlockStmt
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.Name == "main" {
+			mainBody = fn.Body
+		}
+	}
+
+	// Handlers built by a helper defined in main, like blockHandler
+	helpers := make(map[string]ast.Node)
+	ast.Inspect(mainBody, func(n ast.Node) bool {
+		if assign, ok := n.(*ast.AssignStmt); ok && len(assign.Lhs) == 1 && len(assign.Rhs) == 1 {
+			if ident, ok := assign.Lhs[0].(*ast.Ident); ok {
+				helpers[ident.Name] = assign.Rhs[0]
+			}
+		}
+		return true
+	})
+
+	guarded := make(map[string]bool)
+	ast.Inspect(mainBody, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			return true
+		}
+		if sel, ok := call.Fun.(*ast.SelectorExpr); !ok || sel.Sel.Name != "HandleFunc" {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok {
+			return true
+		}
+		route := strings.Trim(lit.Value, `"`)
+		handler := ast.Node(call.Args[1])
+		if helper, ok := call.Args[1].(*ast.CallExpr); ok {
+			if ident, ok := helper.Fun.(*ast.Ident); ok && helpers[ident.Name] != nil {
+				handler = helpers[ident.Name]
+			}
+		}
+		guarded[route] = callsAny(handler, "mutating", "rejectReadOnly")
+		return false
+	})
+
+	for _, route := range mutatingRoutes {
+		if g, ok := guarded[route]; !ok {
+			t.Errorf("%s isn't registered", route)
+		} else if !g {
+			t.Errorf("%s changes something but isn't blocked in read-only mode", route)
+		}
+		delete(guarded, route)
+	}
+	for _, route := range readRoutes {
+		if g, ok := guarded[route]; !ok {
+			t.Errorf("%s isn't registered", route)
+		} else if g {
+			t.Errorf("%s only reads but is blocked in read-only mode", route)
+		}
+		delete(guarded, route)
+	}
+	for route := range guarded {
+		t.Errorf("%s is neither in mutatingRoutes nor in readRoutes", route)
+	}
+}
+
+// callsAny reports whether any of the named functions is called within n
+func callsAny(n ast.Node, names ...string) bool {
+	found := false
+	ast.Inspect(n, func(n ast.Node) bool {
+		for _, name := range names {
+			if expr, ok := n.(ast.Expr); ok && isCallTo(expr, name) {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
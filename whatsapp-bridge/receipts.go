@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Receipt statuses of our own messages, in the order they're reached. A
+// message is sent once the server acknowledged it.
+const (
+	receiptSent      = "sent"
+	receiptDelivered = "delivered"
+	receiptRead      = "read"
+	receiptPlayed    = "played"
+)
+
+// receiptRank orders the statuses in SQL, so a late delivery receipt never
+// overwrites a read one
+const receiptRank = "CASE %s WHEN 'delivered' THEN 1 WHEN 'read' THEN 2 WHEN 'played' THEN 3 ELSE 0 END"
+
+// MessageReceipt is how far one recipient got with our message
+type MessageReceipt struct {
+	Participant string    `json:"participant"`
+	Status      string    `json:"status"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// receiptStatus maps a receipt type to the status it records, or "" for
+// receipts that don't tell about our messages reaching someone
+func receiptStatus(receiptType types.ReceiptType) string {
+	switch receiptType {
+	case types.ReceiptTypeDelivered:
+		return receiptDelivered
+	case types.ReceiptTypeRead:
+		return receiptRead
+	case types.ReceiptTypePlayed:
+		return receiptPlayed
+	}
+	return ""
+}
+
+// handleReceipt records a recipient receiving, reading or playing our
+// messages. Receipts from our own devices, for messages we read, are
+// ignored.
+func handleReceipt(messageStore *MessageStore, v *events.Receipt) {
+	status := receiptStatus(v.Type)
+	if status == "" || v.IsFromMe {
+		return
+	}
+	timestamp := v.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	err := messageStore.SaveReceipts(v.Chat.String(), v.MessageIDs, v.Sender.ToNonAD().String(), status, timestamp)
+	if err != nil {
+		log.Printf("Failed to save %s receipt from %s: %v", status, v.Sender, err)
+	}
+}
+
+// SaveReceipts records how far a recipient got with our messages. Statuses
+// only move forward.
+func (ms *MessageStore) SaveReceipts(chatJID string, messageIDs []types.MessageID, participant, status string, timestamp time.Time) error {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range messageIDs {
+		_, err := tx.Exec(
+			`INSERT INTO receipts (chat_jid, message_id, participant, status, timestamp) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(chat_jid, message_id, participant) DO UPDATE SET status = excluded.status, timestamp = excluded.timestamp
+			WHERE `+fmt.Sprintf(receiptRank, "excluded.status")+` > `+fmt.Sprintf(receiptRank, "receipts.status"),
+			chatJID, id, participant, status, timestamp,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// receiptBatchSize caps the message IDs looked up per query, keeping well
+// under SQLite's limit on bound parameters
+const receiptBatchSize = 500
+
+// GetReceipts gathers the receipts for the given messages of a chat, keyed
+// by message ID. IDs are looked up in batches rather than one by one.
+func (ms *MessageStore) GetReceipts(chatJID string, messageIDs []string) (map[string][]MessageReceipt, error) {
+	receipts := make(map[string][]MessageReceipt)
+	for start := 0; start < len(messageIDs); start += receiptBatchSize {
+		batch := messageIDs[start:min(start+receiptBatchSize, len(messageIDs))]
+		if err := ms.getReceiptBatch(receipts, chatJID, batch); err != nil {
+			return nil, err
+		}
+	}
+	return receipts, nil
+}
+
+// getReceiptBatch adds the receipts for one batch of message IDs to receipts
+func (ms *MessageStore) getReceiptBatch(receipts map[string][]MessageReceipt, chatJID string, messageIDs []string) error {
+	args := make([]interface{}, 0, len(messageIDs)+1)
+	args = append(args, chatJID)
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(messageIDs)), ", ")
+	rows, err := ms.db.Query(
+		"SELECT message_id, participant, status, timestamp FROM receipts WHERE chat_jid = ? AND message_id IN ("+placeholders+") ORDER BY timestamp",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var receipt MessageReceipt
+		if err := rows.Scan(&id, &receipt.Participant, &receipt.Status, &receipt.Timestamp); err != nil {
+			return err
+		}
+		receipts[id] = append(receipts[id], receipt)
+	}
+	return rows.Err()
+}
+
+// setReceipts fills in the status of our own messages from the same chat.
+// The status is the furthest any recipient got; in groups, where each
+// member sends their own receipts, those are listed too.
+func setReceipts(messageStore *MessageStore, chatJID string, messages []*Message) error {
+	var ids []string
+	for _, msg := range messages {
+		if msg.IsFromMe && msg.ServerAcked {
+			ids = append(ids, msg.ID)
+		}
+	}
+	receipts, err := messageStore.GetReceipts(chatJID, ids)
+	if err != nil {
+		return err
+	}
+	jid, _ := types.ParseJID(chatJID)
+	group := classifyJID(jid) == jidGroup
+
+	for _, msg := range messages {
+		if !msg.IsFromMe || !msg.ServerAcked {
+			continue
+		}
+		msg.Status = receiptSent
+		for _, receipt := range receipts[msg.ID] {
+			if receiptOrder(receipt.Status) > receiptOrder(msg.Status) {
+				msg.Status = receipt.Status
+			}
+		}
+		if group {
+			msg.Receipts = receipts[msg.ID]
+		}
+	}
+	return nil
+}
+
+// receiptOrder ranks a status like receiptRank does in SQL
+func receiptOrder(status string) int {
+	switch status {
+	case receiptDelivered:
+		return 1
+	case receiptRead:
+		return 2
+	case receiptPlayed:
+		return 3
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const receiptGroup = "120363000000000000@g.us"
+
+// ownMessage returns a message we sent to the test group that the server accepted
+func ownMessage(id string, ts time.Time) *Message {
+	msg := testMessage(id, "hi", ts)
+	msg.ChatJID = receiptGroup
+	msg.IsFromMe = true
+	msg.ServerAcked = true
+	return msg
+}
+
+func TestGetReceiptsOnlyLoadsGivenMessages(t *testing.T) {
+	ms := newTestStore(t)
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, id := range []string{"M1", "M2", "M3"} {
+		err := ms.SaveReceipts(receiptGroup, []types.MessageID{id}, "222@s.whatsapp.net", receiptRead, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The same ID in another chat is a different message
+	if err := ms.SaveReceipts("333@s.whatsapp.net", []types.MessageID{"M1"}, "333@s.whatsapp.net", receiptPlayed, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	receipts, err := ms.GetReceipts(receiptGroup, []string{"M1", "M3", "M9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 2 || len(receipts["M1"]) != 1 || len(receipts["M3"]) != 1 {
+		t.Fatalf("receipts = %v, want one each for M1 and M3", receipts)
+	}
+	if got := receipts["M1"][0].Status; got != receiptRead {
+		t.Errorf("M1 status = %s, want %s", got, receiptRead)
+	}
+
+	none, err := ms.GetReceipts(receiptGroup, nil)
+	if err != nil || len(none) != 0 {
+		t.Errorf("GetReceipts without IDs = %v, %v, want nothing", none, err)
+	}
+}
+
+func TestGetReceiptsAcrossBatches(t *testing.T) {
+	ms := newTestStore(t)
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ids := make([]string, receiptBatchSize*2+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("M%d", i)
+	}
+	if err := ms.SaveReceipts(receiptGroup, ids, "222@s.whatsapp.net", receiptDelivered, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	receipts, err := ms.GetReceipts(receiptGroup, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != len(ids) {
+		t.Errorf("got receipts for %d messages, want %d", len(receipts), len(ids))
+	}
+}
+
+func TestSetReceipts(t *testing.T) {
+	ms := newTestStore(t)
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := ms.SaveReceipts(receiptGroup, []types.MessageID{"M1"}, "222@s.whatsapp.net", receiptDelivered, ts); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SaveReceipts(receiptGroup, []types.MessageID{"M1"}, "333@s.whatsapp.net", receiptRead, ts.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	received := testMessage("M2", "hello", ts)
+	received.ChatJID = receiptGroup
+	messages := []*Message{ownMessage("M1", ts), ownMessage("M3", ts), received}
+	if err := setReceipts(ms, receiptGroup, messages); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := messages[0].Status; got != receiptRead {
+		t.Errorf("status with a read receipt = %s, want %s", got, receiptRead)
+	}
+	if got := len(messages[0].Receipts); got != 2 {
+		t.Errorf("group message lists %d receipts, want 2", got)
+	}
+	if got := messages[1].Status; got != receiptSent {
+		t.Errorf("status without receipts = %s, want %s", got, receiptSent)
+	}
+	if got := messages[2].Status; got != "" {
+		t.Errorf("received message got status %q", got)
+	}
+}
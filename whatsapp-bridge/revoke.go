@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// revokeWindow is how long after sending WhatsApp still allows deleting a
+// message for everyone
+const revokeWindow = 60 * time.Hour
+
+var (
+	errRevokeTooOld     = errors.New("message is too old to be deleted for everyone")
+	errRevokeNotAllowed = errors.New("only messages we sent, or any message in a group we administer, can be deleted")
+	errRevokeNotAdmin   = errors.New("only group admins can delete other members' messages")
+)
+
+// checkRevoke returns why target can't be revoked, or nil if it can
+func checkRevoke(client *whatsmeow.Client, chat types.JID, target *Message, now time.Time) error {
+	if now.Sub(target.Timestamp) > revokeWindow {
+		return errRevokeTooOld
+	}
+	if target.IsFromMe {
+		return nil
+	}
+	if classifyJID(chat) != jidGroup {
+		return errRevokeNotAllowed
+	}
+
+	admin, err := isGroupAdmin(client, chat)
+	if err != nil {
+		return fmt.Errorf("failed to check admin status: %w", err)
+	}
+	if !admin {
+		return errRevokeNotAdmin
+	}
+	return nil
+}
+
+// buildRevokeMessage builds the message deleting target for everyone. Our
+// own messages are revoked with an empty sender, other people's (as a group
+// admin) with the original author.
+func buildRevokeMessage(client *whatsmeow.Client, chat types.JID, target *Message) (*waE2E.Message, error) {
+	sender := types.EmptyJID
+	if !target.IsFromMe {
+		parsed, err := types.ParseJID(target.Sender)
+		if err != nil {
+			return nil, err
+		}
+		sender = parsed.ToNonAD()
+	}
+	return client.BuildRevoke(chat, sender, target.ID), nil
+}
+
+// handleRevoke marks a message someone deleted for everyone as revoked.
+// Our own deletions from other devices arrive here too.
+func handleRevoke(messageStore *MessageStore, v *events.Message, protocol *waE2E.ProtocolMessage) {
+	targetID := protocol.GetKey().GetID()
+	if targetID == "" {
+		return
+	}
+	if err := messageStore.SetMessageRevoked(v.Info.Chat.String(), targetID, v.Info.Timestamp); err != nil {
+		log.Printf("Failed to mark message %s revoked: %v", targetID, err)
+	}
+}
+
+// latestRevoke returns when a message of a chat was last deleted for everyone
+func (ms *MessageStore) latestRevoke(chatJID string) (time.Time, error) {
+	var at time.Time
+	err := ms.db.QueryRow("SELECT revoked_at FROM messages WHERE chat_jid = ? AND revoked_at IS NOT NULL ORDER BY revoked_at DESC LIMIT 1", chatJID).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return at, err
+}
+
+// isGroupAdmin checks whether our own account is an admin of a group
+func isGroupAdmin(client *whatsmeow.Client, group types.JID) (bool, error) {
+	info, err := client.GetGroupInfo(group)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range info.Participants {
+		if isOwnJID(client, p.JID) || isOwnJID(client, p.PhoneNumber) || isOwnJID(client, p.LID) {
+			return p.IsAdmin || p.IsSuperAdmin, nil
+		}
+	}
+	return false, nil
+}
+
+// isOwnJID reports whether jid is our own phone number or LID
+func isOwnJID(client *whatsmeow.Client, jid types.JID) bool {
+	if jid.IsEmpty() || client.Store.ID == nil {
+		return false
+	}
+	if classifyJID(jid) == jidLID {
+		return jid.User == client.Store.LID.User
+	}
+	return jid.User == client.Store.ID.User
+}
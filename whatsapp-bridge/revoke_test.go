@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBuildRevokeMessageForOwnMessage(t *testing.T) {
+	client := newTestClient(t)
+	chat := types.NewJID("111", types.DefaultUserServer)
+	target := testMessage("OWN1", "oops", time.Now())
+	target.IsFromMe = true
+	target.Sender = client.Store.ID.ToNonAD().String()
+
+	msg, err := buildRevokeMessage(client, chat, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocol := msg.GetProtocolMessage()
+	if protocol.GetType() != waE2E.ProtocolMessage_REVOKE {
+		t.Fatalf("protocol message type = %s, want REVOKE", protocol.GetType())
+	}
+	key := protocol.GetKey()
+	if key.GetID() != "OWN1" || !key.GetFromMe() || key.GetRemoteJID() != chat.String() {
+		t.Fatalf("revoke key = %v, want our own OWN1 in %s", key, chat)
+	}
+	if key.GetParticipant() != "" {
+		t.Errorf("revoke of our own message names participant %s", key.GetParticipant())
+	}
+}
+
+func TestBuildRevokeMessageForGroupMember(t *testing.T) {
+	client := newTestClient(t)
+	group := types.NewJID("123-456", types.GroupServer)
+	target := testMessage("THEIRS", "spam", time.Now())
+	target.ChatJID = group.String()
+	target.Sender = "222@s.whatsapp.net"
+
+	msg, err := buildRevokeMessage(client, group, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := msg.GetProtocolMessage().GetKey()
+	if key.GetFromMe() || key.GetParticipant() != "222@s.whatsapp.net" {
+		t.Fatalf("revoke key = %v, want participant 222@s.whatsapp.net", key)
+	}
+
+	target.Sender = "222:x@s.whatsapp.net"
+	if _, err := buildRevokeMessage(client, group, target); err == nil {
+		t.Error("built a revoke for a message with an invalid sender")
+	}
+}
+
+func TestCheckRevoke(t *testing.T) {
+	client := newTestClient(t)
+	now := time.Now()
+	direct := types.NewJID("111", types.DefaultUserServer)
+
+	own := testMessage("A", "hi", now.Add(-time.Hour))
+	own.IsFromMe = true
+	if err := checkRevoke(client, direct, own, now); err != nil {
+		t.Errorf("recent own message: %v", err)
+	}
+
+	old := testMessage("B", "hi", now.Add(-revokeWindow-time.Minute))
+	old.IsFromMe = true
+	if err := checkRevoke(client, direct, old, now); err != errRevokeTooOld {
+		t.Errorf("old own message: %v, want errRevokeTooOld", err)
+	}
+
+	theirs := testMessage("C", "hi", now.Add(-time.Hour))
+	if err := checkRevoke(client, direct, theirs, now); err != errRevokeNotAllowed {
+		t.Errorf("their message in a direct chat: %v, want errRevokeNotAllowed", err)
+	}
+}
+
+// revokeEvent is sender deleting the message id of a chat for everyone
+func revokeEvent(chat, sender types.JID, fromMe bool, id string, at time.Time) *events.Message {
+	return &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsFromMe: fromMe, IsGroup: chat.Server == types.GroupServer},
+			ID:            "REVOKE-" + id,
+			Timestamp:     at,
+		},
+		Message: &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+			Type: waE2E.ProtocolMessage_REVOKE.Enum(),
+			Key:  &waCommon.MessageKey{RemoteJID: proto.String(chat.String()), FromMe: proto.Bool(fromMe), ID: proto.String(id)},
+		}},
+	}
+}
+
+func TestHandleIncomingRevoke(t *testing.T) {
+	client := newTestClient(t)
+	ms := newTestStore(t)
+	now := time.Now().Truncate(time.Second)
+	group := types.NewJID("120363000000000001", types.GroupServer)
+	me := client.Store.ID.ToNonAD()
+	member := types.NewJID("222", types.DefaultUserServer)
+
+	own := testMessage("OWN1", "sent by us", now.Add(-time.Hour))
+	own.ChatJID, own.Sender, own.IsFromMe = group.String(), me.String(), true
+	theirs := testMessage("THEIRS1", "sent by them", now.Add(-time.Hour))
+	theirs.ChatJID, theirs.Sender = group.String(), member.String()
+	kept := testMessage("KEPT1", "still here", now.Add(-time.Hour))
+	kept.ChatJID, kept.Sender = group.String(), member.String()
+	for _, msg := range []*Message{own, theirs, kept} {
+		if err := ms.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// We deleted our own message from another device
+	handleMessage(client, ms, revokeEvent(group, me, true, own.ID, now.Add(-time.Minute)))
+	// Someone else deleted theirs
+	handleMessage(client, ms, revokeEvent(group, member, false, theirs.ID, now))
+	// A revoke only applies to messages of its own chat
+	handleMessage(client, ms, revokeEvent(member, member, false, kept.ID, now))
+
+	messages, err := ms.GetMessages(group.String(), MessageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("got %d messages, want all 3 kept", len(messages))
+	}
+	for _, msg := range messages {
+		want := msg.ID != kept.ID
+		if msg.Revoked != want {
+			t.Errorf("%s revoked = %v, want %v", msg.ID, msg.Revoked, want)
+		}
+		raw, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var shape struct {
+			Revoked *bool `json:"revoked"`
+		}
+		if err := json.Unmarshal(raw, &shape); err != nil {
+			t.Fatal(err)
+		}
+		if shape.Revoked == nil || *shape.Revoked != want {
+			t.Errorf("%s /api/messages shape = %s, want revoked %v", msg.ID, raw, want)
+		}
+	}
+	if latest, err := ms.latestRevoke(group.String()); err != nil || !latest.Equal(now) {
+		t.Errorf("latestRevoke = %v, %v, want %v", latest, err, now)
+	}
+
+	// Revokes aren't stored as messages of their own
+	if _, err := ms.GetMessage(group.String(), "REVOKE-"+own.ID); err == nil {
+		t.Error("the revoke was stored as a message")
+	}
+}
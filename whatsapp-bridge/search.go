@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+)
+
+// The full-text index is an FTS5 table over the content column, kept in
+// sync by triggers. FTS5 is only compiled into go-sqlite3 with the
+// sqlite_fts5 build tag; without it, search falls back to a LIKE scan.
+// Replacing a message (INSERT OR REPLACE) only fires the delete trigger
+// with recursive_triggers on, which the connection string enables.
+const searchIndexSchema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(content, content='messages', content_rowid='rowid');
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+	INSERT INTO messages_fts(rowid, content) VALUES (new.rowid, new.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+	INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+	INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+	INSERT INTO messages_fts(rowid, content) VALUES (new.rowid, new.content);
+END;
+
+INSERT INTO messages_fts(messages_fts) VALUES ('rebuild');
+`
+
+// searchTriggers keep the full-text index in sync with the messages table
+const searchTriggers = "'messages_fts_insert', 'messages_fts_delete', 'messages_fts_update'"
+
+// setupSearchIndex creates the full-text index on first use, indexing the
+// messages stored so far. It reports whether the index is available.
+func setupSearchIndex(db *sql.DB) (bool, error) {
+	var triggers int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name IN (" + searchTriggers + ")").Scan(&triggers); err != nil {
+		return false, err
+	}
+	if triggers == 3 {
+		if _, err := db.Exec("SELECT rowid FROM messages_fts LIMIT 0"); err == nil {
+			return true, nil
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(searchIndexSchema); err != nil {
+		if !strings.Contains(err.Error(), "no such module: fts5") {
+			return false, err
+		}
+		// A database indexed by a build with FTS5 can't store messages in
+		// one without it while the triggers are there. The index is
+		// rebuilt once a build with FTS5 runs again.
+		for _, trigger := range strings.Split(searchTriggers, ", ") {
+			if _, err := tx.Exec("DROP TRIGGER IF EXISTS " + strings.Trim(trigger, "'")); err != nil {
+				return false, err
+			}
+		}
+		log.Printf("Full-text search needs a build with -tags sqlite_fts5, searching with LIKE instead")
+		return false, tx.Commit()
+	}
+	return true, tx.Commit()
+}
+
+// ftsQuery turns what the user typed into an FTS5 query matching messages
+// that contain every word, quoting each word so punctuation is taken
+// literally instead of as query syntax
+func ftsQuery(q string) string {
+	words := strings.Fields(q)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// likePattern matches content containing q, with LIKE's wildcards escaped
+func likePattern(q string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+}
+
+// SearchMessages finds the messages containing every word of q, newest
+// first, in one chat or in all of them if chatJID is empty. It also
+// returns how many messages match in total.
+func (ms *MessageStore) SearchMessages(q, chatJID string, limit int) ([]*Message, int, error) {
+	where := "rowid IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)"
+	args := []interface{}{ftsQuery(q)}
+	if !ms.fullText {
+		where = `content LIKE ? ESCAPE '\'`
+		args = []interface{}{likePattern(q)}
+	}
+	if chatJID != "" {
+		where += " AND chat_jid = ?"
+		args = append(args, chatJID)
+	}
+
+	var total int
+	if err := ms.db.QueryRow("SELECT COUNT(*) FROM messages WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := ms.db.Query(
+		"SELECT "+messageSelectColumns+" FROM messages WHERE "+where+" ORDER BY timestamp DESC LIMIT ?",
+		append(args, limit)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	messages, err := scanMessages(rows)
+	return messages, total, err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// resolveSenderName returns the name to show for a message sender: the
+// saved contact name, then the push name the message came with, then the
+// push name we last saw. It returns "" if none is known yet.
+func resolveSenderName(client *whatsmeow.Client, sender types.JID, pushName string) string {
+	sender = sender.ToNonAD()
+	if classifyJID(sender) == jidLID {
+		// Contacts are stored under phone numbers
+		if pn, err := client.Store.LIDs.GetPNForLID(context.Background(), sender); err == nil && !pn.IsEmpty() {
+			sender = pn
+		}
+	}
+
+	contact, err := client.Store.Contacts.GetContact(context.Background(), sender)
+	if err == nil && contact.FullName != "" {
+		return contact.FullName
+	}
+	if pushName != "" {
+		return pushName
+	}
+	if err == nil && contact.PushName != "" {
+		return contact.PushName
+	}
+	return ""
+}
+
+// SetSenderName updates the sender name of every message from sender
+func (ms *MessageStore) SetSenderName(sender, name string) (int64, error) {
+	res, err := ms.db.Exec("UPDATE messages SET sender_name = ?, updated_at = ? WHERE sender = ? AND sender_name != ?",
+		name, time.Now(), sender, name)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetUnnamedSenders lists the senders of received messages stored without a name
+func (ms *MessageStore) GetUnnamedSenders() ([]string, error) {
+	rows, err := ms.db.Query("SELECT DISTINCT sender FROM messages WHERE sender_name = '' AND is_from_me = 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var senders []string
+	for rows.Next() {
+		var sender string
+		if err := rows.Scan(&sender); err != nil {
+			return nil, err
+		}
+		senders = append(senders, sender)
+	}
+	return senders, rows.Err()
+}
+
+// updateSenderName stores a newly learned name for a sender's messages.
+// A saved contact name always wins over the push name.
+func updateSenderName(client *whatsmeow.Client, messageStore *MessageStore, sender types.JID, pushName string) {
+	name := resolveSenderName(client, sender, pushName)
+	if name == "" {
+		return
+	}
+	if _, err := messageStore.SetSenderName(sender.ToNonAD().String(), name); err != nil {
+		log.Printf("Failed to update sender name of %s: %v", sender, err)
+	}
+}
+
+// resolveUnnamedSenders names the stored messages whose sender wasn't known
+// when they were stored, e.g. history synced before the contacts were
+func resolveUnnamedSenders(client *whatsmeow.Client, messageStore *MessageStore) (int64, error) {
+	senders, err := messageStore.GetUnnamedSenders()
+	if err != nil {
+		return 0, err
+	}
+
+	var updated int64
+	for _, sender := range senders {
+		jid, err := types.ParseJID(sender)
+		if err != nil {
+			continue
+		}
+		name := resolveSenderName(client, jid, "")
+		if name == "" {
+			continue
+		}
+		n, err := messageStore.SetSenderName(sender, name)
+		if err != nil {
+			return updated, err
+		}
+		updated += n
+	}
+	return updated, nil
+}
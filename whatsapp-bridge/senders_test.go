@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestResolveUnnamedSendersAfterContactSync(t *testing.T) {
+	ms := newTestStore(t)
+	client := newTestClient(t)
+	sender := types.NewJID("222", types.DefaultUserServer)
+
+	// History synced before the contacts, so the sender has no name yet
+	msg := testMessage("H1", "hello", time.Now())
+	msg.Sender = sender.String()
+	if err := ms.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := resolveUnnamedSenders(client, ms); err != nil || n != 0 {
+		t.Fatalf("resolveUnnamedSenders before the contact is known = %d, %v", n, err)
+	}
+
+	if err := client.Store.Contacts.PutContactName(context.Background(), sender, "Bob", "Bob Smith"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := resolveUnnamedSenders(client, ms); err != nil || n != 1 {
+		t.Fatalf("resolveUnnamedSenders = %d, %v, want 1 message named", n, err)
+	}
+	got, err := ms.GetMessage(msg.ChatJID, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SenderName != "Bob Smith" {
+		t.Errorf("sender_name = %q, want Bob Smith", got.SenderName)
+	}
+	// The sender stays the JID, only the display name is filled in
+	if got.Sender != sender.String() {
+		t.Errorf("sender = %q, want %s", got.Sender, sender)
+	}
+
+	if senders, _ := ms.GetUnnamedSenders(); len(senders) != 0 {
+		t.Errorf("senders still unnamed: %v", senders)
+	}
+}
+
+func TestResolveSenderName(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	pn := types.NewJID("333", types.DefaultUserServer)
+	lid := types.NewJID("98765", types.HiddenUserServer)
+
+	if got := resolveSenderName(client, pn, "Carol's phone"); got != "Carol's phone" {
+		t.Errorf("unknown contact with a push name = %q", got)
+	}
+	if _, _, err := client.Store.Contacts.PutPushName(ctx, pn, "Caz"); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolveSenderName(client, pn, ""); got != "Caz" {
+		t.Errorf("stored push name = %q, want Caz", got)
+	}
+
+	// A saved contact name wins over any push name, also for LID senders
+	if err := client.Store.Contacts.PutContactName(ctx, pn, "Carol", "Carol Jones"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Store.LIDs.PutLIDMapping(ctx, lid, pn); err != nil {
+		t.Fatal(err)
+	}
+	for _, jid := range []types.JID{pn, lid} {
+		if got := resolveSenderName(client, jid, "Caz"); got != "Carol Jones" {
+			t.Errorf("resolveSenderName(%s) = %q, want Carol Jones", jid, got)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StorageUsage describes the disk space used by the bridge
+type StorageUsage struct {
+	MediaBytes int64            `json:"media_bytes"`
+	MediaFiles int              `json:"media_files"`
+	Chats      map[string]int64 `json:"chats"`
+	Databases  map[string]int64 `json:"databases"`
+}
+
+// getStorageUsage walks the media cache and sizes the database files
+func getStorageUsage(dbPaths []string) (*StorageUsage, error) {
+	usage := &StorageUsage{
+		Chats:     make(map[string]int64),
+		Databases: make(map[string]int64),
+	}
+
+	err := walkMediaCache(func(path, chat string, info fs.FileInfo) error {
+		usage.MediaBytes += info.Size()
+		usage.MediaFiles++
+		usage.Chats[chat] += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Include SQLite's journal files, which can grow as large as the DB itself
+	for _, dbPath := range dbPaths {
+		for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+			info, err := os.Stat(dbPath + suffix)
+			if err != nil {
+				continue
+			}
+			usage.Databases[filepath.Base(dbPath)+suffix] = info.Size()
+		}
+	}
+
+	return usage, nil
+}
+
+// pruneMediaCache deletes cached media files last modified before cutoff.
+// The message rows are kept, so the media can be downloaded again.
+func pruneMediaCache(cutoff time.Time) (int, int64, error) {
+	deleted := 0
+	var freed int64
+	err := walkMediaCache(func(path, chat string, info fs.FileInfo) error {
+		if !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		deleted++
+		freed += info.Size()
+		return nil
+	})
+	return deleted, freed, err
+}
+
+// walkMediaCache calls fn for every file in the media cache along with the
+// chat directory it belongs to
+func walkMediaCache(fn func(path, chat string, info fs.FileInfo) error) error {
+	err := filepath.WalkDir(mediaCacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		chat := filepath.Base(filepath.Dir(path))
+		return fn(path, chat, info)
+	})
+	if os.IsNotExist(err) {
+		// Nothing has been downloaded yet
+		return nil
+	}
+	return err
+}
+
+// parseAge parses an age such as "30d" or a Go duration such as "12h"
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q", value)
+	}
+	return age, nil
+}
+
+// touchMediaFile marks a cached media file as just accessed. The cache
+// budget evicts by modification time, since access times are often
+// disabled on the filesystem.
+func touchMediaFile(path string) {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to update access time of %s: %v", path, err)
+	}
+}
+
+// enforceMediaCacheBudget deletes the least recently accessed cached media
+// files until the cache fits in maxBytes. The message rows are kept, so
+// evicted media can be downloaded again.
+func enforceMediaCacheBudget(maxBytes int64) (int, int64, error) {
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []cachedFile
+	var total int64
+	err := walkMediaCache(func(path, chat string, info fs.FileInfo) error {
+		files = append(files, cachedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil || total <= maxBytes {
+		return 0, 0, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	deleted := 0
+	var freed int64
+	for _, f := range files {
+		if total-freed <= maxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			return deleted, freed, err
+		}
+		deleted++
+		freed += f.size
+	}
+
+	return deleted, freed, nil
+}
+
+// runMediaCacheJanitor enforces the media cache budget every interval
+func runMediaCacheJanitor(maxBytes int64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, freed, err := enforceMediaCacheBudget(maxBytes)
+		if err != nil {
+			log.Printf("Failed to enforce media cache budget: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Evicted %d cached media files (%d bytes) to stay under %d bytes", deleted, freed, maxBytes)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Event types carried by the live stream
+const (
+	streamMessage    = "message"
+	streamReceipt    = "receipt"
+	streamPresence   = "presence"
+	streamTyping     = "typing"
+	streamConnection = "connection"
+)
+
+var streamEventTypes = map[string]bool{
+	streamMessage:    true,
+	streamReceipt:    true,
+	streamPresence:   true,
+	streamTyping:     true,
+	streamConnection: true,
+}
+
+// streamKeepAlive is how often an idle stream gets a comment, so proxies
+// don't time it out
+const streamKeepAlive = 15 * time.Second
+
+// streamBuffer is how many events a subscriber may fall behind by before
+// it's dropped
+const streamBuffer = 64
+
+// streamEvent is one event pushed to live stream subscribers
+type streamEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// streamSubscriber receives the events of the types it asked for
+type streamSubscriber struct {
+	types map[string]bool
+	// chatJID limits the subscriber to the messages of one chat when set
+	chatJID string
+	events  chan streamEvent
+}
+
+// streamHub fans events out to every subscriber of the live stream
+type streamHub struct {
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]bool
+}
+
+var stream = &streamHub{subscribers: make(map[*streamSubscriber]bool)}
+
+// Subscribe registers a subscriber for the given event types, of one chat
+// if chatJID is set. The initial events are delivered ahead of any others.
+func (h *streamHub) Subscribe(types map[string]bool, chatJID string, initial ...streamEvent) *streamSubscriber {
+	sub := &streamSubscriber{types: types, chatJID: chatJID, events: make(chan streamEvent, streamBuffer+len(initial))}
+	for _, evt := range initial {
+		sub.events <- evt
+	}
+	h.mu.Lock()
+	h.subscribers[sub] = true
+	h.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe removes a subscriber and closes its channel
+func (h *streamHub) Unsubscribe(sub *streamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[sub] {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Close drops every subscriber, ending their streams
+func (h *streamHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Publish sends an event to every subscriber that wants its type. It never
+// blocks: a subscriber that fell too far behind is dropped, closing its
+// stream so the client reconnects instead of silently missing events.
+func (h *streamHub) Publish(eventType string, data interface{}) {
+	evt := streamEvent{Type: eventType, Data: data}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers {
+		if !sub.wants(eventType, data) {
+			continue
+		}
+		select {
+		case sub.events <- evt:
+		default:
+			log.Printf("Dropping a live stream subscriber that fell %d events behind", streamBuffer)
+			delete(h.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// wants reports whether the subscriber asked for an event. Only messages
+// belong to a chat, so a subscriber of one chat gets nothing else.
+func (sub *streamSubscriber) wants(eventType string, data interface{}) bool {
+	if !sub.types[eventType] {
+		return false
+	}
+	if sub.chatJID == "" {
+		return true
+	}
+	msg, ok := data.(*Message)
+	return ok && msg.ChatJID == sub.chatJID
+}
+
+// parseStreamEvents reads the comma-separated ?events= filter. Without one
+// only messages are streamed, which is all the stream used to carry.
+func parseStreamEvents(value string) (map[string]bool, error) {
+	if strings.TrimSpace(value) == "" {
+		return map[string]bool{streamMessage: true}, nil
+	}
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !streamEventTypes[name] {
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+		wanted[name] = true
+	}
+	return wanted, nil
+}
+
+// serveStream writes events to the client as Server-Sent Events until it
+// disconnects or is dropped for falling behind. Each event is flushed right
+// away.
+func serveStream(w http.ResponseWriter, r *http.Request, sub *streamSubscriber) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case evt, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(evt.Data)
+			if err != nil {
+				log.Printf("Failed to encode %s event: %v", evt.Type, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// publishReceipt streams a delivery or read receipt
+func publishReceipt(v *events.Receipt) {
+	receiptType := string(v.Type)
+	if receiptType == "" {
+		receiptType = "delivered"
+	}
+	stream.Publish(streamReceipt, map[string]interface{}{
+		"chat_jid":    v.Chat.String(),
+		"sender":      v.Sender.ToNonAD().String(),
+		"message_ids": v.MessageIDs,
+		"type":        receiptType,
+		"timestamp":   v.Timestamp,
+	})
+}
+
+// publishPresence streams a contact going online or offline
+func publishPresence(v *events.Presence) {
+	var lastSeen *time.Time
+	if !v.LastSeen.IsZero() {
+		lastSeen = &v.LastSeen
+	}
+	stream.Publish(streamPresence, map[string]interface{}{
+		"jid":       v.From.ToNonAD().String(),
+		"online":    !v.Unavailable,
+		"last_seen": lastSeen,
+	})
+}
+
+// publishTyping streams a contact starting or stopping to type or record
+func publishTyping(v *events.ChatPresence) {
+	stream.Publish(streamTyping, map[string]interface{}{
+		"chat_jid": v.Chat.String(),
+		"sender":   v.Sender.ToNonAD().String(),
+		"typing":   v.State == types.ChatPresenceComposing,
+		"audio":    v.Media == types.ChatPresenceMediaAudio,
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamServer serves hub the way /api/stream serves the shared hub
+func streamServer(t *testing.T, hub *streamHub) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wanted, err := parseStreamEvents(r.URL.Query().Get("events"))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sub := hub.Subscribe(wanted, "")
+		defer hub.Unsubscribe(sub)
+		serveStream(w, r, sub)
+	}))
+	t.Cleanup(func() {
+		hub.Close()
+		srv.Close()
+	})
+	return srv
+}
+
+// readStreamEvents reads the names of the next n events off a stream
+func readStreamEvents(t *testing.T, resp *http.Response, n int) []string {
+	t.Helper()
+	names := make(chan string)
+	go func() {
+		defer close(names)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+				names <- name
+			}
+		}
+	}()
+	var got []string
+	for len(got) < n {
+		select {
+		case name, ok := <-names:
+			if !ok {
+				t.Fatalf("stream ended after %v", got)
+			}
+			got = append(got, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after events %v", got)
+		}
+	}
+	return got
+}
+
+func TestStreamOnlySendsRequestedEvents(t *testing.T) {
+	hub := &streamHub{subscribers: make(map[*streamSubscriber]bool)}
+	srv := streamServer(t, hub)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// Messages only by default, as before the filter existed
+		{"", []string{streamMessage, streamMessage}},
+		{"?events=receipt,typing", []string{streamReceipt, streamTyping}},
+		{"?events=Connection,%20presence", []string{streamPresence, streamConnection}},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%q: status = %d", tt.query, resp.StatusCode)
+		}
+
+		// The headers only arrive once subscribed, so nothing is missed
+		hub.Publish(streamMessage, testMessage("MSG1", "hello", time.Now()))
+		hub.Publish(streamReceipt, map[string]interface{}{"type": "read"})
+		hub.Publish(streamPresence, map[string]interface{}{"online": true})
+		hub.Publish(streamTyping, map[string]interface{}{"typing": true})
+		hub.Publish(streamConnection, map[string]interface{}{"state": "connected"})
+		hub.Publish(streamMessage, testMessage("MSG2", "again", time.Now()))
+
+		got := readStreamEvents(t, resp, len(tt.want))
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q: got events %v, want %v", tt.query, got, tt.want)
+		}
+		resp.Body.Close()
+		hub.Close()
+	}
+}
+
+func TestStreamRejectsUnknownEventType(t *testing.T) {
+	srv := streamServer(t, &streamHub{subscribers: make(map[*streamSubscriber]bool)})
+	resp, err := http.Get(srv.URL + "?events=message,calls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestStreamSubscriberOfOneChat(t *testing.T) {
+	hub := &streamHub{subscribers: make(map[*streamSubscriber]bool)}
+	all := map[string]bool{streamMessage: true, streamReceipt: true}
+	sub := hub.Subscribe(all, "111@s.whatsapp.net")
+	defer hub.Unsubscribe(sub)
+
+	other := testMessage("MSG1", "elsewhere", time.Now())
+	other.ChatJID = "222@s.whatsapp.net"
+	hub.Publish(streamMessage, other)
+	hub.Publish(streamReceipt, map[string]interface{}{"type": "read"})
+	hub.Publish(streamMessage, testMessage("MSG2", "here", time.Now()))
+
+	evt := <-sub.events
+	if msg, ok := evt.Data.(*Message); !ok || msg.ID != "MSG2" {
+		t.Fatalf("got %+v, want only MSG2 of the subscribed chat", evt)
+	}
+	if len(sub.events) != 0 {
+		t.Fatalf("%d more events queued, want none", len(sub.events))
+	}
+}
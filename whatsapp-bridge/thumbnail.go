@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	// thumbnailSize is the longest side of a thumbnail in pixels
+	thumbnailSize = 100
+	// thumbnailQuality is the JPEG quality of thumbnails, which are
+	// embedded in the message itself and should stay small
+	thumbnailQuality = 60
+	// ffmpegTimeout bounds extracting a frame from a video
+	ffmpegTimeout = 10 * time.Second
+)
+
+// errNoFFmpeg is returned for video thumbnails when ffmpeg isn't installed
+var errNoFFmpeg = errors.New("ffmpeg is not installed")
+
+// imageThumbnail returns a small JPEG preview of a JPEG, PNG or GIF image,
+// shown in the chat until the recipient downloads the image
+func imageThumbnail(data []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(img, thumbnailSize), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// videoThumbnail returns a small JPEG of the first frame of a video. Go
+// can't decode video, so this shells out to ffmpeg when it's installed.
+func videoThumbnail(path string) ([]byte, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errNoFFmpeg
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+
+	size := strconv.Itoa(thumbnailSize)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, "-loglevel", "error", "-i", path, "-frames:v", "1",
+		"-vf", "scale="+size+":"+size+":force_original_aspect_ratio=decrease",
+		"-q:v", "5", "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("ffmpeg found no frame")
+	}
+	return stdout.Bytes(), nil
+}
+
+// scaleDown shrinks an image so its longest side is at most max pixels,
+// averaging the pixels each thumbnail pixel covers. Transparency is laid
+// over white, since JPEG has none. Smaller images keep their size.
+func scaleDown(img image.Image, max int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	tw, th := w, h
+	if w > max || h > max {
+		tw, th = max, h*max/w
+		if h > w {
+			tw, th = w*max/h, max
+		}
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := bounds.Min.Y+ty*h/th, bounds.Min.Y+(ty+1)*h/th
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := bounds.Min.X+tx*w/tw, bounds.Min.X+(tx+1)*w/tw
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := img.At(x, y).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			// The components are premultiplied by alpha, so adding the
+			// missing opacity in white blends them over a white background
+			white := 0xffff - a/n
+			thumb.Set(tx, ty, color.RGBA64{uint16(r/n + white), uint16(g/n + white), uint16(b/n + white), 0xffff})
+		}
+	}
+	return thumb
+}
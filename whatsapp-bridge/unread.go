@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// markReadBatch caps how many message IDs go into one read receipt
+const markReadBatch = 100
+
+// unreadCondition matches the messages of a chat received after its read
+// marker that weren't marked read one by one. A chat that was never read has
+// all its received messages unread.
+const unreadCondition = `is_from_me = 0 AND read_at IS NULL AND timestamp > COALESCE((SELECT last_read_timestamp FROM chats WHERE chats.jid = messages.chat_jid), '')`
+
+// GetUnreadMessages returns the unread received messages of a chat, oldest first
+func (ms *MessageStore) GetUnreadMessages(chatJID string) ([]*Message, error) {
+	rows, err := ms.db.Query(
+		"SELECT "+messageSelectColumns+" FROM messages WHERE chat_jid = ? AND "+unreadCondition+" ORDER BY timestamp",
+		chatJID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMessages(rows)
+}
+
+// GetUnreadChats lists the chats that have unread messages
+func (ms *MessageStore) GetUnreadChats() ([]string, error) {
+	rows, err := ms.db.Query("SELECT DISTINCT chat_jid FROM messages WHERE " + unreadCondition)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chats []string
+	for rows.Next() {
+		var jid string
+		if err := rows.Scan(&jid); err != nil {
+			return nil, err
+		}
+		chats = append(chats, jid)
+	}
+	return chats, rows.Err()
+}
+
+// CountUnread returns how many received messages of a chat are unread
+func (ms *MessageStore) CountUnread(chatJID string) (int, error) {
+	var count int
+	err := ms.db.QueryRow("SELECT COUNT(*) FROM messages WHERE chat_jid = ? AND "+unreadCondition, chatJID).Scan(&count)
+	return count, err
+}
+
+// SetChatLastRead moves the read marker of a chat forward to at
+func (ms *MessageStore) SetChatLastRead(chatJID string, at time.Time) error {
+	_, err := ms.db.Exec(
+		"UPDATE chats SET last_read_timestamp = ? WHERE jid = ? AND (last_read_timestamp IS NULL OR last_read_timestamp < ?)",
+		at, chatJID, at,
+	)
+	return err
+}
+
+// SetMessagesRead records when messages of a chat were read. Messages
+// already read keep their first read time.
+func (ms *MessageStore) SetMessagesRead(chatJID string, ids []string, at time.Time) error {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, id := range ids {
+		_, err := tx.Exec("UPDATE messages SET read_at = ?, updated_at = ? WHERE chat_jid = ? AND id = ? AND read_at IS NULL",
+			at, now, chatJID, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// markReadFunc sends a read receipt, like client.MarkRead
+type markReadFunc func(ids []types.MessageID, timestamp time.Time, chat, sender types.JID, receiptTypeExtra ...types.ReceiptType) error
+
+// markChatRead sends read receipts for the unread messages of a chat and
+// moves its read marker past them, returning how many were marked
+func markChatRead(markRead markReadFunc, messageStore *MessageStore, chatJID string) (int, error) {
+	chat, err := types.ParseJID(chatJID)
+	if err != nil {
+		return 0, err
+	}
+	messages, err := messageStore.GetUnreadMessages(chatJID)
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+	if err := sendReadReceipts(markRead, chat, messages); err != nil {
+		return 0, err
+	}
+	if err := messageStore.SetMessagesRead(chatJID, messageIDs(messages), time.Now()); err != nil {
+		return 0, err
+	}
+
+	last := messages[len(messages)-1].Timestamp
+	return len(messages), messageStore.SetChatLastRead(chatJID, last)
+}
+
+// sendReadReceipts sends read receipts for received messages of a chat,
+// oldest first. The receipts are batched per sender, since a receipt names
+// a single sender: in groups that's the member who wrote the message.
+func sendReadReceipts(markRead markReadFunc, chat types.JID, messages []*Message) error {
+	bySender := make(map[string][]*Message)
+	var senders []string
+	for _, msg := range messages {
+		if bySender[msg.Sender] == nil {
+			senders = append(senders, msg.Sender)
+		}
+		bySender[msg.Sender] = append(bySender[msg.Sender], msg)
+	}
+
+	for _, senderJID := range senders {
+		sender, err := types.ParseJID(senderJID)
+		if err != nil {
+			continue
+		}
+		pending := bySender[senderJID]
+		for len(pending) > 0 {
+			batch := pending[:min(len(pending), markReadBatch)]
+			pending = pending[len(batch):]
+
+			// Messages are oldest first, so the last one dates the receipt
+			if err := markRead(messageIDs(batch), batch[len(batch)-1].Timestamp, chat, sender); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// messageIDs lists the IDs of messages
+func messageIDs(messages []*Message) []types.MessageID {
+	ids := make([]types.MessageID, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+// MarkReadRequest is the body of /api/markread
+type MarkReadRequest struct {
+	ChatJID    string   `json:"chat_jid"`
+	MessageIDs []string `json:"message_ids"`
+}
+
+// MarkReadResponse tells which messages /api/markread marked read
+type MarkReadResponse struct {
+	Success bool `json:"success"`
+	// Marked counts the messages read receipts were sent for. Our own
+	// messages and those already read are skipped.
+	Marked   int      `json:"marked"`
+	NotFound []string `json:"not_found,omitempty"`
+}
+
+// markMessagesRead sends read receipts for some received messages of a
+// chat and records them as read
+func markMessagesRead(markRead markReadFunc, messageStore *MessageStore, chat types.JID, ids []string) (*MarkReadResponse, error) {
+	resp := &MarkReadResponse{Success: true}
+	var unread []*Message
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		msg, err := messageStore.GetMessage(chat.String(), id)
+		if err == sql.ErrNoRows {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !msg.IsFromMe && msg.ReadAt == nil {
+			unread = append(unread, msg)
+		}
+	}
+	if len(unread) == 0 {
+		return resp, nil
+	}
+
+	sort.Slice(unread, func(i, j int) bool { return unread[i].Timestamp.Before(unread[j].Timestamp) })
+	if err := sendReadReceipts(markRead, chat, unread); err != nil {
+		return nil, err
+	}
+	if err := messageStore.SetMessagesRead(chat.String(), messageIDs(unread), time.Now()); err != nil {
+		return nil, err
+	}
+	resp.Marked = len(unread)
+	return resp, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// readReceipt is one call to a markReadFunc
+type readReceipt struct {
+	ids    []types.MessageID
+	sender string
+}
+
+// recordReceipts returns a markReadFunc that records the receipts it's
+// asked to send
+func recordReceipts(receipts *[]readReceipt) markReadFunc {
+	return func(ids []types.MessageID, timestamp time.Time, chat, sender types.JID, receiptTypeExtra ...types.ReceiptType) error {
+		*receipts = append(*receipts, readReceipt{ids: ids, sender: sender.String()})
+		return nil
+	}
+}
+
+// saveUnread stores n messages from sender in a chat
+func saveUnread(t *testing.T, ms *MessageStore, chatJID, sender string, n int, start time.Time) {
+	t.Helper()
+	if err := ms.SaveChat(chatJID, chatJID); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		msg := testMessage(fmt.Sprintf("%s-%s-%d", chatJID, sender, i), "hi", start.Add(time.Duration(i)*time.Second))
+		msg.ChatJID = chatJID
+		msg.Sender = sender
+		if err := ms.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMarkChatReadClearsUnreadCount(t *testing.T) {
+	ms := newTestStore(t)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	group, other := "120363000000000001@g.us", "444@s.whatsapp.net"
+	saveUnread(t, ms, group, "222@s.whatsapp.net", 150, start)
+	saveUnread(t, ms, group, "333@s.whatsapp.net", 3, start)
+	saveUnread(t, ms, other, "444@s.whatsapp.net", 2, start)
+	own := testMessage("OWN1", "mine", start.Add(time.Minute))
+	own.ChatJID, own.IsFromMe = group, true
+	if err := ms.SaveMessage(own); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := ms.CountUnread(group); err != nil || n != 153 {
+		t.Fatalf("unread before = %d, %v, want 153", n, err)
+	}
+	var receipts []readReceipt
+	marked, err := markChatRead(recordReceipts(&receipts), ms, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marked != 153 {
+		t.Errorf("marked %d messages, want 153", marked)
+	}
+	if n, err := ms.CountUnread(group); err != nil || n != 0 {
+		t.Errorf("unread after = %d, %v, want 0", n, err)
+	}
+	if n, err := ms.CountUnread(other); err != nil || n != 2 {
+		t.Errorf("unread of another chat = %d, %v, want it left at 2", n, err)
+	}
+
+	// Receipts are batched per sender rather than sent one per message
+	var sizes []string
+	for _, receipt := range receipts {
+		sizes = append(sizes, fmt.Sprintf("%s:%d", receipt.sender, len(receipt.ids)))
+	}
+	want := "[222@s.whatsapp.net:100 222@s.whatsapp.net:50 333@s.whatsapp.net:3]"
+	if got := fmt.Sprint(sizes); got != want {
+		t.Errorf("receipts = %s, want %s", got, want)
+	}
+
+	// Messages arriving later are unread again
+	saveUnread(t, ms, group, "555@s.whatsapp.net", 1, start.Add(time.Hour))
+	if n, err := ms.CountUnread(group); err != nil || n != 1 {
+		t.Errorf("unread after a new message = %d, %v, want 1", n, err)
+	}
+}
+
+func TestMarkAllChatsRead(t *testing.T) {
+	ms := newTestStore(t)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	chats := []string{"222@s.whatsapp.net", "333@s.whatsapp.net", "120363000000000001@g.us"}
+	for i, chat := range chats {
+		saveUnread(t, ms, chat, "222@s.whatsapp.net", i+1, start)
+	}
+
+	// Without a chatId every chat with unread messages is marked
+	unread, err := ms.GetUnreadChats()
+	if err != nil || len(unread) != len(chats) {
+		t.Fatalf("GetUnreadChats = %v, %v, want all %d chats", unread, err, len(chats))
+	}
+	var receipts []readReceipt
+	for _, chat := range unread {
+		if _, err := markChatRead(recordReceipts(&receipts), ms, chat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, chat := range chats {
+		if n, err := ms.CountUnread(chat); err != nil || n != 0 {
+			t.Errorf("unread of %s = %d, %v, want 0", chat, n, err)
+		}
+	}
+	if unread, err := ms.GetUnreadChats(); err != nil || len(unread) != 0 {
+		t.Errorf("GetUnreadChats after = %v, %v, want none", unread, err)
+	}
+	if len(receipts) != len(chats) {
+		t.Errorf("sent %d receipts, want one per chat", len(receipts))
+	}
+}
+
+func TestMarkChatReadKeepsUnreadWhenReceiptFails(t *testing.T) {
+	ms := newTestStore(t)
+	chat := "222@s.whatsapp.net"
+	saveUnread(t, ms, chat, chat, 3, time.Now().Add(-time.Hour))
+
+	failing := func(ids []types.MessageID, timestamp time.Time, chat, sender types.JID, receiptTypeExtra ...types.ReceiptType) error {
+		return errors.New("not connected")
+	}
+	if _, err := markChatRead(failing, ms, chat); err == nil {
+		t.Fatal("markChatRead succeeded without sending receipts")
+	}
+	if n, err := ms.CountUnread(chat); err != nil || n != 3 {
+		t.Errorf("unread = %d, %v, want all 3 still unread", n, err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+// SharedContact is a contact card sent in a message
+type SharedContact struct {
+	Name   string   `json:"name"`
+	Phones []string `json:"phones,omitempty"`
+	VCard  string   `json:"vcard"`
+}
+
+// errInvalidVCard is returned when a vcard to send isn't a vCard
+var errInvalidVCard = errors.New("vcard must be a vCard starting with BEGIN:VCARD")
+
+// parseVCard pulls the display name and phone numbers out of a vCard.
+// Only what the messages payload shows is read, the rest is kept as text.
+func parseVCard(vcard string) (name string, phones []string) {
+	// Long lines are folded onto continuation lines starting with a space or tab
+	vcard = strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(vcard)
+	for _, line := range strings.Split(vcard, "\n") {
+		line = strings.TrimRight(line, "\r")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		// Properties may be grouped ("item1.TEL") and carry parameters ("TEL;type=CELL")
+		property, _, _ := strings.Cut(key, ";")
+		if i := strings.LastIndexByte(property, '.'); i >= 0 {
+			property = property[i+1:]
+		}
+		switch strings.ToUpper(property) {
+		case "FN":
+			name = value
+		case "TEL":
+			if value != "" {
+				phones = append(phones, value)
+			}
+		}
+	}
+	return name, phones
+}
+
+// sharedContact reads a contact card, preferring the name WhatsApp shows
+// on the message over the one in the vCard
+func sharedContact(displayName, vcard string) SharedContact {
+	name, phones := parseVCard(vcard)
+	if displayName != "" {
+		name = displayName
+	}
+	return SharedContact{Name: name, Phones: phones, VCard: vcard}
+}
+
+// messageContacts returns the contact cards a message shares, one for a
+// single contact and one per contact for a contact list
+func messageContacts(msg *waE2E.Message) []SharedContact {
+	if contact := msg.GetContactMessage(); contact != nil {
+		return []SharedContact{sharedContact(contact.GetDisplayName(), contact.GetVcard())}
+	}
+	array := msg.GetContactsArrayMessage()
+	if array == nil {
+		return nil
+	}
+	contacts := make([]SharedContact, 0, len(array.GetContacts()))
+	for _, contact := range array.GetContacts() {
+		contacts = append(contacts, sharedContact(contact.GetDisplayName(), contact.GetVcard()))
+	}
+	return contacts
+}
+
+// contactNames describes shared contacts for the content column
+func contactNames(contacts []SharedContact) string {
+	names := make([]string, 0, len(contacts))
+	for _, contact := range contacts {
+		if contact.Name != "" {
+			names = append(names, contact.Name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// applyContacts marks a stored message as a contact message when the
+// received message shares contact cards
+func applyContacts(msg *Message, waMsg *waE2E.Message) {
+	if contacts := messageContacts(waMsg); contacts != nil {
+		msg.Type = "contact"
+		msg.Contacts = contacts
+	}
+}
+
+// buildContactMessage builds the message sharing a vCard
+func buildContactMessage(vcard string) (*waE2E.Message, SharedContact, error) {
+	if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(vcard)), "BEGIN:VCARD") {
+		return nil, SharedContact{}, errInvalidVCard
+	}
+	contact := sharedContact("", vcard)
+	return &waE2E.Message{ContactMessage: &waE2E.ContactMessage{
+		DisplayName: proto.String(contact.Name),
+		Vcard:       proto.String(vcard),
+	}}, contact, nil
+}
+
+// contactsColumn encodes shared contacts for the contacts column, which is
+// empty for other messages
+func contactsColumn(contacts []SharedContact) string {
+	if len(contacts) == 0 {
+		return ""
+	}
+	encoded, err := json.Marshal(contacts)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// parseContactsColumn decodes the contacts column
+func parseContactsColumn(column string) []SharedContact {
+	if column == "" {
+		return nil
+	}
+	var contacts []SharedContact
+	if err := json.Unmarshal([]byte(column), &contacts); err != nil {
+		return nil
+	}
+	return contacts
+}
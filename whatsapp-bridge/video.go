@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// videoInfo is what WhatsApp shows for a video before it's downloaded
+type videoInfo struct {
+	Seconds uint32
+	// Width and Height are the display size, after any rotation
+	Width  uint32
+	Height uint32
+}
+
+// analyzeVideo reads the duration from the movie header (mvhd) of an MP4 or
+// QuickTime file, and the size from the header (tkhd) of its first track
+// with a picture
+func analyzeVideo(data []byte) (videoInfo, error) {
+	var info videoInfo
+	moov, ok := findBox(data, "moov")
+	if !ok {
+		return info, errors.New("no moov box, not an MP4 file")
+	}
+
+	mvhd, ok := findBox(moov, "mvhd")
+	if !ok {
+		return info, errors.New("no mvhd box")
+	}
+	timescale, duration, err := parseMvhd(mvhd)
+	if err != nil {
+		return info, err
+	}
+	if timescale == 0 {
+		return info, errors.New("mvhd has no timescale")
+	}
+	info.Seconds = uint32(math.Round(float64(duration) / float64(timescale)))
+
+	for rest := moov; ; {
+		var trak []byte
+		trak, rest, ok = nextBox(rest, "trak")
+		if !ok {
+			break
+		}
+		tkhd, ok := findBox(trak, "tkhd")
+		if !ok {
+			continue
+		}
+		// Sound tracks have no size
+		if width, height, err := parseTkhd(tkhd); err == nil && width > 0 && height > 0 {
+			info.Width, info.Height = width, height
+			return info, nil
+		}
+	}
+	return info, errors.New("no video track")
+}
+
+// findBox returns the contents of the first box of the given type among
+// the boxes in data
+func findBox(data []byte, boxType string) ([]byte, bool) {
+	box, _, ok := nextBox(data, boxType)
+	return box, ok
+}
+
+// nextBox returns the contents of the first box of the given type among the
+// boxes in data, along with the boxes after it
+func nextBox(data []byte, boxType string) (box, rest []byte, ok bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		name := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			// The box runs to the end of the file
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, nil, false
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, nil, false
+		}
+		if name == boxType {
+			return data[header:size], data[size:], true
+		}
+		data = data[size:]
+	}
+	return nil, nil, false
+}
+
+// parseMvhd reads the timescale and duration of a movie header
+func parseMvhd(mvhd []byte) (timescale uint32, duration uint64, err error) {
+	if len(mvhd) < 1 {
+		return 0, 0, errors.New("mvhd is empty")
+	}
+	switch version := mvhd[0]; version {
+	case 0:
+		// version/flags, creation and modification time, then 32-bit fields
+		if len(mvhd) < 20 {
+			return 0, 0, errors.New("mvhd is too short")
+		}
+		return binary.BigEndian.Uint32(mvhd[12:16]), uint64(binary.BigEndian.Uint32(mvhd[16:20])), nil
+	case 1:
+		// The times and the duration are 64-bit
+		if len(mvhd) < 32 {
+			return 0, 0, errors.New("mvhd is too short")
+		}
+		return binary.BigEndian.Uint32(mvhd[20:24]), binary.BigEndian.Uint64(mvhd[24:32]), nil
+	default:
+		return 0, 0, fmt.Errorf("unknown mvhd version %d", version)
+	}
+}
+
+// parseTkhd reads the display size of a track. Its 16.16 fixed-point width
+// and height are the last fields of the header, right after the
+// transformation matrix, which tells whether the video is turned sideways.
+func parseTkhd(tkhd []byte) (width, height uint32, err error) {
+	if len(tkhd) < 1 {
+		return 0, 0, errors.New("tkhd is empty")
+	}
+	// version/flags, times, track ID, reserved and duration come first
+	matrixAt := 40
+	if tkhd[0] == 1 {
+		matrixAt = 52
+	}
+	if len(tkhd) < matrixAt+36+8 {
+		return 0, 0, errors.New("tkhd is too short")
+	}
+	a := int32(binary.BigEndian.Uint32(tkhd[matrixAt : matrixAt+4]))
+	b := int32(binary.BigEndian.Uint32(tkhd[matrixAt+4 : matrixAt+8]))
+	sizeAt := matrixAt + 36
+	width = binary.BigEndian.Uint32(tkhd[sizeAt:sizeAt+4]) >> 16
+	height = binary.BigEndian.Uint32(tkhd[sizeAt+4:sizeAt+8]) >> 16
+	// Rotated by 90 or 270 degrees, as phones record portrait video
+	if a == 0 && b != 0 {
+		width, height = height, width
+	}
+	return width, height, nil
+}
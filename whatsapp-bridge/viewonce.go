@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+// errViewOnceUnsupported is returned when view_once is asked for on a
+// message that WhatsApp can't show only once
+var errViewOnceUnsupported = errors.New("view_once is only supported for image, video and audio media")
+
+// validateViewOnce checks that a send asking for view_once carries an
+// image, video or audio file. It runs before anything is uploaded.
+func validateViewOnce(req *SendMessageRequest) error {
+	if !req.ViewOnce {
+		return nil
+	}
+	if req.MediaPath == "" {
+		return errViewOnceUnsupported
+	}
+	// A file that can't be read fails the send later on
+	head, _ := sniffFile(req.MediaPath)
+	switch mediaType, _ := chooseMediaType(req.MediaPath, head, req.SendAsDocument); mediaType {
+	case whatsmeow.MediaImage, whatsmeow.MediaVideo, whatsmeow.MediaAudio:
+		return nil
+	}
+	return errViewOnceUnsupported
+}
+
+// wrapViewOnce flags the media of a message as view-once and wraps it in a
+// ViewOnceMessage, so the recipient's app discards it after it's opened.
+// Messages without image, video or audio media are returned unchanged.
+func wrapViewOnce(msg *waE2E.Message) *waE2E.Message {
+	switch {
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ViewOnce = proto.Bool(true)
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ViewOnce = proto.Bool(true)
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ViewOnce = proto.Bool(true)
+	default:
+		return msg
+	}
+	return &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{Message: msg}}
+}
+
+// unwrapViewOnce returns the message inside a view-once wrapper, and
+// whether there was one. Live messages arrive already unwrapped, but
+// history sync keeps the wrapper.
+func unwrapViewOnce(msg *waE2E.Message) (*waE2E.Message, bool) {
+	switch {
+	case msg.GetViewOnceMessage().GetMessage() != nil:
+		return msg.GetViewOnceMessage().GetMessage(), true
+	case msg.GetViewOnceMessageV2().GetMessage() != nil:
+		return msg.GetViewOnceMessageV2().GetMessage(), true
+	case msg.GetViewOnceMessageV2Extension().GetMessage() != nil:
+		return msg.GetViewOnceMessageV2Extension().GetMessage(), true
+	}
+	return msg, false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWrapViewOnce(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      *waE2E.Message
+		viewOnce func(*waE2E.Message) bool
+	}{
+		{"image", &waE2E.Message{ImageMessage: &waE2E.ImageMessage{Caption: proto.String("once")}},
+			func(m *waE2E.Message) bool {
+				return m.GetImageMessage().GetViewOnce() && m.GetImageMessage().GetCaption() == "once"
+			}},
+		{"video", &waE2E.Message{VideoMessage: &waE2E.VideoMessage{}},
+			func(m *waE2E.Message) bool { return m.GetVideoMessage().GetViewOnce() }},
+		{"audio", &waE2E.Message{AudioMessage: &waE2E.AudioMessage{PTT: proto.Bool(true)}},
+			func(m *waE2E.Message) bool { return m.GetAudioMessage().GetViewOnce() }},
+	}
+	for _, tt := range tests {
+		wrapped := wrapViewOnce(tt.msg)
+		inner := wrapped.GetViewOnceMessage().GetMessage()
+		if inner == nil {
+			t.Errorf("%s: not wrapped in a ViewOnceMessage: %v", tt.name, wrapped)
+		} else if !tt.viewOnce(inner) {
+			t.Errorf("%s: media isn't flagged view-once: %v", tt.name, inner)
+		}
+	}
+
+	// Anything else is left as it is
+	for _, msg := range []*waE2E.Message{
+		{DocumentMessage: &waE2E.DocumentMessage{}},
+		{Conversation: proto.String("hi")},
+	} {
+		if wrapped := wrapViewOnce(msg); wrapped != msg || wrapped.GetViewOnceMessage() != nil {
+			t.Errorf("wrapViewOnce changed %v", msg)
+		}
+	}
+}
+
+func TestValidateViewOnce(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"photo.png":  pngHeader,
+		"voice.ogg":  []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00"),
+		"clip.mp4":   []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"),
+		"notes.txt":  []byte("plain text"),
+		"report.pdf": []byte("%PDF-1.7\n"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		req  SendMessageRequest
+		want error
+	}{
+		{SendMessageRequest{ViewOnce: true, MediaPath: filepath.Join(dir, "photo.png")}, nil},
+		{SendMessageRequest{ViewOnce: true, MediaPath: filepath.Join(dir, "voice.ogg")}, nil},
+		{SendMessageRequest{ViewOnce: true, MediaPath: filepath.Join(dir, "clip.mp4")}, nil},
+		{SendMessageRequest{ViewOnce: true, MediaPath: filepath.Join(dir, "notes.txt")}, errViewOnceUnsupported},
+		{SendMessageRequest{ViewOnce: true, MediaPath: filepath.Join(dir, "report.pdf")}, errViewOnceUnsupported},
+		// Images sent as documents aren't images anymore
+		{SendMessageRequest{ViewOnce: true, MediaPath: filepath.Join(dir, "photo.png"), SendAsDocument: true}, errViewOnceUnsupported},
+		{SendMessageRequest{ViewOnce: true, Message: "hi"}, errViewOnceUnsupported},
+		{SendMessageRequest{Message: "hi"}, nil},
+		{SendMessageRequest{MediaPath: filepath.Join(dir, "notes.txt")}, nil},
+	}
+	for _, tt := range tests {
+		req := tt.req
+		if err := validateViewOnce(&req); !errors.Is(err, tt.want) {
+			t.Errorf("validateViewOnce(%s, view_once=%v) = %v, want %v", filepath.Base(req.MediaPath), req.ViewOnce, err, tt.want)
+		}
+	}
+	if code := sendStatusCode(errViewOnceUnsupported); code != http.StatusBadRequest {
+		t.Errorf("status for unsupported view_once = %d, want 400", code)
+	}
+}
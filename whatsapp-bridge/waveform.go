@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+)
+
+// waveformSampleRate is the rate voice notes are decoded at for their
+// waveform, plenty for an envelope of 64 bars
+const waveformSampleRate = 8000
+
+// pcmWaveform returns the loudness of a voice note in waveformLength bars
+// from 0 to 100, as WhatsApp draws under voice messages. Go can't decode
+// Opus, so this shells out to ffmpeg when it's installed.
+func pcmWaveform(data []byte) ([]byte, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errNoFFmpeg
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, "-loglevel", "error", "-i", "pipe:0",
+		"-f", "s16le", "-ac", "1", "-ar", fmt.Sprint(waveformSampleRate), "pipe:1")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return rmsWaveform(stdout.Bytes())
+}
+
+// rmsWaveform splits signed 16-bit little-endian mono PCM into
+// waveformLength bins and scales their RMS so the loudest bin is 100
+func rmsWaveform(pcm []byte) ([]byte, error) {
+	samples := len(pcm) / 2
+	if samples < waveformLength {
+		return nil, errors.New("audio is too short for a waveform")
+	}
+
+	rms := make([]float64, waveformLength)
+	var loudest float64
+	for i := range rms {
+		start, end := i*samples/waveformLength, (i+1)*samples/waveformLength
+		var sum float64
+		for s := start; s < end; s++ {
+			v := float64(int16(binary.LittleEndian.Uint16(pcm[2*s:])))
+			sum += v * v
+		}
+		rms[i] = math.Sqrt(sum / float64(end-start))
+		loudest = max(loudest, rms[i])
+	}
+
+	waveform := make([]byte, waveformLength)
+	if loudest == 0 {
+		// Silence
+		return waveform, nil
+	}
+	for i, v := range rms {
+		waveform[i] = byte(math.Round(v / loudest * 100))
+	}
+	return waveform, nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook delivers the messages of one chat to a receiver
+type Webhook struct {
+	ID      int64  `json:"id"`
+	ChatJID string `json:"chat_jid"`
+	URL     string `json:"url"`
+	// The secret is write-only, listings only say whether one is set
+	Secret    string    `json:"-"`
+	HasSecret bool      `json:"has_secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	webhookAttempts = 4
+	webhookTimeout  = 10 * time.Second
+	// webhookBackoff is the wait before the first retry, doubled after each
+	webhookBackoff = 2 * time.Second
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookDeliveries tracks the deliveries running in the background, so
+// shutting down can cut their retries short and wait for them
+var webhookDeliveries = struct {
+	sync.Mutex
+	sync.WaitGroup
+	stopped bool
+	stop    chan struct{}
+}{stop: make(chan struct{})}
+
+// startWebhookDelivery runs a delivery in the background, unless the
+// bridge is shutting down
+func startWebhookDelivery(deliver func()) {
+	webhookDeliveries.Lock()
+	defer webhookDeliveries.Unlock()
+	if webhookDeliveries.stopped {
+		return
+	}
+	webhookDeliveries.Add(1)
+	go func() {
+		defer webhookDeliveries.Done()
+		deliver()
+	}()
+}
+
+// stopWebhookDeliveries makes the deliveries in the background give up
+// instead of waiting for their next retry, and waits until they have, or
+// until ctx is done
+func stopWebhookDeliveries(ctx context.Context) error {
+	webhookDeliveries.Lock()
+	if !webhookDeliveries.stopped {
+		webhookDeliveries.stopped = true
+		close(webhookDeliveries.stop)
+	}
+	webhookDeliveries.Unlock()
+	return waitGroupContext(ctx, &webhookDeliveries.WaitGroup)
+}
+
+// webhookWait waits for d, returning false if the bridge starts shutting
+// down first
+func webhookWait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-webhookDeliveries.stop:
+		return false
+	}
+}
+
+// globalWebhook receives the messages of every chat. It's configured with
+// WEBHOOK_URL, and WEBHOOK_SECRET to sign the deliveries, rather than
+// through /api/webhooks.
+var globalWebhook = loadGlobalWebhook()
+
+func loadGlobalWebhook() *Webhook {
+	raw := strings.TrimSpace(os.Getenv("WEBHOOK_URL"))
+	if raw == "" {
+		return nil
+	}
+	if err := validateWebhookURL(raw); err != nil {
+		log.Printf("Ignoring WEBHOOK_URL: %v", err)
+		return nil
+	}
+	secret := os.Getenv("WEBHOOK_SECRET")
+	return &Webhook{URL: raw, Secret: secret, HasSecret: secret != ""}
+}
+
+// String names a webhook in logs
+func (hook *Webhook) String() string {
+	if hook == globalWebhook {
+		return fmt.Sprintf("WEBHOOK_URL (%s)", hook.URL)
+	}
+	return fmt.Sprintf("webhook %d (%s)", hook.ID, hook.URL)
+}
+
+// validateWebhookURL checks that a webhook URL is an absolute http(s) URL
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+const webhookColumns = "id, chat_jid, url, secret, created_at"
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*Webhook, error) {
+	var hook Webhook
+	if err := row.Scan(&hook.ID, &hook.ChatJID, &hook.URL, &hook.Secret, &hook.CreatedAt); err != nil {
+		return nil, err
+	}
+	hook.HasSecret = hook.Secret != ""
+	return &hook, nil
+}
+
+// CreateWebhook stores a new webhook and fills in its ID
+func (ms *MessageStore) CreateWebhook(hook *Webhook) error {
+	hook.CreatedAt = time.Now()
+	res, err := ms.db.Exec(
+		"INSERT INTO webhooks (chat_jid, url, secret, created_at) VALUES (?, ?, ?, ?)",
+		hook.ChatJID, hook.URL, hook.Secret, hook.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	hook.ID, err = res.LastInsertId()
+	hook.HasSecret = hook.Secret != ""
+	return err
+}
+
+// UpdateWebhook replaces the chat, URL and secret of a webhook
+func (ms *MessageStore) UpdateWebhook(hook *Webhook) error {
+	res, err := ms.db.Exec(
+		"UPDATE webhooks SET chat_jid = ?, url = ?, secret = ? WHERE id = ?",
+		hook.ChatJID, hook.URL, hook.Secret, hook.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	hook.HasSecret = hook.Secret != ""
+	return nil
+}
+
+// DeleteWebhook removes a webhook, returning sql.ErrNoRows if it doesn't exist
+func (ms *MessageStore) DeleteWebhook(id int64) error {
+	res, err := ms.db.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetWebhook returns a webhook by ID
+func (ms *MessageStore) GetWebhook(id int64) (*Webhook, error) {
+	return scanWebhook(ms.db.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", id))
+}
+
+// GetWebhooks lists the webhooks of a chat, or of every chat if chatJID is empty
+func (ms *MessageStore) GetWebhooks(chatJID string) ([]*Webhook, error) {
+	query := "SELECT " + webhookColumns + " FROM webhooks"
+	var args []interface{}
+	if chatJID != "" {
+		query += " WHERE chat_jid = ?"
+		args = append(args, chatJID)
+	}
+	rows, err := ms.db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []*Webhook
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// dispatchWebhooks delivers a newly stored message to the webhooks of its
+// chat and to WEBHOOK_URL. Each webhook is delivered to and retried on its
+// own, in the background, so a slow receiver never holds up message handling.
+func dispatchWebhooks(messageStore *MessageStore, msg *Message) {
+	hooks, err := messageStore.GetWebhooks(msg.ChatJID)
+	if err != nil {
+		log.Printf("Failed to get webhooks of %s: %v", msg.ChatJID, err)
+	}
+	if globalWebhook != nil {
+		hooks = append(hooks, globalWebhook)
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode message %s for webhooks: %v", msg.ID, err)
+		return
+	}
+	for _, hook := range hooks {
+		startWebhookDelivery(func() { deliverWebhook(hook, payload) })
+	}
+}
+
+// deliverWebhook posts payload to a webhook, retrying with backoff until
+// the receiver answers with a 2xx status
+func deliverWebhook(hook *Webhook, payload []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := postWebhook(hook, payload)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Giving up on %s after %d attempts: %v", hook, attempt, err)
+			return
+		}
+		log.Printf("Delivery to %s failed (attempt %d), retrying in %s: %v", hook, attempt, backoff, err)
+		if !webhookWait(backoff) {
+			log.Printf("Giving up on %s after %d attempts: shutting down", hook, attempt)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// postWebhook makes a single delivery attempt and returns the receiver's
+// status code. With a secret set, the body is signed with HMAC-SHA256 so
+// the receiver can verify it came from us.
+func postWebhook(hook *Webhook, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(payload)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookPayload is a message flagged as a test or a replay, so receivers
+// can tell it apart from live traffic
+type webhookPayload struct {
+	*Message
+	Test   bool `json:"test,omitempty"`
+	Replay bool `json:"replay,omitempty"`
+}
+
+// testWebhook posts a sample message to a webhook once, without retrying,
+// and reports how the receiver answered. Nothing is stored.
+func testWebhook(hook *Webhook, sender string) map[string]interface{} {
+	now := time.Now()
+	payload, err := json.Marshal(webhookPayload{
+		Message: &Message{
+			ID:        fmt.Sprintf("TEST%d", now.UnixNano()),
+			Sender:    sender,
+			Content:   "This is a test message from ThreadScribe",
+			Timestamp: now,
+			ChatJID:   hook.ChatJID,
+			Type:      "text",
+		},
+		Test: true,
+	})
+	if err != nil {
+		return map[string]interface{}{"success": false, "error": err.Error()}
+	}
+
+	start := time.Now()
+	status, err := postWebhook(hook, payload)
+	result := map[string]interface{}{
+		"success":    err == nil,
+		"url":        hook.URL,
+		"signed":     hook.Secret != "",
+		"latency_ms": time.Since(start).Milliseconds(),
+	}
+	if status != 0 {
+		result["status"] = status
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	return result
+}
+
+// replayInterval spaces out replayed messages, so a receiver that was down
+// isn't flooded with its backlog all at once
+const replayInterval = 200 * time.Millisecond
+
+// GetMessagesSince returns the messages of a chat sent at or after since,
+// oldest first
+func (ms *MessageStore) GetMessagesSince(chatJID string, since time.Time) ([]*Message, error) {
+	rows, err := ms.db.Query(
+		"SELECT "+messageSelectColumns+" FROM messages WHERE chat_jid = ? AND timestamp >= ? ORDER BY timestamp ASC, received_at ASC",
+		chatJID, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMessages(rows)
+}
+
+// replayWebhooks delivers stored messages to webhooks again, flagged as
+// replays. Each webhook gets the messages in order, one at a time, with
+// the usual retries.
+func replayWebhooks(hooks []*Webhook, messages []*Message) {
+	payloads := make([][]byte, 0, len(messages))
+	for _, msg := range messages {
+		payload, err := json.Marshal(webhookPayload{Message: msg, Replay: true})
+		if err != nil {
+			log.Printf("Failed to encode message %s for replay: %v", msg.ID, err)
+			continue
+		}
+		payloads = append(payloads, payload)
+	}
+
+	for _, hook := range hooks {
+		startWebhookDelivery(func() {
+			for i, payload := range payloads {
+				if i > 0 && !webhookWait(replayInterval) {
+					log.Printf("Stopped replaying to %s after %d of %d messages: shutting down", hook, i, len(payloads))
+					return
+				}
+				deliverWebhook(hook, payload)
+			}
+			log.Printf("Replayed %d messages to %s", len(payloads), hook)
+		})
+	}
+}
+
+// parseSince reads a point in time given either as an RFC 3339 timestamp
+// or as an age like "2d" or "6h"
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	age, err := parseAge(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("since must be an RFC 3339 timestamp or an age like 2d or 6h")
+	}
+	return now.Add(-age), nil
+}
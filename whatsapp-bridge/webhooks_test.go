@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplayWebhooksInOrderWithReplayFlag(t *testing.T) {
+	var mu sync.Mutex
+	var received []webhookPayload
+	var arrivals []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload webhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("webhook body isn't JSON: %s", body)
+		}
+		mu.Lock()
+		received = append(received, payload)
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	ms := newTestStore(t)
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// Stored out of order, as history sync and live messages can be
+	for _, i := range []int{2, 0, 3, 1} {
+		if err := ms.SaveMessage(testMessage(string(rune('A'+i)), "hi", base.Add(time.Duration(i)*time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := ms.GetMessagesSince("111@s.whatsapp.net", base.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayWebhooks([]*Webhook{{ID: 1, ChatJID: "111@s.whatsapp.net", URL: server.URL}}, messages)
+	webhookDeliveries.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var ids []string
+	for _, payload := range received {
+		ids = append(ids, payload.ID)
+		if !payload.Replay {
+			t.Errorf("message %s delivered without the replay flag", payload.ID)
+		}
+		if payload.Test {
+			t.Errorf("message %s delivered as a test", payload.ID)
+		}
+	}
+	if len(ids) != 3 || ids[0] != "B" || ids[1] != "C" || ids[2] != "D" {
+		t.Fatalf("replayed %v, want [B C D] in order", ids)
+	}
+	for i := 1; i < len(arrivals); i++ {
+		// Allow for timer jitter
+		if gap := arrivals[i].Sub(arrivals[i-1]); gap < replayInterval*9/10 {
+			t.Errorf("messages %d and %d replayed %s apart, want at least %s", i, i+1, gap, replayInterval)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2024-05-01T08:00:00Z", time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)},
+		{"2d", now.Add(-48 * time.Hour)},
+		{"6h", now.Add(-6 * time.Hour)},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.value, now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseSince(%q) = %s, %v, want %s", tt.value, got, err, tt.want)
+		}
+	}
+	if _, err := parseSince("yesterday", now); err == nil {
+		t.Error("parseSince(yesterday) accepted")
+	}
+}
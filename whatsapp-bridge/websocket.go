@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteTimeout is how long a client gets to take one frame
+	wsWriteTimeout = 10 * time.Second
+	// wsPingInterval is how often idle clients are pinged. A client that
+	// hasn't answered by the next ping is considered gone.
+	wsPingInterval = 30 * time.Second
+)
+
+// The socket takes the same origins as the rest of the API (ALLOWED_ORIGINS)
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return originAllowed(r.Header.Get("Origin")) },
+}
+
+// serveWebSocket sends the events of sub to a WebSocket client as JSON until
+// the client goes away or is dropped for falling behind. Each message frame
+// is one stored message, as returned by /api/messages.
+func serveWebSocket(conn *websocket.Conn, sub *streamSubscriber) {
+	defer conn.Close()
+
+	// Clients only talk back to answer pings and to close, but reading is
+	// what notices either
+	gone := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case evt, ok := <-sub.events:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if err := conn.WriteJSON(evt.Data); err != nil {
+				log.Printf("Dropping WebSocket client %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}